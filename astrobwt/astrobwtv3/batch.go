@@ -0,0 +1,29 @@
+package astrobwtv3
+
+import "encoding/binary"
+
+// AstroBWTv3Batch hashes all inputs using a single scratch, hashes must have room for all inputs
+// if scratch is nil, one is taken from pool for the duration of the call
+func AstroBWTv3Batch(inputs [][]byte, scratch *ScratchData, hashes [][32]byte) {
+	if scratch == nil {
+		scratch = Pool.Get().(*ScratchData)
+		defer Pool.Put(scratch)
+	}
+	for i := range inputs {
+		hashes[i] = AstroBWTv3WithScratch(inputs[i], scratch)
+	}
+}
+
+// AstroBWTv3Nonces hashes work for len(hashes) consecutive nonces, nonce is written big endian at offset
+// hashes[i] is the hash of work with nonce first+i, on return work contains the last nonce
+func AstroBWTv3Nonces(work []byte, offset int, first uint32, scratch *ScratchData, hashes [][32]byte) {
+	if scratch == nil {
+		scratch = Pool.Get().(*ScratchData)
+		defer Pool.Put(scratch)
+	}
+	nonce := work[offset : offset+4]
+	for i := range hashes {
+		binary.BigEndian.PutUint32(nonce, first+uint32(i))
+		hashes[i] = AstroBWTv3WithScratch(work, scratch)
+	}
+}
@@ -0,0 +1,129 @@
+package astrobwtv3
+
+import "runtime"
+import "testing"
+import "math/rand"
+import "encoding/binary"
+
+// scratch reuse must not leak state between hashes
+func TestAstroBWTv3WithScratch(t *testing.T) {
+	scratch := NewScratchData()
+	for i := range random_pow_tests {
+		for j := 0; j < 2; j++ {
+			if hash := AstroBWTv3WithScratch([]byte(random_pow_tests[i].in), scratch); hash != AstroBWTv3([]byte(random_pow_tests[i].in)) {
+				t.Fatalf("scratch hash mismatch for %s", random_pow_tests[i].in)
+			}
+		}
+	}
+}
+
+func TestAstroBWTv3Batch(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	inputs := make([][]byte, 32)
+	for i := range inputs {
+		inputs[i] = make([]byte, 48)
+		r.Read(inputs[i])
+	}
+
+	for _, scratch := range []*ScratchData{nil, NewScratchData()} {
+		hashes := make([][32]byte, len(inputs))
+		AstroBWTv3Batch(inputs, scratch, hashes)
+		for i := range inputs {
+			if hashes[i] != AstroBWTv3(inputs[i]) {
+				t.Fatalf("batch hash %d mismatch", i)
+			}
+		}
+	}
+}
+
+func TestAstroBWTv3Nonces(t *testing.T) {
+	var work [48]byte
+	rand.New(rand.NewSource(2)).Read(work[:])
+	last := work[47]
+
+	hashes := make([][32]byte, 16)
+	AstroBWTv3Nonces(work[:], 43, 0xfffffff8, NewScratchData(), hashes) // nonce wraps around
+	for i := range hashes {
+		var expected [48]byte
+		copy(expected[:], work[:])
+		binary.BigEndian.PutUint32(expected[43:], 0xfffffff8+uint32(i))
+		if hashes[i] != AstroBWTv3(expected[:]) {
+			t.Fatalf("nonce hash %d mismatch", i)
+		}
+	}
+	if binary.BigEndian.Uint32(work[43:]) != 7 || work[47] != last {
+		t.Fatalf("work must contain last nonce")
+	}
+}
+
+func benchmark_inputs(count int) [][]byte {
+	r := rand.New(rand.NewSource(3))
+	inputs := make([][]byte, count)
+	for i := range inputs {
+		inputs[i] = make([]byte, 48)
+		r.Read(inputs[i])
+	}
+	return inputs
+}
+
+// current function, scratch comes from pool on every call
+func Benchmark_AstroBWTv3_Pool(b *testing.B) {
+	inputs := benchmark_inputs(1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = AstroBWTv3(inputs[i%1024])
+	}
+}
+
+func Benchmark_AstroBWTv3_Scratch(b *testing.B) {
+	inputs := benchmark_inputs(1024)
+	scratch := NewScratchData()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = AstroBWTv3WithScratch(inputs[i%1024], scratch)
+	}
+}
+
+func Benchmark_AstroBWTv3_Nonces16(b *testing.B) {
+	var work [48]byte
+	rand.New(rand.NewSource(4)).Read(work[:])
+	scratch := NewScratchData()
+	hashes := make([][32]byte, 16)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i += len(hashes) {
+		AstroBWTv3Nonces(work[:], 43, uint32(i), scratch, hashes)
+	}
+}
+
+// pooled scratch is released by GC, so hashing under GC pressure keeps reallocating it
+func Benchmark_AstroBWTv3_Pool_GC(b *testing.B) {
+	inputs := benchmark_inputs(1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%16 == 0 {
+			b.StopTimer()
+			runtime.GC()
+			b.StartTimer()
+		}
+		_ = AstroBWTv3(inputs[i%1024])
+	}
+}
+
+func Benchmark_AstroBWTv3_Scratch_GC(b *testing.B) {
+	inputs := benchmark_inputs(1024)
+	scratch := NewScratchData()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%16 == 0 {
+			b.StopTimer()
+			runtime.GC()
+			b.StartTimer()
+		}
+		_ = AstroBWTv3WithScratch(inputs[i%1024], scratch)
+	}
+}
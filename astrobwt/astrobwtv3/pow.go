@@ -32,11 +32,16 @@ var steps = map[uint64]int{}
 
 // this will generate a hash
 func AstroBWTv3(input []byte) (outputhash [32]byte) {
-
-	//var static_key = [32]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32}
-
 	scratch := Pool.Get().(*ScratchData)
 	defer Pool.Put(scratch)
+	return AstroBWTv3WithScratch(input, scratch)
+}
+
+// AstroBWTv3WithScratch is same as AstroBWTv3 but uses caller provided scratch, which must not be shared between goroutines
+// callers hashing continuously should keep their own scratch, since pooled scratch is released on every GC
+func AstroBWTv3WithScratch(input []byte, scratch *ScratchData) (outputhash [32]byte) {
+
+	//var static_key = [32]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32}
 
 	defer func() {
 		if r := recover(); r != nil { // if something happens due to RAM issues in miner, we should continue, avoiding crashes if possible
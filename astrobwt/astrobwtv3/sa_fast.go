@@ -25,6 +25,11 @@ type ScratchData struct {
 }
 
 var Pool = sync.Pool{New: func() interface{} {
+	return NewScratchData()
+}}
+
+// NewScratchData allocates scratch space required to compute a PoW
+func NewScratchData() *ScratchData {
 	var d ScratchData
 	d.hasher = sha256.New()
 	d.stage1_result = ((*[MAX_LENGTH + 1]uint16)(unsafe.Pointer(&d.indices[0])))
@@ -32,7 +37,7 @@ var Pool = sync.Pool{New: func() interface{} {
 	d.sa_bytes = ((*[(MAX_LENGTH) * 4]byte)(unsafe.Pointer(&d.sa[0])))
 
 	return &d
-}}
+}
 
 func fix(v []byte, indices []uint32, i int) {
 	prev_t := indices[i]
@@ -117,6 +117,14 @@ func (mbl *MiniBlock) GetPoWHash() (hash crypto.Hash) {
 	return astrobwtv3.AstroBWTv3(mbl.Serialize())
 }
 
+// same as GetPoWHash but uses caller provided scratch, nil scratch is taken from pool
+func (mbl *MiniBlock) GetPoWHashWithScratch(scratch *astrobwtv3.ScratchData) (hash crypto.Hash) {
+	if mbl.Height < uint64(globals.Config.MAJOR_HF2_HEIGHT) || scratch == nil {
+		return mbl.GetPoWHash()
+	}
+	return astrobwtv3.AstroBWTv3WithScratch(mbl.Serialize(), scratch)
+}
+
 func (mbl *MiniBlock) SanityCheck() error {
 	if mbl.Version >= 16 {
 		return fmt.Errorf("version not supported")
@@ -19,15 +19,25 @@ package block
 import "fmt"
 import "sort"
 import "sync"
+import "time"
+
+import "github.com/deroproject/derohe/globals"
 
 type MiniBlocksCollection struct {
 	Collection map[MiniBlockKey][]MiniBlock
+	stats      map[MiniBlock]*MiniBlockStats // only used for inspection
 	sync.RWMutex
 }
 
+// local information about a miniblock, not part of consensus
+type MiniBlockStats struct {
+	Received   time.Time // when this node inserted the miniblock
+	Collisions uint64    // number of times a duplicate was rejected
+}
+
 // create a collection
 func CreateMiniBlockCollection() *MiniBlocksCollection {
-	return &MiniBlocksCollection{Collection: map[MiniBlockKey][]MiniBlock{}}
+	return &MiniBlocksCollection{Collection: map[MiniBlockKey][]MiniBlock{}, stats: map[MiniBlock]*MiniBlockStats{}}
 }
 
 // purge all heights less than this height
@@ -44,6 +54,11 @@ func (c *MiniBlocksCollection) PurgeHeight(height int64) (purge_count int) {
 			delete(c.Collection, k)
 		}
 	}
+	for mbl := range c.stats {
+		if mbl.Height <= uint64(height) {
+			delete(c.stats, mbl)
+		}
+	}
 	return purge_count
 }
 
@@ -71,6 +86,25 @@ func (c *MiniBlocksCollection) IsCollision(mbl MiniBlock) bool {
 	return c.isCollisionnolock(mbl)
 }
 
+// check if collision will occur, if yes the duplicate is counted as rejected
+func (c *MiniBlocksCollection) RejectCollision(mbl MiniBlock) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.isCollisionnolock(mbl) {
+		c.countCollisionnolock(mbl)
+		return true
+	}
+	return false
+}
+
+// this assumes that we are already locked
+func (c *MiniBlocksCollection) countCollisionnolock(mbl MiniBlock) {
+	if stats, ok := c.stats[mbl]; ok {
+		stats.Collisions++
+	}
+}
+
 // this assumes that we are already locked
 func (c *MiniBlocksCollection) isCollisionnolock(mbl MiniBlock) bool {
 	mbls := c.Collection[mbl.GetKey()]
@@ -92,10 +126,14 @@ func (c *MiniBlocksCollection) InsertMiniBlock(mbl MiniBlock) (err error, result
 	defer c.Unlock()
 
 	if c.isCollisionnolock(mbl) {
+		c.countCollisionnolock(mbl)
 		return fmt.Errorf("collision %x", mbl.Serialize()), false
 	}
 
 	c.Collection[mbl.GetKey()] = append(c.Collection[mbl.GetKey()], mbl)
+	if c.stats != nil {
+		c.stats[mbl] = &MiniBlockStats{Received: globals.Time()}
+	}
 	return nil, true
 }
 
@@ -127,3 +165,27 @@ func (c *MiniBlocksCollection) GetAllKeys(height int64) (keys []MiniBlockKey) {
 
 	return
 }
+
+// get local stats of a miniblock, returns false if miniblock is unknown
+func (c *MiniBlocksCollection) GetMiniBlockStats(mbl MiniBlock) (stats MiniBlockStats, found bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	if v, ok := c.stats[mbl]; ok {
+		return *v, true
+	}
+	return
+}
+
+// total duplicates rejected at this height
+func (c *MiniBlocksCollection) CollisionCount(height int64) (count uint64) {
+	c.RLock()
+	defer c.RUnlock()
+
+	for mbl, stats := range c.stats {
+		if mbl.Height == uint64(height) {
+			count += stats.Collisions
+		}
+	}
+	return
+}
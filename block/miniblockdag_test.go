@@ -63,3 +63,38 @@ func Test_blockmini_collision(t *testing.T) {
 		t.Fatalf("already inserted block not detected")
 	}
 }
+
+// tests whether rejected duplicates are counted against the inserted miniblock
+func Test_blockmini_collision_stats(t *testing.T) {
+	c := CreateMiniBlockCollection()
+
+	mbl := MiniBlock{Version: 1, Height: 7, PastCount: 1}
+	if _, found := c.GetMiniBlockStats(mbl); found {
+		t.Fatalf("stats found for unknown miniblock")
+	}
+	if c.RejectCollision(mbl) {
+		t.Fatalf("unknown miniblock rejected as collision")
+	}
+	if err, ok := c.InsertMiniBlock(mbl); !ok {
+		t.Fatalf("error inserting miniblock err: %s", err)
+	}
+	if _, ok := c.InsertMiniBlock(mbl); ok {
+		t.Fatalf("duplicate miniblock inserted")
+	}
+	if !c.RejectCollision(mbl) {
+		t.Fatalf("duplicate miniblock not rejected")
+	}
+
+	stats, found := c.GetMiniBlockStats(mbl)
+	if !found || stats.Collisions != 2 || stats.Received.IsZero() {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if c.CollisionCount(7) != 2 || c.CollisionCount(8) != 0 {
+		t.Fatalf("unexpected collision count")
+	}
+
+	c.PurgeHeight(7)
+	if _, found := c.GetMiniBlockStats(mbl); found {
+		t.Fatalf("stats not purged")
+	}
+}
@@ -47,6 +47,7 @@ import "github.com/deroproject/derohe/metrics"
 
 import "github.com/deroproject/derohe/dvm"
 import "github.com/deroproject/derohe/block"
+import "github.com/deroproject/derohe/astrobwt/astrobwtv3"
 import "github.com/deroproject/derohe/globals"
 import "github.com/deroproject/derohe/transaction"
 import "github.com/deroproject/derohe/blockchain/mempool"
@@ -66,15 +67,23 @@ type Blockchain struct {
 
 	mining_blocks_cache          *lru.Cache // used to cache blocks which have been supplied to mining
 	cache_IsMiniblockPowValid    *lru.Cache // used to cache mini blocks pow test result
+	cache_MiniblockPoWHash       *lru.Cache // pow hashes computed in parallel while syncing
 	cache_IsNonceValidTips       *lru.Cache // used to cache nonce tests on specific tips
 	cache_IsAddressHashValid     *lru.Cache // used to cache some outputs
 	cache_Get_Difficulty_At_Tips *lru.Cache // used to cache some outputs
 	cache_BlockPast              *lru.Cache // used to cache a blocks past
 	cache_BlockHeight            *lru.Cache // used to cache a blocks past
 	cache_VersionMerkle          *lru.Cache // used to cache a versions merkle root
+	cache_BlockFeeStats          *lru.Cache // used to cache fee statistics of a block
+
+	fee_estimates fee_estimate_cache // fee estimates of current top block
 
 	integrator_address rpc.Address // integrator rewards will be given to this address
 
+	template_policy       Template_Policy // decides tx selection for block templates, nil means by fees
+	pow_cache             *pow_cache      // verified miniblocks on disk, nil if disabled
+	template_policy_mutex sync.Mutex
+
 	cache_enabled bool // enables all cache, based on ENV  DISABLE_CACHE
 
 	Difficulty        uint64           // current cumulative difficulty
@@ -94,9 +103,14 @@ type Blockchain struct {
 	RPC_NotifyNewBlock      *sync.Cond // used to notify rpc that a new block has been found
 	RPC_NotifyHeightChanged *sync.Cond // used to notify rpc that  chain height has changed due to addition of block
 	RPC_NotifyNewMiniBlock  *sync.Cond // used to notify rpc that a new mini block has been found
+	RPC_NotifyReorg         *sync.Cond // used to notify rpc that main chain has been reorganised
 
 	Sync bool // whether the sync is active, used while bootstrapping
 
+	Prune_Mutex sync.RWMutex   // write locked while pruned state is being swapped in, readers loading state without chain lock take read lock, always before chain lock
+	prune       *online_pruner // background pruning, nil if disabled
+	reorgs      *reorg_history // recent reorganisations of main chain
+
 	sync.RWMutex
 }
 
@@ -140,6 +154,12 @@ func Blockchain_Start(params map[string]interface{}) (*Blockchain, error) {
 	if chain.cache_IsMiniblockPowValid, err = lru.New(8192); err != nil { // temporary cache for miniblock difficulty
 		return nil, err
 	}
+	if chain.cache_MiniblockPoWHash, err = lru.New(8192); err != nil { // temporary cache for precomputed pow hashes
+		return nil, err
+	}
+	if err = chain.init_pow_cache(params); err != nil {
+		return nil, err
+	}
 	if chain.cache_Get_Difficulty_At_Tips, err = lru.New(8192); err != nil { // temporary cache for difficulty
 		return nil, err
 	}
@@ -166,6 +186,10 @@ func Blockchain_Start(params map[string]interface{}) (*Blockchain, error) {
 		return nil, err
 	}
 
+	if chain.cache_BlockFeeStats, err = lru.New(1024); err != nil { // temporary cache for fee estimation
+		return nil, err
+	}
+
 	chain.cache_enabled = os.Getenv("DISABLE_CACHE") == "" // disable cache if the environ var is set
 	if !chain.cache_enabled {
 		logger.Info("All caching except mining jobs will be disabled")
@@ -188,6 +212,9 @@ func Blockchain_Start(params map[string]interface{}) (*Blockchain, error) {
 	chain.RPC_NotifyNewBlock = sync.NewCond(&sync.Mutex{})      // used by dero daemon to notify all websockets that new block has arrived
 	chain.RPC_NotifyHeightChanged = sync.NewCond(&sync.Mutex{}) // used by dero daemon to notify all websockets that chain height has changed
 	chain.RPC_NotifyNewMiniBlock = sync.NewCond(&sync.Mutex{})  // used by dero daemon to notify all websockets that new miniblock has arrived
+	chain.RPC_NotifyReorg = sync.NewCond(&sync.Mutex{})         // used by dero daemon to notify all websockets that chain has reorganised
+
+	chain.reorgs = load_reorg_history(globals.GetDataDirectory())
 
 	if chain.Store.Topo_store.Count() == 0 && !chain.Store.IsBalancesIntialized() {
 		logger.Info("Genesis block not in store, add it now")
@@ -270,8 +297,17 @@ try_again:
 		}
 	}
 
+	if params["--prune-depth"] != nil {
+		if err = chain.start_pruner(params["--prune-depth"].(int64)); err != nil {
+			return nil, err
+		}
+	}
+
 	atomic.AddUint32(&globals.Subsystem_Active, 1) // increment subsystem
 
+	chain.restore_pools()
+	globals.Cron.AddFunc(POOL_SAVE_INTERVAL, chain.save_pools)
+
 	globals.Cron.AddFunc("@every 360s", clean_up_valid_cache) // cleanup valid tx cache
 	globals.Cron.AddFunc("@every 60s", func() {               // mempool house keeping
 
@@ -360,11 +396,14 @@ func (chain *Blockchain) Shutdown() {
 	chain.Lock()            // take the lock as chain is no longer in unsafe mode
 	close(chain.Exit_Event) // send signal to everyone we are shutting down
 
+	chain.save_pools()       // pending txs are restored on next startup
 	chain.Mempool.Shutdown() // shutdown mempool first
 	chain.Regpool.Shutdown() // shutdown regpool first
 
 	logger.Info("Stopping Blockchain")
 	//chain.Store.Shutdown()
+	chain.Store.Block_tx_store.Close()
+	chain.pow_cache.close()
 	atomic.AddUint32(&globals.Subsystem_Active, ^uint32(0)) // this decrement 1 fom subsystem
 	logger.Info("Stopped Blockchain")
 }
@@ -400,6 +439,7 @@ func (chain *Blockchain) Add_Complete_Block(cbl *block.Complete_Block) (err erro
 
 	result = false
 	height_changed := false
+	reorged := false
 
 	processing_start := time.Now()
 
@@ -455,6 +495,12 @@ func (chain *Blockchain) Add_Complete_Block(cbl *block.Complete_Block) (err erro
 				chain.RPC_NotifyHeightChanged.L.Unlock()
 			}
 
+			if reorged {
+				chain.RPC_NotifyReorg.L.Lock()
+				chain.RPC_NotifyReorg.Broadcast()
+				chain.RPC_NotifyReorg.L.Unlock()
+			}
+
 		} else {
 			logger.V(1).Error(err, "Block rejected by chain", "BLID", block_hash, "bl", fmt.Sprintf("%x", bl.Serialize()), "stack", debug.Stack())
 			logger.V(1).Error(err, "Block rejected by chain", "BLID", block_hash)
@@ -592,15 +638,17 @@ func (chain *Blockchain) Add_Complete_Block(cbl *block.Complete_Block) (err erro
 		for _, mbl := range bl.MiniBlocks {
 			var miner_hash crypto.Hash
 			copy(miner_hash[:], mbl.KeyHash[:])
-			if mbl.Final == false && !chain.IsAddressHashValid(true, miner_hash) {
+			if mbl.Final == false && !chain.isAddressHashValidnolock(true, miner_hash) {
 				err = fmt.Errorf("miner address not registered")
 				return err, false
 			}
 		}
 
 		// verify Pow of miniblocks
+		scratch := astrobwtv3.Pool.Get().(*astrobwtv3.ScratchData)
+		defer astrobwtv3.Pool.Put(scratch)
 		for i, mbl := range bl.MiniBlocks {
-			if !chain.VerifyMiniblockPoW(bl, mbl) {
+			if !chain.VerifyMiniblockPoWWithScratch(bl, mbl, scratch) {
 				block_logger.Error(fmt.Errorf("MiniBlock has invalid PoW"), "rejecting", "i", i)
 				return errormsg.ErrInvalidPoW, false
 			}
@@ -892,7 +940,6 @@ func (chain *Blockchain) Add_Complete_Block(cbl *block.Complete_Block) (err erro
 
 		}
 
-		var balance_tree, sc_meta *graviton.Tree
 		var ss *graviton.Snapshot
 		if bl_current.Height == 0 { // if it's genesis block
 			if ss, err = chain.Store.Balance_store.LoadSnapshot(0); err != nil {
@@ -912,102 +959,9 @@ func (chain *Blockchain) Add_Complete_Block(cbl *block.Complete_Block) (err erro
 				panic(err)
 			}
 		}
-		if balance_tree, err = ss.GetTree(config.BALANCE_TREE); err != nil {
-			panic(err)
-		}
-		if sc_meta, err = ss.GetTree(config.SC_META); err != nil {
-			panic(err)
-		}
-
-		fees_collected := uint64(0)
-
-		// side blocks only represent chain strenth , else they are are ignored
-		// this means they donot get any reward , 0 reward
-		// their transactions are ignored
-
-		//chain.Store.Topo_store.Write(i+base_topo_index, full_order[i],0, int64(bl_current.Height)) // write entry so as sideblock could work
-		var data_trees []*graviton.Tree
-
-		{
-
-			sc_change_cache := map[crypto.Hash]*graviton.Tree{} // cache entire changes for entire block
-
-			// install hardcoded contracts
-			if err = chain.install_hardcoded_contracts(sc_change_cache, ss, balance_tree, sc_meta, bl_current.Height); err != nil {
-				panic(err)
-			}
-
-			for _, txhash := range bl_current.Tx_hashes { // execute all the transactions
-				if tx_bytes, err := chain.Store.Block_tx_store.ReadTX(txhash); err != nil {
-					panic(err)
-				} else {
-					var tx transaction.Transaction
-					if err = tx.Deserialize(tx_bytes); err != nil {
-						panic(err)
-					}
-					for t := range tx.Payloads {
-						if !tx.Payloads[t].SCID.IsZero() {
-							tree, _ := ss.GetTree(string(tx.Payloads[t].SCID[:]))
-							sc_change_cache[tx.Payloads[t].SCID] = tree
-						}
-					}
-					// we have loaded a tx successfully, now lets execute it
-					tx_fees := chain.process_transaction(sc_change_cache, tx, balance_tree, bl_current.Height)
-
-					//fmt.Printf("transaction %s type %s data %+v\n", txhash, tx.TransactionType, tx.SCDATA)
-					if tx.TransactionType == transaction.SC_TX {
-						tx_fees, err = chain.process_transaction_sc(sc_change_cache, ss, bl_current.Height, uint64(current_topo_block), bl_current.Timestamp/1000, bl_current_hash, tx, balance_tree, sc_meta)
-
-						//fmt.Printf("Processsing sc err %s\n", err)
-						if err == nil { // TODO process gasg here
-
-						}
-					}
-					fees_collected += tx_fees
-				}
-			}
-
-			// at this point, we must commit all the SCs, so entire tree hash is interlinked
-			for scid, v := range sc_change_cache {
-				meta_bytes, err := sc_meta.Get(dvm.SC_Meta_Key(scid))
-				if err != nil {
-					panic(err)
-				}
-
-				var meta dvm.SC_META_DATA // the meta contains metadata about SC
-
-				if bl_current.Height < uint64(globals.Config.HF2_HEIGHT) {
-					if err := meta.UnmarshalBinary(meta_bytes); err != nil {
-						panic(err)
-					}
-					if meta.DataHash, err = v.Hash(); err != nil { // encode data tree hash
-						panic(err)
-					}
-					sc_meta.Put(dvm.SC_Meta_Key(scid), meta.MarshalBinary())
-				} else {
-					if err := meta.UnmarshalBinaryGood(meta_bytes); err != nil {
-						panic(err)
-					}
-					if meta.DataHash, err = v.Hash(); err != nil { // encode data tree hash
-						panic(err)
-					}
-					sc_meta.Put(dvm.SC_Meta_Key(scid), meta.MarshalBinaryGood())
-				}
-				data_trees = append(data_trees, v)
-
-				/*fmt.Printf("will commit tree name %x \n", v.GetName())
-								c := v.Cursor()
-					for k, v, err := c.First(); err == nil; k, v, err = c.Next() {
-					fmt.Printf("key=%x, value=%x\n", k, v)
-				}*/
-
-			}
-
-			chain.process_miner_transaction(bl_current, bl_current.Height == 0, balance_tree, fees_collected, bl_current.Height)
-		}
 
 		// we are here, means everything is okay, lets commit the update balance tree
-		data_trees = append(data_trees, balance_tree, sc_meta)
+		data_trees := chain.execute_block(bl_current, ss)
 		//fmt.Printf("committing data trees %+v\n", data_trees)
 		commit_version, err := graviton.Commit(data_trees...)
 		if err != nil {
@@ -1022,8 +976,14 @@ func (chain *Blockchain) Add_Complete_Block(cbl *block.Complete_Block) (err erro
 			fix_bl := bl_current
 			fix_pos := bl_current.Height
 			fix_commit_version := commit_version
+			var old_blocks, new_blocks []crypto.Hash // track blocks displaced from main chain
 			for ; ; fix_pos-- {
 
+				if r, err := chain.Store.Topo_store.Read(int64(fix_bl.Height)); err == nil && !r.IsClean() && r.BLOCK_ID != fix_bl.GetHash() {
+					old_blocks = append([]crypto.Hash{r.BLOCK_ID}, old_blocks...)
+					new_blocks = append([]crypto.Hash{fix_bl.GetHash()}, new_blocks...)
+				}
+
 				chain.Store.Topo_store.Write(int64(fix_bl.Height), fix_bl.GetHash(), fix_commit_version, int64(fix_bl.Height))
 				logger.V(1).Info("fixed loop", "topo", fix_pos)
 
@@ -1052,6 +1012,11 @@ func (chain *Blockchain) Add_Complete_Block(cbl *block.Complete_Block) (err erro
 
 			}
 
+			if len(old_blocks) >= 1 {
+				chain.record_reorg(int64(fix_pos), old_blocks, new_blocks)
+				reorged = true
+			}
+
 		}
 
 		if logger.V(1).Enabled() {
@@ -1182,7 +1147,13 @@ func (chain *Blockchain) BlockCheckSum(cbl *block.Complete_Block) []byte {
 // verifying everything  means everything possible
 // this only change mempool, no DB changes
 func (chain *Blockchain) Add_TX_To_Pool(tx *transaction.Transaction) error {
-	var err error
+	return chain.Add_TX_To_Pool_Source(tx, mempool.TX_Source{})
+}
+
+// same as above, but tx was relayed by a peer, so mempool can apply per peer/IP limits
+func (chain *Blockchain) Add_TX_To_Pool_Source(tx *transaction.Transaction, source mempool.TX_Source) error {
+	chain.Prune_Mutex.RLock() // state versions must not change under us
+	defer chain.Prune_Mutex.RUnlock()
 
 	if tx.IsPremine() {
 		return fmt.Errorf("premine tx not mineable")
@@ -1214,6 +1185,31 @@ func (chain *Blockchain) Add_TX_To_Pool(tx *transaction.Transaction) error {
 		}
 	}
 
+	if err := chain.verifyTXForPoolnolock(tx); err != nil {
+		return err
+	}
+
+	txhash := tx.GetHash()
+	if err := chain.Mempool.Mempool_Add_TX_Source(tx, 0, source); err != nil { // new tx come with 0 marker
+		//rlog.Tracef(2, "TX %s rejected by pool by mempool", txhash)
+		return fmt.Errorf("TX %s rejected by mempool, err %s", txhash, err)
+	}
+	//rlog.Tracef(2, "Successfully added tx %s to pool", txhash)
+	return nil
+}
+
+// does all the checks a tx must pass before it can be added to mempool, but does not add it
+// this is also used to validate txs in stem phase, which are not yet placed in mempool
+func (chain *Blockchain) Verify_TX_For_Pool(tx *transaction.Transaction) error {
+	chain.Prune_Mutex.RLock() // state versions must not change under us
+	defer chain.Prune_Mutex.RUnlock()
+	return chain.verifyTXForPoolnolock(tx)
+}
+
+// same as above, used while Prune_Mutex is held
+func (chain *Blockchain) verifyTXForPoolnolock(tx *transaction.Transaction) error {
+	var err error
+
 	switch tx.TransactionType {
 	case transaction.BURN_TX, transaction.NORMAL, transaction.SC_TX:
 	default:
@@ -1294,14 +1290,7 @@ func (chain *Blockchain) Add_TX_To_Pool(tx *transaction.Transaction) error {
 		return fmt.Errorf("Incoming TX %s could not be verified, err %s", txhash, err)
 	}
 
-	if chain.Mempool.Mempool_Add_TX(tx, 0) { // new tx come with 0 marker
-		//rlog.Tracef(2, "Successfully added tx %s to pool", txhash)
-		return nil
-	} else {
-		//rlog.Tracef(2, "TX %s rejected by pool by mempool", txhash)
-		return fmt.Errorf("TX %s rejected by pool by mempool", txhash)
-	}
-
+	return nil
 }
 
 // side blocks are blocks which lost the race the to become part
@@ -1423,6 +1412,10 @@ func (chain *Blockchain) Rewind_Chain(rewind_count int) (result bool) {
 		if r.Height == 1 {
 			break
 		}
+
+		if top_block_topo_index-rewinded <= chain.Pruned { // history before pruned topoheight is not available
+			break
+		}
 		rewinded++
 	}
 
@@ -1604,6 +1597,11 @@ func (chain *Blockchain) flip_top() {
 					}
 
 					chain.Store.Topo_store.Write(int64(fix_bl.Height), ehash, fix_commit_version, int64(fix_bl.Height))
+					chain.record_reorg(int64(fix_bl.Height), []crypto.Hash{top_id}, []crypto.Hash{ehash})
+
+					chain.RPC_NotifyReorg.L.Lock()
+					chain.RPC_NotifyReorg.Broadcast()
+					chain.RPC_NotifyReorg.L.Unlock()
 
 					//	fmt.Printf("flipped top from %s to %s\n", top_id, ehash)
 
@@ -21,6 +21,7 @@ import "math"
 import "math/big"
 
 import "github.com/deroproject/derohe/block"
+import "github.com/deroproject/derohe/astrobwt/astrobwtv3"
 import "github.com/deroproject/derohe/config"
 import "github.com/deroproject/derohe/cryptography/crypto"
 import "github.com/deroproject/derohe/globals"
@@ -152,6 +153,11 @@ func (chain *Blockchain) Get_Difficulty_At_Tips(tips []crypto.Hash) *big.Int {
 }
 
 func (chain *Blockchain) VerifyMiniblockPoW(bl *block.Block, mbl block.MiniBlock) bool {
+	return chain.VerifyMiniblockPoWWithScratch(bl, mbl, nil)
+}
+
+// verify PoW of miniblock using caller provided scratch, so that verifying many miniblocks does not churn the pool
+func (chain *Blockchain) VerifyMiniblockPoWWithScratch(bl *block.Block, mbl block.MiniBlock, scratch *astrobwtv3.ScratchData) bool {
 	var cachekey []byte
 	for i := range bl.Tips {
 		cachekey = append(cachekey, bl.Tips[i][:]...)
@@ -160,8 +166,14 @@ func (chain *Blockchain) VerifyMiniblockPoW(bl *block.Block, mbl block.MiniBlock
 	if _, ok := chain.cache_IsMiniblockPowValid.Get(fmt.Sprintf("%s", cachekey)); ok {
 		return true
 	}
+	if chain.pow_cache.has(cachekey) {
+		return true
+	}
 
-	PoW := mbl.GetPoWHash()
+	PoW, ok := chain.precomputed_pow(mbl)
+	if !ok {
+		PoW = mbl.GetPoWHashWithScratch(scratch)
+	}
 	block_difficulty := chain.Get_Difficulty_At_Tips(bl.Tips)
 
 	// test new difficulty checksm whether they are equivalent to integer math
@@ -177,6 +189,7 @@ func (chain *Blockchain) VerifyMiniblockPoW(bl *block.Block, mbl block.MiniBlock
 		if chain.cache_enabled {
 			chain.cache_IsMiniblockPowValid.Add(fmt.Sprintf("%s", cachekey), true) // set in cache
 		}
+		chain.pow_cache.add(cachekey)
 		return true
 	}
 	return false
@@ -0,0 +1,190 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package blockchain
+
+// this file estimates the fee per KB a tx must pay to be mined within N blocks
+// the estimate is built from the pool contents ahead of the tx and how full recent blocks were
+
+import "sort"
+import "sync"
+
+import "github.com/deroproject/derohe/config"
+import "github.com/deroproject/derohe/cryptography/crypto"
+import "github.com/deroproject/derohe/transaction"
+import "github.com/deroproject/derohe/blockchain/mempool"
+
+const FEE_ESTIMATE_HISTORY = 100      // number of recent blocks considered for fee estimation
+const FEE_ESTIMATE_DEFAULT_BLOCKS = 3 // default inclusion target in blocks
+const FEE_ESTIMATE_MAX_BLOCKS = 100   // max inclusion target in blocks
+
+// space available to normal txs in a block, see Create_new_miner_block
+const BLOCK_TX_CAPACITY = config.STARGATE_HE_MAX_BLOCK_SIZE - 102400
+
+// fee statistics of a single block
+type block_fee_stat struct {
+	Size        uint64 // size of all normal txs in block
+	MinFeePerKB uint64 // lowest fee per KB paid by a tx in this block, 0 if block has no txs
+	Fees        uint64 // total fees paid by txs in this block
+}
+
+// Fee_Estimate is the result of a fee estimation
+type Fee_Estimate struct {
+	Blocks          uint64 // inclusion target in blocks
+	FeePerKB        uint64 // estimated fee per KB needed
+	MedianBlockSize uint64 // median size of txs in recent blocks
+	PoolAhead       uint64 // bytes of pool txs which will be mined before a tx paying FeePerKB
+}
+
+// estimates are computed once per top block, since every GetInfo call requests one
+type fee_estimate_cache struct {
+	sync.Mutex
+	top       crypto.Hash
+	estimates map[uint64]Fee_Estimate // by inclusion target
+}
+
+// Estimate_Fee_Per_KB estimates fee per KB required to get a tx mined within target_blocks blocks
+// it only reads chain state, so it is safe to call from any rpc goroutine
+func (chain *Blockchain) Estimate_Fee_Per_KB(target_blocks uint64) (result Fee_Estimate) {
+	if target_blocks == 0 {
+		target_blocks = FEE_ESTIMATE_DEFAULT_BLOCKS
+	}
+	if target_blocks > FEE_ESTIMATE_MAX_BLOCKS {
+		target_blocks = FEE_ESTIMATE_MAX_BLOCKS
+	}
+
+	cache := &chain.fee_estimates
+	cache.Lock()
+	defer cache.Unlock()
+	if top := chain.Get_Top_ID(); cache.estimates == nil || cache.top != top {
+		cache.top, cache.estimates = top, map[uint64]Fee_Estimate{}
+	}
+	if result, ok := cache.estimates[target_blocks]; ok {
+		return result
+	}
+
+	recent := chain.recent_block_fee_stats(FEE_ESTIMATE_HISTORY)
+	result = estimate_fee_per_kb(chain.Mempool.Mempool_List_TX_SortedInfo(), recent, target_blocks)
+	cache.estimates[target_blocks] = result
+	return
+}
+
+// collect fee stats for last count blocks in topological order, newest first
+func (chain *Blockchain) recent_block_fee_stats(count int64) (stats []block_fee_stat) {
+	top := chain.Load_TOPO_HEIGHT()
+	pruned := chain.LocatePruneTopo()
+	for topo := top; topo >= 0 && topo > top-count && topo >= pruned; topo-- {
+		blid, err := chain.Load_Block_Topological_order_at_index(topo)
+		if err != nil {
+			break
+		}
+		stat, err := chain.block_fee_stats(blid)
+		if err != nil {
+			break
+		}
+		stats = append(stats, stat)
+	}
+	return
+}
+
+// calculate fee stats of a block, results are cached since blocks do not change
+func (chain *Blockchain) block_fee_stats(blid crypto.Hash) (stat block_fee_stat, err error) {
+	if stati, ok := chain.cache_BlockFeeStats.Get(blid); ok {
+		return stati.(block_fee_stat), nil
+	}
+
+	bl, err := chain.Load_BL_FROM_ID(blid)
+	if err != nil {
+		return
+	}
+
+	for _, txhash := range bl.Tx_hashes {
+		var tx transaction.Transaction
+		var tx_bytes []byte
+		if tx_bytes, err = chain.Store.Block_tx_store.ReadTX(txhash); err != nil {
+			return
+		}
+		if err = tx.Deserialize(tx_bytes); err != nil {
+			return
+		}
+		if tx.IsRegistration() { // registrations do not pay fees and have their own space
+			continue
+		}
+		size := uint64(len(tx_bytes))
+		fee_per_kb := tx.Fees() * 1024 / size
+		if stat.MinFeePerKB == 0 || fee_per_kb < stat.MinFeePerKB {
+			stat.MinFeePerKB = fee_per_kb
+		}
+		stat.Size += size
+		stat.Fees += tx.Fees()
+	}
+
+	chain.cache_BlockFeeStats.Add(blid, stat)
+	return
+}
+
+// pool is ordered by exact fee rate, highest first, fee per byte of real txs is mostly 0 and cannot be used
+// a tx paying estimated fee must outbid everything which will not fit in target_blocks blocks
+// if recent blocks were mostly full, the lowest fees they accepted are also honored
+func estimate_fee_per_kb(pool []mempool.TX_Sorting_struct, recent []block_fee_stat, target_blocks uint64) (result Fee_Estimate) {
+	result.Blocks = target_blocks
+	result.FeePerKB = config.FEE_PER_KB
+
+	pool = append([]mempool.TX_Sorting_struct{}, pool...)
+	sort.SliceStable(pool, func(i, j int) bool { return pool[i].Fees*pool[j].Size > pool[j].Fees*pool[i].Size })
+
+	capacity := target_blocks * BLOCK_TX_CAPACITY
+	for i := range pool {
+		if result.PoolAhead+pool[i].Size > capacity {
+			if fee := pool[i].Fees*1024/pool[i].Size + 1; fee > result.FeePerKB {
+				result.FeePerKB = fee
+			}
+			break
+		}
+		result.PoolAhead += pool[i].Size
+	}
+
+	if len(recent) == 0 {
+		return
+	}
+
+	sizes := make([]uint64, 0, len(recent))
+	var full_mins []uint64
+	for _, stat := range recent {
+		sizes = append(sizes, stat.Size)
+		if stat.Size >= BLOCK_TX_CAPACITY*9/10 {
+			full_mins = append(full_mins, stat.MinFeePerKB)
+		}
+	}
+	result.MedianBlockSize = median_uint64(sizes)
+
+	// congestion is only considered if it has been sustained for a quarter of recent blocks
+	if len(full_mins)*4 >= len(recent) {
+		if fee := median_uint64(full_mins); fee > result.FeePerKB {
+			result.FeePerKB = fee
+		}
+	}
+	return
+}
+
+func median_uint64(list []uint64) uint64 {
+	if len(list) == 0 {
+		return 0
+	}
+	sorted := append([]uint64{}, list...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)/2]
+}
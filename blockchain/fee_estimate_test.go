@@ -0,0 +1,85 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package blockchain
+
+import "testing"
+
+import "github.com/deroproject/derohe/config"
+import "github.com/deroproject/derohe/blockchain/mempool"
+
+// estimate must be at network minimum for idle chains, outbid backlog beyond target and honor sustained congestion
+func Test_Fee_Estimate(t *testing.T) {
+	if result := estimate_fee_per_kb(nil, nil, 1); result.FeePerKB != config.FEE_PER_KB || result.MedianBlockSize != 0 {
+		t.Fatalf("idle chain estimate %+v", result)
+	}
+
+	// backlog of 3 full blocks of real sized txs, which pay far less than a unit per byte, cheapest listed first
+	const tx_size = 2600
+	per_block := uint64(BLOCK_TX_CAPACITY / tx_size)
+	var pool []mempool.TX_Sorting_struct
+	for i := uint64(0); i < 3; i++ {
+		for j := uint64(0); j < per_block; j++ {
+			pool = append(pool, mempool.TX_Sorting_struct{Fees: 100 + i*100, Size: tx_size})
+		}
+	}
+
+	if result := estimate_fee_per_kb(pool, nil, 1); result.FeePerKB != 200*1024/tx_size+1 || result.PoolAhead != per_block*tx_size {
+		t.Fatalf("1 block estimate %+v", result)
+	}
+	if result := estimate_fee_per_kb(pool, nil, 2); result.FeePerKB != 100*1024/tx_size+1 || result.PoolAhead != 2*per_block*tx_size {
+		t.Fatalf("2 block estimate %+v", result)
+	}
+	if result := estimate_fee_per_kb(pool, nil, 3); result.FeePerKB != config.FEE_PER_KB {
+		t.Fatalf("backlog fits, yet estimate %+v", result)
+	}
+
+	full := block_fee_stat{Size: BLOCK_TX_CAPACITY, MinFeePerKB: 5000}
+	empty := block_fee_stat{Size: 1000, MinFeePerKB: config.FEE_PER_KB}
+
+	recent := []block_fee_stat{full, empty, empty, empty, empty}
+	if result := estimate_fee_per_kb(nil, recent, 1); result.FeePerKB != config.FEE_PER_KB || result.MedianBlockSize != 1000 {
+		t.Fatalf("single full block must not raise fees %+v", result)
+	}
+
+	recent = []block_fee_stat{full, full, empty}
+	if result := estimate_fee_per_kb(nil, recent, 1); result.FeePerKB != 5000 || result.MedianBlockSize != BLOCK_TX_CAPACITY {
+		t.Fatalf("congested chain estimate %+v", result)
+	}
+}
+
+// estimates are computed once per top block
+func Test_Fee_Estimate_Cache(t *testing.T) {
+	chain, miner := test_simulator_chain(t)
+	defer chain.Shutdown()
+
+	if result := chain.Estimate_Fee_Per_KB(1); result.FeePerKB != config.FEE_PER_KB {
+		t.Fatalf("idle chain estimate %+v", result)
+	}
+	chain.fee_estimates.Lock()
+	chain.fee_estimates.estimates[1] = Fee_Estimate{Blocks: 1, FeePerKB: 12345}
+	chain.fee_estimates.Unlock()
+	if result := chain.Estimate_Fee_Per_KB(1); result.FeePerKB != 12345 {
+		t.Fatalf("estimate must be cached for current block %+v", result)
+	}
+
+	if err, _ := chain.Add_Complete_Block(reorg_test_block(t, chain, miner)); err != nil {
+		t.Fatalf("cannot add block err %s", err)
+	}
+	if result := chain.Estimate_Fee_Per_KB(1); result.FeePerKB != config.FEE_PER_KB {
+		t.Fatalf("estimate must be recomputed for new block %+v", result)
+	}
+}
@@ -22,6 +22,9 @@ import "sort"
 import "time"
 import "sync/atomic"
 
+import "encoding/hex"
+import "encoding/json"
+
 import "github.com/go-logr/logr"
 
 import "github.com/deroproject/derohe/transaction"
@@ -34,6 +37,7 @@ type TX_Sorting_struct struct {
 	FeesPerByte uint64      // this is fees per byte
 	Hash        crypto.Hash // transaction hash
 	Size        uint64      // transaction size
+	Fees        uint64      // total fees of transaction
 }
 
 // NOTE: do NOT consider this code as useless, as it is used to avooid double spending attacks within the block and within the pool
@@ -53,6 +57,13 @@ type Mempool struct {
 	modified      bool                // used to monitor whethel mem pool contents have changed,
 	height        uint64              // track blockchain height
 
+	accounting      sync.Mutex        // protects fields below, which track usage of pool
+	size            uint64            // size of all txs in bytes
+	sources         map[string]uint64 // count of txs relayed per peer/IP
+	max_size        uint64
+	max_tx_per_peer uint64
+	max_tx_per_ip   uint64
+
 	// global variable , but don't see it utilisation here except fot tx verification
 	//chain *Blockchain
 	Exit_Mutex chan bool
@@ -67,10 +78,53 @@ type mempool_object struct {
 	Height     uint64 //  at which height the tx unlocks in the mempool
 	Size       uint64 // size in bytes of the TX
 	FEEperBYTE uint64 // fee per byte
+	Source     TX_Source
 }
 
 var loggerpool logr.Logger
 
+// marshal object as json
+func (obj *mempool_object) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		Tx     string `json:"tx"` // hex encoding
+		Added  uint64 `json:"added"`
+		Height uint64 `json:"height"`
+	}{
+		Tx:     hex.EncodeToString(obj.Tx.Serialize()),
+		Added:  obj.Added,
+		Height: obj.Height,
+	})
+}
+
+// unmarshal object from json encoding
+func (obj *mempool_object) UnmarshalJSON(data []byte) error {
+	aux := &struct {
+		Tx     string `json:"tx"`
+		Added  uint64 `json:"added"`
+		Height uint64 `json:"height"`
+	}{}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	obj.Added = aux.Added
+	obj.Height = aux.Height
+
+	tx_bytes, err := hex.DecodeString(aux.Tx)
+	if err != nil {
+		return err
+	}
+	obj.Size = uint64(len(tx_bytes))
+
+	obj.Tx = &transaction.Transaction{}
+	if err = obj.Tx.Deserialize(tx_bytes); err != nil {
+		return err
+	}
+	obj.FEEperBYTE = obj.Tx.Fees() / obj.Size
+	return nil
+}
+
 func Init_Mempool(params map[string]interface{}) (*Mempool, error) {
 	var mempool Mempool
 	//mempool.chain = params["chain"].(*Blockchain)
@@ -80,6 +134,7 @@ func Init_Mempool(params map[string]interface{}) (*Mempool, error) {
 	atomic.AddUint32(&globals.Subsystem_Active, 1) // increment subsystem
 
 	mempool.Exit_Mutex = make(chan bool)
+	mempool.policy_init()
 
 	metrics.Set.GetOrCreateGauge("mempool_count", func() float64 {
 		count := float64(0)
@@ -89,6 +144,11 @@ func Init_Mempool(params map[string]interface{}) (*Mempool, error) {
 		})
 		return count
 	})
+	metrics.Set.GetOrCreateGauge("mempool_size_bytes", func() float64 {
+		mempool.accounting.Lock()
+		defer mempool.accounting.Unlock()
+		return float64(mempool.size)
+	})
 
 	return &mempool, nil
 }
@@ -116,7 +176,7 @@ func (pool *Mempool) HouseKeeping(height uint64) {
 }
 
 func (pool *Mempool) Shutdown() {
-	//TODO save mempool tx somewhere
+	// txs are persisted by blockchain using Save, since only it can verify them again on startup
 
 	close(pool.Exit_Mutex) // stop relaying
 
@@ -128,6 +188,30 @@ func (pool *Mempool) Shutdown() {
 
 }
 
+// persists all txs of pool to file, so they survive restarts
+// file is written completely before replacing the older one
+func (pool *Mempool) Save(filename string) error {
+	objects := []*mempool_object{}
+	pool.txs.Range(func(k, value interface{}) bool {
+		objects = append(objects, value.(*mempool_object))
+		return true
+	})
+
+	return globals.SaveJSON(filename, objects)
+}
+
+// reads txs saved using Save, these must be verified again before adding them to pool
+func Load(filename string) (txs []*transaction.Transaction, err error) {
+	var objects []*mempool_object
+	if err = globals.LoadJSON(filename, &objects); err != nil {
+		return
+	}
+	for _, object := range objects {
+		txs = append(txs, object.Tx)
+	}
+	return
+}
+
 // start pool monitoring for changes for some specific time
 // this is required so as we can add or discard transactions while selecting work for mining
 func (pool *Mempool) Monitor() {
@@ -146,49 +230,72 @@ func (pool *Mempool) HasChanged() (result bool) {
 
 // a tx should only be added to pool after verification is complete
 func (pool *Mempool) Mempool_Add_TX(tx *transaction.Transaction, Height uint64) (result bool) {
-	result = false
+	return pool.Mempool_Add_TX_Source(tx, Height, TX_Source{}) == nil
+}
+
+// add tx relayed by a source, policy is applied, txs may be replaced or evicted to make space
+func (pool *Mempool) Mempool_Add_TX_Source(tx *transaction.Transaction, Height uint64, source TX_Source) (err error) {
 	pool.Lock()
 	defer pool.Unlock()
 
 	var object mempool_object
 	tx_hash := crypto.Hash(tx.GetHash())
 
-	dup_within_tx := map[crypto.Hash]bool{}
-
-	for i := range tx.Payloads {
-		if pool.Mempool_Nonce_Used(tx.Payloads[i].Proof.Nonce()) {
-			return false
-		}
-		if _, ok := dup_within_tx[tx.Payloads[i].Proof.Nonce()]; ok {
-			return false
-		}
-		dup_within_tx[tx.Payloads[i].Proof.Nonce()] = true
-	}
-
 	// check if tx already exists, skip it
 	if _, ok := pool.txs.Load(tx_hash); ok {
 		//rlog.Debugf("Pool already contains %s, skipping", tx_hash)
-		return false
+		return fmt.Errorf("TX %s already in pool", tx_hash)
 	}
 
-	for i := range tx.Payloads {
-		pool.nonces.Store(tx.Payloads[i].Proof.Nonce(), true)
-	}
-
-	// we are here means we can add it to pool
 	object.Tx = tx
 	object.Height = Height
 	object.Added = uint64(time.Now().UTC().Unix())
-
 	object.Size = uint64(len(tx.Serialize()))
 	object.FEEperBYTE = tx.Fees() / object.Size
+	object.Source = source
+
+	conflicts, err := pool.find_conflicts(tx)
+	if err != nil {
+		return reject("nonce", err)
+	}
+	if len(conflicts) >= 1 {
+		if err = check_replacement(&object, conflicts); err != nil {
+			return reject("nonce", err)
+		}
+	}
+
+	if err = pool.check_source_limits(source, conflicts); err != nil {
+		return reject("source_limit", err)
+	}
+
+	evict, err := pool.select_evictions(&object, conflicts)
+	if err != nil {
+		return reject("full", err)
+	}
+
+	// we are here means we can add it to pool
+	for _, c := range conflicts {
+		loggerpool.V(1).Info("TX replaced", "txid", c.Tx.GetHash(), "by", tx_hash)
+		metrics.Set.GetOrCreateCounter("mempool_replaced_total").Inc()
+		pool.Mempool_Delete_TX(c.Tx.GetHash())
+	}
+	for _, txhash := range evict {
+		loggerpool.V(1).Info("TX evicted", "txid", txhash, "for", tx_hash)
+		metrics.Set.GetOrCreateCounter("mempool_evicted_total").Inc()
+		pool.Mempool_Delete_TX(txhash)
+	}
+
+	for i := range tx.Payloads {
+		pool.nonces.Store(tx.Payloads[i].Proof.Nonce(), tx_hash)
+	}
 
 	pool.txs.Store(tx_hash, &object)
+	pool.account(&object, true)
 	pool.modified = true // pool has been modified
 
 	//pool.sort_list() // sort and update pool list
 
-	return true
+	return nil
 }
 
 // check whether a tx exists in the pool
@@ -231,15 +338,20 @@ func (pool *Mempool) Mempool_Delete_TX(txid crypto.Hash) (tx *transaction.Transa
 	// we reached here means, we have the tx remove it from our list, do maintainance cleapup and discard it
 	object := objecti.(*mempool_object)
 	tx = object.Tx
-	pool.txs.Delete(txid)
+	if _, loaded := pool.txs.LoadAndDelete(txid); !loaded { // someone else deleted it
+		return nil
+	}
+	pool.account(object, false)
 
 	// remove all the key images
 	//TODO
 	//	for i := 0; i < len(object.Tx.Vin); i++ {
 	//		pool.nonces.Delete(object.Tx.Vin[i].(transaction.Txin_to_key).K_image)
 	//	}
-	for i := range tx.Payloads {
-		pool.nonces.Delete(tx.Payloads[i].Proof.Nonce())
+	for i := range tx.Payloads { // nonce may already belong to a replacement
+		if owner, ok := pool.nonces.Load(tx.Payloads[i].Proof.Nonce()); ok && owner.(crypto.Hash) == txid {
+			pool.nonces.Delete(tx.Payloads[i].Proof.Nonce())
+		}
 	}
 
 	//pool.sort_list()     // sort and update pool list
@@ -307,6 +419,30 @@ func (pool *Mempool) Mempool_List_TX_SortedInfo() []TX_Sorting_struct {
 	*/
 }
 
+// TX_Info describes a pool entry, used to report pool contents
+type TX_Info struct {
+	Hash       crypto.Hash
+	Tx         *transaction.Transaction
+	Added      uint64 // time in epoch format
+	Height     uint64 // at which height the tx unlocks in the mempool
+	Size       uint64
+	FEEperBYTE uint64
+}
+
+// return all pool entries, sorted by fees per byte, highest first
+func (pool *Mempool) Mempool_List_TX_Info() []TX_Info {
+	var list []TX_Info
+
+	pool.txs.Range(func(k, value interface{}) bool {
+		v := value.(*mempool_object)
+		list = append(list, TX_Info{Hash: k.(crypto.Hash), Tx: v.Tx, Added: v.Added, Height: v.Height, Size: v.Size, FEEperBYTE: v.FEEperBYTE})
+		return true
+	})
+
+	sort.SliceStable(list, func(i, j int) bool { return list[i].FEEperBYTE > list[j].FEEperBYTE })
+	return list
+}
+
 // print current mempool txs
 // TODO add sorting
 func (pool *Mempool) Mempool_Print() {
@@ -368,7 +504,7 @@ func (pool *Mempool) sort_list() ([]crypto.Hash, []TX_Sorting_struct) {
 		txhash := k.(crypto.Hash)
 		v := value.(*mempool_object)
 		if v.Height <= pool.height {
-			data = append(data, TX_Sorting_struct{Hash: txhash, FeesPerByte: v.FEEperBYTE, Size: v.Size})
+			data = append(data, TX_Sorting_struct{Hash: txhash, FeesPerByte: v.FEEperBYTE, Size: v.Size, Fees: v.Tx.Fees()})
 		}
 		return true
 	})
@@ -19,16 +19,23 @@ package mempool
 //import "fmt"
 //import "bytes"
 import "testing"
+import "sync"
 import "encoding/hex"
+import "path/filepath"
 
 import "github.com/deroproject/derohe/transaction"
+import "github.com/deroproject/derohe/cryptography/crypto"
+
+// this tx is from  internal testnet
+// tx_id 499002f3fb7fea8a71dac93dea65c0ff74be05b0858078a27a48d78b71eacf87
+const test_tx_hex = "01000003519b9e874a9dd7fcbfb7802268123dcf970c336891101a3a0705855b72b9eb08c80100000000000000000000000000000000000000000000000000000000000000000000f394d06566a81b024fd8624b4c8592f8b9344e58f227261eb08d821bd190b4ac9c7df0660038ddcf881602a14fe5ad8eebff83d3ce3541a1f232fe61acf71109e417160936863e8c0597c798b73ef08e76b8eeebcaf20260ba91fcdef5f626361f824dc6197b02c599d4511c624a933226d8fccc125611ec80d8ad5acea4baf2f1c77e4c5525d9859b40f43daaf3d4e4450203d80419dcb026b9adbd7d6912284ee9ce20f3721076947f16e1faefd9b8c35116f4cf0044ead0a12fda3f3bcf2ed91627b922c02c10d112df9e782d3750cda151f6ba2ebe6495065141f32800894566011198c4055458005a31d3e285037446ba14bac54420bcab87cbebeaccab1f158b011e90132b7310e6c866e348cab68d21bad1d9f811b4d667a1e40bdef1a19259d3000b972ae06da958658b12ca4a45c2c6ea50d305be86f7e979fc962c687eb012f401a2c4bf0beb6c713343b94d65ee6d937660480daf670ab5b0ed421a9103e8a25119c836dd799600e67e4ec66ef680833398a99b16956aed2ee5bd9e6c8e68009a01145636e5e448d6c8ab902db394aa9c5aeee92dd150e1150d5b8f6674f330c279010912df27232ae126525a130ed8a9b4dee62eb57ce1d8a42ae9bcef867b10ce94012f94aa78846fcdda504243f83f3122aee5dc38dd32fa2a90224b3a40b4cf79c301129028709e39591c55e6e477a36cc26dc2efd7183fb59f51635dbd114dfed9d5010d66f31b781fa181c2114600ee1f03d55439355265700fb9d35ac684a19db398001e12558cc17e59fb85fb825481dee6fef3612c043bb38ca4833183da5381364600077a99d4d2df2f06067359f178a40f98a3e0943309c5ce3ce5398b9909174254012aa49cfc78ebec51c00e7824db0d8d41ef43fbb0396824d2c31b7db64124cc61000a8b51bd6c94a502f7aea3e5001f00d76b165ad580e48f8aa72813da8240286e00055f3480aa7cdb68a20d4b1e567d42389b44cf4e345da9e5a5655a80418695bc012c8f1e1ef8af646b4fb08afaeb3febde17c4c0d04b30dfd22d96a32ced9c9439010c40484e1547d307ad56b79bb7450e4eaaed7ed79bd5392dffd7449043f8783a0015104264f8d80356176ca6fdf4777e4ebc8edcbab50f8b6c366ac75ebd6bb5c701078d55053d2d41f21f51d5e617f282ba9dfa2576f0231048dd73998ceaa699fd0105821b61addd6935c7d80e65c706f0f2aa2d73ad22c5548c9c8b92cd82689dc40115f576c413a37014b9ee5377b121c69ad6e0f00f2b4f6c99d1f68b00a5d923370119b29fe6e9cf35f1344e24d52ee1fdb6521de3176f3d2b2a2b9327ae6e6cfbb10017198369a6ff180253700361c40e7f378c8e7ead6e04f01dbf5b4c47e7e1e4ff001abaf84628764eccbc5d0f66dc0a99505bb0e598362c45312470526afad11caf00242c6a902c564b3b363eb4ae08f643f18571779428358bfbdaf9856b0ebf229f0100000000000000000000000000000000000000000000000000000000000000001b7a78b6f573d4ac5d3a8d7d10dafac0dbc92604474417b29d40448d9fbc821d0fe3f73da41b27752d5db0658fcc0bff7da21112417ac719e491fdd43c8e5d0b07bcca22c27367a276e6a4e0cfb1bfbc772842898356ad4723101d4ada5137f409bb3b290d7519da3af15feb09e183e2be809690099551f1cb984deb1295b7611dd0cfd9000482314a388512d278fc22b2f6e3fc6e95023b4bd228e22626b7440119fa2c6f45a33b008ef5b23a5522ebbf0bf5f26d8263613a7f9b5ad9a192357600107a023453f7f79f413756dfba0096ae5d13158bbbb147089a020e819ef6640728acf01c811b967d1a14d767ac20088c5ca1613aa5d94ebe7fe2840b6431d8d002137dae183071d12cd9fb14c4b4738ef750ff514ce26257d1245eaedfea625516bfcb075a33a8910dc4e40742bfaa70d95591711e9db33d0db0be06cc819817072c22a9c81f4369f68bb1ef71c7f7458671d647caef18b30cca91da4f1b201d082a03306b4a07d1f0e1a8cc8844038fc524201a6c3a346a971203fd45458d292987d44049eecdac25c5622465a8d683a43621612d2fb283724b17a7bfa3bad2266a6fb1cf669eef21c90e24e85d6ab48e8b237355e964407dde00d65fb442dd210ce0378349f533c0e8ab65293de5319e246a044ed22b1e6db28add1508dd6f0da22954eea8a431b211a8b54147e32fec6593f9fb731389f62f94d5047e0f3301216576c71a79629bc3879325280e216d59cf7e6ff2d6a0babe418f8f2ed603ce010e16785f8c855043221ed5a603d4ed4e8e90059669543738ceb2a04dc996079c01264e9beaf4bb82e1b8f47bb0c239167064001e306eeef2b5495ec42754806b65012357f738543b13594ff081a070dbc0575645ac5ce8e0f89d3afdeb3d49e9ddae012a17d5095b9cef08f6eee2ce733dbf2cfcdb8c23e39410ed973e68cf8505266d00280c52b45752dd12ba84499618898111a8f9b19f2b76c06917e57eef221f3387011cc3360b478d144118a82a3c4391814f34aac2fb0f2d043394304bed179689e501292ca5631820f5f465242b4cc517f06c153c176a43f77daca463b7e2d3e2d7ba001aa0b2c90c3172cd2556137d78748f47924432449210d8b2f5e27adb6210bc77012c92a12526a5b0b1ef60994eb4d08e9bb5a3ea330d417838a52ad8636d37fa9e00131153c9affeefd6b98ecb6a80f5e6ea97417376030325182c064e12dd353c32011f4e25c49eea09adaa46d56642e2ea0afced2d75036acd3839435863f1ec3bf1002e19fe8456a7236c8fb77a15f87164debaad865e85c3468152a5deaffde3da6a01"
 
 // test the mempool interface with valid TX
 func Test_mempool(t *testing.T) {
 
 	// this tx is from  internal testnet
 	// tx_id 499002f3fb7fea8a71dac93dea65c0ff74be05b0858078a27a48d78b71eacf87
-	tx_hex := "01000003519b9e874a9dd7fcbfb7802268123dcf970c336891101a3a0705855b72b9eb08c80100000000000000000000000000000000000000000000000000000000000000000000f394d06566a81b024fd8624b4c8592f8b9344e58f227261eb08d821bd190b4ac9c7df0660038ddcf881602a14fe5ad8eebff83d3ce3541a1f232fe61acf71109e417160936863e8c0597c798b73ef08e76b8eeebcaf20260ba91fcdef5f626361f824dc6197b02c599d4511c624a933226d8fccc125611ec80d8ad5acea4baf2f1c77e4c5525d9859b40f43daaf3d4e4450203d80419dcb026b9adbd7d6912284ee9ce20f3721076947f16e1faefd9b8c35116f4cf0044ead0a12fda3f3bcf2ed91627b922c02c10d112df9e782d3750cda151f6ba2ebe6495065141f32800894566011198c4055458005a31d3e285037446ba14bac54420bcab87cbebeaccab1f158b011e90132b7310e6c866e348cab68d21bad1d9f811b4d667a1e40bdef1a19259d3000b972ae06da958658b12ca4a45c2c6ea50d305be86f7e979fc962c687eb012f401a2c4bf0beb6c713343b94d65ee6d937660480daf670ab5b0ed421a9103e8a25119c836dd799600e67e4ec66ef680833398a99b16956aed2ee5bd9e6c8e68009a01145636e5e448d6c8ab902db394aa9c5aeee92dd150e1150d5b8f6674f330c279010912df27232ae126525a130ed8a9b4dee62eb57ce1d8a42ae9bcef867b10ce94012f94aa78846fcdda504243f83f3122aee5dc38dd32fa2a90224b3a40b4cf79c301129028709e39591c55e6e477a36cc26dc2efd7183fb59f51635dbd114dfed9d5010d66f31b781fa181c2114600ee1f03d55439355265700fb9d35ac684a19db398001e12558cc17e59fb85fb825481dee6fef3612c043bb38ca4833183da5381364600077a99d4d2df2f06067359f178a40f98a3e0943309c5ce3ce5398b9909174254012aa49cfc78ebec51c00e7824db0d8d41ef43fbb0396824d2c31b7db64124cc61000a8b51bd6c94a502f7aea3e5001f00d76b165ad580e48f8aa72813da8240286e00055f3480aa7cdb68a20d4b1e567d42389b44cf4e345da9e5a5655a80418695bc012c8f1e1ef8af646b4fb08afaeb3febde17c4c0d04b30dfd22d96a32ced9c9439010c40484e1547d307ad56b79bb7450e4eaaed7ed79bd5392dffd7449043f8783a0015104264f8d80356176ca6fdf4777e4ebc8edcbab50f8b6c366ac75ebd6bb5c701078d55053d2d41f21f51d5e617f282ba9dfa2576f0231048dd73998ceaa699fd0105821b61addd6935c7d80e65c706f0f2aa2d73ad22c5548c9c8b92cd82689dc40115f576c413a37014b9ee5377b121c69ad6e0f00f2b4f6c99d1f68b00a5d923370119b29fe6e9cf35f1344e24d52ee1fdb6521de3176f3d2b2a2b9327ae6e6cfbb10017198369a6ff180253700361c40e7f378c8e7ead6e04f01dbf5b4c47e7e1e4ff001abaf84628764eccbc5d0f66dc0a99505bb0e598362c45312470526afad11caf00242c6a902c564b3b363eb4ae08f643f18571779428358bfbdaf9856b0ebf229f0100000000000000000000000000000000000000000000000000000000000000001b7a78b6f573d4ac5d3a8d7d10dafac0dbc92604474417b29d40448d9fbc821d0fe3f73da41b27752d5db0658fcc0bff7da21112417ac719e491fdd43c8e5d0b07bcca22c27367a276e6a4e0cfb1bfbc772842898356ad4723101d4ada5137f409bb3b290d7519da3af15feb09e183e2be809690099551f1cb984deb1295b7611dd0cfd9000482314a388512d278fc22b2f6e3fc6e95023b4bd228e22626b7440119fa2c6f45a33b008ef5b23a5522ebbf0bf5f26d8263613a7f9b5ad9a192357600107a023453f7f79f413756dfba0096ae5d13158bbbb147089a020e819ef6640728acf01c811b967d1a14d767ac20088c5ca1613aa5d94ebe7fe2840b6431d8d002137dae183071d12cd9fb14c4b4738ef750ff514ce26257d1245eaedfea625516bfcb075a33a8910dc4e40742bfaa70d95591711e9db33d0db0be06cc819817072c22a9c81f4369f68bb1ef71c7f7458671d647caef18b30cca91da4f1b201d082a03306b4a07d1f0e1a8cc8844038fc524201a6c3a346a971203fd45458d292987d44049eecdac25c5622465a8d683a43621612d2fb283724b17a7bfa3bad2266a6fb1cf669eef21c90e24e85d6ab48e8b237355e964407dde00d65fb442dd210ce0378349f533c0e8ab65293de5319e246a044ed22b1e6db28add1508dd6f0da22954eea8a431b211a8b54147e32fec6593f9fb731389f62f94d5047e0f3301216576c71a79629bc3879325280e216d59cf7e6ff2d6a0babe418f8f2ed603ce010e16785f8c855043221ed5a603d4ed4e8e90059669543738ceb2a04dc996079c01264e9beaf4bb82e1b8f47bb0c239167064001e306eeef2b5495ec42754806b65012357f738543b13594ff081a070dbc0575645ac5ce8e0f89d3afdeb3d49e9ddae012a17d5095b9cef08f6eee2ce733dbf2cfcdb8c23e39410ed973e68cf8505266d00280c52b45752dd12ba84499618898111a8f9b19f2b76c06917e57eef221f3387011cc3360b478d144118a82a3c4391814f34aac2fb0f2d043394304bed179689e501292ca5631820f5f465242b4cc517f06c153c176a43f77daca463b7e2d3e2d7ba001aa0b2c90c3172cd2556137d78748f47924432449210d8b2f5e27adb6210bc77012c92a12526a5b0b1ef60994eb4d08e9bb5a3ea330d417838a52ad8636d37fa9e00131153c9affeefd6b98ecb6a80f5e6ea97417376030325182c064e12dd353c32011f4e25c49eea09adaa46d56642e2ea0afced2d75036acd3839435863f1ec3bf1002e19fe8456a7236c8fb77a15f87164debaad865e85c3468152a5deaffde3da6a01"
+	tx_hex := test_tx_hex
 
 	var tx, dup_tx transaction.Transaction
 
@@ -133,3 +140,166 @@ func Test_mempool(t *testing.T) {
 	}
 
 }
+
+// returns sample tx with modified fees, all such txs share nonce
+func test_tx(t *testing.T, fees uint64) *transaction.Transaction {
+	var tx transaction.Transaction
+	tx_raw, _ := hex.DecodeString(test_tx_hex)
+	if err := tx.Deserialize(tx_raw); err != nil {
+		t.Fatalf("Tx Deserialisation failed")
+	}
+	tx.Payloads[0].Statement.Fees = fees
+	return &tx
+}
+
+// places a tx in pool bypassing policy, used to simulate txs with other nonces
+func test_insert(pool *Mempool, txhash crypto.Hash, tx *transaction.Transaction, source TX_Source) {
+	object := &mempool_object{Tx: tx, Size: uint64(len(tx.Serialize())), Source: source}
+	object.FEEperBYTE = tx.Fees() / object.Size
+	pool.txs.Store(txhash, object)
+	pool.account(object, true)
+}
+
+// test replace by fee, per source limits and eviction
+func Test_mempool_policy(t *testing.T) {
+	pool, _ := Init_Mempool(nil)
+	source := TX_Source{Peer: 1, IP: "127.0.0.1"}
+
+	low := test_tx(t, 1000)
+	if err := pool.Mempool_Add_TX_Source(low, 0, source); err != nil {
+		t.Fatalf("Cannot add transaction to pool err %s", err)
+	}
+	size := uint64(len(low.Serialize()))
+	if policy := pool.Policy(); policy.Count != 1 || policy.Size != size || policy.MaxSize != DEFAULT_MAX_SIZE {
+		t.Fatalf("Pool policy is wrong %+v", policy)
+	}
+
+	if err := pool.Mempool_Add_TX_Source(test_tx(t, 1050), 0, source); err == nil {
+		t.Fatalf("Replacement with insufficient fees must be rejected")
+	}
+
+	pool.max_tx_per_peer = 1 // replacement does not count towards limit
+	high := test_tx(t, 2000)
+	if err := pool.Mempool_Add_TX_Source(high, 0, source); err != nil {
+		t.Fatalf("Replacement failed err %s", err)
+	}
+	if pool.Mempool_TX_Exist(low.GetHash()) || !pool.Mempool_TX_Exist(high.GetHash()) {
+		t.Fatalf("Replaced tx must be removed from pool")
+	}
+	if owner, _ := pool.nonces.Load(high.Payloads[0].Proof.Nonce()); owner != high.GetHash() {
+		t.Fatalf("Nonce must belong to replacement")
+	}
+	if policy := pool.Policy(); policy.Count != 1 || policy.Size != size {
+		t.Fatalf("Pool accounting is wrong after replacement %+v", policy)
+	}
+
+	test_insert(pool, crypto.Hash{1}, test_tx(t, 10), TX_Source{Peer: 2})
+	if err := pool.Mempool_Add_TX_Source(test_tx(t, 4000), 0, TX_Source{Peer: 2}); err == nil {
+		t.Fatalf("Peer limit must be applied")
+	}
+	pool.max_tx_per_peer = 0
+
+	// pool is full, cheapest tx is evicted for a replacement paying more
+	pool.max_size = 2 * size
+	if err := pool.Mempool_Add_TX_Source(test_tx(t, 4000), 0, TX_Source{}); err != nil {
+		t.Fatalf("Replacement failed in full pool err %s", err)
+	}
+	if !pool.Mempool_TX_Exist(crypto.Hash{1}) {
+		t.Fatalf("Tx must not be evicted when replacement frees space")
+	}
+	pool.max_size = size + size/2
+	if err := pool.Mempool_Add_TX_Source(test_tx(t, 8000), 0, TX_Source{}); err != nil {
+		t.Fatalf("Tx must be accepted by evicting cheaper tx err %s", err)
+	}
+	if pool.Mempool_TX_Exist(crypto.Hash{1}) {
+		t.Fatalf("Cheapest tx must be evicted")
+	}
+	if policy := pool.Policy(); policy.Count != 1 || policy.Size != size || policy.LowestFeePerKB != 0 {
+		t.Fatalf("Pool accounting is wrong after eviction %+v", policy)
+	}
+
+	pool.Mempool_flush()
+	expensive := test_tx(t, 1000000)
+	expensive_size := uint64(len(expensive.Serialize()))
+	pool.max_size = expensive_size
+	test_insert(pool, crypto.Hash{2}, expensive, TX_Source{})
+	if policy := pool.Policy(); policy.LowestFeePerKB != (1000000*1024+expensive_size-1)/expensive_size {
+		t.Fatalf("Full pool must report lowest fee per KB %+v", policy)
+	}
+	if err := pool.Mempool_Add_TX_Source(test_tx(t, 1000), 0, TX_Source{}); err == nil {
+		t.Fatalf("Pool is full of better paying txs, tx must be rejected")
+	}
+	if pool.Mempool_Delete_TX(crypto.Hash{2}) == nil || pool.Policy().Size != 0 {
+		t.Fatalf("Pool accounting is wrong after delete")
+	}
+}
+
+// real txs pay far less than a unit per byte, eviction and reported fees must still follow exact fee rates
+func Test_mempool_policy_realistic_fees(t *testing.T) {
+	pool, _ := Init_Mempool(nil)
+	size := uint64(len(test_tx(t, 1000).Serialize()))
+	if 2000 >= size {
+		t.Fatalf("test txs must pay less than a unit per byte, size %d", size)
+	}
+
+	for i, fees := range []uint64{1000, 500, 1500} {
+		test_insert(pool, crypto.Hash{byte(i + 1)}, test_tx(t, fees), TX_Source{})
+	}
+	pool.max_size = 3 * size
+	if policy := pool.Policy(); policy.LowestFeePerKB != (500*1024+size-1)/size {
+		t.Fatalf("Full pool must report lowest fee per KB of cheapest tx %+v", policy)
+	}
+
+	if err := pool.Mempool_Add_TX_Source(test_tx(t, 2000), 0, TX_Source{}); err != nil {
+		t.Fatalf("Tx must be accepted by evicting cheaper tx err %s", err)
+	}
+	if pool.Mempool_TX_Exist(crypto.Hash{2}) || !pool.Mempool_TX_Exist(crypto.Hash{1}) || !pool.Mempool_TX_Exist(crypto.Hash{3}) {
+		t.Fatalf("Only the cheapest tx must be evicted")
+	}
+	if policy := pool.Policy(); policy.LowestFeePerKB != (1000*1024+size-1)/size {
+		t.Fatalf("Full pool must report lowest fee per KB after eviction %+v", policy)
+	}
+	if err := pool.Mempool_Add_TX_Source(test_tx(t, 800), 0, TX_Source{}); err == nil {
+		t.Fatalf("Pool is full of better paying txs, tx must be rejected")
+	}
+}
+
+// saved pool must load back all txs
+func Test_mempool_persist(t *testing.T) {
+	pool, _ := Init_Mempool(nil)
+	filename := filepath.Join(t.TempDir(), "mempool.json")
+
+	if txs, err := Load(filename); err != nil || len(txs) != 0 {
+		t.Fatalf("Missing file must load as empty pool err %s", err)
+	}
+
+	tx := test_tx(t, 1000)
+	if err := pool.Mempool_Add_TX_Source(tx, 0, TX_Source{}); err != nil {
+		t.Fatalf("Cannot add transaction to pool err %s", err)
+	}
+	// cron and shutdown may save at the same time
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- pool.Save(filename)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Cannot save pool err %s", err)
+		}
+	}
+
+	txs, err := Load(filename)
+	if err != nil || len(txs) != 1 || txs[0].GetHash() != tx.GetHash() {
+		t.Fatalf("Saved pool not loaded correctly err %s", err)
+	}
+	if leftovers, _ := filepath.Glob(filename + ".*.tmp"); len(leftovers) != 0 {
+		t.Fatalf("Temp files left behind %v", leftovers)
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mempool
+
+// this file implements admission policy of the pool
+// pool size is limited in bytes, when full lowest fee per byte txs are evicted in favour of better paying txs
+// a tx using a nonce already in pool replaces the conflicting txs, if it pays sufficiently more fees (replace by fee)
+// txs relayed by a single peer or a single IP are limited, so a peer cannot fill the pool on its own
+
+import "fmt"
+import "sort"
+import "strconv"
+
+import "github.com/deroproject/derohe/cryptography/crypto"
+import "github.com/deroproject/derohe/globals"
+import "github.com/deroproject/derohe/metrics"
+import "github.com/deroproject/derohe/transaction"
+
+const DEFAULT_MAX_SIZE = 64 * 1024 * 1024 // default max size of all txs in pool in bytes
+const DEFAULT_MAX_TX_PER_PEER = 1000      // default max txs in pool relayed by a single peer
+const DEFAULT_MAX_TX_PER_IP = 2000        // default max txs in pool relayed from a single IP, an IP may run several peers
+const RBF_MIN_BUMP_PERCENT = 10           // replacement must pay atleast this much percent more than all txs it replaces
+
+// where did a tx come from, zero value is used for local txs (rpc, wallets), which are not limited
+type TX_Source struct {
+	Peer uint64 // peer id of relaying peer
+	IP   string // IP of relaying peer
+}
+
+func (s TX_Source) keys() (keys []string) {
+	if s.Peer != 0 {
+		keys = append(keys, "peer:"+strconv.FormatUint(s.Peer, 16))
+	}
+	if s.IP != "" {
+		keys = append(keys, "ip:"+s.IP)
+	}
+	return
+}
+
+// current policy and usage of pool, limits of 0 mean unlimited
+type Policy struct {
+	MaxSize        uint64 // max size of all txs in bytes
+	Size           uint64 // current size of all txs in bytes
+	Count          uint64 // current tx count
+	LowestFeePerKB uint64 // when pool is full, a tx must pay more than this per KB to be accepted, rounded up
+	RBFBumpPercent uint64 // replacement must pay this much percent more fees than the txs it replaces
+	MaxTxPerPeer   uint64
+	MaxTxPerIP     uint64
+}
+
+// setup limits from command line
+func (pool *Mempool) policy_init() {
+	pool.max_size = DEFAULT_MAX_SIZE
+	pool.max_tx_per_peer = DEFAULT_MAX_TX_PER_PEER
+	pool.max_tx_per_ip = DEFAULT_MAX_TX_PER_IP
+	pool.sources = map[string]uint64{}
+
+	for _, limit := range []struct {
+		option string
+		value  *uint64
+	}{{"--mempool-size", &pool.max_size}, {"--mempool-peer-limit", &pool.max_tx_per_peer}, {"--mempool-ip-limit", &pool.max_tx_per_ip}} {
+		if _, ok := globals.Arguments[limit.option]; ok && globals.Arguments[limit.option] != nil {
+			i, err := strconv.ParseUint(globals.Arguments[limit.option].(string), 10, 64)
+			if err != nil {
+				loggerpool.Error(err, "error parsing option, using default", "option", limit.option, "default", *limit.value)
+			} else {
+				*limit.value = i
+			}
+		}
+	}
+}
+
+// returns current policy and usage
+func (pool *Mempool) Policy() (policy Policy) {
+	pool.accounting.Lock()
+	policy.MaxSize = pool.max_size
+	policy.Size = pool.size
+	policy.MaxTxPerPeer = pool.max_tx_per_peer
+	policy.MaxTxPerIP = pool.max_tx_per_ip
+	pool.accounting.Unlock()
+
+	policy.RBFBumpPercent = RBF_MIN_BUMP_PERCENT
+
+	var lowest *mempool_object
+	pool.txs.Range(func(k, value interface{}) bool {
+		policy.Count++
+		if v := value.(*mempool_object); lowest == nil || lower_fee_rate(v.Tx.Fees(), v.Size, lowest.Tx.Fees(), lowest.Size) {
+			lowest = v
+		}
+		return true
+	})
+	if policy.MaxSize != 0 && lowest != nil && policy.Size*10 >= policy.MaxSize*9 { // pool is considered full at 90 %
+		policy.LowestFeePerKB = fee_per_kb(lowest.Tx.Fees(), lowest.Size)
+	}
+	return
+}
+
+// called whenever a tx is added or removed
+func (pool *Mempool) account(object *mempool_object, added bool) {
+	pool.accounting.Lock()
+	defer pool.accounting.Unlock()
+
+	for _, key := range object.Source.keys() {
+		if added {
+			pool.sources[key]++
+		} else if pool.sources[key] <= 1 {
+			delete(pool.sources, key)
+		} else {
+			pool.sources[key]--
+		}
+	}
+	if added {
+		pool.size += object.Size
+	} else {
+		pool.size -= object.Size
+	}
+}
+
+// checks whether source can relay more txs, txs being replaced are not counted
+func (pool *Mempool) check_source_limits(source TX_Source, conflicts []*mempool_object) error {
+	pool.accounting.Lock()
+	defer pool.accounting.Unlock()
+
+	count := func(key string) (c uint64) {
+		c = pool.sources[key]
+		for _, conflict := range conflicts {
+			for _, ckey := range conflict.Source.keys() {
+				if ckey == key && c >= 1 {
+					c--
+				}
+			}
+		}
+		return
+	}
+
+	if source.Peer != 0 && pool.max_tx_per_peer != 0 && count("peer:"+strconv.FormatUint(source.Peer, 16)) >= pool.max_tx_per_peer {
+		return fmt.Errorf("peer %x has %d txs in pool, limit reached", source.Peer, pool.max_tx_per_peer)
+	}
+	if source.IP != "" && pool.max_tx_per_ip != 0 && count("ip:"+source.IP) >= pool.max_tx_per_ip {
+		return fmt.Errorf("IP %s has %d txs in pool, limit reached", source.IP, pool.max_tx_per_ip)
+	}
+	return nil
+}
+
+// whether a pays less fees per byte than b, compared without rounding
+func lower_fee_rate(a_fee, a_size, b_fee, b_size uint64) bool {
+	return a_fee*b_size < b_fee*a_size
+}
+
+// fees per KB rounded up, fees of real txs are much less than a unit per byte
+func fee_per_kb(fee, size uint64) uint64 {
+	if size == 0 {
+		return 0
+	}
+	return (fee*1024 + size - 1) / size
+}
+
+// finds txs in pool which use any of the nonces of tx, these have to be replaced if tx is to be added
+func (pool *Mempool) find_conflicts(tx *transaction.Transaction) (conflicts []*mempool_object, err error) {
+	seen := map[crypto.Hash]bool{}
+	dup_within_tx := map[crypto.Hash]bool{}
+	for i := range tx.Payloads {
+		nonce := tx.Payloads[i].Proof.Nonce()
+		if dup_within_tx[nonce] {
+			return nil, fmt.Errorf("duplicate nonce within tx")
+		}
+		dup_within_tx[nonce] = true
+
+		if txhashi, ok := pool.nonces.Load(nonce); ok {
+			txhash := txhashi.(crypto.Hash)
+			if seen[txhash] {
+				continue
+			}
+			seen[txhash] = true
+			if objecti, ok := pool.txs.Load(txhash); ok {
+				conflicts = append(conflicts, objecti.(*mempool_object))
+			}
+		}
+	}
+	return
+}
+
+// checks whether tx pays sufficiently to replace conflicting txs
+func check_replacement(object *mempool_object, conflicts []*mempool_object) error {
+	var fees, size uint64
+	for _, c := range conflicts {
+		fees += c.Tx.Fees()
+		size += c.Size
+	}
+	new_fees := object.Tx.Fees()
+	if new_fees <= fees || new_fees*100 < fees*(100+RBF_MIN_BUMP_PERCENT) {
+		return fmt.Errorf("replacement fees %d must be atleast %d%% more than %d of txs being replaced", new_fees, RBF_MIN_BUMP_PERCENT, fees)
+	}
+	if lower_fee_rate(new_fees, object.Size, fees, size) {
+		return fmt.Errorf("replacement must not lower fees per byte")
+	}
+	return nil
+}
+
+// selects lowest fee per byte txs, which must be evicted to make space for object
+// only txs paying less per byte than object are evicted, txs in exclude are going away anyway
+func (pool *Mempool) select_evictions(object *mempool_object, exclude []*mempool_object) (evict []crypto.Hash, err error) {
+	pool.accounting.Lock()
+	max_size, size := pool.max_size, pool.size
+	pool.accounting.Unlock()
+
+	if max_size == 0 {
+		return
+	}
+	for _, c := range exclude {
+		size -= c.Size
+	}
+	if size+object.Size <= max_size {
+		return
+	}
+
+	excluded := map[crypto.Hash]bool{}
+	for _, c := range exclude {
+		excluded[c.Tx.GetHash()] = true
+	}
+
+	type candidate struct {
+		hash   crypto.Hash
+		object *mempool_object
+	}
+	var candidates []candidate
+	pool.txs.Range(func(k, value interface{}) bool {
+		txhash := k.(crypto.Hash)
+		v := value.(*mempool_object)
+		if !excluded[txhash] && lower_fee_rate(v.Tx.Fees(), v.Size, object.Tx.Fees(), object.Size) {
+			candidates = append(candidates, candidate{hash: txhash, object: v})
+		}
+		return true
+	})
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i].object, candidates[j].object
+		return lower_fee_rate(a.Tx.Fees(), a.Size, b.Tx.Fees(), b.Size)
+	})
+
+	for _, c := range candidates {
+		if size+object.Size <= max_size {
+			break
+		}
+		evict = append(evict, c.hash)
+		size -= c.object.Size
+	}
+	if size+object.Size > max_size {
+		return nil, fmt.Errorf("mempool is full, fee per KB %d is too low", fee_per_kb(object.Tx.Fees(), object.Size))
+	}
+	return
+}
+
+func reject(reason string, err error) error {
+	metrics.Set.GetOrCreateCounter(fmt.Sprintf(`mempool_rejected_total{reason="%s"}`, reason)).Inc()
+	return err
+}
@@ -37,11 +37,112 @@ import "github.com/deroproject/derohe/rpc"
 
 import "github.com/deroproject/derohe/errormsg"
 import "github.com/deroproject/derohe/transaction"
+import "github.com/deroproject/derohe/blockchain/mempool"
 
 import "github.com/deroproject/graviton"
 
 const TX_VALIDITY_HEIGHT = 11
 
+// Template_Policy lets operators decide which mempool txs are selected while building block templates
+// txs are still validated as usual, policy can only reorder or skip them
+type Template_Policy interface {
+	Priority(txid crypto.Hash) bool                             // priority txs are selected before others irrespective of fees
+	Exclude(txid crypto.Hash, tx *transaction.Transaction) bool // excluded txs are never selected
+	MaxBlockSize() uint64                                       // max bytes of txs in a block, 0 means network limit
+}
+
+// Static_Template_Policy is a policy based on fixed lists
+type Static_Template_Policy struct {
+	PriorityTXIDs []crypto.Hash
+	ExcludeTXIDs  []crypto.Hash
+	ExcludeSCIDs  []crypto.Hash // SC invocations and token transfers of these SCs are excluded
+	MaxSize       uint64
+}
+
+func (p *Static_Template_Policy) Priority(txid crypto.Hash) bool {
+	for i := range p.PriorityTXIDs {
+		if p.PriorityTXIDs[i] == txid {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Static_Template_Policy) Exclude(txid crypto.Hash, tx *transaction.Transaction) bool {
+	for i := range p.ExcludeTXIDs {
+		if p.ExcludeTXIDs[i] == txid {
+			return true
+		}
+	}
+	if tx == nil || len(p.ExcludeSCIDs) == 0 {
+		return false
+	}
+
+	var scids []crypto.Hash
+	if tx.TransactionType == transaction.SC_TX && tx.SCDATA.Has(rpc.SCID, rpc.DataHash) {
+		scids = append(scids, tx.SCDATA.Value(rpc.SCID, rpc.DataHash).(crypto.Hash))
+	}
+	for i := range tx.Payloads {
+		scids = append(scids, tx.Payloads[i].SCID)
+	}
+	for i := range p.ExcludeSCIDs {
+		for j := range scids {
+			if !p.ExcludeSCIDs[i].IsZero() && p.ExcludeSCIDs[i] == scids[j] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *Static_Template_Policy) MaxBlockSize() uint64 {
+	return p.MaxSize
+}
+
+// set policy used to build block templates, nil restores default fee based selection
+func (chain *Blockchain) SetTemplatePolicy(policy Template_Policy) {
+	chain.template_policy_mutex.Lock()
+	chain.template_policy = policy
+	chain.template_policy_mutex.Unlock()
+
+	cache_block_mutex.Lock() // next template should follow new policy
+	cache_block = block.Block{}
+	cache_block_mutex.Unlock()
+}
+
+func (chain *Blockchain) GetTemplatePolicy() Template_Policy {
+	chain.template_policy_mutex.Lock()
+	defer chain.template_policy_mutex.Unlock()
+	return chain.template_policy
+}
+
+// apply policy to fee sorted mempool list, priority txs are moved ahead keeping their fee order
+// returns selectable txs and max size of txs in block
+func apply_template_policy(policy Template_Policy, list []mempool.TX_Sorting_struct, get_tx func(crypto.Hash) *transaction.Transaction) (result []mempool.TX_Sorting_struct, max_size uint64) {
+	max_size = BLOCK_TX_CAPACITY
+	if policy == nil {
+		return list, max_size
+	}
+	if size := policy.MaxBlockSize(); size > 0 && size < max_size {
+		max_size = size
+	}
+
+	var normal []mempool.TX_Sorting_struct
+	for i := range list {
+		if policy.Exclude(list[i].Hash, get_tx(list[i].Hash)) {
+			logger.V(8).Info("not selecting tx due to template policy", "txid", list[i].Hash)
+			continue
+		}
+		if policy.Priority(list[i].Hash) {
+			result = append(result, list[i])
+		} else {
+			normal = append(normal, list[i])
+		}
+	}
+	result = append(result, normal...)
+	return
+}
+
 // structure used to rank/sort  blocks on a number of factors
 type BlockScore struct {
 	BLID crypto.Hash
@@ -105,6 +206,8 @@ func convert_uint32_to_crypto_hash(i uint32) crypto.Hash {
 func (chain *Blockchain) Create_new_miner_block(miner_address rpc.Address) (cbl *block.Complete_Block, bl block.Block, err error) {
 	//chain.Lock()
 	//defer chain.Unlock()
+	chain.Prune_Mutex.RLock() // state versions must not change under us
+	defer chain.Prune_Mutex.RUnlock()
 
 	cbl = &block.Complete_Block{}
 
@@ -225,6 +328,7 @@ func (chain *Blockchain) Create_new_miner_block(miner_address rpc.Address) (cbl
 	// select tx based on fees
 	// first of lets find the tx fees collected by consuming txs from mempool
 	tx_hash_list_sorted := chain.Mempool.Mempool_List_TX_SortedInfo() // hash of all tx expected to be included within this block , sorted by fees
+	tx_hash_list_sorted, max_txs_size := apply_template_policy(chain.GetTemplatePolicy(), tx_hash_list_sorted, chain.Mempool.Mempool_Get_TX)
 
 	logger.V(8).Info("mempool returned tx list", "tx_list", tx_hash_list_sorted)
 	var pre_check cbl_verify // used to verify sanity of new block
@@ -242,7 +346,7 @@ func (chain *Blockchain) Create_new_miner_block(miner_address rpc.Address) (cbl
 	}
 
 	for i := range tx_hash_list_sorted {
-		if (sizeoftxs + tx_hash_list_sorted[i].Size) > (config.STARGATE_HE_MAX_BLOCK_SIZE - 102400) { // limit block to max possible
+		if (sizeoftxs + tx_hash_list_sorted[i].Size) > max_txs_size { // limit block to max possible
 			break
 		}
 
@@ -613,6 +717,13 @@ func (chain *Blockchain) ExpandMiniBlockTip(hash crypto.Hash) (result crypto.Has
 
 // it is USED by consensus and p2p whether the miners has is valid
 func (chain *Blockchain) IsAddressHashValid(skip_cache bool, hashes ...crypto.Hash) (found bool) {
+	chain.Prune_Mutex.RLock() // state versions must not change under us
+	defer chain.Prune_Mutex.RUnlock()
+	return chain.isAddressHashValidnolock(skip_cache, hashes...)
+}
+
+// same as above, used while chain lock is held
+func (chain *Blockchain) isAddressHashValidnolock(skip_cache bool, hashes ...crypto.Hash) (found bool) {
 
 	if skip_cache {
 		for _, hash := range hashes { // check whether everything could be satisfied via cache
@@ -658,3 +769,29 @@ hard_way:
 
 	return true
 }
+
+// MiniBlock_Reward locates a miniblock within blocks at height and returns reward paid to its miner
+// found is false if no block in topological order contains the miniblock, eg it was orphaned
+// reward is an estimate for blocks with SC txs, since gas refunds are not considered
+func (chain *Blockchain) MiniBlock_Reward(mblid crypto.Hash, height int64) (reward uint64, found bool) {
+	for _, blid := range chain.Get_Blocks_At_Height(height) {
+		if !chain.Is_Block_Topological_order(blid) {
+			continue
+		}
+		bl, err := chain.Load_BL_FROM_ID(blid)
+		if err != nil {
+			continue
+		}
+		for _, mbl := range bl.MiniBlocks {
+			if mbl.Final || mbl.GetHash() != mblid {
+				continue
+			}
+			stat, err := chain.block_fee_stats(blid)
+			if err != nil {
+				return
+			}
+			return (CalcBlockReward(bl.Height) + stat.Fees) / uint64(len(bl.MiniBlocks)), true
+		}
+	}
+	return
+}
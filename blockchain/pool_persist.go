@@ -0,0 +1,93 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package blockchain
+
+// this file persists mempool and regpool across restarts
+// pools are saved periodically and on shutdown, on startup every tx is verified again against current tips
+// txs which became invalid meanwhile (mined, double spent, expired or already registered) are dropped
+
+import "path/filepath"
+
+import "github.com/deroproject/derohe/blockchain/mempool"
+import "github.com/deroproject/derohe/blockchain/regpool"
+import "github.com/deroproject/derohe/globals"
+import "github.com/deroproject/derohe/metrics"
+import "github.com/deroproject/derohe/transaction"
+
+const POOL_SAVE_INTERVAL = "@every 300s" // pools are also saved periodically, so a crash loses little
+
+func mempool_file() string {
+	return filepath.Join(globals.GetDataDirectory(), "mempool.json")
+}
+
+func regpool_file() string {
+	return filepath.Join(globals.GetDataDirectory(), "regpool.json")
+}
+
+// save both pools to data directory
+func (chain *Blockchain) save_pools() {
+	if err := chain.Mempool.Save(mempool_file()); err != nil {
+		logger.Error(err, "saving mempool", "file", mempool_file())
+	}
+	if err := chain.Regpool.Save(regpool_file()); err != nil {
+		logger.Error(err, "saving regpool", "file", regpool_file())
+	}
+}
+
+// load pools saved at previous exit, every tx is verified again before adding it to pool
+func (chain *Blockchain) restore_pools() {
+	var restored, dropped int
+
+	for _, filename := range []string{regpool_file(), mempool_file()} {
+		var txs []*transaction.Transaction
+		var err error
+		if filename == mempool_file() {
+			txs, err = mempool.Load(filename)
+		} else {
+			txs, err = regpool.Load(filename)
+		}
+		if err != nil {
+			logger.Error(err, "loading saved pool, ignoring it", "file", filename)
+			continue
+		}
+
+		for _, tx := range txs {
+			if err = chain.restore_tx(tx); err != nil {
+				logger.V(1).Info("saved tx dropped", "txid", tx.GetHash(), "err", err)
+				dropped++
+			} else {
+				restored++
+			}
+		}
+	}
+
+	if restored+dropped >= 1 {
+		logger.Info("Restored saved pools", "restored", restored, "dropped", dropped)
+	}
+	metrics.Set.GetOrCreateCounter("mempool_restored_total").Add(restored)
+	metrics.Set.GetOrCreateCounter("mempool_restore_dropped_total").Add(dropped)
+}
+
+// verify tx against current tips and add it to pool
+func (chain *Blockchain) restore_tx(tx *transaction.Transaction) error {
+	if tx.IsRegistration() {
+		if err := chain.Verify_Transaction_NonCoinbase(tx); err != nil {
+			return err
+		}
+	}
+	return chain.Add_TX_To_Pool(tx) // normal txs are fully verified here, including nonce checks
+}
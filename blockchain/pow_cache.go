@@ -0,0 +1,166 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package blockchain
+
+// this file speeds up miniblock PoW verification
+// while syncing, PoW hashes of queued miniblocks are computed in parallel before blocks are added one by one
+// optionally, verified miniblocks are remembered on disk, so restarts and verify-chain do not redo the work
+// disk cache is a direct mapped table of truncated hashes, so it never grows beyond configured size
+
+import "os"
+import "sync"
+import "runtime"
+import "strconv"
+import "path/filepath"
+import "encoding/binary"
+
+import "github.com/minio/sha256-simd"
+
+import "github.com/deroproject/derohe/astrobwt/astrobwtv3"
+import "github.com/deroproject/derohe/block"
+import "github.com/deroproject/derohe/cryptography/crypto"
+import "github.com/deroproject/derohe/globals"
+
+const POW_CACHE_SLOT_SIZE = 16 // bytes of verification key stored per slot
+
+type pow_cache struct {
+	sync.Mutex
+	file  *os.File
+	slots uint64
+}
+
+func pow_cache_file() string {
+	return filepath.Join(globals.GetDataDirectory(), "powcache.bin")
+}
+
+// open disk cache of size_mb megabytes, existing cache is reused
+func open_pow_cache(filename string, size_mb uint64) (*pow_cache, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(size_mb * 1024 * 1024)
+	if err = file.Truncate(size); err != nil { // resizing only moves slots, stale slots just miss
+		file.Close()
+		return nil, err
+	}
+	return &pow_cache{file: file, slots: uint64(size) / POW_CACHE_SLOT_SIZE}, nil
+}
+
+// verification key covers tips and miniblock, since difficulty depends on tips
+func pow_cache_key(cachekey []byte) (key [POW_CACHE_SLOT_SIZE]byte) {
+	hash := sha256.Sum256(cachekey)
+	copy(key[:], hash[:])
+	return
+}
+
+func (c *pow_cache) offset(key [POW_CACHE_SLOT_SIZE]byte) int64 {
+	return int64(binary.BigEndian.Uint64(key[:])%c.slots) * POW_CACHE_SLOT_SIZE
+}
+
+func (c *pow_cache) has(cachekey []byte) bool {
+	if c == nil || c.slots == 0 {
+		return false
+	}
+	key := pow_cache_key(cachekey)
+	var slot [POW_CACHE_SLOT_SIZE]byte
+	c.Lock()
+	defer c.Unlock()
+	if _, err := c.file.ReadAt(slot[:], c.offset(key)); err != nil {
+		return false
+	}
+	return slot == key
+}
+
+func (c *pow_cache) add(cachekey []byte) {
+	if c == nil || c.slots == 0 {
+		return
+	}
+	key := pow_cache_key(cachekey)
+	c.Lock()
+	defer c.Unlock()
+	if _, err := c.file.WriteAt(key[:], c.offset(key)); err != nil {
+		logger.V(1).Error(err, "PoW cache could not be written")
+	}
+}
+
+func (c *pow_cache) close() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.file.Close()
+	c.slots = 0
+}
+
+// setup disk cache if --pow-cache was provided
+func (chain *Blockchain) init_pow_cache(params map[string]interface{}) (err error) {
+	if params["--pow-cache"] == nil {
+		return nil
+	}
+	size_mb, err := strconv.ParseUint(params["--pow-cache"].(string), 10, 64)
+	if err != nil || size_mb == 0 {
+		return err
+	}
+	if chain.pow_cache, err = open_pow_cache(pow_cache_file(), size_mb); err == nil {
+		logger.Info("PoW cache enabled", "file", pow_cache_file(), "size_mb", size_mb)
+	}
+	return
+}
+
+// compute PoW hashes of miniblocks in parallel, VerifyMiniblockPoW will pick them up instead of hashing again
+// this does not verify anything, since difficulty is only known once past blocks are added
+func (chain *Blockchain) PreVerify_MiniBlocks_PoW(mbls []block.MiniBlock) {
+	var jobs = make(chan block.MiniBlock, len(mbls))
+	for _, mbl := range mbls {
+		if _, ok := chain.cache_MiniblockPoWHash.Get(string(mbl.Serialize())); !ok {
+			jobs <- mbl
+		}
+	}
+	close(jobs)
+
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer globals.Recover(1)
+			scratch := astrobwtv3.Pool.Get().(*astrobwtv3.ScratchData)
+			defer astrobwtv3.Pool.Put(scratch)
+			for mbl := range jobs {
+				chain.cache_MiniblockPoWHash.Add(string(mbl.Serialize()), mbl.GetPoWHashWithScratch(scratch))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// PoW hash precomputed by PreVerify_MiniBlocks_PoW, it is consumed on use
+func (chain *Blockchain) precomputed_pow(mbl block.MiniBlock) (pow crypto.Hash, ok bool) {
+	key := string(mbl.Serialize())
+	if value, found := chain.cache_MiniblockPoWHash.Get(key); found {
+		chain.cache_MiniblockPoWHash.Remove(key)
+		return value.(crypto.Hash), true
+	}
+	return
+}
@@ -0,0 +1,90 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package blockchain
+
+import "os"
+import "testing"
+import "path/filepath"
+
+import "github.com/hashicorp/golang-lru"
+
+import "github.com/deroproject/derohe/block"
+
+// verified keys must survive reopening, resizing must not give false positives
+func Test_PoW_Cache(t *testing.T) {
+	dir, err := os.MkdirTemp("", "powcache")
+	if err != nil {
+		t.Fatalf("temp dir err %s", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "powcache.bin")
+
+	cache, err := open_pow_cache(filename, 1)
+	if err != nil {
+		t.Fatalf("cache could not be opened err %s", err)
+	}
+	if cache.has([]byte("key1")) {
+		t.Fatalf("empty cache cannot have keys")
+	}
+	cache.add([]byte("key1"))
+	if !cache.has([]byte("key1")) || cache.has([]byte("key2")) {
+		t.Fatalf("cache lookup failed")
+	}
+	cache.close()
+	if cache.has([]byte("key1")) {
+		t.Fatalf("closed cache cannot have keys")
+	}
+
+	if cache, err = open_pow_cache(filename, 1); err != nil || !cache.has([]byte("key1")) {
+		t.Fatalf("cache must persist err %v", err)
+	}
+	cache.close()
+
+	if cache, err = open_pow_cache(filename, 2); err != nil || cache.has([]byte("key2")) {
+		t.Fatalf("resized cache failed err %v", err)
+	}
+	cache.close()
+
+	var disabled *pow_cache
+	disabled.add([]byte("key1"))
+	if disabled.has([]byte("key1")) {
+		t.Fatalf("disabled cache cannot have keys")
+	}
+}
+
+// precomputed hashes must equal serially computed ones and be consumed on use
+func Test_PreVerify_PoW(t *testing.T) {
+	var chain Blockchain
+	chain.cache_MiniblockPoWHash, _ = lru.New(64)
+
+	var mbls []block.MiniBlock
+	for i := 0; i < 4; i++ {
+		mbls = append(mbls, block.MiniBlock{Version: 1, Height: 1000000, Timestamp: uint16(i), PastCount: 1})
+	}
+	chain.PreVerify_MiniBlocks_PoW(mbls)
+
+	for i := range mbls {
+		pow, ok := chain.precomputed_pow(mbls[i])
+		if !ok || pow != mbls[i].GetPoWHash() {
+			t.Fatalf("precomputed pow %d mismatch", i)
+		}
+		if _, ok = chain.precomputed_pow(mbls[i]); ok {
+			t.Fatalf("precomputed pow must be consumed")
+		}
+	}
+	chain.PreVerify_MiniBlocks_PoW(nil)
+}
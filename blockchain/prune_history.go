@@ -71,13 +71,10 @@ func Prune_Blockchain(prune_topo int64) (err error) {
 
 	current_path := filepath.Join(globals.GetDataDirectory())
 
-	if store.Balance_store, err = graviton.NewDiskStore(filepath.Join(current_path, "balances")); err == nil {
-		if err = store.Topo_store.Open(current_path); err == nil {
-			store.Block_tx_store.basedir = current_path
-		} else {
-			return err
-		}
+	if err = store.Initialize(nil); err != nil {
+		return err
 	}
+	defer store.Block_tx_store.Close()
 
 	max_topoheight := store.Topo_store.Count()
 	for ; max_topoheight >= 0; max_topoheight-- {
@@ -117,7 +114,7 @@ func Prune_Blockchain(prune_topo int64) (err error) {
 // any error while deleting should be considered non fatal
 func discard_blocks_and_transactions(store *storage, topoheight int64) {
 
-	globals.Logger.Info("Block store before pruning", "size", ByteCountIEC(DirSize(filepath.Join(store.Block_tx_store.basedir, "bltx_store"))))
+	globals.Logger.Info("Block store before pruning", "size", ByteCountIEC(store.Block_tx_store.Size()))
 
 	for i := int64(0); i < topoheight-20; i++ { // donot some more blocks for sanity currently
 		if toporecord, err := store.Topo_store.Read(i); err == nil {
@@ -138,7 +135,10 @@ func discard_blocks_and_transactions(store *storage, topoheight int64) {
 			}
 		}
 	}
-	globals.Logger.Info("Block store after pruning ", "size", ByteCountIEC(DirSize(filepath.Join(store.Block_tx_store.basedir, "bltx_store"))))
+	if err := store.Block_tx_store.Compact(); err != nil {
+		globals.Logger.Error(err, "error compacting block store")
+	}
+	globals.Logger.Info("Block store after pruning ", "size", ByteCountIEC(store.Block_tx_store.Size()))
 }
 
 // clone a snapshot, this is a dero arch dependent
@@ -246,7 +246,8 @@ func clone_snapshot(rsource, wsource *graviton.Store, r_ssversion uint64) (lates
 
 // diff a snapshot from block to block, this is a dero arch dependent
 // entire block is done in a single commit
-func diff_snapshot(rsource, wsource *graviton.Store, old_version uint64, new_version uint64) (latest_commit_version uint64, err error) {
+// changes are applied over write_version of wsource, 0 means latest
+func diff_snapshot(rsource, wsource *graviton.Store, old_version uint64, new_version uint64, write_version uint64) (latest_commit_version uint64, err error) {
 
 	var sc_trees []*graviton.Tree
 	var old_ss, new_ss, write_ss *graviton.Snapshot
@@ -259,7 +260,7 @@ func diff_snapshot(rsource, wsource *graviton.Store, old_version uint64, new_ver
 	if new_ss, err = rsource.LoadSnapshot(new_version); err != nil {
 		return
 	}
-	if write_ss, err = wsource.LoadSnapshot(0); err != nil {
+	if write_ss, err = wsource.LoadSnapshot(write_version); err != nil {
 		return
 	}
 
@@ -319,7 +320,7 @@ func diff_snapshot(rsource, wsource *graviton.Store, old_version uint64, new_ver
 		if write_tree, err = write_ss.GetTree(string(scid)); err != nil {
 			return
 		}
-		c := old_tree.Cursor()
+		c := new_tree.Cursor() // sc is new, so all its data is in new tree, old tree is always empty here
 		for k, v, err := c.First(); err == nil; k, v, err = c.Next() {
 			write_tree.Put(k, v)
 		}
@@ -349,7 +350,7 @@ func diff_snapshot(rsource, wsource *graviton.Store, old_version uint64, new_ver
 // this will rewrite the graviton store
 func rewrite_graviton_store(store *storage, prune_topoheight int64, max_topoheight int64) (err error) {
 	var write_store *graviton.Store
-	writebalancestorepath := filepath.Join(store.Block_tx_store.basedir, "balances_new")
+	writebalancestorepath := filepath.Join(globals.GetDataDirectory(), "balances_new")
 
 	if write_store, err = graviton.NewDiskStore(writebalancestorepath); err != nil {
 		return err
@@ -389,7 +390,7 @@ func rewrite_graviton_store(store *storage, prune_topoheight int64, max_topoheig
 
 				if new_toporecord, err = store.Topo_store.Read(new_topo); err == nil {
 					var latest_commit_version uint64
-					latest_commit_version, err = diff_snapshot(store.Balance_store, write_store, old_toporecord.State_Version, new_toporecord.State_Version)
+					latest_commit_version, err = diff_snapshot(store.Balance_store, write_store, old_toporecord.State_Version, new_toporecord.State_Version, 0)
 					if err != nil {
 						return err
 					}
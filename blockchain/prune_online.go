@@ -0,0 +1,484 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package blockchain
+
+// this file implements online pruning, history older than a configurable depth is discarded while the daemon keeps running
+// graviton history is discarded by rewriting the state at prune point into a new store in background and replaying all later blocks,
+// only the final catch up and swap of stores is done with the chain locked
+// a journal is written before the swap, so a crash during swap is completed on next startup
+// blocks/txs below prune point are discarded incrementally and the block store is compacted afterwards
+
+import "os"
+import "fmt"
+import "sync"
+import "time"
+import "errors"
+import "path/filepath"
+import "encoding/json"
+
+import "github.com/deroproject/derohe/block"
+import "github.com/deroproject/derohe/globals"
+import "github.com/deroproject/derohe/metrics"
+
+import "github.com/deroproject/graviton"
+
+const PRUNE_MIN_DEPTH = 1000                  // atleast this many topoheights are kept, rewinds and fastsyncing peers need recent history
+const PRUNE_CHECK_INTERVAL = 10 * time.Minute // how often we check whether history needs to be pruned
+const PRUNE_LOCKED_REPLAY = 50                // blocks near top may be reorganised, so they are replayed only with chain locked
+
+// status of background pruning
+type PruneStatus struct {
+	Enabled         bool
+	Running         bool
+	Phase           string  // idle, state, swap or blocks
+	Progress        float64 // percent of current phase
+	Depth           int64   // topoheights kept
+	PrunedTopo      int64   // history before this topoheight has been discarded
+	Runs            uint64
+	BlocksDiscarded uint64
+	TxsDiscarded    uint64
+	LastRun         time.Time
+	LastDuration    time.Duration
+	LastError       string
+}
+
+type online_pruner struct {
+	sync.Mutex
+	status PruneStatus
+}
+
+// written before swapping stores, contains new state versions of all topoheights
+type prune_journal struct {
+	PruneTopo    int64    `json:"prune_topo"`
+	MajorVersion uint64   `json:"major_version"` // version of state at prune_topo, used for all topoheights till prune_topo
+	Versions     []uint64 `json:"versions"`      // versions of topoheights after prune_topo
+}
+
+// persisted pruning state
+type prune_progress struct {
+	DiscardedTill int64 `json:"discarded_till"` // blocks/txs before this topoheight have been discarded
+}
+
+func load_json(filename string, obj interface{}) bool {
+	file, err := os.Open(filename)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Error(err, "opening file", "file", filename)
+		}
+		return false
+	}
+	defer file.Close()
+	if err = json.NewDecoder(file).Decode(obj); err != nil {
+		logger.Error(err, "Error unmarshalling", "file", filename)
+		return false
+	}
+	return true
+}
+
+// data is synced to disk, since journal must survive a crash
+func save_json(filename string, obj interface{}) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "\t")
+	if err = encoder.Encode(obj); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func load_prune_journal(basedir string) *prune_journal {
+	var journal prune_journal
+	if load_json(filepath.Join(basedir, "prune_journal.json"), &journal) {
+		return &journal
+	}
+	return nil
+}
+
+// swaps pruned state in place and updates versions of topo records and blocks
+// every step can be repeated, so an interrupted swap is completed on next startup
+func (s *storage) apply_prune_journal(basedir string, journal *prune_journal) (err error) {
+	current_path := filepath.Join(basedir, "balances")
+	new_path := filepath.Join(basedir, "balances_new")
+	old_path := filepath.Join(basedir, "balances_old")
+
+	if _, err = os.Stat(new_path); err == nil {
+		os.RemoveAll(old_path)
+		if err = os.Rename(current_path, old_path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err = os.Rename(new_path, current_path); err != nil {
+			return err
+		}
+	}
+
+	var store *graviton.Store
+	if store, err = graviton.NewDiskStore(current_path); err != nil {
+		return err
+	}
+	s.Balance_store = store
+
+	if err = s.Topo_store.rewrite_versions(0, journal.PruneTopo, journal.MajorVersion); err != nil {
+		return err
+	}
+
+	// blocks kept before prune point are discarded later, only the last few of them will remain
+	start := journal.PruneTopo - 20
+	if start < 0 {
+		start = 0
+	}
+	for topo := start; topo <= journal.PruneTopo+int64(len(journal.Versions)); topo++ {
+		version := journal.MajorVersion
+		if topo > journal.PruneTopo {
+			version = journal.Versions[topo-journal.PruneTopo-1]
+		}
+		record, err := s.Topo_store.Read(topo)
+		if err != nil {
+			return err
+		}
+		if record.State_Version != version {
+			if err = s.Topo_store.Write(topo, record.BLOCK_ID, version, record.Height); err != nil {
+				return err
+			}
+		}
+
+		// blocks also carry the version of their state
+		if v, err := s.Block_tx_store.ReadBlockSnapshotVersion(record.BLOCK_ID); err == nil && v != version {
+			block_data, err := s.Block_tx_store.ReadBlock(record.BLOCK_ID)
+			if err != nil {
+				return err
+			}
+			diff, err := s.Block_tx_store.ReadBlockDifficulty(record.BLOCK_ID)
+			if err != nil {
+				return err
+			}
+			height, err := s.Block_tx_store.ReadBlockHeight(record.BLOCK_ID)
+			if err != nil {
+				return err
+			}
+			s.Block_tx_store.DeleteBlock(record.BLOCK_ID)
+			if err = s.Block_tx_store.WriteBlock(record.BLOCK_ID, block_data, diff, version, height); err != nil {
+				return err
+			}
+		}
+	}
+	if err = s.Topo_store.topomapping.Sync(); err != nil {
+		return err
+	}
+
+	pruned_till = -1 // prune point has moved
+	if err = os.Remove(filepath.Join(basedir, "prune_journal.json")); errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	return err
+}
+
+// starts background pruning, history older than depth topoheights is discarded
+func (chain *Blockchain) start_pruner(depth int64) error {
+	if depth < PRUNE_MIN_DEPTH {
+		return fmt.Errorf("prune depth must be atleast %d", PRUNE_MIN_DEPTH)
+	}
+	chain.prune = &online_pruner{status: PruneStatus{Enabled: true, Depth: depth, Phase: "idle"}}
+
+	metrics.Set.GetOrCreateGauge("blockchain_pruned_topoheight", func() float64 {
+		return float64(chain.LocatePruneTopo())
+	})
+	metrics.Set.GetOrCreateGauge("blockchain_prune_progress", func() float64 {
+		return chain.Prune_Status().Progress
+	})
+
+	logger.Info("Online pruning enabled", "depth", depth)
+	go chain.prune_loop()
+	return nil
+}
+
+func (chain *Blockchain) prune_loop() {
+	defer globals.Recover(1)
+	ticker := time.NewTicker(PRUNE_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-chain.Exit_Event:
+			return
+		case <-ticker.C:
+		}
+		if !chain.Sync { // do not prune while bootstrapping
+			continue
+		}
+		if err := chain.prune_once(); err != nil {
+			logger.Error(err, "Online pruning failed")
+		}
+	}
+}
+
+// returns status of background pruning
+func (chain *Blockchain) Prune_Status() PruneStatus {
+	if chain.prune == nil {
+		return PruneStatus{Phase: "idle", PrunedTopo: chain.LocatePruneTopo()}
+	}
+	chain.prune.Lock()
+	defer chain.prune.Unlock()
+	status := chain.prune.status
+	status.PrunedTopo = chain.LocatePruneTopo()
+	return status
+}
+
+func (p *online_pruner) set_phase(phase string, progress float64) {
+	p.Lock()
+	defer p.Unlock()
+	p.status.Phase, p.status.Progress = phase, progress
+}
+
+// prunes history, if enough history has accumulated since last prune
+// state is rewritten only after depth more topoheights have accumulated, so that the store is not rewritten too often
+func (chain *Blockchain) prune_once() (err error) {
+	p := chain.prune
+	p.Lock()
+	if p.status.Running {
+		p.Unlock()
+		return nil
+	}
+	depth := p.status.Depth
+	p.Unlock()
+
+	prune_topo := chain.Load_TOPO_HEIGHT() - depth
+	if prune_topo-chain.LocatePruneTopo() < depth {
+		return nil
+	}
+
+	start := time.Now()
+	p.Lock()
+	p.status.Running = true
+	p.Unlock()
+
+	defer func() {
+		p.Lock()
+		p.status.Running, p.status.Phase, p.status.Progress = false, "idle", 0
+		p.status.LastRun, p.status.LastDuration = start, time.Since(start)
+		p.status.Runs++
+		p.status.LastError = ""
+		if err != nil {
+			p.status.LastError = err.Error()
+		}
+		p.Unlock()
+		metrics.Set.GetOrCreateCounter("blockchain_prune_runs_total").Inc()
+		metrics.Set.GetOrCreateHistogram("blockchain_prune_duration_histogram_seconds").UpdateDuration(start)
+	}()
+
+	logger.Info("Online pruning started", "prune_topoheight", prune_topo)
+	if err = chain.prune_state(prune_topo); err != nil {
+		return err
+	}
+	if err = chain.prune_blocks(prune_topo); err != nil {
+		return err
+	}
+	logger.Info("Online pruning completed", "prune_topoheight", prune_topo, "duration", time.Since(start))
+	return nil
+}
+
+// rewrites state into a new store without history before prune_topo and swaps it in
+func (chain *Blockchain) prune_state(prune_topo int64) (err error) {
+	basedir := globals.GetDataDirectory()
+	new_path := filepath.Join(basedir, "balances_new")
+
+	os.RemoveAll(new_path)
+	write_store, err := graviton.NewDiskStore(new_path)
+	if err != nil {
+		return err
+	}
+	write_store_open, journal_written := true, false
+	defer func() {
+		if err != nil && !journal_written { // discard partial store
+			if write_store_open {
+				write_store.Close()
+			}
+			os.RemoveAll(new_path)
+		}
+	}()
+
+	old_store := chain.Store.Balance_store
+	prune_record, err := chain.Store.Topo_store.Read(prune_topo)
+	if err != nil {
+		return err
+	}
+
+	chain.prune.set_phase("state", 0)
+	major_version, err := clone_snapshot(old_store, write_store, prune_record.State_Version)
+	if err != nil {
+		return err
+	}
+
+	type replayed struct {
+		blid        [32]byte
+		old_version uint64
+		new_version uint64
+	}
+	var replay []replayed // replay[i] is topoheight prune_topo+1+i
+
+	replay_till := func(end int64) error {
+		for topo := prune_topo + 1 + int64(len(replay)); topo <= end; topo++ {
+			previous_old, previous_new := prune_record.State_Version, major_version
+			if len(replay) > 0 {
+				previous_old, previous_new = replay[len(replay)-1].old_version, replay[len(replay)-1].new_version
+			}
+			record, err := chain.Store.Topo_store.Read(topo)
+			if err != nil {
+				return err
+			}
+			version, err := diff_snapshot(old_store, write_store, previous_old, record.State_Version, previous_new)
+			if err != nil {
+				return err
+			}
+			replay = append(replay, replayed{blid: record.BLOCK_ID, old_version: record.State_Version, new_version: version})
+			chain.prune.set_phase("state", float64(topo-prune_topo)*100/float64(end-prune_topo))
+		}
+		return nil
+	}
+
+	if err = replay_till(chain.Load_TOPO_HEIGHT() - PRUNE_LOCKED_REPLAY); err != nil {
+		return err
+	}
+
+	// everything from here is done with chain locked, readers needing consistent state wait on Prune_Mutex
+	// Prune_Mutex is taken first, so a long reader delays pruning but not the chain
+	chain.Prune_Mutex.Lock()
+	defer chain.Prune_Mutex.Unlock()
+	chain.Lock()
+	defer chain.Unlock()
+	chain.prune.set_phase("swap", 0)
+
+	// blocks replayed without lock may have been reorganised or rewinded, such blocks are replayed again
+	top := chain.Load_TOPO_HEIGHT()
+	if top <= prune_topo {
+		return fmt.Errorf("chain has been rewinded below prune point")
+	}
+	if int64(len(replay)) > top-prune_topo {
+		replay = replay[:top-prune_topo]
+	}
+	for i := range replay {
+		record, err := chain.Store.Topo_store.Read(prune_topo + 1 + int64(i))
+		if err != nil {
+			return err
+		}
+		if record.BLOCK_ID != replay[i].blid || record.State_Version != replay[i].old_version {
+			replay = replay[:i]
+			break
+		}
+	}
+	if err = replay_till(top); err != nil {
+		return err
+	}
+
+	// state at prune point and top must be exactly same in both stores
+	checks := map[uint64]uint64{prune_record.State_Version: major_version}
+	if len(replay) > 0 {
+		checks[replay[len(replay)-1].old_version] = replay[len(replay)-1].new_version
+	}
+	for old_version, new_version := range checks {
+		old_hash, err := store_merkle_hash(old_store, old_version)
+		if err != nil {
+			return err
+		}
+		new_hash, err := store_merkle_hash(write_store, new_version)
+		if err != nil {
+			return err
+		}
+		if old_hash != new_hash {
+			return fmt.Errorf("pruned state does not match, version %d hash %s, pruned version %d hash %s", old_version, old_hash, new_version, new_hash)
+		}
+	}
+
+	write_store.Close()
+	write_store_open = false
+
+	journal := prune_journal{PruneTopo: prune_topo, MajorVersion: major_version}
+	for i := range replay {
+		journal.Versions = append(journal.Versions, replay[i].new_version)
+	}
+	if err = save_json(filepath.Join(basedir, "prune_journal.json"), &journal); err != nil {
+		return err
+	}
+	journal_written = true // from here, swap is completed on restart if it fails, so new store must not be discarded
+
+	if err = chain.Store.apply_prune_journal(basedir, &journal); err != nil {
+		logger.Error(err, "pruned state could not be swapped, restart daemon to complete pruning")
+		return err
+	}
+
+	chain.cache_VersionMerkle.Purge() // versions have been renumbered
+	chain.Pruned = chain.LocatePruneTopo()
+
+	// every reader of old store either holds chain lock or Prune_Mutex, so none of them is using it anymore
+	old_store.Close()
+	os.RemoveAll(filepath.Join(basedir, "balances_old"))
+	return nil
+}
+
+// discards blocks and txs before prune point, progress is saved so that they are not visited again
+func (chain *Blockchain) prune_blocks(prune_topo int64) (err error) {
+	state_file := filepath.Join(globals.GetDataDirectory(), "prune.json")
+	var state prune_progress
+	load_json(state_file, &state)
+
+	end := prune_topo - 20 // keep some more blocks for sanity, same as offline pruning
+	chain.prune.set_phase("blocks", 0)
+
+	for topo := state.DiscardedTill; topo < end; topo++ {
+		if record, err := chain.Store.Topo_store.Read(topo); err == nil {
+			var bl block.Block
+			if block_data, err := chain.Store.Block_tx_store.ReadBlock(record.BLOCK_ID); err == nil {
+				if err = bl.Deserialize(block_data); err == nil {
+					for _, txhash := range bl.Tx_hashes { // we also have to purge the tx hashes
+						if chain.Store.Block_tx_store.DeleteTX(txhash) == nil {
+							metrics.Set.GetOrCreateCounter("blockchain_prune_txs_discarded_total").Inc()
+							chain.prune.Lock()
+							chain.prune.status.TxsDiscarded++
+							chain.prune.Unlock()
+						}
+					}
+				}
+				if chain.Store.Block_tx_store.DeleteBlock(record.BLOCK_ID) == nil {
+					metrics.Set.GetOrCreateCounter("blockchain_prune_blocks_discarded_total").Inc()
+					chain.prune.Lock()
+					chain.prune.status.BlocksDiscarded++
+					chain.prune.Unlock()
+				}
+			}
+		}
+
+		if topo%1000 == 0 {
+			chain.prune.set_phase("blocks", float64(topo-state.DiscardedTill)*100/float64(end-state.DiscardedTill))
+			select {
+			case <-chain.Exit_Event: // resume from here next time
+				state.DiscardedTill = topo
+				return save_json(state_file, &state)
+			default:
+			}
+		}
+	}
+
+	if end > state.DiscardedTill {
+		state.DiscardedTill = end
+		if err = save_json(state_file, &state); err != nil {
+			return err
+		}
+	}
+	return chain.Store.Block_tx_store.Compact()
+}
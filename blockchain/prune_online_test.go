@@ -0,0 +1,151 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package blockchain
+
+import "os"
+import "testing"
+import "math/big"
+import "path/filepath"
+
+import "github.com/go-logr/logr"
+
+import "github.com/deroproject/derohe/config"
+import "github.com/deroproject/derohe/globals"
+import "github.com/deroproject/graviton"
+
+// commits count versions into a graviton store at path
+func test_versions(t *testing.T, path string, count int) {
+	store, err := graviton.NewDiskStore(path)
+	if err != nil {
+		t.Fatalf("cannot create store err %s", err)
+	}
+	defer store.Close()
+	for i := 0; i < count; i++ {
+		ss, _ := store.LoadSnapshot(0)
+		tree, _ := ss.GetTree("test")
+		tree.Put([]byte{byte(i)}, []byte{byte(i)})
+		if _, err := graviton.Commit(tree); err != nil {
+			t.Fatalf("commit failed err %s", err)
+		}
+	}
+}
+
+// an interrupted swap must be completed on startup, repeatedly if required
+func Test_Prune_Journal(t *testing.T) {
+	globals.Logger = logr.Discard()
+	globals.Arguments = map[string]interface{}{"--data-dir": t.TempDir()}
+	basedir := globals.GetDataDirectory()
+	os.MkdirAll(basedir, 0700)
+	pruned_till = -1
+	defer func() { pruned_till = -1 }()
+
+	var s storage
+	if err := s.Initialize(nil); err != nil {
+		t.Fatalf("cannot initialize store err %s", err)
+	}
+	s.Balance_store.Close()
+
+	// 20 topoheights each with its own version, history till topo 9 is pruned into 11 versions
+	for i := int64(0); i < 20; i++ {
+		h, data := test_object(byte(i+1), 100)
+		s.Topo_store.Write(i, h, uint64(i+1), i)
+		s.Block_tx_store.WriteBlock(h, data, big.NewInt(i), uint64(i+1), uint64(i))
+	}
+	test_versions(t, filepath.Join(basedir, "balances"), 20)
+	test_versions(t, filepath.Join(basedir, "balances_new"), 11)
+
+	journal := prune_journal{PruneTopo: 9, MajorVersion: 1}
+	for v := uint64(2); v <= 11; v++ {
+		journal.Versions = append(journal.Versions, v)
+	}
+	if err := save_json(filepath.Join(basedir, "prune_journal.json"), &journal); err != nil {
+		t.Fatalf("cannot save journal err %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := s.apply_prune_journal(basedir, &journal); err != nil {
+			t.Fatalf("applying journal failed err %s", err)
+		}
+		if _, err := os.Stat(filepath.Join(basedir, "balances_new")); !os.IsNotExist(err) {
+			t.Fatalf("new store must have been moved in place")
+		}
+		if _, err := os.Stat(filepath.Join(basedir, "prune_journal.json")); !os.IsNotExist(err) {
+			t.Fatalf("journal must be removed after swap")
+		}
+		if ss, err := s.Balance_store.LoadSnapshot(0); err != nil || ss.GetVersion() != 11 {
+			t.Fatalf("pruned store not in place err %v", err)
+		}
+		for topo := int64(0); topo < 20; topo++ {
+			expected := uint64(1)
+			if topo > journal.PruneTopo {
+				expected = uint64(topo) - 8
+			}
+			record, _ := s.Topo_store.Read(topo)
+			version, err := s.Block_tx_store.ReadBlockSnapshotVersion(record.BLOCK_ID)
+			if record.State_Version != expected || err != nil || version != expected {
+				t.Fatalf("topo %d version %d block version %d expected %d", topo, record.State_Version, version, expected)
+			}
+		}
+		pruned_till = -1
+		if prune_topo := s.Topo_store.LocatePruneTopo(); prune_topo != journal.PruneTopo {
+			t.Fatalf("prune topo %d expected %d", prune_topo, journal.PruneTopo)
+		}
+		s.Balance_store.Close()
+	}
+}
+
+// data of a sc installed between two versions must be carried into the pruned store
+func Test_Diff_Snapshot_New_SC(t *testing.T) {
+	source, _ := graviton.NewMemStore()
+	write, _ := graviton.NewMemStore()
+	scid := []byte("0123456789abcdef0123456789abcdef")
+
+	ss, _ := source.LoadSnapshot(0)
+	balance_tree, _ := ss.GetTree(config.BALANCE_TREE)
+	meta_tree, _ := ss.GetTree(config.SC_META)
+	balance_tree.Put([]byte("account"), []byte("balance"))
+	if _, err := graviton.Commit(balance_tree, meta_tree); err != nil {
+		t.Fatalf("commit failed err %s", err)
+	}
+
+	ss, _ = source.LoadSnapshot(0)
+	balance_tree, _ = ss.GetTree(config.BALANCE_TREE)
+	meta_tree, _ = ss.GetTree(config.SC_META)
+	sc_tree, _ := ss.GetTree(string(scid))
+	meta_tree.Put(scid, []byte("meta"))
+	sc_tree.Put([]byte("key"), []byte("value"))
+	if _, err := graviton.Commit(balance_tree, meta_tree, sc_tree); err != nil {
+		t.Fatalf("commit failed err %s", err)
+	}
+
+	base, err := clone_snapshot(source, write, 1)
+	if err != nil {
+		t.Fatalf("clone failed err %s", err)
+	}
+	version, err := diff_snapshot(source, write, 1, 2, base)
+	if err != nil {
+		t.Fatalf("diff failed err %s", err)
+	}
+
+	ss, _ = write.LoadSnapshot(version)
+	if sc_tree, err = ss.GetTree(string(scid)); err != nil {
+		t.Fatalf("sc tree missing err %s", err)
+	}
+	if value, err := sc_tree.Get([]byte("key")); err != nil || string(value) != "value" {
+		t.Fatalf("sc data was not copied, value %q err %v", value, err)
+	}
+}
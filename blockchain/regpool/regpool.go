@@ -183,7 +183,7 @@ func (pool *Regpool) HouseKeeping(height uint64, Verifier func(*transaction.Tran
 }
 
 func (pool *Regpool) Shutdown() {
-	//TODO save regpool tx somewhere
+	// txs are persisted by blockchain using Save, since only it can verify them again on startup
 
 	close(pool.Exit_Mutex) // stop relaying
 
@@ -195,6 +195,30 @@ func (pool *Regpool) Shutdown() {
 
 }
 
+// persists all txs of pool to file, so they survive restarts
+// file is written completely before replacing the older one
+func (pool *Regpool) Save(filename string) error {
+	objects := []*regpool_object{}
+	pool.txs.Range(func(k, value interface{}) bool {
+		objects = append(objects, value.(*regpool_object))
+		return true
+	})
+
+	return globals.SaveJSON(filename, objects)
+}
+
+// reads txs saved using Save, these must be verified again before adding them to pool
+func Load(filename string) (txs []*transaction.Transaction, err error) {
+	var objects []*regpool_object
+	if err = globals.LoadJSON(filename, &objects); err != nil {
+		return
+	}
+	for _, object := range objects {
+		txs = append(txs, object.Tx)
+	}
+	return
+}
+
 // start pool monitoring for changes for some specific time
 // this is required so as we can add or discard transactions while selecting work for mining
 func (pool *Regpool) Monitor() {
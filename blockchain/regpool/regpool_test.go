@@ -20,6 +20,7 @@ package regpool
 //import "bytes"
 import "testing"
 import "encoding/hex"
+import "path/filepath"
 
 import "github.com/deroproject/derohe/transaction"
 
@@ -137,3 +138,28 @@ func Test_regpool(t *testing.T) {
 	}
 
 }
+
+// saved pool must load back all txs
+func Test_regpool_persist(t *testing.T) {
+	tx_hex := "010000010ccf5f06ed0d8b66da41b3054438996fb57801e57b0809fec9816432715a1ae90004e22ceb7a312c7a5d1e19dd5eb6bec3ba182a77fdbd0004ac7ea2bece9cc8a00141663a9d5680f724ee9bfe4cf27e3a88e74986923e05f533d46643b052f397"
+
+	var tx transaction.Transaction
+	tx_raw, _ := hex.DecodeString(tx_hex)
+	if err := tx.Deserialize(tx_raw); err != nil {
+		t.Fatalf("Tx Deserialisation failed")
+	}
+
+	pool, _ := Init_Regpool(nil)
+	filename := filepath.Join(t.TempDir(), "regpool.json")
+	if !pool.Regpool_Add_TX(&tx, 0) {
+		t.Fatalf("Cannot Add transaction to pool")
+	}
+	if err := pool.Save(filename); err != nil {
+		t.Fatalf("Cannot save pool err %s", err)
+	}
+
+	txs, err := Load(filename)
+	if err != nil || len(txs) != 1 || txs[0].GetHash() != tx.GetHash() {
+		t.Fatalf("Saved pool not loaded correctly err %s", err)
+	}
+}
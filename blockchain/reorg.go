@@ -0,0 +1,174 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package blockchain
+
+// this file tracks reorganisations of the main chain
+// a reorg occurs when a heavier branch replaces blocks which were already topo ordered, displaced blocks become side blocks
+// txs of displaced blocks which are not part of new branch are returned to pool, so they can be mined again
+// a bounded history is kept on disk, so operators can tune confirmation policies using real data
+
+import "sync"
+import "time"
+import "path/filepath"
+
+import "github.com/deroproject/derohe/cryptography/crypto"
+import "github.com/deroproject/derohe/globals"
+import "github.com/deroproject/derohe/metrics"
+import "github.com/deroproject/derohe/transaction"
+
+const REORG_HISTORY_MAX = 1000 // only this many recent reorgs are kept
+
+// a single reorganisation of main chain
+type ReorgEvent struct {
+	Time        time.Time     `json:"time"`
+	Height      int64         `json:"height"`     // height of new top block
+	TopoHeight  int64         `json:"topoheight"` // first topoheight which was rewritten
+	Depth       int64         `json:"depth"`      // number of main chain blocks displaced
+	OldTop      crypto.Hash   `json:"old_top"`
+	NewTop      crypto.Hash   `json:"new_top"`
+	OldBlocks   []crypto.Hash `json:"old_blocks"` // displaced blocks, lowest first
+	NewBlocks   []crypto.Hash `json:"new_blocks"` // blocks which replaced them, lowest first
+	TxsReturned []crypto.Hash `json:"txs_returned"`
+}
+
+type reorg_history struct {
+	sync.Mutex
+	filename string
+	events   []ReorgEvent // oldest first
+}
+
+func load_reorg_history(basedir string) *reorg_history {
+	history := &reorg_history{filename: filepath.Join(basedir, "reorgs.json")}
+	if err := globals.LoadJSON(history.filename, &history.events); err != nil {
+		logger.Error(err, "loading reorg history", "file", history.filename)
+	}
+	if len(history.events) > REORG_HISTORY_MAX {
+		history.events = history.events[len(history.events)-REORG_HISTORY_MAX:]
+	}
+	return history
+}
+
+func (history *reorg_history) add(event ReorgEvent) {
+	history.Lock()
+	defer history.Unlock()
+
+	history.events = append(history.events, event)
+	if len(history.events) > REORG_HISTORY_MAX {
+		history.events = append([]ReorgEvent{}, history.events[len(history.events)-REORG_HISTORY_MAX:]...)
+	}
+	if err := globals.SaveJSON(history.filename, history.events); err != nil {
+		logger.Error(err, "saving reorg history", "file", history.filename)
+	}
+}
+
+// returns upto count recent events, newest first
+func (history *reorg_history) get(count int) (events []ReorgEvent) {
+	history.Lock()
+	defer history.Unlock()
+
+	for i := len(history.events) - 1; i >= 0 && len(events) < count; i-- {
+		events = append(events, history.events[i])
+	}
+	return
+}
+
+// returns upto count recent reorgs, newest first
+func (chain *Blockchain) Get_Reorgs(count int) []ReorgEvent {
+	if chain.reorgs == nil || count <= 0 {
+		return nil
+	}
+	return chain.reorgs.get(count)
+}
+
+// called with chain locked, after topo records from topoheight have been rewritten
+// old_blocks are blocks displaced from main chain and new_blocks replaced them, both lowest first
+func (chain *Blockchain) record_reorg(topoheight int64, old_blocks, new_blocks []crypto.Hash) (event ReorgEvent) {
+	event = ReorgEvent{Time: time.Now().UTC(), TopoHeight: topoheight, Depth: int64(len(old_blocks)), OldBlocks: old_blocks, NewBlocks: new_blocks}
+	if len(old_blocks) >= 1 {
+		event.OldTop = old_blocks[len(old_blocks)-1]
+	}
+	if len(new_blocks) >= 1 {
+		event.NewTop = new_blocks[len(new_blocks)-1]
+		event.Height = chain.Load_Height_for_BL_ID(event.NewTop)
+	}
+
+	event.TxsReturned = chain.return_displaced_txs(old_blocks, new_blocks)
+
+	logger.Info("Chain reorganised", "depth", event.Depth, "topoheight", topoheight, "old_top", event.OldTop, "new_top", event.NewTop, "txs_returned", len(event.TxsReturned))
+
+	metrics.Set.GetOrCreateCounter("blockchain_reorg_total").Inc()
+	metrics.Set.GetOrCreateCounter("blockchain_reorg_blocks_displaced_total").Add(len(old_blocks))
+	metrics.Set.GetOrCreateCounter("blockchain_reorg_txs_returned_total").Add(len(event.TxsReturned))
+	metrics.Set.GetOrCreateHistogram("blockchain_reorg_depth").Update(float64(event.Depth))
+
+	if chain.reorgs != nil {
+		chain.reorgs.add(event)
+	}
+	return
+}
+
+// txs of displaced blocks which are not mined in new branch are placed back in pool
+// txs referencing a displaced block can never be mined, so they are dropped
+func (chain *Blockchain) return_displaced_txs(old_blocks, new_blocks []crypto.Hash) (returned []crypto.Hash) {
+	mined := map[crypto.Hash]bool{}
+	for _, blid := range new_blocks {
+		if bl, err := chain.Load_BL_FROM_ID(blid); err == nil {
+			for _, txhash := range bl.Tx_hashes {
+				mined[txhash] = true
+			}
+		}
+	}
+
+	for _, blid := range old_blocks {
+		bl, err := chain.Load_BL_FROM_ID(blid)
+		if err != nil {
+			logger.Error(err, "loading displaced block", "blid", blid)
+			continue
+		}
+		for _, txhash := range bl.Tx_hashes {
+			if mined[txhash] {
+				continue
+			}
+			tx_bytes, err := chain.Store.Block_tx_store.ReadTX(txhash)
+			if err != nil {
+				continue
+			}
+			var tx transaction.Transaction
+			if err = tx.Deserialize(tx_bytes); err != nil {
+				continue
+			}
+
+			if !tx.IsRegistration() {
+				if toporecord, err := chain.Store.Topo_store.Read(int64(tx.Height)); err != nil || toporecord.BLOCK_ID != tx.BLID {
+					logger.V(1).Info("displaced tx dropped, reference not in main chain", "txid", txhash)
+					continue
+				}
+			}
+
+			var added bool
+			if tx.IsRegistration() {
+				added = chain.Regpool.Regpool_Add_TX(&tx, 0)
+			} else {
+				added = chain.Mempool.Mempool_Add_TX(&tx, 0)
+			}
+			if added {
+				returned = append(returned, txhash)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,191 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package blockchain
+
+import "fmt"
+import "testing"
+
+import "github.com/go-logr/logr"
+
+import "github.com/deroproject/derohe/block"
+import "github.com/deroproject/derohe/cryptography/crypto"
+import "github.com/deroproject/derohe/globals"
+import "github.com/deroproject/derohe/rpc"
+import "github.com/deroproject/derohe/transaction"
+import "github.com/deroproject/derohe/walletapi"
+
+// history must be bounded, returned newest first and survive restarts
+func Test_Reorg_History(t *testing.T) {
+	logger = logr.Discard()
+	basedir := t.TempDir()
+
+	chain := &Blockchain{reorgs: load_reorg_history(basedir)}
+	if events := chain.Get_Reorgs(10); len(events) != 0 {
+		t.Fatalf("empty history returned %d events", len(events))
+	}
+
+	for i := 0; i < REORG_HISTORY_MAX+5; i++ {
+		chain.reorgs.add(ReorgEvent{TopoHeight: int64(i), Depth: 1, OldBlocks: []crypto.Hash{{byte(i)}}})
+	}
+
+	chain = &Blockchain{reorgs: load_reorg_history(basedir)}
+	if events := chain.Get_Reorgs(2 * REORG_HISTORY_MAX); len(events) != REORG_HISTORY_MAX {
+		t.Fatalf("history not bounded, expected %d actual %d", REORG_HISTORY_MAX, len(events))
+	}
+
+	events := chain.Get_Reorgs(3)
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events actual %d", len(events))
+	}
+	for i, event := range events {
+		if expected := int64(REORG_HISTORY_MAX + 4 - i); event.TopoHeight != expected {
+			t.Fatalf("event %d expected topoheight %d actual %d", i, expected, event.TopoHeight)
+		}
+	}
+	last := events[0].TopoHeight
+	if events[0].OldBlocks[0] != (crypto.Hash{byte(last)}) {
+		t.Fatalf("event not persisted correctly %+v", events[0])
+	}
+}
+
+// mines a block on given tips, block template is taken from chain and moved to tips
+func reorg_test_block(t *testing.T, chain *Blockchain, miner rpc.Address, tips ...crypto.Hash) *block.Complete_Block {
+	cbl, _, err := chain.Create_new_miner_block(miner)
+	if err != nil {
+		t.Fatalf("cannot create block err %s", err)
+	}
+	if len(tips) >= 1 {
+		cbl.Bl.Tips = tips
+		cbl.Bl.Height = uint64(chain.Load_Height_for_BL_ID(tips[0]) + 1)
+	}
+	cbl.Bl.MiniBlocks = append(cbl.Bl.MiniBlocks, ConvertBlockToMiniblock(*cbl.Bl, miner))
+	return cbl
+}
+
+// starts a simulator chain in a temporary directory, miner is registered at genesis
+func test_simulator_chain(t *testing.T) (*Blockchain, rpc.Address) {
+	logger = logr.Discard()
+	globals.Arguments = map[string]interface{}{"--testnet": true, "--simulator": true, "--data-dir": t.TempDir()}
+	globals.Initialize()
+
+	miner_wallet, _ := walletapi.Create_Encrypted_Wallet_Random_Memory("")
+	miner := miner_wallet.GetAddress()
+	genesis_tx := transaction.Transaction{Transaction_Prefix: transaction.Transaction_Prefix{Version: 1, Value: 2012345}}
+	copy(genesis_tx.MinerAddress[:], miner.PublicKey.EncodeCompressed())
+	globals.Config.Genesis_Tx = fmt.Sprintf("%x", genesis_tx.Serialize())
+
+	chain, err := Blockchain_Start(map[string]interface{}{"--simulator": true})
+	if err != nil {
+		t.Fatalf("cannot start chain err %s", err)
+	}
+	return chain, miner
+}
+
+// a heavier branch displaces a block, event is recorded and txs of displaced block go back to pool
+func Test_Reorg_Displaced_Txs(t *testing.T) {
+	chain, miner := test_simulator_chain(t)
+	defer chain.Shutdown()
+
+	for i := 0; i < 2; i++ {
+		if err, _ := chain.Add_Complete_Block(reorg_test_block(t, chain, miner)); err != nil {
+			t.Fatalf("cannot add block err %s", err)
+		}
+	}
+	base := chain.Get_Top_ID()
+
+	other := reorg_test_block(t, chain, miner) // competing block without the tx
+
+	user, _ := walletapi.Create_Encrypted_Wallet_Random_Memory("")
+	tx := user.GetRegistrationTX()
+	if err := chain.Add_TX_To_Pool(tx); err != nil {
+		t.Fatalf("cannot add tx to pool err %s", err)
+	}
+	displaced := reorg_test_block(t, chain, miner)
+	if len(displaced.Txs) != 1 {
+		t.Fatalf("tx was not mined, block has %d txs", len(displaced.Txs))
+	}
+	if err, _ := chain.Add_Complete_Block(displaced); err != nil {
+		t.Fatalf("cannot add block err %s", err)
+	}
+	chain.Regpool.Regpool_Delete_TX(tx.GetHash()) // as done by housekeeping once tx is mined
+	if err, _ := chain.Add_Complete_Block(other); err != nil {
+		t.Fatalf("cannot add competing block err %s", err)
+	}
+	if len(chain.Get_Reorgs(10)) != 0 {
+		t.Fatalf("block at same height must not reorganise chain")
+	}
+
+	heavier := reorg_test_block(t, chain, miner, other.Bl.GetHash())
+	if err, _ := chain.Add_Complete_Block(heavier); err != nil {
+		t.Fatalf("cannot add heavier block err %s", err)
+	}
+
+	events := chain.Get_Reorgs(10)
+	if len(events) != 1 {
+		t.Fatalf("expected 1 reorg, recorded %d", len(events))
+	}
+	event := events[0]
+	if event.Depth != 1 || event.OldTop != displaced.Bl.GetHash() || len(event.NewBlocks) != 1 || event.NewBlocks[0] != other.Bl.GetHash() {
+		t.Fatalf("wrong reorg recorded %+v", event)
+	}
+	if len(event.TxsReturned) != 1 || event.TxsReturned[0] != tx.GetHash() || !chain.Regpool.Regpool_TX_Exist(tx.GetHash()) {
+		t.Fatalf("displaced tx was not returned to pool %+v", event)
+	}
+	if chain.Get_Top_ID() != heavier.Bl.GetHash() || chain.Load_Block_Topological_order(base) != 2 {
+		t.Fatalf("chain did not switch to heavier branch")
+	}
+
+	if events := load_reorg_history(globals.GetDataDirectory()).get(10); len(events) != 1 || events[0].OldTop != event.OldTop {
+		t.Fatalf("reorg was not persisted")
+	}
+}
+
+// history store reads blocks of a stopped chain without opening balances
+func Test_Open_History_Store(t *testing.T) {
+	chain, miner := test_simulator_chain(t)
+	for i := 0; i < 3; i++ {
+		if err, _ := chain.Add_Complete_Block(reorg_test_block(t, chain, miner)); err != nil {
+			t.Fatalf("cannot add block err %s", err)
+		}
+	}
+	top := chain.Get_Top_ID()
+	topo := chain.Load_TOPO_HEIGHT()
+	chain.Shutdown()
+
+	store, err := Open_History_Store()
+	if err != nil {
+		t.Fatalf("cannot open history store err %s", err)
+	}
+	defer store.Close_History()
+
+	if store.Topo_store.Count() != topo+1 || store.Balance_store != nil {
+		t.Fatalf("unexpected store count %d topo %d", store.Topo_store.Count(), topo)
+	}
+	record, err := store.Topo_store.Read(topo)
+	if err != nil || record.BLOCK_ID != top {
+		t.Fatalf("top block not found %s err %v", record, err)
+	}
+	if _, err := store.Block_tx_store.ReadBlockDifficulty(top); err != nil {
+		t.Fatalf("difficulty not found err %s", err)
+	}
+
+	globals.Arguments["--data-dir"] = t.TempDir()
+	globals.Initialize()
+	if _, err := Open_History_Store(); err == nil {
+		t.Fatalf("empty data directory must not be opened")
+	}
+}
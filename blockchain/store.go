@@ -16,6 +16,7 @@
 
 package blockchain
 
+import "os"
 import "fmt"
 import "math/big"
 import "path/filepath"
@@ -31,7 +32,7 @@ import "github.com/deroproject/graviton"
 // though these can be done within a single DB, these are separated for completely clarity purposes
 type storage struct {
 	Balance_store  *graviton.Store // stores most critical data, only history can be purged, its merkle tree is stored in the block
-	Block_tx_store storefs         // stores blocks which can be discarded at any time(only past but keep recent history for rollback)
+	Block_tx_store BlockTxStore    // stores blocks which can be discarded at any time(only past but keep recent history for rollback)
 	Topo_store     storetopofs     // stores topomapping which can only be discarded by punching holes in the start of the file
 }
 
@@ -39,11 +40,17 @@ func (s *storage) Initialize(params map[string]interface{}) (err error) {
 
 	current_path := filepath.Join(globals.GetDataDirectory())
 
-	if s.Balance_store, err = graviton.NewDiskStore(filepath.Join(current_path, "balances")); err == nil {
-		if err = s.Topo_store.Open(current_path); err == nil {
-			s.Block_tx_store.basedir = current_path
+	if err = s.Topo_store.Open(current_path); err == nil {
+		if s.Block_tx_store, err = open_block_store(current_path); err == nil {
+			if journal := load_prune_journal(current_path); journal != nil { // online pruning was interrupted while swapping state
+				logger.Info("Completing interrupted pruning", "prune_topoheight", journal.PruneTopo)
+				err = s.apply_prune_journal(current_path, journal)
+			} else {
+				s.Balance_store, err = graviton.NewDiskStore(filepath.Join(current_path, "balances"))
+			}
 		}
 	}
+	os.RemoveAll(filepath.Join(current_path, "balances_old")) // left over from online pruning
 
 	if err != nil {
 		logger.Error(err, "Cannot open store")
@@ -54,6 +61,30 @@ func (s *storage) Initialize(params map[string]interface{}) (err error) {
 	return nil
 }
 
+// Open_History_Store opens only topo and block stores of data directory, balances are not opened and chain is not started
+// it is meant for tools which only read block history, caller must call Close_History when done
+func Open_History_Store() (s *storage, err error) {
+	current_path := filepath.Join(globals.GetDataDirectory())
+	if _, err = os.Stat(filepath.Join(current_path, "topo.map")); err != nil { // never create a new chain
+		return nil, fmt.Errorf("no chain found in data directory: %s", err)
+	}
+
+	s = &storage{}
+	if err = s.Topo_store.Open(current_path); err != nil {
+		return nil, err
+	}
+	if s.Block_tx_store, err = open_block_store(current_path); err != nil {
+		s.Topo_store.topomapping.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *storage) Close_History() {
+	s.Block_tx_store.Close()
+	s.Topo_store.topomapping.Close()
+}
+
 func (s *storage) IsBalancesIntialized() bool {
 	var err error
 	var balancehash, random_hash [32]byte
@@ -300,7 +331,19 @@ func (chain *Blockchain) Load_Merkle_Hash(version uint64) (hash crypto.Hash, err
 		return
 	}
 
-	ss, err := chain.Store.Balance_store.LoadSnapshot(version)
+	if hash, err = store_merkle_hash(chain.Store.Balance_store, version); err != nil {
+		return
+	}
+
+	if chain.cache_enabled { //set in cache
+		chain.cache_VersionMerkle.Add(version, hash)
+	}
+	return hash, nil
+}
+
+// state root of a version within a store
+func store_merkle_hash(store *graviton.Store, version uint64) (hash crypto.Hash, err error) {
+	ss, err := store.LoadSnapshot(version)
 	if err != nil {
 		return
 	}
@@ -324,10 +367,6 @@ func (chain *Blockchain) Load_Merkle_Hash(version uint64) (hash crypto.Hash, err
 	for i := range balance_merkle_hash {
 		hash[i] = balance_merkle_hash[i] ^ meta_merkle_hash[i]
 	}
-
-	if chain.cache_enabled { //set in cache
-		chain.cache_VersionMerkle.Add(version, hash)
-	}
 	return hash, nil
 }
 
@@ -0,0 +1,171 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package blockchain
+
+// this file defines the interface for block/tx storage, so that backends can be switched
+// blocks/txs can be discarded at any time(only past but keep recent history for rollback)
+
+import "os"
+import "fmt"
+import "math/big"
+import "path/filepath"
+
+import "github.com/deroproject/derohe/globals"
+
+const (
+	BLOCK_STORE_FS   = "fs"   // every block/tx is a file, uses an inode per object
+	BLOCK_STORE_PACK = "pack" // blocks/txs are appended to large segment files, with an index
+)
+
+// every backend must implement this interface
+type BlockTxStore interface {
+	ReadBlock(h [32]byte) ([]byte, error)
+	DeleteBlock(h [32]byte) error
+	ReadBlockDifficulty(h [32]byte) (*big.Int, error)
+	ReadBlockSnapshotVersion(h [32]byte) (uint64, error)
+	ReadBlockHeight(h [32]byte) (uint64, error)
+	WriteBlock(h [32]byte, data []byte, difficulty *big.Int, ss_version uint64, height uint64) error
+
+	ReadTX(h [32]byte) ([]byte, error)
+	WriteTX(h [32]byte, data []byte) error
+	DeleteTX(h [32]byte) error
+
+	// visits every block and tx in the store, used for migration
+	Walk(block_handler func(h [32]byte, data []byte, difficulty *big.Int, ss_version uint64, height uint64) error, tx_handler func(h [32]byte, data []byte) error) error
+
+	Compact() error // reclaim space used by deleted objects, if backend needs it
+	Size() int64    // bytes used on disk
+	Close() error
+}
+
+// detects the backend used by existing data in basedir, empty if there is no data
+func detect_block_store(basedir string) string {
+	if _, err := os.Stat(filepath.Join(basedir, "bltx_pack")); err == nil {
+		return BLOCK_STORE_PACK
+	}
+	if _, err := os.Stat(filepath.Join(basedir, "bltx_pack.compact")); err == nil { // interrupted compaction
+		return BLOCK_STORE_PACK
+	}
+	if _, err := os.Stat(filepath.Join(basedir, "bltx_store")); err == nil {
+		return BLOCK_STORE_FS
+	}
+	return ""
+}
+
+// directory used by backend within basedir
+func block_store_dir(kind string) string {
+	if kind == BLOCK_STORE_PACK {
+		return "bltx_pack"
+	}
+	return "bltx_store"
+}
+
+func new_block_store(kind string, basedir string) (BlockTxStore, error) {
+	switch kind {
+	case BLOCK_STORE_FS:
+		return &storefs{basedir: basedir}, nil
+	case BLOCK_STORE_PACK:
+		return open_storepack(filepath.Join(basedir, block_store_dir(kind)))
+	default:
+		return nil, fmt.Errorf("unknown block store \"%s\", valid options are %s,%s", kind, BLOCK_STORE_FS, BLOCK_STORE_PACK)
+	}
+}
+
+// opens block store, existing data decides the backend, new nodes use fs unless pack is requested with --block-store
+func open_block_store(basedir string) (BlockTxStore, error) {
+	requested := ""
+	if _, ok := globals.Arguments["--block-store"]; ok && globals.Arguments["--block-store"] != nil {
+		requested = globals.Arguments["--block-store"].(string)
+	}
+
+	kind := detect_block_store(basedir)
+	switch {
+	case kind == "" && requested == "":
+		kind = BLOCK_STORE_FS
+	case kind == "":
+		kind = requested
+	case requested != "" && requested != kind:
+		logger.Info("existing block store is used, run with --migrate-block-store to convert it", "existing", kind, "requested", requested)
+	}
+	return new_block_store(kind, basedir)
+}
+
+// converts block store in data directory to the requested backend, old store is deleted only after everything is copied
+// new store is built in a temporary directory and moved in place, so an interrupted migration leaves the old store usable
+// node must not be running
+func Migrate_Block_Store(to string) (err error) {
+	basedir := globals.GetDataDirectory()
+
+	from := detect_block_store(basedir)
+	if from == "" {
+		return fmt.Errorf("no block store found in %s", basedir)
+	}
+	if from == to {
+		return fmt.Errorf("block store is already \"%s\"", to)
+	}
+
+	var source, target BlockTxStore
+	if source, err = new_block_store(from, basedir); err != nil {
+		return
+	}
+	defer source.Close()
+
+	if to != BLOCK_STORE_FS && to != BLOCK_STORE_PACK {
+		return fmt.Errorf("unknown block store \"%s\", valid options are %s,%s", to, BLOCK_STORE_FS, BLOCK_STORE_PACK)
+	}
+
+	tmpdir := filepath.Join(basedir, "bltx_migrate")
+	os.RemoveAll(tmpdir) // discard any earlier interrupted migration
+	if err = os.MkdirAll(tmpdir, 0700); err != nil {
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+
+	if target, err = new_block_store(to, tmpdir); err != nil {
+		return
+	}
+
+	globals.Logger.Info("Migrating block store", "from", from, "to", to, "size", ByteCountIEC(source.Size()))
+
+	block_count, tx_count := 0, 0
+	err = source.Walk(func(h [32]byte, data []byte, difficulty *big.Int, ss_version uint64, height uint64) error {
+		block_count++
+		if block_count%10000 == 0 {
+			globals.Logger.Info("Migrating block store", "blocks", block_count, "txs", tx_count)
+		}
+		return target.WriteBlock(h, data, difficulty, ss_version, height)
+	}, func(h [32]byte, data []byte) error {
+		tx_count++
+		return target.WriteTX(h, data)
+	})
+
+	if cerr := target.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil { // partial target is discarded, source is still intact
+		return err
+	}
+	os.MkdirAll(filepath.Join(tmpdir, block_store_dir(to)), 0700) // store may be empty
+	if err = os.Rename(filepath.Join(tmpdir, block_store_dir(to)), filepath.Join(basedir, block_store_dir(to))); err != nil {
+		return err
+	}
+
+	source.Close()
+	os.RemoveAll(filepath.Join(basedir, block_store_dir(from)))
+	globals.Logger.Info("Block store migrated successfully", "blocks", block_count, "txs", tx_count)
+	return nil
+}
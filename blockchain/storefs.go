@@ -20,7 +20,9 @@ package blockchain
 
 import "os"
 import "fmt"
+import "errors"
 import "strings"
+import "encoding/hex"
 import "io/ioutil"
 import "math/big"
 import "path/filepath"
@@ -232,3 +234,70 @@ func (s *storefs) DeleteTX(h [32]byte) (err error) {
 	file := filepath.Join(dir, fmt.Sprintf("%x.tx", h[:]))
 	return os.Remove(file)
 }
+
+// visits all blocks and txs, directory layout is bltx_store/xx/yy/
+func (s *storefs) Walk(block_handler func(h [32]byte, data []byte, difficulty *big.Int, ss_version uint64, height uint64) error, tx_handler func(h [32]byte, data []byte) error) error {
+	dir := filepath.Join(s.basedir, "bltx_store")
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		return nil // nothing stored yet
+	}
+	return filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		var h [32]byte
+		name := d.Name()
+		if len(name) < 64 {
+			return nil
+		}
+		if _, err := hex.Decode(h[:], []byte(name[:64])); err != nil {
+			return nil // not our file
+		}
+
+		switch {
+		case name[64:] == ".tx":
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return tx_handler(h, data)
+
+		case strings.HasPrefix(name[64:], ".block_"):
+			parts := strings.Split(name, "_")
+			if len(parts) != 4 {
+				return fmt.Errorf("invalid block filename %s", name)
+			}
+			diff := new(big.Int)
+			var ss_version, height uint64
+			if _, err := fmt.Sscan(parts[1], diff); err != nil {
+				return err
+			}
+			if _, err := fmt.Sscan(parts[2], &ss_version); err != nil {
+				return err
+			}
+			if _, err := fmt.Sscan(parts[3], &height); err != nil {
+				return err
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return block_handler(h, data, diff, ss_version, height)
+		}
+		return nil
+	})
+}
+
+// filesystem reclaims space itself
+func (s *storefs) Compact() error {
+	return nil
+}
+
+func (s *storefs) Size() int64 {
+	return DirSize(filepath.Join(s.basedir, "bltx_store"))
+}
+
+func (s *storefs) Close() error {
+	return nil
+}
@@ -0,0 +1,646 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package blockchain
+
+// this file implements a pack store, blocks/txs are appended to segment files of upto 256 MB instead of a file per object
+// location of every object is appended to an index file, which is loaded in memory at startup, so every lookup is O(1)
+// deleted/overwritten objects leave holes in segments, which are reclaimed by compaction
+// index records carry a checksum, so a torn write at the end of index (crash) is detected and discarded
+// segments are synced when they are full, data and index are synced on every write, so an acknowledged write survives a crash
+
+import "os"
+import "io"
+import "fmt"
+import "sync"
+import "bufio"
+import "errors"
+import "math/big"
+import "hash/crc32"
+import "path/filepath"
+import "encoding/binary"
+
+const PACK_SEGMENT_SIZE = 256 * 1024 * 1024 // new segment is started once a segment reaches this size
+
+const (
+	pack_record_block        = 1
+	pack_record_tx           = 2
+	pack_record_delete_block = 3
+	pack_record_delete_tx    = 4
+)
+
+const pack_record_header = 1 + 32               // kind + hash
+const pack_record_entry = 4 + 8 + 4 + 4 + 8 + 8 // segment, offset, length, crc, ss_version, height
+
+// location of an object within segments
+type pack_entry struct {
+	segment    uint32
+	offset     uint64
+	length     uint32
+	crc        uint32 // checksum of data
+	ss_version uint64
+	height     uint64
+	difficulty *big.Int // nil for txs
+}
+
+type storepack struct {
+	sync.RWMutex
+	dir        string
+	index      *os.File
+	index_size int64
+	segments   []*os.File
+	sizes      []int64 // size of every segment
+	blocks     map[[32]byte]*pack_entry
+	txs        map[[32]byte]*pack_entry
+	live, dead int64 // bytes used by current and discarded objects
+	closed     bool
+	compacting sync.Mutex // only one compaction runs at a time
+	batch      bool       // writes are not synced individually, store is synced once all writes are done, used by compaction
+}
+
+func segment_name(dir string, i int) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d.pack", i))
+}
+
+func open_storepack(dir string) (s *storepack, err error) {
+	// recover from an interrupted compaction, compacted store is complete once original has been moved away
+	if _, err = os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		if _, err = os.Stat(dir + ".compact"); err == nil {
+			if err = os.Rename(dir+".compact", dir); err != nil {
+				return nil, err
+			}
+		}
+	}
+	os.RemoveAll(dir + ".compact")
+	os.RemoveAll(dir + ".old")
+
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s = &storepack{dir: dir, blocks: map[[32]byte]*pack_entry{}, txs: map[[32]byte]*pack_entry{}}
+	for i := 0; ; i++ {
+		file, err := os.OpenFile(segment_name(dir, i), os.O_RDWR, 0600)
+		if errors.Is(err, os.ErrNotExist) {
+			break
+		} else if err != nil {
+			s.Close()
+			return nil, err
+		}
+		fstat, err := file.Stat()
+		if err != nil {
+			file.Close()
+			s.Close()
+			return nil, err
+		}
+		s.segments = append(s.segments, file)
+		s.sizes = append(s.sizes, fstat.Size())
+	}
+	if len(s.segments) == 0 {
+		if err = s.new_segment(); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	if s.index, err = os.OpenFile(filepath.Join(dir, "index"), os.O_RDWR|os.O_CREATE, 0600); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if err = s.load_index(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *storepack) new_segment() error {
+	file, err := os.OpenFile(segment_name(s.dir, len(s.segments)), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	s.segments = append(s.segments, file)
+	s.sizes = append(s.sizes, 0)
+	return nil
+}
+
+// calls handler for every valid index record, returns number of bytes consumed
+func scan_index(r io.Reader, handler func(body []byte)) (offset int64) {
+	reader := bufio.NewReaderSize(r, 1024*1024)
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			break
+		}
+		length := binary.LittleEndian.Uint32(header[:])
+		if length < pack_record_header || length > pack_record_header+pack_record_entry+1024 {
+			break
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(header[4:]) {
+			break
+		}
+		handler(body)
+		offset += int64(len(header)) + int64(length)
+	}
+	return offset
+}
+
+// reads all index records, a damaged tail is discarded
+func (s *storepack) load_index() error {
+	offset := scan_index(io.NewSectionReader(s.index, 0, 1<<62), s.apply_record)
+
+	fstat, err := s.index.Stat()
+	if err != nil {
+		return err
+	}
+	if fstat.Size() != offset {
+		logger.Info("block store index has damaged tail, discarding", "bytes", fstat.Size()-offset)
+		if err = s.index.Truncate(offset); err != nil {
+			return err
+		}
+	}
+	s.index_size = offset
+	return nil
+}
+
+// applies an index record to in memory index
+func (s *storepack) apply_record(body []byte) {
+	var h [32]byte
+	kind := body[0]
+	copy(h[:], body[1:pack_record_header])
+
+	var m map[[32]byte]*pack_entry
+	switch kind {
+	case pack_record_block, pack_record_delete_block:
+		m = s.blocks
+	case pack_record_tx, pack_record_delete_tx:
+		m = s.txs
+	default:
+		return
+	}
+
+	if old, ok := m[h]; ok {
+		s.live -= int64(old.length)
+		s.dead += int64(old.length)
+		delete(m, h)
+	}
+
+	if kind == pack_record_delete_block || kind == pack_record_delete_tx || len(body) < pack_record_header+pack_record_entry {
+		return
+	}
+
+	entry := decode_entry(kind, body[pack_record_header:])
+
+	// data which never reached the disk, cannot be used
+	if int(entry.segment) >= len(s.sizes) || entry.offset+uint64(entry.length) > uint64(s.sizes[entry.segment]) {
+		return
+	}
+	m[h] = entry
+	s.live += int64(entry.length)
+}
+
+func decode_entry(kind byte, e []byte) *pack_entry {
+	entry := &pack_entry{
+		segment:    binary.LittleEndian.Uint32(e[0:]),
+		offset:     binary.LittleEndian.Uint64(e[4:]),
+		length:     binary.LittleEndian.Uint32(e[12:]),
+		crc:        binary.LittleEndian.Uint32(e[16:]),
+		ss_version: binary.LittleEndian.Uint64(e[20:]),
+		height:     binary.LittleEndian.Uint64(e[28:]),
+	}
+	if kind == pack_record_block {
+		entry.difficulty = new(big.Int).SetBytes(e[pack_record_entry:])
+	}
+	return entry
+}
+
+// appends a record to index, lock must be held
+func (s *storepack) write_record(kind byte, h [32]byte, entry *pack_entry) error {
+	body := make([]byte, pack_record_header, pack_record_header+pack_record_entry+32)
+	body[0] = kind
+	copy(body[1:], h[:])
+	if entry != nil {
+		var e [pack_record_entry]byte
+		binary.LittleEndian.PutUint32(e[0:], entry.segment)
+		binary.LittleEndian.PutUint64(e[4:], entry.offset)
+		binary.LittleEndian.PutUint32(e[12:], entry.length)
+		binary.LittleEndian.PutUint32(e[16:], entry.crc)
+		binary.LittleEndian.PutUint64(e[20:], entry.ss_version)
+		binary.LittleEndian.PutUint64(e[28:], entry.height)
+		body = append(body, e[:]...)
+		if entry.difficulty != nil {
+			body = append(body, entry.difficulty.Bytes()...)
+		}
+	}
+
+	record := make([]byte, 8, 8+len(body))
+	binary.LittleEndian.PutUint32(record[0:], uint32(len(body)))
+	binary.LittleEndian.PutUint32(record[4:], crc32.ChecksumIEEE(body))
+	record = append(record, body...)
+
+	if _, err := s.index.WriteAt(record, s.index_size); err != nil {
+		return err
+	}
+	if !s.batch {
+		if err := s.index.Sync(); err != nil {
+			return err
+		}
+	}
+	s.index_size += int64(len(record))
+	s.apply_record(body)
+	return nil
+}
+
+// appends object data to current segment and records it in index
+func (s *storepack) put(kind byte, h [32]byte, data []byte, difficulty *big.Int, ss_version uint64, height uint64) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return os.ErrClosed
+	}
+
+	crc := crc32.ChecksumIEEE(data)
+	if old, ok := s.objects(kind)[h]; ok && old.crc == crc && old.length == uint32(len(data)) && old.ss_version == ss_version && old.height == height {
+		if difficulty == nil || (old.difficulty != nil && old.difficulty.Cmp(difficulty) == 0) {
+			return nil // same object is already stored
+		}
+	}
+
+	current := len(s.segments) - 1
+	if s.sizes[current] > 0 && s.sizes[current]+int64(len(data)) > PACK_SEGMENT_SIZE {
+		if err := s.segments[current].Sync(); err != nil { // full segment is never written again
+			return err
+		}
+		if err := s.new_segment(); err != nil {
+			return err
+		}
+		current++
+	}
+
+	if _, err := s.segments[current].WriteAt(data, s.sizes[current]); err != nil {
+		return err
+	}
+	if !s.batch { // data must be on disk before index points to it
+		if err := s.segments[current].Sync(); err != nil {
+			return err
+		}
+	}
+	entry := &pack_entry{segment: uint32(current), offset: uint64(s.sizes[current]), length: uint32(len(data)), crc: crc, ss_version: ss_version, height: height, difficulty: difficulty}
+	s.sizes[current] += int64(len(data))
+
+	return s.write_record(kind, h, entry)
+}
+
+func (s *storepack) remove(kind byte, h [32]byte) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return os.ErrClosed
+	}
+
+	m := s.txs
+	if kind == pack_record_delete_block {
+		m = s.blocks
+	}
+	if _, ok := m[h]; !ok {
+		return os.ErrNotExist
+	}
+	return s.write_record(kind, h, nil)
+}
+
+func (s *storepack) objects(kind byte) map[[32]byte]*pack_entry {
+	if kind == pack_record_block {
+		return s.blocks
+	}
+	return s.txs
+}
+
+func (s *storepack) get_entry(kind byte, h [32]byte) (*pack_entry, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if s.closed {
+		return nil, os.ErrClosed
+	}
+	if entry, ok := s.objects(kind)[h]; ok {
+		return entry, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+// reads and verifies data of an object, lock must be held
+func (s *storepack) read(entry *pack_entry) ([]byte, error) {
+	data := make([]byte, entry.length)
+	if _, err := s.segments[entry.segment].ReadAt(data, int64(entry.offset)); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(data) != entry.crc {
+		return nil, fmt.Errorf("block store corruption in segment %d offset %d", entry.segment, entry.offset)
+	}
+	return data, nil
+}
+
+// looks up and reads an object under a single lock, so compaction cannot move it in between
+func (s *storepack) get(kind byte, h [32]byte) ([]byte, *pack_entry, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if s.closed {
+		return nil, nil, os.ErrClosed
+	}
+	entry, ok := s.objects(kind)[h]
+	if !ok {
+		return nil, nil, os.ErrNotExist
+	}
+	data, err := s.read(entry)
+	return data, entry, err
+}
+
+func (s *storepack) ReadBlock(h [32]byte) ([]byte, error) {
+	var dummy [32]byte
+	if h == dummy {
+		return nil, fmt.Errorf("empty block")
+	}
+	data, _, err := s.get(pack_record_block, h)
+	return data, err
+}
+
+func (s *storepack) DeleteBlock(h [32]byte) error {
+	return s.remove(pack_record_delete_block, h)
+}
+
+func (s *storepack) ReadBlockDifficulty(h [32]byte) (*big.Int, error) {
+	entry, err := s.get_entry(pack_record_block, h)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).Set(entry.difficulty), nil
+}
+
+func (s *storepack) ReadBlockSnapshotVersion(h [32]byte) (uint64, error) {
+	entry, err := s.get_entry(pack_record_block, h)
+	if err != nil {
+		return 0, err
+	}
+	return entry.ss_version, nil
+}
+
+func (s *storepack) ReadBlockHeight(h [32]byte) (uint64, error) {
+	entry, err := s.get_entry(pack_record_block, h)
+	if err != nil {
+		return 0, err
+	}
+	return entry.height, nil
+}
+
+func (s *storepack) WriteBlock(h [32]byte, data []byte, difficulty *big.Int, ss_version uint64, height uint64) error {
+	return s.put(pack_record_block, h, data, new(big.Int).Set(difficulty), ss_version, height)
+}
+
+func (s *storepack) ReadTX(h [32]byte) ([]byte, error) {
+	data, _, err := s.get(pack_record_tx, h)
+	return data, err
+}
+
+func (s *storepack) WriteTX(h [32]byte, data []byte) error {
+	return s.put(pack_record_tx, h, data, nil, 0, 0)
+}
+
+func (s *storepack) DeleteTX(h [32]byte) error {
+	return s.remove(pack_record_delete_tx, h)
+}
+
+// visits all blocks and txs, objects written while walking may not be visited
+func (s *storepack) Walk(block_handler func(h [32]byte, data []byte, difficulty *big.Int, ss_version uint64, height uint64) error, tx_handler func(h [32]byte, data []byte) error) error {
+	var blocks, txs [][32]byte
+
+	s.RLock()
+	for h := range s.blocks {
+		blocks = append(blocks, h)
+	}
+	for h := range s.txs {
+		txs = append(txs, h)
+	}
+	s.RUnlock()
+
+	// objects are looked up again, since compaction may have moved them, deleted ones are skipped
+	for _, h := range blocks {
+		data, entry, err := s.get(pack_record_block, h)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err = block_handler(h, data, new(big.Int).Set(entry.difficulty), entry.ss_version, entry.height); err != nil {
+			return err
+		}
+	}
+	for _, h := range txs {
+		data, _, err := s.get(pack_record_tx, h)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err = tx_handler(h, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewrites live objects to new segments, if atleast a quarter of space is used by discarded objects
+// objects are copied without blocking readers and writers, writes done while copying are replayed from index
+// before the compacted store is swapped in under lock
+func (s *storepack) Compact() (err error) {
+	s.compacting.Lock()
+	defer s.compacting.Unlock()
+
+	type object struct {
+		kind  byte
+		h     [32]byte
+		entry *pack_entry
+	}
+	var objects []object
+
+	s.RLock()
+	if s.closed {
+		s.RUnlock()
+		return os.ErrClosed
+	}
+	if s.dead == 0 || s.dead*4 < s.live+s.dead {
+		s.RUnlock()
+		return nil
+	}
+	for h, entry := range s.blocks {
+		objects = append(objects, object{pack_record_block, h, entry})
+	}
+	for h, entry := range s.txs {
+		objects = append(objects, object{pack_record_tx, h, entry})
+	}
+	copied_index := s.index_size
+	s.RUnlock()
+
+	compact_dir := s.dir + ".compact"
+	os.RemoveAll(compact_dir)
+	compact, err := open_storepack(compact_dir)
+	if err != nil {
+		return err
+	}
+	compact.batch = true // synced once before it is swapped in
+	defer func() {
+		if compact != nil {
+			compact.Close()
+			os.RemoveAll(compact_dir)
+		}
+	}()
+
+	// segments are append only, so data of a snapshotted entry stays valid even if object is later overwritten
+	for _, o := range objects {
+		s.RLock()
+		if s.closed {
+			s.RUnlock()
+			return os.ErrClosed
+		}
+		data, err := s.read(o.entry)
+		s.RUnlock()
+		if err != nil {
+			return err
+		}
+		if err = compact.put(o.kind, o.h, data, o.entry.difficulty, o.entry.ss_version, o.entry.height); err != nil {
+			return err
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return os.ErrClosed
+	}
+
+	// replay records written while copying
+	scan_index(io.NewSectionReader(s.index, copied_index, s.index_size-copied_index), func(body []byte) {
+		if err != nil {
+			return
+		}
+		var h [32]byte
+		kind := body[0]
+		copy(h[:], body[1:pack_record_header])
+		switch {
+		case kind == pack_record_delete_block || kind == pack_record_delete_tx:
+			if rerr := compact.remove(kind, h); rerr != nil && !errors.Is(rerr, os.ErrNotExist) {
+				err = rerr
+			}
+		case (kind == pack_record_block || kind == pack_record_tx) && len(body) >= pack_record_header+pack_record_entry:
+			entry := decode_entry(kind, body[pack_record_header:])
+			var data []byte
+			if data, err = s.read(entry); err == nil {
+				err = compact.put(kind, h, data, entry.difficulty, entry.ss_version, entry.height)
+			}
+		}
+	})
+	if err == nil {
+		err = compact.sync()
+	}
+	if err != nil {
+		return err
+	}
+	compact.Close()
+	compact = nil
+
+	before := s.live + s.dead
+	s.close_files()
+	if err = os.Rename(s.dir, s.dir+".old"); err != nil {
+		os.RemoveAll(compact_dir)
+		return s.reopen(err)
+	}
+	if err = os.Rename(compact_dir, s.dir); err != nil {
+		if rerr := os.Rename(s.dir+".old", s.dir); rerr != nil {
+			s.closed = true
+			return fmt.Errorf("block store compaction failed, original store left at %s: %w", s.dir+".old", err)
+		}
+		return s.reopen(err)
+	}
+
+	if err = s.reopen(nil); err != nil {
+		return err
+	}
+	logger.V(1).Info("block store compacted", "before", ByteCountIEC(before), "after", ByteCountIEC(s.live))
+	return nil
+}
+
+// reopens store from disk after files were closed, cause is returned if reopening succeeds, lock must be held
+func (s *storepack) reopen(cause error) error {
+	reopened, err := open_storepack(s.dir)
+	if err != nil {
+		s.closed = true
+		if cause != nil {
+			return fmt.Errorf("%w, reopening block store failed: %s", cause, err)
+		}
+		return err
+	}
+	s.index, s.index_size, s.segments, s.sizes = reopened.index, reopened.index_size, reopened.segments, reopened.sizes
+	s.blocks, s.txs, s.live, s.dead, s.closed = reopened.blocks, reopened.txs, reopened.live, reopened.dead, false
+	return cause
+}
+
+func (s *storepack) Size() (size int64) {
+	s.RLock()
+	defer s.RUnlock()
+	for _, segment_size := range s.sizes {
+		size += segment_size
+	}
+	return size + s.index_size
+}
+
+func (s *storepack) sync() (err error) {
+	for _, file := range s.segments {
+		if serr := file.Sync(); err == nil {
+			err = serr
+		}
+	}
+	if s.index != nil {
+		if serr := s.index.Sync(); err == nil {
+			err = serr
+		}
+	}
+	return
+}
+
+// close all files, lock must be held
+func (s *storepack) close_files() {
+	for _, file := range s.segments {
+		file.Close()
+	}
+	if s.index != nil {
+		s.index.Close()
+	}
+	s.segments, s.sizes, s.index = nil, nil, nil
+	s.closed = true
+}
+
+func (s *storepack) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return nil
+	}
+	err := s.sync()
+	s.close_files()
+	return err
+}
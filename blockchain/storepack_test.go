@@ -0,0 +1,252 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package blockchain
+
+import "os"
+import "sync"
+import "bytes"
+import "testing"
+import "math/big"
+import "path/filepath"
+
+import "github.com/go-logr/logr"
+
+import "github.com/deroproject/derohe/globals"
+
+func test_object(i byte, size int) (h [32]byte, data []byte) {
+	h[0], h[31] = i, 0xaa
+	return h, bytes.Repeat([]byte{i}, size)
+}
+
+func Test_StorePack(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "bltx_pack")
+
+	store, err := open_storepack(dir)
+	if err != nil {
+		t.Fatalf("cannot open store err %s", err)
+	}
+
+	for i := byte(1); i <= 20; i++ {
+		h, data := test_object(i, 1000)
+		if err = store.WriteBlock(h, data, big.NewInt(int64(i)*1000), uint64(i), uint64(i)+1); err != nil {
+			t.Fatalf("cannot write block err %s", err)
+		}
+		if err = store.WriteTX(h, data[:100]); err != nil {
+			t.Fatalf("cannot write tx err %s", err)
+		}
+	}
+
+	// block rewritten with new snapshot version, and some deleted objects
+	h5, data5 := test_object(5, 1000)
+	store.DeleteBlock(h5)
+	store.WriteBlock(h5, data5, big.NewInt(5000), 500, 6)
+	for i := byte(10); i <= 20; i++ {
+		h, _ := test_object(i, 0)
+		store.DeleteBlock(h)
+		store.DeleteTX(h)
+	}
+
+	check := func(store BlockTxStore) {
+		t.Helper()
+		for i := byte(1); i <= 20; i++ {
+			h, data := test_object(i, 1000)
+			block, err := store.ReadBlock(h)
+			tx, txerr := store.ReadTX(h)
+			if i >= 10 {
+				if err == nil || txerr == nil {
+					t.Fatalf("deleted object %d could be read", i)
+				}
+				continue
+			}
+			if err != nil || !bytes.Equal(block, data) || txerr != nil || !bytes.Equal(tx, data[:100]) {
+				t.Fatalf("object %d could not be read err %v txerr %v", i, err, txerr)
+			}
+			if height, _ := store.ReadBlockHeight(h); height != uint64(i)+1 {
+				t.Fatalf("block %d height %d", i, height)
+			}
+			if diff, _ := store.ReadBlockDifficulty(h); diff.Int64() != int64(i)*1000 {
+				t.Fatalf("block %d difficulty %s", i, diff)
+			}
+			version, _ := store.ReadBlockSnapshotVersion(h)
+			if (i == 5 && version != 500) || (i != 5 && version != uint64(i)) {
+				t.Fatalf("block %d snapshot version %d", i, version)
+			}
+		}
+	}
+	check(store)
+
+	// index is rebuilt on reopen, a torn index record is discarded
+	store.Close()
+	index, _ := os.OpenFile(filepath.Join(dir, "index"), os.O_RDWR|os.O_APPEND, 0600)
+	index.Write([]byte{0x40, 0, 0, 0, 1, 2, 3})
+	index.Close()
+	if store, err = open_storepack(dir); err != nil {
+		t.Fatalf("cannot reopen store err %s", err)
+	}
+	check(store)
+
+	before := store.Size()
+	if err = store.Compact(); err != nil {
+		t.Fatalf("compaction failed err %s", err)
+	}
+	if store.Size() >= before {
+		t.Fatalf("compaction did not reclaim space, before %d after %d", before, store.Size())
+	}
+	check(store)
+	h, data := test_object(30, 100)
+	if err = store.WriteTX(h, data); err != nil {
+		t.Fatalf("cannot write after compaction err %s", err)
+	}
+	store.Close()
+
+	if store, err = open_storepack(dir); err != nil {
+		t.Fatalf("cannot reopen store err %s", err)
+	}
+	check(store)
+	store.Close()
+}
+
+// reads and writes done while compacting are not lost, failed swap leaves store usable
+func Test_StorePack_Compact_Concurrent(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "bltx_pack")
+	store, err := open_storepack(dir)
+	if err != nil {
+		t.Fatalf("cannot open store err %s", err)
+	}
+	defer store.Close()
+
+	for i := byte(1); i <= 100; i++ {
+		h, data := test_object(i, 4000)
+		store.WriteBlock(h, data, big.NewInt(1), 1, uint64(i))
+		if i > 50 {
+			store.DeleteBlock(h)
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := byte(101); i <= 200; i++ {
+			h, data := test_object(i, 100)
+			if err := store.WriteTX(h, data); err != nil {
+				t.Errorf("cannot write tx err %s", err)
+				return
+			}
+			old, olddata := test_object(i-100, 4000)
+			if block, err := store.ReadBlock(old); i <= 150 && (err != nil || !bytes.Equal(block, olddata)) {
+				t.Errorf("block %d could not be read while compacting err %v", i-100, err)
+				return
+			}
+		}
+	}()
+	if err = store.Compact(); err != nil {
+		t.Fatalf("compaction failed err %s", err)
+	}
+	wg.Wait()
+
+	for i := byte(101); i <= 200; i++ {
+		h, data := test_object(i, 100)
+		if tx, err := store.ReadTX(h); err != nil || !bytes.Equal(tx, data) {
+			t.Fatalf("tx %d written while compacting was lost err %v", i, err)
+		}
+	}
+
+	// original store cannot be moved away, compaction fails but store remains open
+	for i := byte(1); i <= 50; i++ {
+		h, _ := test_object(i, 0)
+		store.DeleteBlock(h)
+	}
+	os.MkdirAll(filepath.Join(dir+".old", "busy"), 0700)
+	if err = store.Compact(); err == nil {
+		t.Fatalf("compaction should fail")
+	}
+	h, data := test_object(201, 100)
+	if err = store.WriteTX(h, data); err != nil {
+		t.Fatalf("store not usable after failed compaction err %s", err)
+	}
+	if tx, err := store.ReadTX(h); err != nil || !bytes.Equal(tx, data) {
+		t.Fatalf("store not usable after failed compaction err %v", err)
+	}
+}
+
+// blocks and txs survive migration in both directions
+func Test_Migrate_Block_Store(t *testing.T) {
+	globals.Logger = logr.Discard()
+	globals.Arguments = map[string]interface{}{"--data-dir": t.TempDir()}
+	basedir := globals.GetDataDirectory()
+	os.MkdirAll(basedir, 0700)
+
+	fs, _ := new_block_store(BLOCK_STORE_FS, basedir)
+	for i := byte(1); i <= 10; i++ {
+		h, data := test_object(i, 200)
+		fs.WriteBlock(h, data, big.NewInt(int64(i)), uint64(i), uint64(i))
+		fs.WriteTX(h, data[:10])
+	}
+
+	for _, to := range []string{BLOCK_STORE_PACK, BLOCK_STORE_FS} {
+		if err := Migrate_Block_Store(to); err != nil {
+			t.Fatalf("migration to %s failed err %s", to, err)
+		}
+		if kind := detect_block_store(basedir); kind != to {
+			t.Fatalf("store is %s after migrating to %s", kind, to)
+		}
+		store, _ := open_block_store(basedir)
+		for i := byte(1); i <= 10; i++ {
+			h, data := test_object(i, 200)
+			block, err := store.ReadBlock(h)
+			tx, txerr := store.ReadTX(h)
+			height, _ := store.ReadBlockHeight(h)
+			if err != nil || txerr != nil || !bytes.Equal(block, data) || !bytes.Equal(tx, data[:10]) || height != uint64(i) {
+				t.Fatalf("object %d lost while migrating to %s", i, to)
+			}
+		}
+		store.Close()
+	}
+
+	if err := Migrate_Block_Store(BLOCK_STORE_FS); err == nil {
+		t.Fatalf("migration to same store must fail")
+	}
+}
+
+// new data directories use file per object store, pack store is only used if requested
+func Test_Block_Store_Default(t *testing.T) {
+	globals.Logger = logr.Discard()
+	globals.Arguments = map[string]interface{}{"--data-dir": t.TempDir()}
+	basedir := globals.GetDataDirectory()
+	os.MkdirAll(basedir, 0700)
+
+	store, err := open_block_store(basedir)
+	if err != nil {
+		t.Fatalf("block store could not be opened err %s", err)
+	}
+	if _, ok := store.(*storefs); !ok {
+		t.Fatalf("new data directory must use %s store", BLOCK_STORE_FS)
+	}
+	store.Close()
+
+	globals.Arguments["--block-store"] = BLOCK_STORE_PACK
+	packdir := filepath.Join(basedir, "pack")
+	os.MkdirAll(packdir, 0700)
+	if store, err = open_block_store(packdir); err != nil {
+		t.Fatalf("block store could not be opened err %s", err)
+	}
+	if _, ok := store.(*storepack); !ok {
+		t.Fatalf("requested %s store was not used", BLOCK_STORE_PACK)
+	}
+	store.Close()
+}
@@ -96,6 +96,30 @@ func (s *storetopofs) Write(index int64, blid [32]byte, state_version uint64, he
 	return err
 }
 
+// sets state version of all records from start till end(inclusive), used while pruning
+// records are rewritten in chunks, since there may be millions of them
+func (s *storetopofs) rewrite_versions(start, end int64, state_version uint64) error {
+	const chunk = 64 * 1024
+	buf := make([]byte, chunk*TOPORECORD_SIZE)
+	for i := start; i <= end; i += chunk {
+		count := end - i + 1
+		if count > chunk {
+			count = chunk
+		}
+		data := buf[:count*TOPORECORD_SIZE]
+		if _, err := s.topomapping.ReadAt(data, i*TOPORECORD_SIZE); err != nil {
+			return err
+		}
+		for j := int64(0); j < count; j++ {
+			binary.LittleEndian.PutUint64(data[j*TOPORECORD_SIZE+32:], state_version)
+		}
+		if _, err := s.topomapping.WriteAt(data, i*TOPORECORD_SIZE); err != nil {
+			return err
+		}
+	}
+	return s.topomapping.Sync()
+}
+
 func (s *storetopofs) Clean(index int64) (err error) {
 	var state_version uint64
 	var blid [32]byte
@@ -0,0 +1,61 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package blockchain
+
+import "testing"
+
+import "github.com/deroproject/derohe/blockchain/mempool"
+import "github.com/deroproject/derohe/cryptography/crypto"
+import "github.com/deroproject/derohe/rpc"
+import "github.com/deroproject/derohe/transaction"
+
+// priority txs must move ahead keeping fee order, excluded txs must be dropped and size limit capped at network limit
+func Test_Template_Policy(t *testing.T) {
+	hash := func(i byte) (h crypto.Hash) { h[0] = i; return }
+	var list []mempool.TX_Sorting_struct
+	for i := byte(1); i <= 5; i++ {
+		list = append(list, mempool.TX_Sorting_struct{Hash: hash(i), FeesPerByte: uint64(10 - i), Size: 1000})
+	}
+
+	scid := hash(0xff)
+	txs := map[crypto.Hash]*transaction.Transaction{}
+	txs[hash(2)] = &transaction.Transaction{TransactionType: transaction.NORMAL, Payloads: []transaction.AssetPayload{{SCID: scid}}}
+	txs[hash(3)] = &transaction.Transaction{TransactionType: transaction.SC_TX, SCDATA: rpc.Arguments{{Name: rpc.SCID, DataType: rpc.DataHash, Value: scid}}}
+	get_tx := func(h crypto.Hash) *transaction.Transaction { return txs[h] }
+
+	if result, size := apply_template_policy(nil, list, get_tx); len(result) != 5 || size != BLOCK_TX_CAPACITY {
+		t.Fatalf("default policy must keep list %v size %d", result, size)
+	}
+
+	policy := &Static_Template_Policy{PriorityTXIDs: []crypto.Hash{hash(5), hash(4)}, ExcludeTXIDs: []crypto.Hash{hash(1)}, ExcludeSCIDs: []crypto.Hash{scid}, MaxSize: 50000}
+	result, size := apply_template_policy(policy, list, get_tx)
+	if size != 50000 {
+		t.Fatalf("unexpected size limit %d", size)
+	}
+	if len(result) != 2 || result[0].Hash != hash(4) || result[1].Hash != hash(5) {
+		t.Fatalf("unexpected selection %v", result)
+	}
+
+	policy.MaxSize = 1 << 40
+	if _, size = apply_template_policy(policy, list, get_tx); size != BLOCK_TX_CAPACITY {
+		t.Fatalf("size limit cannot exceed network limit %d", size)
+	}
+
+	if policy.Exclude(hash(6), nil) || policy.Exclude(hash(6), &transaction.Transaction{TransactionType: transaction.NORMAL, Payloads: []transaction.AssetPayload{{}}}) {
+		t.Fatalf("unrelated txs must not be excluded")
+	}
+}
@@ -441,3 +441,109 @@ func Extract_signer(tx *transaction.Transaction) (signer [33]byte, err error) {
 
 	return signer, fmt.Errorf("unknown signer")
 }
+
+// executes all transactions, smart contracts and miner tx of a block over state of its parent
+// returns all changed trees, balance tree and sc meta tree are the last 2, nothing is committed
+// any error is reported as panic, same as rest of block processing
+func (chain *Blockchain) execute_block(bl_current *block.Block, ss *graviton.Snapshot) (data_trees []*graviton.Tree) {
+	var err error
+	var balance_tree, sc_meta *graviton.Tree
+	bl_current_hash := bl_current.GetHash()
+	current_topo_block := bl_current.Height
+
+	if balance_tree, err = ss.GetTree(config.BALANCE_TREE); err != nil {
+		panic(err)
+	}
+	if sc_meta, err = ss.GetTree(config.SC_META); err != nil {
+		panic(err)
+	}
+
+	fees_collected := uint64(0)
+
+	// side blocks only represent chain strenth , else they are are ignored
+	// this means they donot get any reward , 0 reward
+	// their transactions are ignored
+
+	//chain.Store.Topo_store.Write(i+base_topo_index, full_order[i],0, int64(bl_current.Height)) // write entry so as sideblock could work
+
+	{
+
+		sc_change_cache := map[crypto.Hash]*graviton.Tree{} // cache entire changes for entire block
+
+		// install hardcoded contracts
+		if err = chain.install_hardcoded_contracts(sc_change_cache, ss, balance_tree, sc_meta, bl_current.Height); err != nil {
+			panic(err)
+		}
+
+		for _, txhash := range bl_current.Tx_hashes { // execute all the transactions
+			if tx_bytes, err := chain.Store.Block_tx_store.ReadTX(txhash); err != nil {
+				panic(err)
+			} else {
+				var tx transaction.Transaction
+				if err = tx.Deserialize(tx_bytes); err != nil {
+					panic(err)
+				}
+				for t := range tx.Payloads {
+					if !tx.Payloads[t].SCID.IsZero() {
+						tree, _ := ss.GetTree(string(tx.Payloads[t].SCID[:]))
+						sc_change_cache[tx.Payloads[t].SCID] = tree
+					}
+				}
+				// we have loaded a tx successfully, now lets execute it
+				tx_fees := chain.process_transaction(sc_change_cache, tx, balance_tree, bl_current.Height)
+
+				//fmt.Printf("transaction %s type %s data %+v\n", txhash, tx.TransactionType, tx.SCDATA)
+				if tx.TransactionType == transaction.SC_TX {
+					tx_fees, err = chain.process_transaction_sc(sc_change_cache, ss, bl_current.Height, uint64(current_topo_block), bl_current.Timestamp/1000, bl_current_hash, tx, balance_tree, sc_meta)
+
+					//fmt.Printf("Processsing sc err %s\n", err)
+					if err == nil { // TODO process gasg here
+
+					}
+				}
+				fees_collected += tx_fees
+			}
+		}
+
+		// at this point, we must commit all the SCs, so entire tree hash is interlinked
+		for scid, v := range sc_change_cache {
+			meta_bytes, err := sc_meta.Get(dvm.SC_Meta_Key(scid))
+			if err != nil {
+				panic(err)
+			}
+
+			var meta dvm.SC_META_DATA // the meta contains metadata about SC
+
+			if bl_current.Height < uint64(globals.Config.HF2_HEIGHT) {
+				if err := meta.UnmarshalBinary(meta_bytes); err != nil {
+					panic(err)
+				}
+				if meta.DataHash, err = v.Hash(); err != nil { // encode data tree hash
+					panic(err)
+				}
+				sc_meta.Put(dvm.SC_Meta_Key(scid), meta.MarshalBinary())
+			} else {
+				if err := meta.UnmarshalBinaryGood(meta_bytes); err != nil {
+					panic(err)
+				}
+				if meta.DataHash, err = v.Hash(); err != nil { // encode data tree hash
+					panic(err)
+				}
+				sc_meta.Put(dvm.SC_Meta_Key(scid), meta.MarshalBinaryGood())
+			}
+			data_trees = append(data_trees, v)
+
+			/*fmt.Printf("will commit tree name %x \n", v.GetName())
+							c := v.Cursor()
+				for k, v, err := c.First(); err == nil; k, v, err = c.Next() {
+				fmt.Printf("key=%x, value=%x\n", k, v)
+			}*/
+
+		}
+
+		chain.process_miner_transaction(bl_current, bl_current.Height == 0, balance_tree, fees_collected, bl_current.Height)
+	}
+
+	data_trees = append(data_trees, balance_tree, sc_meta)
+	return data_trees
+}
@@ -0,0 +1,244 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package blockchain
+
+// offline chain verifier, every topoheight is checked independently so the work is spread over all cores
+// checks are the same as done while adding a block, state is recomputed from parent state without committing
+
+import "fmt"
+import "sort"
+import "sync"
+import "runtime"
+import "sync/atomic"
+import "runtime/debug"
+
+import "github.com/deroproject/derohe/block"
+import "github.com/deroproject/derohe/astrobwt/astrobwtv3"
+import "github.com/deroproject/derohe/cryptography/crypto"
+import "github.com/deroproject/derohe/transaction"
+
+// checks done by verifier, reported in errors
+const (
+	VERIFY_TOPO       = "topo"       // topo record and block are consistent
+	VERIFY_DAG        = "dag"        // tips exist and follow dag rules
+	VERIFY_MINIBLOCKS = "miniblocks" // miniblock consensus rules
+	VERIFY_POW        = "pow"        // PoW of every miniblock
+	VERIFY_TX         = "tx"         // coinbase and tx proofs
+	VERIFY_STATE      = "state"      // recomputed state root matches stored version
+)
+
+// a failed check at a topoheight
+type VerifyError struct {
+	Topo  int64
+	BLID  crypto.Hash
+	Check string
+	Err   error
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("topoheight %d block %s %s check failed: %s", e.Topo, e.BLID, e.Check, e.Err)
+}
+
+type VerifyResult struct {
+	From, To int64
+	Verified int64          // topoheights verified successfully
+	First    *VerifyError   // first divergence, nil if entire range is good
+	Errors   []*VerifyError // all errors found, sorted by topoheight, topoheights after first divergence may not be verified
+}
+
+// verifies all topoheights from till to(inclusive) using workers goroutines, progress is called regularly
+func (chain *Blockchain) Verify_Chain(from, to int64, workers int, progress func(verified, total int64)) (result VerifyResult, err error) {
+	if to < 0 || to > chain.Load_TOPO_HEIGHT() {
+		to = chain.Load_TOPO_HEIGHT()
+	}
+	if pruned := chain.LocatePruneTopo(); pruned != 0 && from <= pruned {
+		from = pruned + 1 // history before pruned topoheight is not available
+	}
+	if from < 0 || from > to {
+		return result, fmt.Errorf("invalid range from %d to %d", from, to)
+	}
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	result.From, result.To = from, to
+
+	var verified, done int64
+	first_failure := int64(to + 1) // topoheights after a divergence are not checked
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+
+	topos := make(chan int64, workers*4)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for topo := range topos {
+				if topo < atomic.LoadInt64(&first_failure) {
+					chain.Prune_Mutex.RLock()
+					verr := chain.verify_topo(topo)
+					chain.Prune_Mutex.RUnlock()
+					if verr != nil {
+						lock.Lock()
+						result.Errors = append(result.Errors, verr)
+						for {
+							current := atomic.LoadInt64(&first_failure)
+							if topo >= current || atomic.CompareAndSwapInt64(&first_failure, current, topo) {
+								break
+							}
+						}
+						lock.Unlock()
+					} else {
+						atomic.AddInt64(&verified, 1)
+					}
+				}
+				if d := atomic.AddInt64(&done, 1); progress != nil && d%1000 == 0 {
+					progress(d, to-from+1)
+				}
+			}
+		}()
+	}
+
+	for topo := from; topo <= to && topo < atomic.LoadInt64(&first_failure); topo++ {
+		topos <- topo
+	}
+	close(topos)
+	wg.Wait()
+
+	sort.Slice(result.Errors, func(i, j int) bool { return result.Errors[i].Topo < result.Errors[j].Topo })
+	if len(result.Errors) > 0 {
+		result.First = result.Errors[0]
+	}
+	result.Verified = verified
+	return result, nil
+}
+
+// verifies a single topoheight
+func (chain *Blockchain) verify_topo(topo int64) (verr *VerifyError) {
+	var record TopoRecord
+	fail := func(check string, err error) *VerifyError {
+		return &VerifyError{Topo: topo, BLID: record.BLOCK_ID, Check: check, Err: err}
+	}
+	defer func() { // any panic while executing block is also a failure
+		if r := recover(); r != nil {
+			verr = fail(VERIFY_STATE, fmt.Errorf("panic %v stack %s", r, debug.Stack()))
+		}
+	}()
+
+	record, err := chain.Store.Topo_store.Read(topo)
+	if err != nil {
+		return fail(VERIFY_TOPO, err)
+	}
+	if record.IsClean() {
+		return fail(VERIFY_TOPO, fmt.Errorf("topo record is empty"))
+	}
+	bl, err := chain.Load_BL_FROM_ID(record.BLOCK_ID)
+	if err != nil {
+		return fail(VERIFY_TOPO, err)
+	}
+	if int64(bl.Height) != record.Height {
+		return fail(VERIFY_TOPO, fmt.Errorf("block height %d topo record height %d", bl.Height, record.Height))
+	}
+	if version, err := chain.ReadBlockSnapshotVersion(record.BLOCK_ID); err != nil || version != record.State_Version {
+		return fail(VERIFY_TOPO, fmt.Errorf("block state version %d topo record version %d err %v", version, record.State_Version, err))
+	}
+
+	cbl := &block.Complete_Block{Bl: bl}
+	for _, txhash := range bl.Tx_hashes {
+		var tx transaction.Transaction
+		if tx_bytes, err := chain.Store.Block_tx_store.ReadTX(txhash); err != nil {
+			return fail(VERIFY_TX, fmt.Errorf("cannot read tx %s err %s", txhash, err))
+		} else if err = tx.Deserialize(tx_bytes); err != nil {
+			return fail(VERIFY_TX, fmt.Errorf("cannot deserialize tx %s err %s", txhash, err))
+		} else if tx.GetHash() != txhash {
+			return fail(VERIFY_TX, fmt.Errorf("tx %s is stored with wrong hash", txhash))
+		}
+		cbl.Txs = append(cbl.Txs, &tx)
+	}
+
+	if bl.Height != 0 {
+		for _, tip := range bl.Tips {
+			if !chain.Block_Exists(tip) {
+				return fail(VERIFY_DAG, fmt.Errorf("tip %s is missing", tip))
+			}
+		}
+		if bl.Height >= 2 && !chain.CheckDagStructure(bl.Tips) {
+			return fail(VERIFY_DAG, fmt.Errorf("tips do not follow dag structure"))
+		}
+	}
+
+	if !chain.simulator {
+		if err = Verify_MiniBlocks(*bl); err != nil {
+			return fail(VERIFY_MINIBLOCKS, err)
+		}
+		if bl.Height != 0 {
+			if err = chain.Verify_MiniBlocks_HashCheck(cbl); err != nil {
+				return fail(VERIFY_MINIBLOCKS, err)
+			}
+		}
+		scratch := astrobwtv3.Pool.Get().(*astrobwtv3.ScratchData)
+		defer astrobwtv3.Pool.Put(scratch)
+		for i, mbl := range bl.MiniBlocks {
+			if !chain.VerifyMiniblockPoWWithScratch(bl, mbl, scratch) {
+				return fail(VERIFY_POW, fmt.Errorf("miniblock %d has invalid PoW", i))
+			}
+		}
+	}
+
+	if bl.Height != 0 {
+		if err = chain.Verify_Transaction_Coinbase(cbl, &bl.Miner_TX); err != nil {
+			return fail(VERIFY_TX, err)
+		}
+	}
+	for _, tx := range cbl.Txs {
+		if err = chain.Verify_Transaction_NonCoinbase(tx); err != nil {
+			return fail(VERIFY_TX, fmt.Errorf("tx %s err %s", tx.GetHash(), err))
+		}
+	}
+
+	if bl.Height == 0 { // genesis state has no parent to recompute from
+		return nil
+	}
+	parent_version, err := chain.ReadBlockSnapshotVersion(bl.Tips[0])
+	if err != nil {
+		return fail(VERIFY_STATE, err)
+	}
+	ss, err := chain.Store.Balance_store.LoadSnapshot(parent_version)
+	if err != nil {
+		return fail(VERIFY_STATE, err)
+	}
+	data_trees := chain.execute_block(bl, ss)
+	balance_hash, err := data_trees[len(data_trees)-2].Hash()
+	if err != nil {
+		return fail(VERIFY_STATE, err)
+	}
+	meta_hash, err := data_trees[len(data_trees)-1].Hash()
+	if err != nil {
+		return fail(VERIFY_STATE, err)
+	}
+	var computed crypto.Hash
+	for i := range computed {
+		computed[i] = balance_hash[i] ^ meta_hash[i]
+	}
+	stored, err := chain.Load_Merkle_Hash(record.State_Version)
+	if err != nil {
+		return fail(VERIFY_STATE, err)
+	}
+	if computed != stored {
+		return fail(VERIFY_STATE, fmt.Errorf("recomputed state %s stored version %d state %s", computed, record.State_Version, stored))
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import "os"
+import "fmt"
+import "sort"
+import "strconv"
+import "strings"
+import "path/filepath"
+
+// thread affinity layouts, benchmark decides which one suits a machine
+const AFFINITY_NONE = "none"             // threads are scheduled by OS
+const AFFINITY_SEQUENTIAL = "sequential" // thread i runs on cpu i
+const AFFINITY_AVOID_HT = "avoid-ht"     // threads fill one cpu of every core first, so that hyperthread siblings are used last
+
+var affinity_layouts = []string{AFFINITY_NONE, AFFINITY_SEQUENTIAL, AFFINITY_AVOID_HT}
+var affinity_layout = AFFINITY_AVOID_HT
+
+// hyperthread siblings of every core as read by read_topology, nil if unknown
+var cpu_siblings [][]int
+
+func parse_affinity(layout string) (string, error) {
+	for _, l := range affinity_layouts {
+		if l == layout {
+			return layout, nil
+		}
+	}
+	return "", fmt.Errorf("unknown affinity layout %q, possible values %v", layout, affinity_layouts)
+}
+
+// cpu on which i'th of count threads should run, -1 if thread should not be pinned
+func affinity_cpu(layout string, i int, count int) int {
+	if i < 0 || i >= count {
+		return -1
+	}
+	switch layout {
+	case AFFINITY_SEQUENTIAL:
+		return i
+	case AFFINITY_AVOID_HT:
+		return avoid_ht_order(cpu_siblings, count)[i]
+	}
+	return -1
+}
+
+// order in which avoid-ht uses cpus below count, first cpu of every core, then second cpu of every core and so on
+// cpus missing from topology, or all of them if topology is unknown, follow assuming adjacent cpus are siblings
+func avoid_ht_order(siblings [][]int, count int) (order []int) {
+	used := map[int]bool{}
+	for round, more := 0, true; more; round++ {
+		more = false
+		for _, core := range siblings {
+			if round >= len(core) {
+				continue
+			}
+			more = true
+			if cpu := core[round]; cpu < count && !used[cpu] {
+				used[cpu] = true
+				order = append(order, cpu)
+			}
+		}
+	}
+	for _, first := range []int{0, 1} {
+		for cpu := first; cpu < count; cpu += 2 {
+			if !used[cpu] {
+				order = append(order, cpu)
+			}
+		}
+	}
+	return
+}
+
+// read hyperthread siblings from /sys/devices/system/cpu/cpu*/topology/thread_siblings_list, only linux provides it
+// cores are sorted by their first cpu
+func read_topology() (siblings [][]int) {
+	files, _ := filepath.Glob("/sys/devices/system/cpu/cpu[0-9]*/topology/thread_siblings_list")
+	seen := map[string]bool{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		list := strings.TrimSpace(string(data))
+		if seen[list] { // every sibling of a core reports same list
+			continue
+		}
+		seen[list] = true
+		if cpus, err := parse_cpu_list(list); err == nil && len(cpus) > 0 {
+			siblings = append(siblings, cpus)
+		}
+	}
+	sort.Slice(siblings, func(i, j int) bool { return siblings[i][0] < siblings[j][0] })
+	return
+}
+
+// parse kernel cpu list such as "0,4" or "0-1,8-9"
+func parse_cpu_list(list string) (cpus []int, err error) {
+	for _, part := range strings.Split(list, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpu list %q", list)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+				return nil, fmt.Errorf("invalid cpu list %q", list)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	sort.Ints(cpus)
+	return
+}
+
+// topology for reports, such as "2 cores, 4 cpus, siblings 0,2 1,3"
+func describe_topology(siblings [][]int) string {
+	if len(siblings) == 0 {
+		return "unknown, avoid-ht assumes adjacent cpus are siblings"
+	}
+	cpus := 0
+	var cores []string
+	for _, core := range siblings {
+		cpus += len(core)
+		list := make([]string, len(core))
+		for i, cpu := range core {
+			list[i] = strconv.Itoa(cpu)
+		}
+		cores = append(cores, strings.Join(list, ","))
+	}
+	return fmt.Sprintf("%d cores, %d cpus, siblings %s", len(siblings), cpus, strings.Join(cores, " "))
+}
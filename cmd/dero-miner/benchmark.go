@@ -0,0 +1,231 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+// this file implements --bench, which measures AstroBWTv3 hashrate of this machine
+// thread counts, affinity layouts and garbage collector settings are tried one after another
+// GOGC is the only memory allocator setting tuned, go runtime has no other allocator knobs, huge pages are only reported
+// best combination is printed and optionally written as a config file for --config
+
+import "os"
+import "fmt"
+import "sync"
+import "time"
+import "bufio"
+import "strings"
+import "strconv"
+import "runtime"
+import "crypto/rand"
+import "sync/atomic"
+import "runtime/debug"
+
+import "github.com/deroproject/derohe/block"
+import "github.com/deroproject/derohe/astrobwt/astrobwtv3"
+
+const BENCH_TIME = 5 // seconds per measurement
+
+var bench_gogc = []int{100, 200, 400}
+
+type bench_result struct {
+	threads  int
+	affinity string
+	gogc     int
+	hashrate float64
+}
+
+type hugepage_info struct {
+	transparent string // mode of transparent huge pages, empty if unknown
+	total       uint64 // reserved huge pages
+	free        uint64
+	size        string
+}
+
+// measure hashrate of threads hashing for duration
+func bench_run(threads int, layout string, gogc int, duration time.Duration) float64 {
+	old := debug.SetGCPercent(gogc)
+	defer debug.SetGCPercent(old)
+	runtime.GC()
+
+	var total uint64
+	var wg sync.WaitGroup
+	start := time.Now()
+	deadline := start.Add(duration)
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			runtime.LockOSThread() // never unlocked, so thread with changed affinity exits with goroutine
+			pin_thread(affinity_cpu(layout, i, runtime.GOMAXPROCS(0)))
+
+			var work [block.MINIBLOCK_SIZE]byte
+			rand.Read(work[:])
+			scratch := astrobwtv3.NewScratchData()
+			hashes := make([][32]byte, batch_size)
+			for nonce := uint32(0); time.Now().Before(deadline); nonce += uint32(len(hashes)) {
+				astrobwtv3.AstroBWTv3Nonces(work[:], block.MINIBLOCK_SIZE-5, nonce, scratch, hashes)
+				atomic.AddUint64(&total, uint64(len(hashes)))
+			}
+		}(i)
+	}
+	wg.Wait()
+	return float64(total) / time.Since(start).Seconds()
+}
+
+// thread counts worth trying on a machine with cpus
+func bench_thread_counts(cpus int) (counts []int) {
+	seen := map[int]bool{}
+	for _, count := range []int{1, cpus / 4, cpus / 2, (cpus * 3) / 4, cpus - 1, cpus} {
+		if count >= 1 && !seen[count] {
+			seen[count] = true
+			counts = append(counts, count)
+		}
+	}
+	for i := 1; i < len(counts); i++ { // keep ascending order
+		for j := i; j > 0 && counts[j] < counts[j-1]; j-- {
+			counts[j], counts[j-1] = counts[j-1], counts[j]
+		}
+	}
+	return
+}
+
+// best result, fewer threads are preferred when hashrate is within 1%
+func bench_best(results []bench_result) (best bench_result) {
+	for _, r := range results {
+		switch {
+		case best.hashrate == 0:
+			best = r
+		case r.hashrate > best.hashrate*1.01:
+			best = r
+		case r.hashrate >= best.hashrate*0.99 && r.threads < best.threads:
+			best = r
+		}
+	}
+	return
+}
+
+func parse_thp(content string) string {
+	if i := strings.Index(content, "["); i >= 0 {
+		if j := strings.Index(content[i:], "]"); j > 0 {
+			return content[i+1 : i+j]
+		}
+	}
+	return strings.TrimSpace(content)
+}
+
+func parse_meminfo(content string, info *hugepage_info) {
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "HugePages_Total:":
+			info.total, _ = strconv.ParseUint(fields[1], 10, 64)
+		case "HugePages_Free:":
+			info.free, _ = strconv.ParseUint(fields[1], 10, 64)
+		case "Hugepagesize:":
+			info.size = strings.Join(fields[1:], " ")
+		}
+	}
+}
+
+// huge pages reduce TLB misses on scratch memory, go runtime uses transparent huge pages when enabled
+func read_hugepages() (info hugepage_info) {
+	if data, err := os.ReadFile("/sys/kernel/mm/transparent_hugepage/enabled"); err == nil {
+		info.transparent = parse_thp(string(data))
+	}
+	if data, err := os.ReadFile("/proc/meminfo"); err == nil {
+		parse_meminfo(string(data), &info)
+	}
+	return
+}
+
+func format_hashrate(hashrate float64) string {
+	switch {
+	case hashrate > 1000000:
+		return fmt.Sprintf("%.3f MH/s", hashrate/1000000.0)
+	case hashrate > 1000:
+		return fmt.Sprintf("%.3f KH/s", hashrate/1000.0)
+	}
+	return fmt.Sprintf("%.1f H/s", hashrate)
+}
+
+// run benchmark suite and print tuning report, report is also written to config_file if provided
+func benchmark(duration time.Duration, config_file string) error {
+	cpus := runtime.GOMAXPROCS(0)
+	hugepages := read_hugepages()
+
+	fmt.Printf("Host: %s GOMAXPROCS %d\n", host_description(), cpus)
+	fmt.Printf("CPU topology: %s\n", describe_topology(cpu_siblings))
+	if hugepages.transparent == "" {
+		fmt.Printf("Transparent huge pages: unknown\n")
+	} else {
+		fmt.Printf("Transparent huge pages: %s\n", hugepages.transparent)
+	}
+	if hugepages.size != "" {
+		fmt.Printf("Reserved huge pages: %d free %d size %s\n", hugepages.total, hugepages.free, hugepages.size)
+	}
+	fmt.Printf("Memory allocator: only GOGC is tuned, go runtime has no other allocator settings\n")
+	fmt.Printf("Each measurement takes %s\n\n", duration)
+
+	fmt.Printf("%10s %12s %8s %20s %20s\n", "Threads", "Affinity", "GOGC", "Hash Rate", "Per Thread")
+	var results []bench_result
+	measure := func(threads int, layout string, gogc int) bench_result {
+		r := bench_result{threads: threads, affinity: layout, gogc: gogc, hashrate: bench_run(threads, layout, gogc, duration)}
+		fmt.Printf("%10d %12s %8d %20s %20s\n", r.threads, r.affinity, r.gogc, format_hashrate(r.hashrate), format_hashrate(r.hashrate/float64(r.threads)))
+		results = append(results, r)
+		return r
+	}
+
+	// thread count is most important, then layout and finally garbage collector
+	var stage []bench_result
+	for _, count := range bench_thread_counts(cpus) {
+		stage = append(stage, measure(count, AFFINITY_AVOID_HT, bench_gogc[0]))
+	}
+	best := bench_best(stage)
+
+	stage = []bench_result{best}
+	for _, layout := range affinity_layouts {
+		if layout != best.affinity {
+			stage = append(stage, measure(best.threads, layout, best.gogc))
+		}
+	}
+	best = bench_best(stage)
+
+	stage = []bench_result{best}
+	for _, gogc := range bench_gogc {
+		if gogc != best.gogc {
+			stage = append(stage, measure(best.threads, best.affinity, gogc))
+		}
+	}
+	best = bench_best(stage)
+
+	fmt.Printf("\nRecommended: --mining-threads=%d --affinity=%s --gogc=%d (%s)\n", best.threads, best.affinity, best.gogc, format_hashrate(best.hashrate))
+	if hugepages.transparent == "never" {
+		fmt.Printf("Enabling transparent huge pages (madvise or always) may improve hashrate\n")
+	}
+
+	if config_file != "" {
+		config := Miner_Config{Threads: best.threads, Affinity: best.affinity, GOGC: best.gogc, Hashrate: best.hashrate, Host: host_description()}
+		if err := config.save(config_file); err != nil {
+			return err
+		}
+		fmt.Printf("Config written to %s, use it with --config=%s\n", config_file, config_file)
+	}
+	return nil
+}
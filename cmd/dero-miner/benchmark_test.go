@@ -0,0 +1,137 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import "testing"
+import "path/filepath"
+
+func Test_Affinity_CPU(t *testing.T) {
+	for _, count := range []int{1, 2, 3, 4, 7, 8} {
+		for _, layout := range []string{AFFINITY_SEQUENTIAL, AFFINITY_AVOID_HT} {
+			used := map[int]bool{}
+			for i := 0; i < count; i++ {
+				cpu := affinity_cpu(layout, i, count)
+				if cpu < 0 || cpu >= count || used[cpu] {
+					t.Fatalf("layout %s count %d thread %d invalid cpu %d", layout, count, i, cpu)
+				}
+				used[cpu] = true
+			}
+		}
+	}
+	if affinity_cpu(AFFINITY_AVOID_HT, 1, 8) != 2 || affinity_cpu(AFFINITY_AVOID_HT, 4, 8) != 1 {
+		t.Fatalf("avoid-ht should fill even cpus first")
+	}
+	if affinity_cpu(AFFINITY_NONE, 0, 8) != -1 || affinity_cpu(AFFINITY_SEQUENTIAL, 8, 8) != -1 {
+		t.Fatalf("thread should not be pinned")
+	}
+}
+
+// avoid-ht must use one cpu of every core first, siblings as reported by kernel
+func Test_Avoid_HT_Topology(t *testing.T) {
+	if cpus, err := parse_cpu_list("0-1,8-9"); err != nil || len(cpus) != 4 || cpus[2] != 8 {
+		t.Fatalf("cpu list not parsed %v %v", cpus, err)
+	}
+	for _, list := range []string{"", "a", "3-1", "1,"} {
+		if _, err := parse_cpu_list(list); err == nil {
+			t.Fatalf("cpu list %q must be rejected", list)
+		}
+	}
+
+	siblings := [][]int{{0, 4}, {1, 5}, {2, 6}, {3, 7}} // linux enumerates siblings of all cores last
+	order := avoid_ht_order(siblings, 8)
+	for i, cpu := range []int{0, 1, 2, 3, 4, 5, 6, 7} {
+		if order[i] != cpu {
+			t.Fatalf("unexpected order %v", order)
+		}
+	}
+
+	// cpus beyond count are skipped, cpus missing from topology come last
+	if order = avoid_ht_order([][]int{{0, 4}, {1, 5}}, 4); len(order) != 4 || order[0] != 0 || order[1] != 1 || order[2] != 2 || order[3] != 3 {
+		t.Fatalf("unexpected order %v", order)
+	}
+
+	defer func(old [][]int) { cpu_siblings = old }(cpu_siblings)
+	cpu_siblings = siblings
+	if affinity_cpu(AFFINITY_AVOID_HT, 4, 8) != 4 {
+		t.Fatalf("avoid-ht must follow topology")
+	}
+	if describe_topology(siblings) != "4 cores, 8 cpus, siblings 0,4 1,5 2,6 3,7" {
+		t.Fatalf("unexpected description %s", describe_topology(siblings))
+	}
+}
+
+func Test_Parse_Affinity(t *testing.T) {
+	if layout, err := parse_affinity("sequential"); err != nil || layout != AFFINITY_SEQUENTIAL {
+		t.Fatalf("parse affinity failed err %v", err)
+	}
+	if _, err := parse_affinity("random"); err == nil {
+		t.Fatalf("unknown affinity must be rejected")
+	}
+}
+
+func Test_Config(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "miner.json")
+	config := Miner_Config{Threads: 6, Affinity: AFFINITY_SEQUENTIAL, GOGC: 200, Hashrate: 1234.5, Host: "test"}
+	if err := config.save(filename); err != nil {
+		t.Fatalf("save failed err %s", err)
+	}
+	loaded, err := load_config(filename)
+	if err != nil {
+		t.Fatalf("load failed err %s", err)
+	}
+	if loaded != config {
+		t.Fatalf("config mismatch expected %+v actual %+v", config, loaded)
+	}
+
+	config.Affinity = "random"
+	config.save(filename)
+	if _, err = load_config(filename); err == nil {
+		t.Fatalf("invalid affinity must be rejected")
+	}
+}
+
+func Test_Bench_Helpers(t *testing.T) {
+	counts := bench_thread_counts(8)
+	expected := []int{1, 2, 4, 6, 7, 8}
+	if len(counts) != len(expected) {
+		t.Fatalf("thread counts expected %v actual %v", expected, counts)
+	}
+	for i := range counts {
+		if counts[i] != expected[i] {
+			t.Fatalf("thread counts expected %v actual %v", expected, counts)
+		}
+	}
+	if counts := bench_thread_counts(1); len(counts) != 1 || counts[0] != 1 {
+		t.Fatalf("thread counts %v", counts)
+	}
+
+	best := bench_best([]bench_result{{threads: 8, hashrate: 1000}, {threads: 6, hashrate: 995}, {threads: 4, hashrate: 800}})
+	if best.threads != 6 {
+		t.Fatalf("expected 6 threads within 1%% of best, actual %+v", best)
+	}
+}
+
+func Test_Hugepages(t *testing.T) {
+	if mode := parse_thp("always [madvise] never\n"); mode != "madvise" {
+		t.Fatalf("unexpected thp mode %q", mode)
+	}
+	var info hugepage_info
+	parse_meminfo("MemTotal:       16318032 kB\nHugePages_Total:      16\nHugePages_Free:       12\nHugepagesize:       2048 kB\n", &info)
+	if info.total != 16 || info.free != 12 || info.size != "2048 kB" {
+		t.Fatalf("unexpected hugepage info %+v", info)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+// tuning parameters can be loaded from a json file using --config, benchmark can write one with --write-config
+// command line options override values from config file
+
+import "os"
+import "fmt"
+import "runtime"
+import "encoding/json"
+import "runtime/debug"
+
+type Miner_Config struct {
+	Threads  int     `json:"mining_threads"`     // 0 means number of cpus
+	Affinity string  `json:"affinity"`           // none, sequential or avoid-ht
+	GOGC     int     `json:"gogc"`               // garbage collector target percentage, 0 means go default
+	Hashrate float64 `json:"hashrate,omitempty"` // measured by benchmark, only informational
+	Host     string  `json:"host,omitempty"`     // machine on which benchmark ran, only informational
+}
+
+func load_config(filename string) (config Miner_Config, err error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("config file %s could not be parsed err: %s", filename, err)
+	}
+	if config.Affinity != "" {
+		if _, err = parse_affinity(config.Affinity); err != nil {
+			return
+		}
+	}
+	if config.Threads < 0 || config.GOGC < 0 {
+		return config, fmt.Errorf("config file %s has negative values", filename)
+	}
+	return
+}
+
+func (config Miner_Config) save(filename string) error {
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0644)
+}
+
+// apply tuning, zero values keep current settings
+func (config Miner_Config) apply() {
+	if config.Threads > 0 {
+		threads = config.Threads
+	}
+	if config.Affinity != "" {
+		affinity_layout = config.Affinity
+	}
+	if config.GOGC > 0 {
+		debug.SetGCPercent(config.GOGC)
+	}
+}
+
+func host_description() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s %s/%s %d cpus", hostname, runtime.GOOS, runtime.GOARCH, runtime.NumCPU())
+}
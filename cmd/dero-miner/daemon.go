@@ -0,0 +1,208 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+// this file manages connection to daemons
+// daemons are tried in priority order, miner falls back to next daemon on failure and switches back once a better daemon is reachable
+// connection is considered stale if no job arrives for a while, so that miner does not waste hashes on old work
+
+import "net"
+import "time"
+import "strings"
+import "net/url"
+import "crypto/tls"
+import "sync/atomic"
+
+import "github.com/deroproject/derohe/globals"
+import "github.com/deroproject/derohe/rpc"
+
+import "github.com/gorilla/websocket"
+
+const BACKOFF_MIN = time.Second          // first retry delay once all daemons have failed
+const BACKOFF_MAX = 60 * time.Second     // retry delay never exceeds this
+const SWITCH_BACK_INTERVAL = time.Minute // how often higher priority daemons are probed
+const JOB_TIMEOUT = 30                   // seconds without job after which connection is stale
+
+var daemons []string        // in priority order
+var daemon_index int32 = -1 // currently connected daemon, -1 if none
+var job_timeout = JOB_TIMEOUT * time.Second
+var job_time int64 // unix nano time of last job
+var reconnects uint64
+
+// parse comma separated list of daemons, duplicates are removed
+func parse_daemons(list string) (result []string) {
+	seen := map[string]bool{}
+	for _, daemon := range strings.Split(list, ",") {
+		daemon = strings.TrimSpace(daemon)
+		if daemon == "" || seen[daemon] {
+			continue
+		}
+		seen[daemon] = true
+		result = append(result, daemon)
+	}
+	return
+}
+
+// exponential backoff, jitter is in range [0,1) and spreads retries between half and full delay
+func backoff(attempt int, jitter float64) time.Duration {
+	delay := BACKOFF_MAX
+	if attempt < 16 && BACKOFF_MIN<<uint(attempt) < BACKOFF_MAX {
+		delay = BACKOFF_MIN << uint(attempt)
+	}
+	return delay/2 + time.Duration(jitter*float64(delay/2))
+}
+
+// whether current job is too old to be mined
+func job_stale() bool {
+	last := atomic.LoadInt64(&job_time)
+	return last == 0 || time.Since(time.Unix(0, last)) > job_timeout
+}
+
+// counters are maintained per connection by daemon, so only their increase is accumulated
+func counter_delta(current, previous uint64) uint64 {
+	if current >= previous {
+		return current - previous
+	}
+	return current
+}
+
+func dial_daemon(daemon string, wallet_address string) (*websocket.Conn, error) {
+	u := url.URL{Scheme: "wss", Host: daemon, Path: "/ws/" + wallet_address}
+	logger.V(1).Info("connecting to ", "url", u.String())
+
+	dialer := websocket.Dialer{Proxy: websocket.DefaultDialer.Proxy, HandshakeTimeout: 10 * time.Second, TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	conn, _, err := dialer.Dial(u.String(), nil)
+	return conn, err
+}
+
+// continuously get work
+func getwork(wallet_address string) {
+	attempt := 0
+	for {
+		jobs := 0
+		for i := range daemons {
+			conn, err := dial_daemon(daemons[i], wallet_address)
+			if err != nil {
+				logger.Error(err, "Error connecting to server", "server adress", daemons[i])
+				continue
+			}
+			logger.Info("connected to daemon", "server adress", daemons[i], "priority", i)
+			jobs = read_jobs(conn, i)
+			atomic.AddUint64(&reconnects, 1)
+			break // start again from highest priority daemon
+		}
+
+		if jobs > 0 { // connection was working, reconnect immediately
+			attempt = 0
+			continue
+		}
+
+		delay := backoff(attempt, globals.Global_Random.Float64())
+		attempt++
+		logger.Info("Will try again", "delay", delay.String())
+		time.Sleep(delay)
+	}
+}
+
+// read jobs from a connected daemon till connection fails, becomes stale or a better daemon is available
+func read_jobs(conn *websocket.Conn, index int) (jobs int) {
+	connection_mutex.Lock()
+	connection = conn
+	connection_mutex.Unlock()
+	atomic.StoreInt32(&daemon_index, int32(index))
+
+	done := make(chan struct{})
+	var switching int32
+	defer func() {
+		close(done)
+		atomic.StoreInt32(&daemon_index, -1)
+		connection_mutex.Lock()
+		connection = nil
+		connection_mutex.Unlock()
+		conn.Close()
+	}()
+
+	if index > 0 {
+		go func() {
+			ticker := time.NewTicker(SWITCH_BACK_INTERVAL)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+				}
+				for i := 0; i < index; i++ {
+					if probe, err := dial_daemon(daemons[i], wallet_address); err == nil {
+						probe.Close()
+						logger.Info("switching back to daemon", "server adress", daemons[i], "priority", i)
+						atomic.StoreInt32(&switching, 1)
+						conn.Close() // reader will return
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	var last rpc.GetBlockTemplate_Result
+	for {
+		var result rpc.GetBlockTemplate_Result
+		conn.SetReadDeadline(time.Now().Add(job_timeout))
+		if err := conn.ReadJSON(&result); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				logger.Error(nil, "job is stale, reconnecting", "server adress", daemons[index], "timeout", job_timeout.String())
+			} else if atomic.LoadInt32(&switching) == 0 {
+				logger.Error(err, "connection error", "server adress", daemons[index])
+			}
+			return
+		}
+		jobs++
+
+		mutex.Lock()
+		job = result
+		job_counter++
+		mutex.Unlock()
+		atomic.StoreInt64(&job_time, time.Now().UnixNano())
+		if result.LastError != "" {
+			logger.Error(nil, "received error", "err", result.LastError)
+		}
+
+		atomic.AddUint64(&block_counter, counter_delta(result.Blocks, last.Blocks))
+		atomic.AddUint64(&mini_block_counter, counter_delta(result.MiniBlocks, last.MiniBlocks)) // note if the miner submits the job late, though his counter
+		// will increase, but a block has been already found, so
+		// orphan miniblocks may be there ( means they will not br rewarded)
+		atomic.AddUint64(&rejected, counter_delta(result.Rejected, last.Rejected))
+		last = result
+
+		hash_rate = result.Difficultyuint64
+		our_height = int64(result.Height)
+		Difficulty = result.Difficultyuint64
+
+		//fmt.Printf("recv: %+v diff %d\n", result, Difficulty)
+	}
+}
+
+// submit work to connected daemon, work is dropped if no daemon is connected
+func submit_work(params rpc.SubmitBlock_Params) {
+	defer globals.Recover(1)
+	connection_mutex.Lock()
+	defer connection_mutex.Unlock()
+	if connection != nil {
+		connection.WriteJSON(params)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import "time"
+import "testing"
+
+func Test_Parse_Daemons(t *testing.T) {
+	list := parse_daemons(" 127.0.0.1:10100, minernode1.dero.live:10100,,127.0.0.1:10100 ")
+	if len(list) != 2 || list[0] != "127.0.0.1:10100" || list[1] != "minernode1.dero.live:10100" {
+		t.Fatalf("unexpected daemons %v", list)
+	}
+	if list := parse_daemons(""); len(list) != 0 {
+		t.Fatalf("unexpected daemons %v", list)
+	}
+}
+
+func Test_Backoff(t *testing.T) {
+	tests := []struct {
+		attempt  int
+		jitter   float64
+		expected time.Duration
+	}{
+		{0, 0, BACKOFF_MIN / 2},
+		{0, 0.999999999, BACKOFF_MIN - 1},
+		{3, 0, 4 * time.Second},
+		{3, 0.5, 6 * time.Second},
+		{10, 0, BACKOFF_MAX / 2},
+		{100, 0, BACKOFF_MAX / 2},
+	}
+	for _, test := range tests {
+		if delay := backoff(test.attempt, test.jitter); delay != test.expected {
+			t.Fatalf("attempt %d jitter %f expected %s actual %s", test.attempt, test.jitter, test.expected, delay)
+		}
+	}
+}
+
+func Test_Counter_Delta(t *testing.T) {
+	if counter_delta(10, 4) != 6 || counter_delta(3, 10) != 3 || counter_delta(0, 0) != 0 {
+		t.Fatalf("counter delta failed")
+	}
+}
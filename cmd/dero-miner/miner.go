@@ -20,11 +20,10 @@ import "io"
 import "os"
 import "fmt"
 import "time"
-import "net/url"
 import "crypto/rand"
-import "crypto/tls"
 import "sync"
 import "runtime"
+import "runtime/debug"
 import "math/big"
 import "path/filepath"
 import "encoding/hex"
@@ -57,6 +56,7 @@ var job_counter int64
 var maxdelay int = 10000
 var threads int
 var iterations int = 100
+var batch_size = 8            // nonces hashed by a thread before checking for new job
 var max_pow_size int = 819200 //astrobwt.MAX_LENGTH
 var wallet_address string
 var daemon_rpc_address string
@@ -77,21 +77,29 @@ ONE CPU, ONE VOTE.
 http://wiki.dero.io
 
 Usage:
-  dero-miner  --wallet-address=<wallet_address> [--daemon-rpc-address=<minernode1.dero.live:10100>] [--mining-threads=<threads>] [--testnet] [--debug]
-  dero-miner --bench 
+  dero-miner  --wallet-address=<wallet_address> [--daemon-rpc-address=<minernode1.dero.live:10100>] [--mining-threads=<threads>] [--config=<miner.json>] [--affinity=<avoid-ht>] [--gogc=<100>] [--stats-bind=<127.0.0.1:10200>] [--job-timeout=<30>] [--testnet] [--debug]
+  dero-miner --bench [--bench-time=<5>] [--write-config=<miner.json>] [--debug]
   dero-miner -h | --help
   dero-miner --version
 
 Options:
   -h --help     Show this screen.
   --version     Show version.
-  --bench  	    Run benchmark mode.
-  --daemon-rpc-address=<127.0.0.1:10102>    Miner will connect to daemon RPC on this port (default minernode1.dero.live:10100).
+  --bench  	    Run benchmark mode, measures thread counts, affinity layouts and GOGC settings and prints recommended tuning. GOGC is the only memory allocator setting tuned.
+  --bench-time=<5>    Seconds spent on each benchmark measurement.
+  --write-config=<miner.json>    Write recommended tuning found by benchmark to this file.
+  --daemon-rpc-address=<127.0.0.1:10102>    Miner will connect to daemon RPC on this port (default minernode1.dero.live:10100). Comma separated list of daemons in priority order enables failover.
   --wallet-address=<wallet_address>    This address is rewarded when a block is mined sucessfully.
-  --mining-threads=<threads>         Number of CPU threads for mining [default: ` + fmt.Sprintf("%d", runtime.GOMAXPROCS(0)) + `]
+  --mining-threads=<threads>         Number of CPU threads for mining, default is number of CPUs (` + fmt.Sprintf("%d", runtime.GOMAXPROCS(0)) + `).
+  --config=<miner.json>    Load tuning (threads, affinity, gogc) from file written by --bench --write-config, command line options override it.
+  --affinity=<avoid-ht>    Thread affinity layout, possible values none, sequential, avoid-ht (default).
+  --gogc=<100>    Garbage collector target percentage, must be positive, default is go runtime default.
+  --stats-bind=<127.0.0.1:10200>    Serve miner statistics as json on this ip:port, disabled by default.
+  --job-timeout=<30>    Reconnect if no job is received for these many seconds, mining pauses meanwhile.
 
 Example Mainnet: ./dero-miner-linux-amd64 --wallet-address dero1qy0ehnqjpr0wxqnknyc66du2fsxyktppkr8m8e6jvplp954klfjz2qqhmy4zf --daemon-rpc-address=minernode1.dero.live:10100
 Example Testnet: ./dero-miner-linux-amd64 --wallet-address deto1qy0ehnqjpr0wxqnknyc66du2fsxyktppkr8m8e6jvplp954klfjz2qqdzcd8p --daemon-rpc-address=127.0.0.1:40402 
+Example Failover: ./dero-miner-linux-amd64 --wallet-address dero1qy0ehnqjpr0wxqnknyc66du2fsxyktppkr8m8e6jvplp954klfjz2qqhmy4zf --daemon-rpc-address=127.0.0.1:10100,minernode1.dero.live:10100
 If daemon running on local machine no requirement of '--daemon-rpc-address' argument. 
 `
 var Exit_In_Progress = make(chan bool)
@@ -164,8 +172,49 @@ func main() {
 	if globals.Arguments["--daemon-rpc-address"] != nil {
 		daemon_rpc_address = globals.Arguments["--daemon-rpc-address"].(string)
 	}
+	if daemons = parse_daemons(daemon_rpc_address); len(daemons) == 0 {
+		logger.Error(nil, "No daemon address provided.")
+		return
+	}
+
+	if globals.Arguments["--job-timeout"] != nil {
+		if s, err := strconv.Atoi(globals.Arguments["--job-timeout"].(string)); err == nil && s > 0 {
+			job_timeout = time.Duration(s) * time.Second
+		} else {
+			logger.Error(err, "Job timeout argument cannot be parsed.")
+		}
+	}
+
+	cpu_siblings = read_topology()
+	logger.Info("CPU topology", "layout", describe_topology(cpu_siblings))
 
 	threads = runtime.GOMAXPROCS(0)
+	if globals.Arguments["--config"] != nil {
+		config, err := load_config(globals.Arguments["--config"].(string))
+		if err != nil {
+			logger.Error(err, "Config file cannot be loaded.")
+			return
+		}
+		config.apply()
+		logger.Info("Loaded config", "file", globals.Arguments["--config"].(string), "threads", threads, "affinity", affinity_layout, "gogc", config.GOGC)
+	}
+
+	if globals.Arguments["--affinity"] != nil {
+		if affinity_layout, err = parse_affinity(globals.Arguments["--affinity"].(string)); err != nil {
+			logger.Error(err, "Affinity argument cannot be parsed.")
+			return
+		}
+	}
+
+	if globals.Arguments["--gogc"] != nil {
+		s, err := strconv.Atoi(globals.Arguments["--gogc"].(string))
+		if err != nil || s <= 0 {
+			logger.Error(fmt.Errorf("--gogc must be a positive percentage"), "GOGC argument cannot be parsed.", "gogc", globals.Arguments["--gogc"])
+			return
+		}
+		debug.SetGCPercent(s)
+	}
+
 	if globals.Arguments["--mining-threads"] != nil {
 		if s, err := strconv.Atoi(globals.Arguments["--mining-threads"].(string)); err == nil {
 			threads = s
@@ -179,26 +228,24 @@ func main() {
 	}
 
 	if globals.Arguments["--bench"].(bool) {
-
-		var wg sync.WaitGroup
-
-		fmt.Printf("%20s %20s %20s %20s %20s \n", "Threads", "Total Time", "Total Iterations", "Time/PoW ", "Hash Rate/Sec")
-		iterations = 1000
-		for bench := 1; bench <= threads; bench++ {
-			processor = 0
-			now := time.Now()
-			for i := 0; i < bench; i++ {
-				wg.Add(1)
-				go random_execution(&wg, iterations)
+		bench_time := BENCH_TIME
+		if globals.Arguments["--bench-time"] != nil {
+			if s, err := strconv.Atoi(globals.Arguments["--bench-time"].(string)); err == nil && s > 0 {
+				bench_time = s
+			} else {
+				logger.Error(err, "Bench time argument cannot be parsed.")
 			}
-			wg.Wait()
-			duration := time.Now().Sub(now)
-
-			fmt.Printf("%20s %20s %20s %20s %20s \n", fmt.Sprintf("%d", bench), fmt.Sprintf("%s", duration), fmt.Sprintf("%d", bench*iterations),
-				fmt.Sprintf("%s", duration/time.Duration(bench*iterations)), fmt.Sprintf("%.1f", float32(time.Second)/(float32(duration/time.Duration(bench*iterations)))))
+		}
 
+		config_file := ""
+		if globals.Arguments["--write-config"] != nil {
+			config_file = globals.Arguments["--write-config"].(string)
 		}
 
+		if err := benchmark(time.Duration(bench_time)*time.Second, config_file); err != nil {
+			logger.Error(err, "Benchmark failed.")
+			os.Exit(1)
+		}
 		os.Exit(0)
 	}
 
@@ -313,6 +360,12 @@ func main() {
 		threads = 255
 	}
 
+	stats_init(threads)
+	go stats_sampler()
+	if globals.Arguments["--stats-bind"] != nil {
+		go stats_server(globals.Arguments["--stats-bind"].(string))
+	}
+
 	go getwork(wallet_address)
 
 	for i := 0; i < threads; i++ {
@@ -375,81 +428,9 @@ func main() {
 
 }
 
-func random_execution(wg *sync.WaitGroup, iterations int) {
-	var workbuf [255]byte
-
-	runtime.LockOSThread()
-	//threadaffinity()
-
-	scratch := astrobwt_fast.Pool.Get().(*astrobwt_fast.ScratchData)
-	rand.Read(workbuf[:])
-	_ = scratch
-
-	for i := 0; i < iterations; i++ {
-		//_ = astrobwt_fast.POW_optimized(workbuf[:], scratch)
-		_ = astrobwtv3.AstroBWTv3(workbuf[:])
-	}
-	wg.Done()
-	runtime.UnlockOSThread()
-}
-
-// continuously get work
-
 var connection *websocket.Conn
 var connection_mutex sync.Mutex
 
-func getwork(wallet_address string) {
-	var err error
-
-	for {
-
-		u := url.URL{Scheme: "wss", Host: daemon_rpc_address, Path: "/ws/" + wallet_address}
-		logger.Info("connecting to ", "url", u.String())
-
-		dialer := websocket.DefaultDialer
-		dialer.TLSClientConfig = &tls.Config{
-			InsecureSkipVerify: true,
-		}
-		connection, _, err = websocket.DefaultDialer.Dial(u.String(), nil)
-		if err != nil {
-			logger.Error(err, "Error connecting to server", "server adress", daemon_rpc_address)
-			logger.Info("Will try in 10 secs", "server adress", daemon_rpc_address)
-			time.Sleep(10 * time.Second)
-
-			continue
-		}
-
-		var result rpc.GetBlockTemplate_Result
-	wait_for_another_job:
-
-		if err = connection.ReadJSON(&result); err != nil {
-			logger.Error(err, "connection error")
-			continue
-		}
-
-		mutex.Lock()
-		job = result
-		job_counter++
-		mutex.Unlock()
-		if job.LastError != "" {
-			logger.Error(nil, "received error", "err", job.LastError)
-		}
-
-		block_counter = job.Blocks
-		mini_block_counter = job.MiniBlocks // note if the miner submits the job late, though his counter
-		// will increase, but a block has been already found, so
-		// orphan miniblocks may be there ( means they will not br rewarded)
-		rejected = job.Rejected
-		hash_rate = job.Difficultyuint64
-		our_height = int64(job.Height)
-		Difficulty = job.Difficultyuint64
-
-		//fmt.Printf("recv: %+v diff %d\n", result, Difficulty)
-		goto wait_for_another_job
-	}
-
-}
-
 func mineblock(tid int) {
 	var diff big.Int
 	var work [block.MINIBLOCK_SIZE]byte
@@ -459,6 +440,8 @@ func mineblock(tid int) {
 	rand.Read(random_buf[:])
 
 	scratch := astrobwt_fast.Pool.Get().(*astrobwt_fast.ScratchData)
+	scratch_v3 := astrobwtv3.NewScratchData() // owned by this thread, so GC never frees it
+	hashes := make([][32]byte, batch_size)
 
 	time.Sleep(5 * time.Second)
 
@@ -471,6 +454,11 @@ func mineblock(tid int) {
 	i := uint32(0)
 
 	for {
+		if job_stale() { // do not waste hashes on old work
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
 		mutex.RLock()
 		myjob := job
 		local_job_counter = job_counter
@@ -503,37 +491,31 @@ func mineblock(tid int) {
 
 				powhash := astrobwt_fast.POW_optimized(work[:], scratch)
 				atomic.AddUint64(&counter, 1)
+				atomic.AddUint64(&thread_counters[tid], 1)
 
 				if CheckPowHashBig(powhash, &diff) == true { // note we are doing a local, NW might have moved meanwhile
 					logger.V(1).Info("Successfully found DERO miniblock (going to submit)", "difficulty", myjob.Difficulty, "height", myjob.Height)
-					func() {
-						defer globals.Recover(1)
-						connection_mutex.Lock()
-						defer connection_mutex.Unlock()
-						connection.WriteJSON(rpc.SubmitBlock_Params{JobID: myjob.JobID, MiniBlockhashing_blob: fmt.Sprintf("%x", work[:])})
-					}()
+					atomic.AddUint64(&thread_submitted[tid], 1)
+					submit_work(rpc.SubmitBlock_Params{JobID: myjob.JobID, MiniBlockhashing_blob: fmt.Sprintf("%x", work[:])})
 
 				}
 			}
 		} else {
 
 			for local_job_counter == job_counter { // update job when it comes, expected rate 1 per second
-				i++
-				binary.BigEndian.PutUint32(nonce_buf, i)
-
-				powhash := astrobwtv3.AstroBWTv3(work[:])
-				atomic.AddUint64(&counter, 1)
-
-				if CheckPowHashBig(powhash, &diff) == true { // note we are doing a local, NW might have moved meanwhile
-					logger.V(1).Info("Successfully found DERO miniblock (going to submit)", "difficulty", myjob.Difficulty, "height", myjob.Height)
-					func() {
-						defer globals.Recover(1)
-						connection_mutex.Lock()
-						defer connection_mutex.Unlock()
-						connection.WriteJSON(rpc.SubmitBlock_Params{JobID: myjob.JobID, MiniBlockhashing_blob: fmt.Sprintf("%x", work[:])})
-					}()
-
+				astrobwtv3.AstroBWTv3Nonces(work[:], block.MINIBLOCK_SIZE-5, i+1, scratch_v3, hashes)
+				atomic.AddUint64(&counter, uint64(len(hashes)))
+				atomic.AddUint64(&thread_counters[tid], uint64(len(hashes)))
+
+				for j := range hashes {
+					if CheckPowHashBig(hashes[j], &diff) == true { // note we are doing a local, NW might have moved meanwhile
+						logger.V(1).Info("Successfully found DERO miniblock (going to submit)", "difficulty", myjob.Difficulty, "height", myjob.Height)
+						binary.BigEndian.PutUint32(nonce_buf, i+1+uint32(j))
+						atomic.AddUint64(&thread_submitted[tid], 1)
+						submit_work(rpc.SubmitBlock_Params{JobID: myjob.JobID, MiniBlockhashing_blob: fmt.Sprintf("%x", work[:])})
+					}
 				}
+				i += uint32(len(hashes))
 			}
 
 		}
@@ -0,0 +1,154 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+// this file serves miner statistics as json, so that rigs can be monitored
+// hashrates are averaged over last STATS_WINDOW seconds
+
+import "net"
+import "time"
+import "sync"
+import "net/http"
+import "sync/atomic"
+import "encoding/json"
+
+import "github.com/deroproject/derohe/config"
+
+const STATS_WINDOW = 10 // seconds
+
+var start_time = time.Now()
+var thread_counters []uint64  // hashes computed by each thread
+var thread_submitted []uint64 // work submitted by each thread
+
+type stats_sample struct {
+	time     time.Time
+	counters []uint64
+}
+
+var stats_mutex sync.Mutex
+var stats_samples []stats_sample
+
+type Thread_Stats struct {
+	ID        int     `json:"id"`
+	Hashrate  float64 `json:"hashrate"`
+	Hashes    uint64  `json:"hashes"`
+	Submitted uint64  `json:"submitted"`
+}
+
+type Miner_Stats struct {
+	Version    string         `json:"version"`
+	Uptime     int64          `json:"uptime"` // seconds
+	Daemon     string         `json:"daemon"` // empty if not connected
+	Priority   int            `json:"priority"`
+	Reconnects uint64         `json:"reconnects"`
+	Height     int64          `json:"height"`
+	Difficulty uint64         `json:"difficulty"`
+	JobAge     int64          `json:"job_age"` // seconds since last job, -1 if no job received
+	Stale      bool           `json:"stale"`
+	Hashrate   float64        `json:"hashrate"`
+	Blocks     uint64         `json:"blocks"`
+	MiniBlocks uint64         `json:"miniblocks"`
+	Accepted   uint64         `json:"accepted"` // blocks and miniblocks accepted by daemon
+	Rejected   uint64         `json:"rejected"`
+	Threads    []Thread_Stats `json:"threads"`
+}
+
+func stats_init(threads int) {
+	thread_counters = make([]uint64, threads)
+	thread_submitted = make([]uint64, threads)
+}
+
+// take a sample of thread counters every second
+func stats_sampler() {
+	for {
+		sample := stats_sample{time: time.Now(), counters: make([]uint64, len(thread_counters))}
+		for i := range thread_counters {
+			sample.counters[i] = atomic.LoadUint64(&thread_counters[i])
+		}
+		stats_mutex.Lock()
+		stats_samples = append(stats_samples, sample)
+		if len(stats_samples) > STATS_WINDOW+1 {
+			stats_samples = stats_samples[1:]
+		}
+		stats_mutex.Unlock()
+		time.Sleep(time.Second)
+	}
+}
+
+func current_stats() (stats Miner_Stats) {
+	stats.Version = config.Version.String()
+	stats.Uptime = int64(time.Since(start_time).Seconds())
+	stats.Priority = int(atomic.LoadInt32(&daemon_index))
+	if stats.Priority >= 0 && stats.Priority < len(daemons) {
+		stats.Daemon = daemons[stats.Priority]
+	}
+	stats.Reconnects = atomic.LoadUint64(&reconnects)
+	stats.Height = our_height
+	stats.Difficulty = Difficulty
+	stats.JobAge = -1
+	if last := atomic.LoadInt64(&job_time); last != 0 {
+		stats.JobAge = int64(time.Since(time.Unix(0, last)).Seconds())
+	}
+	stats.Stale = job_stale()
+	stats.Blocks = atomic.LoadUint64(&block_counter)
+	stats.MiniBlocks = atomic.LoadUint64(&mini_block_counter)
+	stats.Accepted = stats.Blocks + stats.MiniBlocks
+	stats.Rejected = atomic.LoadUint64(&rejected)
+
+	stats_mutex.Lock()
+	var first, last stats_sample
+	if len(stats_samples) >= 2 {
+		first, last = stats_samples[0], stats_samples[len(stats_samples)-1]
+	}
+	stats_mutex.Unlock()
+
+	elapsed := last.time.Sub(first.time).Seconds()
+	stats.Threads = []Thread_Stats{}
+	for i := range thread_counters {
+		thread := Thread_Stats{ID: i, Hashes: atomic.LoadUint64(&thread_counters[i]), Submitted: atomic.LoadUint64(&thread_submitted[i])}
+		if elapsed > 0 && i < len(first.counters) && i < len(last.counters) {
+			thread.Hashrate = float64(last.counters[i]-first.counters[i]) / elapsed
+		}
+		stats.Hashrate += thread.Hashrate
+		stats.Threads = append(stats.Threads, thread)
+	}
+	return
+}
+
+// serve stats if --stats-bind was provided
+func stats_server(address string) {
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		logger.Error(err, "--stats-bind address is invalid")
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" && r.URL.Path != "/stats" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(current_stats())
+	})
+
+	logger.Info("Stats will be served", "address", addr.String())
+	if err = http.ListenAndServe(addr.String(), mux); err != nil {
+		logger.Error(err, "Stats server failed")
+	}
+}
@@ -21,7 +21,12 @@ package main
 
 var processor int32
 
-// TODO
+// threads cannot be pinned on this platform, they are scheduled by OS whatever the affinity layout is
 func threadaffinity() {
 
 }
+
+// no-op on this platform
+func pin_thread(cpu int) {
+
+}
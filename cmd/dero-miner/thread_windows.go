@@ -66,20 +66,15 @@ func threadaffinity() {
 	if lock_on_cpu >= int32(runtime.GOMAXPROCS(0)) { // threads are more than cpu, we do not know what to do
 		return
 	}
+	pin_thread(affinity_cpu(affinity_layout, int(lock_on_cpu), runtime.GOMAXPROCS(0)))
+}
 
-	if lock_on_cpu >= bits.UintSize {
+// pin current OS thread to a cpu, negative cpu leaves thread unpinned
+func pin_thread(cpu int) {
+	if cpu < 0 || cpu >= bits.UintSize {
 		return
 	}
 	var cpuset uint
-	cpuset = 1 << uint(avoidHT(int(lock_on_cpu)))
+	cpuset = 1 << uint(cpu)
 	SetThreadAffinityMask(CurrentThread(), cpuset)
 }
-
-func avoidHT(i int) int {
-	count := runtime.GOMAXPROCS(0)
-	if i < count/2 {
-		return i * 2
-	} else {
-		return (i-count/2)*2 + 1
-	}
-}
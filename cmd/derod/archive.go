@@ -0,0 +1,402 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+// this file implements a portable chain archive, used to seed nodes from a file without p2p
+// archive is a stream of complete blocks in topological order, every record carries a crc
+// and the trailer carries a hash of the entire stream, so truncated or damaged archives are detected
+// import is resumable, progress is saved within data directory
+
+import "os"
+import "io"
+import "fmt"
+import "hash"
+import "time"
+import "bufio"
+import "bytes"
+import "hash/crc32"
+import "crypto/sha256"
+import "encoding/json"
+import "encoding/binary"
+import "path/filepath"
+import "os/signal"
+
+import "github.com/deroproject/derohe/block"
+import "github.com/deroproject/derohe/blockchain"
+import "github.com/deroproject/derohe/cryptography/crypto"
+import "github.com/deroproject/derohe/globals"
+import "github.com/deroproject/derohe/p2p"
+import "github.com/deroproject/derohe/transaction"
+
+var archive_magic = [8]byte{'D', 'E', 'R', 'O', 'A', 'R', 'C', 'H'}
+
+const ARCHIVE_VERSION = 1
+const ARCHIVE_HEADER_SIZE = 8 + 4 + 16 + 8 + 8 + 4 // magic, version, network id, from, to, crc
+const ARCHIVE_RECORD_SIZE = 8 + 32 + 4 + 4         // topo, blid, length, crc followed by block
+const ARCHIVE_MAX_RECORD = 64 * 1024 * 1024        // sanity limit for a single complete block
+const archive_trailer_topo = -1                    // trailer is topo -1, followed by block count and hash of stream
+
+type archive_header struct {
+	Magic   [8]byte // kind of archive, blocks or state snapshot
+	Network [16]byte
+	From    int64
+	To      int64
+}
+
+type archive_record struct {
+	Topo  int64
+	BLID  crypto.Hash
+	Block []byte // complete block in p2p format
+}
+
+func (h *archive_header) serialize() []byte {
+	buf := make([]byte, ARCHIVE_HEADER_SIZE)
+	copy(buf, h.Magic[:])
+	binary.BigEndian.PutUint32(buf[8:], ARCHIVE_VERSION)
+	copy(buf[12:], h.Network[:])
+	binary.BigEndian.PutUint64(buf[28:], uint64(h.From))
+	binary.BigEndian.PutUint64(buf[36:], uint64(h.To))
+	binary.BigEndian.PutUint32(buf[44:], crc32.ChecksumIEEE(buf[:44]))
+	return buf
+}
+
+func (h *archive_header) deserialize(buf []byte) error {
+	if len(buf) != ARCHIVE_HEADER_SIZE {
+		return fmt.Errorf("not a chain archive")
+	}
+	if crc32.ChecksumIEEE(buf[:44]) != binary.BigEndian.Uint32(buf[44:]) {
+		return fmt.Errorf("archive header is corrupted")
+	}
+	if version := binary.BigEndian.Uint32(buf[8:]); version != ARCHIVE_VERSION {
+		return fmt.Errorf("unsupported archive version %d", version)
+	}
+	copy(h.Magic[:], buf[:8])
+	copy(h.Network[:], buf[12:])
+	h.From = int64(binary.BigEndian.Uint64(buf[28:]))
+	h.To = int64(binary.BigEndian.Uint64(buf[36:]))
+	return nil
+}
+
+type archive_writer struct {
+	w     *bufio.Writer
+	hash  hash.Hash
+	count uint64
+}
+
+func new_archive_writer(w io.Writer, header archive_header) (*archive_writer, error) {
+	a := &archive_writer{w: bufio.NewWriterSize(w, 1024*1024), hash: sha256.New()}
+	if _, err := a.w.Write(header.serialize()); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *archive_writer) write(record archive_record) error {
+	var buf [ARCHIVE_RECORD_SIZE]byte
+	binary.BigEndian.PutUint64(buf[0:], uint64(record.Topo))
+	copy(buf[8:], record.BLID[:])
+	binary.BigEndian.PutUint32(buf[40:], uint32(len(record.Block)))
+	binary.BigEndian.PutUint32(buf[44:], crc32.ChecksumIEEE(record.Block))
+
+	a.hash.Write(buf[:])
+	a.hash.Write(record.Block)
+	a.count++
+	if _, err := a.w.Write(buf[:]); err != nil {
+		return err
+	}
+	_, err := a.w.Write(record.Block)
+	return err
+}
+
+// trailer marks the archive complete
+func (a *archive_writer) close() error {
+	var buf [8 + 8 + 32]byte
+	trailer_topo := int64(archive_trailer_topo)
+	binary.BigEndian.PutUint64(buf[0:], uint64(trailer_topo))
+	binary.BigEndian.PutUint64(buf[8:], a.count)
+	copy(buf[16:], a.hash.Sum(nil))
+	if _, err := a.w.Write(buf[:]); err != nil {
+		return err
+	}
+	return a.w.Flush()
+}
+
+type archive_reader struct {
+	r      *bufio.Reader
+	hash   hash.Hash
+	count  uint64
+	offset int64 // offset of next record within file
+	header archive_header
+}
+
+func new_archive_reader(r io.Reader, magic [8]byte) (*archive_reader, error) {
+	a := &archive_reader{r: bufio.NewReaderSize(r, 1024*1024), hash: sha256.New(), offset: ARCHIVE_HEADER_SIZE}
+	buf := make([]byte, ARCHIVE_HEADER_SIZE)
+	if _, err := io.ReadFull(a.r, buf); err != nil {
+		return nil, fmt.Errorf("cannot read archive header err %s", err)
+	}
+	if err := a.header.deserialize(buf); err != nil {
+		return nil, err
+	}
+	if a.header.Magic != magic {
+		return nil, fmt.Errorf("archive is of kind %q, expected %q", a.header.Magic[:], magic[:])
+	}
+	return a, nil
+}
+
+// returns next record, io.EOF is returned only after the trailer has been verified
+func (a *archive_reader) next() (record archive_record, err error) {
+	var buf [ARCHIVE_RECORD_SIZE]byte
+	if _, err = io.ReadFull(a.r, buf[:8]); err != nil {
+		return record, fmt.Errorf("archive is incomplete err %s", io.ErrUnexpectedEOF)
+	}
+
+	if record.Topo = int64(binary.BigEndian.Uint64(buf[0:])); record.Topo == archive_trailer_topo {
+		var trailer [8 + 32]byte
+		if _, err = io.ReadFull(a.r, trailer[:]); err != nil {
+			return record, fmt.Errorf("archive is incomplete err %s", io.ErrUnexpectedEOF)
+		}
+		if binary.BigEndian.Uint64(trailer[:]) != a.count || !bytes.Equal(trailer[8:], a.hash.Sum(nil)) {
+			return record, fmt.Errorf("archive checksum mismatch, archive is corrupted")
+		}
+		return record, io.EOF
+	}
+
+	if _, err = io.ReadFull(a.r, buf[8:]); err != nil {
+		return record, fmt.Errorf("archive is incomplete err %s", io.ErrUnexpectedEOF)
+	}
+	copy(record.BLID[:], buf[8:])
+	length := binary.BigEndian.Uint32(buf[40:])
+	if length > ARCHIVE_MAX_RECORD {
+		return record, fmt.Errorf("archive record at topoheight %d is too large %d", record.Topo, length)
+	}
+	record.Block = make([]byte, length)
+	if _, err = io.ReadFull(a.r, record.Block); err != nil {
+		return record, fmt.Errorf("archive is incomplete err %s", io.ErrUnexpectedEOF)
+	}
+	if crc32.ChecksumIEEE(record.Block) != binary.BigEndian.Uint32(buf[44:]) {
+		return record, fmt.Errorf("archive record at topoheight %d is corrupted", record.Topo)
+	}
+
+	a.hash.Write(buf[:])
+	a.hash.Write(record.Block)
+	a.count++
+	a.offset += ARCHIVE_RECORD_SIZE + int64(length)
+	return record, nil
+}
+
+// import progress, saved regularly so that an interrupted import continues where it stopped
+type import_progress struct {
+	File   string `json:"file"`
+	Header []byte `json:"header"`
+	Offset int64  `json:"offset"`
+	Count  uint64 `json:"count"`
+	Hash   []byte `json:"hash"` // state of stream hash at offset
+}
+
+func import_progress_file() string {
+	return filepath.Join(globals.GetDataDirectory(), "import.json")
+}
+
+func (a *archive_reader) save_progress(filename string) error {
+	state, err := a.hash.(interface{ MarshalBinary() ([]byte, error) }).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	progress := import_progress{File: filename, Header: a.header.serialize(), Offset: a.offset, Count: a.count, Hash: state}
+	data, err := json.Marshal(&progress)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(import_progress_file(), data, 0600)
+}
+
+// positions reader after the last imported record, if the same archive was being imported earlier
+func (a *archive_reader) resume(file *os.File, filename string) (bool, error) {
+	var progress import_progress
+	data, err := os.ReadFile(import_progress_file())
+	if err != nil || json.Unmarshal(data, &progress) != nil {
+		return false, nil
+	}
+	if progress.File != filename || !bytes.Equal(progress.Header, a.header.serialize()) {
+		return false, nil
+	}
+	if err = a.hash.(interface{ UnmarshalBinary([]byte) error }).UnmarshalBinary(progress.Hash); err != nil {
+		return false, nil
+	}
+	if _, err = file.Seek(progress.Offset, io.SeekStart); err != nil {
+		return false, err
+	}
+	a.r.Reset(file)
+	a.offset, a.count = progress.Offset, progress.Count
+	return true, nil
+}
+
+// reads a complete block from chain
+func load_complete_block(chain *blockchain.Blockchain, blid crypto.Hash) (*block.Complete_Block, error) {
+	bl, err := chain.Load_BL_FROM_ID(blid)
+	if err != nil {
+		return nil, err
+	}
+	cbl := &block.Complete_Block{Bl: bl}
+	for _, txid := range bl.Tx_hashes {
+		var tx transaction.Transaction
+		if tx_bytes, err := chain.Store.Block_tx_store.ReadTX(txid); err != nil {
+			return nil, fmt.Errorf("cannot read tx %s err %s", txid, err)
+		} else if err = tx.Deserialize(tx_bytes); err != nil {
+			return nil, fmt.Errorf("cannot deserialize tx %s err %s", txid, err)
+		}
+		cbl.Txs = append(cbl.Txs, &tx)
+	}
+	return cbl, nil
+}
+
+// exports complete blocks from topoheight from till to(inclusive) into an archive
+func export_chain(chain *blockchain.Blockchain, from, to int64, filename string) (err error) {
+	if to < 0 || to > chain.Load_TOPO_HEIGHT() {
+		to = chain.Load_TOPO_HEIGHT()
+	}
+	if pruned := chain.LocatePruneTopo(); from <= pruned && pruned != 0 {
+		return fmt.Errorf("chain has been pruned till topoheight %d, export from %d onwards", pruned, pruned+1)
+	}
+	if from < 0 || from > to {
+		return fmt.Errorf("invalid range from %d to %d", from, to)
+	}
+
+	// archive is written to a temporary file and renamed when complete
+	file, err := os.Create(filename + ".part")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		file.Close()
+		if err != nil {
+			os.Remove(filename + ".part")
+		}
+	}()
+
+	header := archive_header{Magic: archive_magic, From: from, To: to}
+	copy(header.Network[:], globals.Config.Network_ID.Bytes())
+	writer, err := new_archive_writer(file, header)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	for topo := from; topo <= to; topo++ {
+		blid, err := chain.Load_Block_Topological_order_at_index(topo)
+		if err != nil {
+			return fmt.Errorf("cannot load block at topoheight %d err %s", topo, err)
+		}
+		cbl, err := load_complete_block(chain, blid)
+		if err != nil {
+			return fmt.Errorf("cannot load block at topoheight %d err %s", topo, err)
+		}
+		if err = writer.write(archive_record{Topo: topo, BLID: blid, Block: p2p.Convert_CBL_TO_P2PCBL(cbl, true)}); err != nil {
+			return err
+		}
+		if topo%10000 == 0 {
+			logger.Info("Exporting", "topoheight", topo, "to", to)
+		}
+	}
+	if err = writer.close(); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	if err = os.Rename(filename+".part", filename); err != nil {
+		return err
+	}
+	logger.Info("Export completed", "file", filename, "blocks", writer.count, "duration", time.Since(start))
+	return nil
+}
+
+// imports an archive, blocks are validated and added as if received from network
+// blocks already present are skipped, so an archive can be imported over an existing chain
+func import_chain(chain *blockchain.Blockchain, filename string) (err error) {
+	if filename, err = filepath.Abs(filename); err != nil {
+		return err
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := new_archive_reader(file, archive_magic)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(reader.header.Network[:], globals.Config.Network_ID.Bytes()) {
+		return fmt.Errorf("archive belongs to a different network")
+	}
+	if resumed, err := reader.resume(file, filename); err != nil {
+		return err
+	} else if resumed {
+		logger.Info("Resuming import", "file", filename, "imported", reader.count)
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	start := time.Now()
+	added, skipped := uint64(0), uint64(0)
+	for {
+		select {
+		case <-interrupt:
+			logger.Info("Import interrupted, run import again to continue", "imported", reader.count)
+			return reader.save_progress(filename)
+		default:
+		}
+
+		record, err := reader.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if chain.Block_Exists(record.BLID) {
+			skipped++
+		} else {
+			cbl, err := p2p.Convert_P2PCBL_TO_CBL(record.Block)
+			if err != nil {
+				return fmt.Errorf("cannot decode block at topoheight %d err %s", record.Topo, err)
+			}
+			if cbl.Bl.GetHash() != record.BLID {
+				return fmt.Errorf("block at topoheight %d does not match its id", record.Topo)
+			}
+			if err, ok := chain.Add_Complete_Block(cbl); !ok {
+				return fmt.Errorf("block at topoheight %d rejected err %s", record.Topo, err)
+			}
+			added++
+		}
+
+		if reader.count%1000 == 0 {
+			if err = reader.save_progress(filename); err != nil {
+				return err
+			}
+			logger.Info("Importing", "topoheight", record.Topo, "to", reader.header.To, "height", chain.Get_Height())
+		}
+	}
+
+	os.Remove(import_progress_file())
+	logger.Info("Import completed", "file", filename, "added", added, "skipped", skipped, "topoheight", chain.Load_TOPO_HEIGHT(), "duration", time.Since(start))
+	return nil
+}
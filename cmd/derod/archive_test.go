@@ -0,0 +1,141 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import "os"
+import "io"
+import "bytes"
+import "strings"
+import "testing"
+import "path/filepath"
+
+import "github.com/go-logr/logr"
+
+import "github.com/deroproject/derohe/globals"
+
+func test_archive(t *testing.T, count int) []byte {
+	var buf bytes.Buffer
+	writer, err := new_archive_writer(&buf, archive_header{Magic: archive_magic, From: 1, To: int64(count)})
+	if err != nil {
+		t.Fatalf("cannot create archive err %s", err)
+	}
+	for i := 1; i <= count; i++ {
+		record := archive_record{Topo: int64(i), Block: bytes.Repeat([]byte{byte(i)}, i*10)}
+		record.BLID[0] = byte(i)
+		if err = writer.write(record); err != nil {
+			t.Fatalf("cannot write record err %s", err)
+		}
+	}
+	if err = writer.close(); err != nil {
+		t.Fatalf("cannot close archive err %s", err)
+	}
+	return buf.Bytes()
+}
+
+// reads all records, returns topoheights read and final error
+func read_archive(reader *archive_reader) (topos []int64, err error) {
+	for {
+		var record archive_record
+		if record, err = reader.next(); err != nil {
+			return
+		}
+		if len(record.Block) != int(record.Topo)*10 || record.BLID[0] != byte(record.Topo) {
+			return topos, io.ErrUnexpectedEOF
+		}
+		topos = append(topos, record.Topo)
+	}
+}
+
+func Test_Archive(t *testing.T) {
+	data := test_archive(t, 20)
+
+	reader, err := new_archive_reader(bytes.NewReader(data), archive_magic)
+	if err != nil || reader.header.From != 1 || reader.header.To != 20 {
+		t.Fatalf("cannot read header err %v header %+v", err, reader.header)
+	}
+	if topos, err := read_archive(reader); err != io.EOF || len(topos) != 20 {
+		t.Fatalf("archive read %d records err %v", len(topos), err)
+	}
+
+	// truncated archive must never be reported as complete
+	for _, size := range []int{ARCHIVE_HEADER_SIZE + 10, len(data) / 2, len(data) - 1} {
+		reader, _ := new_archive_reader(bytes.NewReader(data[:size]), archive_magic)
+		if _, err := read_archive(reader); err == nil || err == io.EOF || !strings.Contains(err.Error(), "incomplete") {
+			t.Fatalf("truncated archive of size %d not detected err %v", size, err)
+		}
+	}
+
+	// damaged block
+	corrupted := append([]byte{}, data...)
+	corrupted[ARCHIVE_HEADER_SIZE+ARCHIVE_RECORD_SIZE+3] ^= 1
+	reader, _ = new_archive_reader(bytes.NewReader(corrupted), archive_magic)
+	if topos, err := read_archive(reader); len(topos) != 0 || err == nil || !strings.Contains(err.Error(), "corrupted") {
+		t.Fatalf("corrupted record not detected err %v", err)
+	}
+
+	// damaged record header is caught by trailer checksum
+	corrupted = append([]byte{}, data...)
+	corrupted[ARCHIVE_HEADER_SIZE+8+5] ^= 1
+	reader, _ = new_archive_reader(bytes.NewReader(corrupted), archive_magic)
+	if _, err := read_archive(reader); err == nil || err == io.EOF {
+		t.Fatalf("corrupted record header not detected")
+	}
+
+	corrupted = append([]byte{}, data...)
+	corrupted[20] ^= 1
+	if _, err := new_archive_reader(bytes.NewReader(corrupted), archive_magic); err == nil {
+		t.Fatalf("corrupted archive header not detected")
+	}
+}
+
+func Test_Archive_Resume(t *testing.T) {
+	globals.Logger = logr.Discard()
+	globals.Arguments = map[string]interface{}{"--data-dir": t.TempDir()}
+	os.MkdirAll(globals.GetDataDirectory(), 0700)
+
+	filename := filepath.Join(t.TempDir(), "chain.archive")
+	if err := os.WriteFile(filename, test_archive(t, 20), 0600); err != nil {
+		t.Fatalf("cannot write archive err %s", err)
+	}
+
+	file, _ := os.Open(filename)
+	reader, _ := new_archive_reader(file, archive_magic)
+	for i := 0; i < 7; i++ {
+		reader.next()
+	}
+	if err := reader.save_progress(filename); err != nil {
+		t.Fatalf("cannot save progress err %s", err)
+	}
+	file.Close()
+
+	file, _ = os.Open(filename)
+	defer file.Close()
+	reader, _ = new_archive_reader(file, archive_magic)
+	if resumed, err := reader.resume(file, filename); !resumed || err != nil {
+		t.Fatalf("import not resumed err %v", err)
+	}
+	if topos, err := read_archive(reader); err != io.EOF || len(topos) != 13 || topos[0] != 8 {
+		t.Fatalf("resumed import read %v err %v", topos, err)
+	}
+
+	// progress of some other archive is not used
+	file.Seek(0, io.SeekStart)
+	reader, _ = new_archive_reader(file, archive_magic)
+	if resumed, _ := reader.resume(file, filename+".other"); resumed {
+		t.Fatalf("progress of other archive must not be used")
+	}
+}
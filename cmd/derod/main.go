@@ -18,6 +18,7 @@ package main
 
 import "io"
 import "os"
+import "net"
 import "time"
 import "fmt"
 import "bytes"
@@ -59,7 +60,12 @@ var command_line string = `derod
 DERO : A secure, private blockchain with smart-contracts
 
 Usage:
-  derod [--help] [--version] [--testnet] [--debug]  [--sync-node] [--timeisinsync] [--fastsync] [--socks-proxy=<socks_ip:port>] [--data-dir=<directory>] [--p2p-bind=<0.0.0.0:18089>] [--add-exclusive-node=<ip:port>]... [--add-priority-node=<ip:port>]... [--min-peers=<11>] [--max-peers=<100>] [--rpc-bind=<127.0.0.1:9999>] [--getwork-bind=<0.0.0.0:18089>] [--node-tag=<unique name>] [--prune-history=<50>] [--integrator-address=<address>] [--clog-level=1] [--flog-level=1]
+  derod [--help] [--version] [--testnet] [--debug]  [--sync-node] [--timeisinsync] [--fastsync] [--fastsync-verify] [--socks-proxy=<socks_ip:port>] [--p2p-external-address=<xyz.onion:18089>] [--data-dir=<directory>] [--p2p-bind=<0.0.0.0:18089>] [--add-exclusive-node=<ip:port>]... [--add-priority-node=<ip:port>]... [--min-peers=<11>] [--max-peers=<100>] [--p2p-max-upload=<0>] [--p2p-max-download=<0>] [--p2p-max-upload-peer=<0>] [--p2p-max-download-peer=<0>] [--rpc-bind=<127.0.0.1:9999>] [--rpc-admin-login=<username:password>] [--getwork-bind=<0.0.0.0:18089>] [--getwork-vardiff=<15>] [--stratum-bind=<0.0.0.0:10300>] [--pool-wallet=<wallet.db>] [--pool-wallet-password=<password>] [--pool-share-diff=<0>] [--pool-fee=<1.0>] [--pool-payout-threshold=<100000>] [--pool-http-bind=<127.0.0.1:10110>] [--node-tag=<unique name>] [--dandelion] [--dandelion-fluff=<10>] [--dandelion-embargo=<30>] [--mempool-size=<67108864>] [--mempool-peer-limit=<1000>] [--mempool-ip-limit=<2000>] [--prune-history=<50>] [--prune-depth=<20000>] [--block-store=<fs>] [--migrate-block-store=<pack>] [--integrator-address=<address>] [--pow-cache=<0>] [--clog-level=1] [--flog-level=1]
+  derod export [--testnet] [--debug] [--data-dir=<directory>] [--from=<0>] [--to=<topoheight>] <file>
+  derod import [--testnet] [--debug] [--data-dir=<directory>] <file>
+  derod export-state [--testnet] [--debug] [--data-dir=<directory>] [--topoheight=<topoheight>] <file>
+  derod import-state [--testnet] [--debug] [--data-dir=<directory>] --state-hash=<hash> <file>
+  derod verify-chain [--testnet] [--debug] [--data-dir=<directory>] [--from=<0>] [--to=<topoheight>] [--workers=<cpus>] [--pow-cache=<0>]
   derod -h | --help
   derod --version
 
@@ -71,20 +77,57 @@ Options:
   --clog-level=1	Set console log level (0 to 127) 
   --flog-level=1	Set file log level (0 to 127)
   --fastsync      Fast sync mode (this option has effect only while bootstrapping)
+  --fastsync-verify  Fastsync only if state is vouched by peers on different subnets, otherwise a single peer is trusted
   --timeisinsync  Confirms to daemon that time is in sync, so daemon doesn't try to sync
-  --socks-proxy=<socks_ip:port>  Use a proxy to connect to network.
+  --socks-proxy=<socks_ip:port>  Use a proxy to connect to network, p2p runs over tcp only and connects to onion/i2p peers.
+  --p2p-external-address=<xyz.onion:18089>  Onion/i2p address advertised to peers, when running behind a hidden service with --socks-proxy.
   --data-dir=<directory>    Store blockchain data at this location
   --rpc-bind=<127.0.0.1:9999>    RPC listens on this ip:port
+  --rpc-admin-login=<username:password>	Enables admin rpc (DERO.SetTemplatePolicy) on /admin/json_rpc, requests must use these credentials
   --p2p-bind=<0.0.0.0:18089>    p2p server listens on this ip:port, specify port 0 to disable listening server
   --getwork-bind=<0.0.0.0:10100>    getwork server listens on this ip:port, specify port 0 to disable listening server
+  --getwork-vardiff=<15>	seconds between shares of each miner worker, share difficulty is adjusted per worker, disabled by default
+  --stratum-bind=<0.0.0.0:10300>	stratum server for miners listens on this ip:port, disabled by default
+  --pool-wallet=<wallet.db>	Enables pool mode, miners mine to this wallet's address and rewards are paid out from it using PPLNS
+  --pool-wallet-password=<password>	Password of pool wallet
+  --pool-share-diff=<0>	Difficulty of pool shares, 0 uses network difficulty divided by 64
+  --pool-fee=<1.0>	Pool fee in percent, deducted from every reward found by pool
+  --pool-payout-threshold=<100000>	Miners are paid once their balance reaches this amount in atomic units (100000 is 1 DERO)
+  --pool-http-bind=<127.0.0.1:10110>	Pool statistics are served as json on this ip:port
   --add-exclusive-node=<ip:port>	Connect to specific peer only 
   --add-priority-node=<ip:port>	Maintain persistant connection to specified peer
   --sync-node       Sync node automatically with the seeds nodes. This option is for rare use.
   --node-tag=<unique name>	Unique name of node, visible to everyone
+  --p2p-max-upload=<0>	Limit total p2p upload in KB/s, 0 is unlimited. Blocks and miniblocks are served first
+  --p2p-max-download=<0>	Limit total p2p download in KB/s, 0 is unlimited
+  --p2p-max-upload-peer=<0>	Limit p2p upload per peer in KB/s, 0 is unlimited
+  --p2p-max-download-peer=<0>	Limit p2p download per peer in KB/s, 0 is unlimited
+  --dandelion  Relay txs submitted to this node using stem phase first, hiding this node as origin
+  --dandelion-fluff=<10>	Probability in percent with which a stem tx is fluffed at each hop
+  --dandelion-embargo=<30>	Seconds after which a stem tx not seen in network is fluffed by this node (a random delay is added)
+  --mempool-size=<67108864>	Max size of all txs in mempool in bytes, when full lowest fee per byte txs are evicted (0 is unlimited)
+  --mempool-peer-limit=<1000>	Max txs in mempool relayed by a single peer (0 is unlimited)
+  --mempool-ip-limit=<2000>	Max txs in mempool relayed from a single IP (0 is unlimited)
   --integrator-address	if this node mines a block,Integrator rewards will be given to address.default is dev's address.
   --min-peers=<31>	  Node will try to maintain atleast this many connections to peers
   --max-peers=<101>	  Node will maintain maximim this many connections to peers and will stop accepting connections
   --prune-history=<50>	prunes blockchain history until the specific topo_height
+  --prune-depth=<20000>	Keeps pruning history in background while running, only this many recent topoheights are kept (minimum 1000)
+  --block-store=<fs>	Block/tx storage for a new data directory, fs (file per object, default) or pack (segment files with index, opt-in). Existing data is always used as it is
+  --migrate-block-store=<pack>	Converts existing block/tx storage to fs or pack and continues
+  --pow-cache=<0>	Size in MB of on disk cache of verified miniblock PoW, reused across restarts and verify-chain, disabled by default
+  --from=<0>	export, verify-chain: first topoheight
+  --to=<topoheight>	export, verify-chain: last topoheight, default is chain top
+  --workers=<cpus>	verify-chain: topoheights verified in parallel, default is number of cpus
+  --topoheight=<topoheight>	export-state: topoheight of exported state, default is chain top
+  --state-hash=<hash>	import-state: state hash printed by export-state on a node you trust, it covers state after last snapshot block and difficulty of first blocks
+
+Commands:
+  export	Writes complete blocks in topological order to a checksummed archive file and exits
+  import	Validates and adds all blocks from an archive file and exits, an interrupted import continues where it stopped
+  export-state	Writes state at a topoheight together with the blocks before it to a snapshot file and exits
+  import-state	Imports a snapshot into an empty data directory, state must match --state-hash and blocks must carry valid PoW, then exits
+  verify-chain	Verifies stored chain, PoW, miniblocks, tx proofs and state of every block, reports first divergence and exits
 
   `
 
@@ -163,6 +206,14 @@ func main() {
 
 	params := map[string]interface{}{}
 
+	// check whether block store needs to be converted, if requested do so
+	if _, ok := globals.Arguments["--migrate-block-store"]; ok && globals.Arguments["--migrate-block-store"] != nil {
+		if err := blockchain.Migrate_Block_Store(globals.Arguments["--migrate-block-store"].(string)); err != nil {
+			logger.Error(err, "Error migrating block store")
+			return
+		}
+	}
+
 	// check  whether we are pruning, if requested do so
 	prune_topo := int64(50)
 	if _, ok := globals.Arguments["--prune-history"]; ok && globals.Arguments["--prune-history"] != nil { // user specified a limit, use it if possible
@@ -189,6 +240,15 @@ func main() {
 		}
 	}
 
+	if _, ok := globals.Arguments["--prune-depth"]; ok && globals.Arguments["--prune-depth"] != nil {
+		i, err := strconv.ParseInt(globals.Arguments["--prune-depth"].(string), 10, 64)
+		if err != nil {
+			logger.Error(err, "error Parsing --prune-depth ")
+			return
+		}
+		params["--prune-depth"] = i
+	}
+
 	if _, ok := globals.Arguments["--timeisinsync"]; ok {
 		globals.TimeIsInSync = globals.Arguments["--timeisinsync"].(bool)
 	}
@@ -205,15 +265,40 @@ func main() {
 
 	params["chain"] = chain
 
+	// export/import work offline and exit once done
+	for _, command := range []string{"export", "import", "export-state", "import-state", "verify-chain"} {
+		if globals.Arguments[command] == true {
+			if err = run_offline_command(chain, command); err != nil {
+				logger.Error(err, "Command failed", "command", command)
+			}
+			chain.Shutdown()
+			return
+		}
+	}
+
 	// since user is using a proxy, he definitely does not want to give out his IP
+	// unless he is running a hidden service, which forwards to p2p-bind
 	if globals.Arguments["--socks-proxy"] != nil {
-		globals.Arguments["--p2p-bind"] = ":0"
-		logger.Info("Disabling P2P server since we are using socks proxy")
+		if globals.Arguments["--p2p-external-address"] == nil {
+			globals.Arguments["--p2p-bind"] = ":0"
+			logger.Info("Disabling P2P server since we are using socks proxy")
+		} else if globals.Arguments["--p2p-bind"] == nil { // listen locally on the same port as the hidden service
+			if _, port, err := net.SplitHostPort(globals.Arguments["--p2p-external-address"].(string)); err == nil {
+				globals.Arguments["--p2p-bind"] = "127.0.0.1:" + port
+			}
+		}
 	}
 
 	p2p.P2P_Init(params)
 	rpcserver, _ := derodrpc.RPCServer_Start(params)
 
+	if wallet, err := open_pool_wallet(); err != nil {
+		logger.Error(err, "Pool mode could not be enabled")
+		return
+	} else if wallet != nil {
+		derodrpc.PoolWallet = wallet
+	}
+
 	go derodrpc.Getwork_server()
 
 	// setup function pointers
@@ -373,6 +458,83 @@ func main() {
 	}
 }
 
+// runs export/import commands, these do not need network
+func run_offline_command(chain *blockchain.Blockchain, command string) (err error) {
+	int_argument := func(name string, value int64) (int64, error) {
+		if globals.Arguments[name] == nil {
+			return value, nil
+		}
+		i, err := strconv.ParseInt(globals.Arguments[name].(string), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("error Parsing %s err %s", name, err)
+		}
+		return i, nil
+	}
+
+	filename, _ := globals.Arguments["<file>"].(string)
+	switch command {
+	case "export":
+		var from, to int64
+		if from, err = int_argument("--from", 0); err != nil {
+			return err
+		}
+		if to, err = int_argument("--to", -1); err != nil {
+			return err
+		}
+		return export_chain(chain, from, to, filename)
+	case "import":
+		return import_chain(chain, filename)
+	case "export-state":
+		var topo int64
+		if topo, err = int_argument("--topoheight", -1); err != nil {
+			return err
+		}
+		return export_state(chain, topo, filename)
+	case "import-state":
+		state_hash, _ := globals.Arguments["--state-hash"].(string)
+		var trusted crypto.Hash
+		if decoded, err := hex.DecodeString(state_hash); err != nil || len(decoded) != len(trusted) {
+			return fmt.Errorf("invalid --state-hash %q", state_hash)
+		} else {
+			copy(trusted[:], decoded)
+		}
+		return import_state(chain, filename, trusted)
+	case "verify-chain":
+		var from, to, workers int64
+		if from, err = int_argument("--from", 0); err != nil {
+			return err
+		}
+		if to, err = int_argument("--to", -1); err != nil {
+			return err
+		}
+		if workers, err = int_argument("--workers", 0); err != nil {
+			return err
+		}
+		return verify_chain(chain, from, to, int(workers))
+	}
+	return fmt.Errorf("unknown command %s", command)
+}
+
+// verifies stored chain and reports the first divergence
+func verify_chain(chain *blockchain.Blockchain, from, to int64, workers int) error {
+	start := time.Now()
+	result, err := chain.Verify_Chain(from, to, workers, func(verified, total int64) {
+		logger.Info("Verifying chain", "done", verified, "total", total, "percent", float64(verified*100)/float64(total))
+	})
+	if err != nil {
+		return err
+	}
+	logger.Info("Chain verification completed", "from", result.From, "to", result.To, "verified", result.Verified, "duration", time.Since(start))
+	for _, verr := range result.Errors {
+		logger.Error(verr.Err, "Verification failed", "topoheight", verr.Topo, "blid", verr.BLID, "check", verr.Check)
+	}
+	if result.First != nil {
+		return fmt.Errorf("chain diverges at topoheight %d: %s", result.First.Topo, result.First)
+	}
+	logger.Info("Chain is consistent")
+	return nil
+}
+
 func readline_loop(l *readline.Instance, chain *blockchain.Blockchain, logger logr.Logger) (err error) {
 
 	defer func() {
@@ -501,12 +663,14 @@ restart_loop:
 					diff = chain.Load_Block_Difficulty(current_block_id)
 				}
 
+				chain.Prune_Mutex.RLock() // state versions must not change under us
 				version, err := chain.ReadBlockSnapshotVersion(current_block_id)
 				if err != nil {
 					panic(err)
 				}
 
 				balance_hash, err := chain.Load_Merkle_Hash(version)
+				chain.Prune_Mutex.RUnlock()
 
 				if err != nil {
 					panic(err)
@@ -517,6 +681,18 @@ restart_loop:
 				logger.Info("\n")
 
 			}
+		case command == "print_miniblocks": // prints miniblock DAG pending for next block or given height
+			var params rpc.GetMiniBlocks_Params
+			if len(line_parts) == 2 {
+				if s, err := strconv.ParseUint(line_parts[1], 10, 64); err == nil {
+					params.Height = s
+				} else {
+					logger.Error(err, "Invalid height value", "value", line_parts[1])
+					continue
+				}
+			}
+			print_miniblocks(derodrpc.GetMiniBlocksInfo(chain, params))
+
 		case command == "regpool_print":
 			chain.Regpool.Regpool_Print()
 
@@ -572,6 +748,11 @@ restart_loop:
 				logger.Error(fmt.Errorf("mempool_delete_tx  needs a single transaction id as argument"), "")
 			}
 
+		case command == "template_policy":
+			if err := template_policy_command(chain, line_parts[1:]); err != nil {
+				logger.Error(err, "template_policy failed")
+			}
+
 		case command == "version":
 			logger.Info("", "OS", runtime.GOOS, "ARCH", runtime.GOARCH, "GOMAXPROCS", runtime.GOMAXPROCS(0))
 			logger.Info("", "Version", config.Version.String())
@@ -644,7 +825,10 @@ restart_loop:
 
 			if block_data, err := os.ReadFile(fmt.Sprintf("/tmp/%s.block", hash)); err == nil {
 
-				cbl = p2p.Convert_P2PCBL_TO_CBL(block_data)
+				if cbl, err = p2p.Convert_P2PCBL_TO_CBL(block_data); err != nil {
+					fmt.Printf("err decoding block %s\n", err)
+					continue
+				}
 			} else {
 				fmt.Printf("err reading block %s\n", err)
 				continue
@@ -748,12 +932,14 @@ restart_loop:
 			fmt.Printf("difficulty: %s\n", chain.Load_Block_Difficulty(hash).String())
 			fmt.Printf("TopoHeight: %d\n", chain.Load_Block_Topological_order(hash))
 
+			chain.Prune_Mutex.RLock() // state versions must not change under us
 			version, err := chain.ReadBlockSnapshotVersion(hash)
 			if err != nil {
 				panic(err)
 			}
 
 			bhash, err := chain.Load_Merkle_Hash(version)
+			chain.Prune_Mutex.RUnlock()
 			if err != nil {
 				panic(err)
 			}
@@ -1156,6 +1342,45 @@ func prettyprint_json(b []byte) []byte {
 	return out.Bytes()
 }
 
+// print miniblock set, one branch per key, key building on current tips is marked
+func print_miniblocks(result rpc.GetMiniBlocks_Result) {
+	fmt.Printf("Miniblocks at height %d count %d collisions %d\n", result.Height, result.Count, result.Collisions)
+	fmt.Printf("Tips %s\n", strings.Join(result.Tips, " "))
+	if len(result.Keys) == 0 {
+		fmt.Printf("No miniblocks\n")
+		return
+	}
+	for _, key := range result.Keys {
+		mark := ""
+		if key.Tips {
+			mark = " (current tips)"
+		}
+		fmt.Printf("\nKey %s count %d%s\n", strings.Join(key.Past, " + "), key.Count, mark)
+		for i, mbl := range key.MiniBlocks {
+			branch := "├─"
+			if i == len(key.MiniBlocks)-1 {
+				branch = "└─"
+			}
+			flags := ""
+			if mbl.HighDiff {
+				flags += " HighDiff"
+			}
+			if mbl.Final {
+				flags += " Final"
+			}
+			received := "-"
+			if mbl.Received != 0 {
+				received = time.UnixMilli(mbl.Received).Format("15:04:05.000")
+			}
+			miner := mbl.Miner
+			if miner == "" {
+				miner = "-"
+			}
+			fmt.Printf("  %s %2d %s time %5d received %s collisions %d miner %s%s\n", branch, i+1, mbl.Hash[:16], mbl.Timestamp, received, mbl.Collisions, miner, flags)
+		}
+	}
+}
+
 func usage(w io.Writer) {
 	io.WriteString(w, "commands:\n")
 	io.WriteString(w, "\t\033[1mhelp\033[0m\t\tthis help\n")
@@ -1163,6 +1388,7 @@ func usage(w io.Writer) {
 	io.WriteString(w, "\t\033[1mprint_bc\033[0m\tPrint blockchain info in a given blocks range, print_bc <begin_height> <end_height>\n")
 	io.WriteString(w, "\t\033[1mprint_block\033[0m\tPrint block, print_block <block_hash> or <block_height>\n")
 	io.WriteString(w, "\t\033[1mprint_tx\033[0m\tPrint transaction, print_tx <transaction_hash>\n")
+	io.WriteString(w, "\t\033[1mprint_miniblocks\033[0m\tPrint miniblocks pending for next block, print_miniblocks [height]\n")
 	io.WriteString(w, "\t\033[1mstatus\033[0m\t\tShow general information\n")
 	io.WriteString(w, "\t\033[1mpeer_list\033[0m\tPrint peer list\n")
 	io.WriteString(w, "\t\033[1msyncinfo\033[0m\tPrint information about connected peers and their state\n")
@@ -1177,6 +1403,7 @@ func usage(w io.Writer) {
 	io.WriteString(w, "\t\033[1mregpool_delete_tx\033[0m\t\tDelete specific tx from regpool\n")
 	io.WriteString(w, "\t\033[1mregpool_flush\033[0m\t\tFlush mempool\n")
 	io.WriteString(w, "\t\033[1msetintegratoraddress\033[0m\t\tChange current integrated address\n")
+	io.WriteString(w, "\t\033[1mtemplate_policy\033[0m\t\tSelect txs for block templates, template_policy [clear | priority <txid>... | exclude <txid>... | exclude_sc <scid>... | max_size <bytes>]\n")
 
 	io.WriteString(w, "\t\033[1mversion\033[0m\t\tShow version\n")
 	io.WriteString(w, "\t\033[1mexit\033[0m\t\tQuit the daemon\n")
@@ -1198,10 +1425,12 @@ var completer = readline.NewPrefixCompleter(
 	readline.PcItem("peer_list"),
 	readline.PcItem("print_bc"),
 	readline.PcItem("print_block"),
+	readline.PcItem("print_miniblocks"),
 	readline.PcItem("block_export"),
 	readline.PcItem("block_import"),
 	//	readline.PcItem("print_tx"),
 	readline.PcItem("setintegratoraddress"),
+	readline.PcItem("template_policy"),
 	readline.PcItem("status"),
 	readline.PcItem("syncinfo"),
 	readline.PcItem("version"),
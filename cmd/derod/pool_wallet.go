@@ -0,0 +1,77 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+// this file opens the wallet used by pool mode of getwork server to pay out miners
+// the wallet syncs with this daemon's own RPC server
+
+import "fmt"
+import "net"
+
+import "github.com/deroproject/derohe/config"
+import "github.com/deroproject/derohe/globals"
+import "github.com/deroproject/derohe/walletapi"
+
+// returns nil wallet if pool mode is not requested
+func open_pool_wallet() (wallet *walletapi.Wallet_Disk, err error) {
+	if globals.Arguments["--pool-wallet"] == nil {
+		return nil, nil
+	}
+
+	endpoint, err := local_rpc_address()
+	if err != nil {
+		return nil, err
+	}
+
+	password := ""
+	if v := globals.Arguments["--pool-wallet-password"]; v != nil {
+		password = v.(string)
+	}
+	if wallet, err = walletapi.Open_Encrypted_Wallet(globals.Arguments["--pool-wallet"].(string), password); err != nil {
+		return nil, fmt.Errorf("could not open pool wallet: %s", err)
+	}
+
+	globals.Arguments["--daemon-address"] = endpoint // feed it for wallet
+	wallet.SetNetwork(globals.IsMainnet())
+	wallet.SetOnlineMode()
+	go walletapi.Keep_Connectivity()
+	return wallet, nil
+}
+
+// address at which this daemon's RPC server can be reached locally
+func local_rpc_address() (string, error) {
+	port := config.Mainnet.RPC_Default_Port
+	if !globals.IsMainnet() {
+		port = config.Testnet.RPC_Default_Port
+	}
+	ip := net.IPv4(127, 0, 0, 1)
+
+	if v := globals.Arguments["--rpc-bind"]; v != nil {
+		addr, err := net.ResolveTCPAddr("tcp", v.(string))
+		if err != nil {
+			return "", fmt.Errorf("--rpc-bind address is invalid: %s", err)
+		}
+		if addr.Port == 0 {
+			return "", fmt.Errorf("pool mode requires RPC server for pool wallet")
+		}
+		port = addr.Port
+		if addr.IP != nil && !addr.IP.IsUnspecified() {
+			ip = addr.IP
+		}
+	}
+	return net.JoinHostPort(ip.String(), fmt.Sprintf("%d", port)), nil
+}
@@ -27,6 +27,9 @@ import "github.com/deroproject/derohe/blockchain"
 
 /* fill up the above structure from the blockchain */
 func GetBlockHeader(chain *blockchain.Blockchain, hash crypto.Hash) (result rpc.BlockHeader_Print, err error) {
+	chain.Prune_Mutex.RLock() // state versions must not change under us
+	defer chain.Prune_Mutex.RUnlock()
+
 	bl, err := chain.Load_BL_FROM_ID(hash)
 	if err != nil {
 		return
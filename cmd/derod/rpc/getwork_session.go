@@ -0,0 +1,390 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rpc
+
+// this file tracks statistics of every connected miner (getwork or stratum)
+// miners may name their workers, "<address>.<worker>", and each worker gets its own share difficulty (vardiff)
+// shares are used to estimate hashrate of each worker, totals per protocol are exported as prometheus metrics
+// named workers also get their own metrics, limited to WORKER_METRICS_MAX workers to keep cardinality bounded
+
+import "fmt"
+import "sync"
+import "time"
+import "strconv"
+import "strings"
+import "math/big"
+
+import "github.com/deroproject/derohe/cryptography/crypto"
+import "github.com/deroproject/derohe/globals"
+import "github.com/deroproject/derohe/metrics"
+import "github.com/deroproject/derohe/rpc"
+import "github.com/deroproject/graviton"
+
+const VARDIFF_MIN_DIFFICULTY = 1000 // vardiff never goes below this, unless network difficulty is lower
+const VARDIFF_RETARGET_FACTOR = 8   // difficulty is retargetted after these many target share intervals
+const VARDIFF_RETARGET_SHARES = 16  // or after these many shares, whichever is earlier
+const VARDIFF_MAX_CHANGE = 4        // difficulty changes at most by this factor on a retarget
+const SESSION_JOBS_MAX = 16         // jobs remembered per miner
+const SESSION_HASHRATE_WINDOW = 600 // seconds of shares used to estimate hashrate
+const WORKER_NAME_MAX = 32
+const WORKER_METRICS_MAX = 100 // named workers which get their own metrics, others are only counted in totals
+
+var vardiff_target uint64 // seconds between shares of a worker, 0 disables vardiff
+
+// configure vardiff from --getwork-vardiff
+func vardiff_init() {
+	if v := globals.Arguments["--getwork-vardiff"]; v != nil {
+		if target, err := strconv.ParseUint(v.(string), 10, 64); err == nil {
+			vardiff_target = target
+		} else {
+			logger_getwork.Error(err, "--getwork-vardiff is invalid, vardiff is disabled")
+		}
+	}
+}
+
+type session_job struct {
+	tstamp     uint64
+	difficulty uint64   // share difficulty
+	network    *big.Int // network difficulty
+}
+
+type share_event struct {
+	time       int64
+	difficulty uint64
+}
+
+func new_session(addr rpc.Address, worker string, protocol string) *user_session {
+	metrics_register(protocol)
+	v := &user_session{address: addr, address_sum: graviton.Sum(addr.PublicKey.EncodeCompressed()), worker: worker, protocol: protocol, connected: time.Now(), rejects: map[string]uint64{}}
+	worker_register(v)
+	return v
+}
+
+// split "<address>.<worker>", worker names are limited to a few safe characters
+func parse_worker(login string) (address string, worker string) {
+	address = login
+	if i := strings.Index(login, "."); i >= 0 {
+		address, worker = login[:i], login[i+1:]
+	}
+	worker = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+		return -1
+	}, worker)
+	if len(worker) > WORKER_NAME_MAX {
+		worker = worker[:WORKER_NAME_MAX]
+	}
+	return
+}
+
+// share difficulty for a job, job is remembered so that submitted work can be validated
+func (v *user_session) job_difficulty(job *mining_job) uint64 {
+	v.Lock()
+	defer v.Unlock()
+
+	difficulty := ^uint64(0)
+	if job.job_diff.IsUint64() {
+		difficulty = job.job_diff.Uint64()
+	}
+	switch {
+	case v.fixed_difficulty != 0:
+		difficulty = v.fixed_difficulty
+		if difficulty < STRATUM_MIN_DIFFICULTY {
+			difficulty = STRATUM_MIN_DIFFICULTY
+		}
+	case vardiff_target != 0:
+		difficulty = v.vardiff()
+	}
+	if job.diff.IsUint64() && difficulty > job.diff.Uint64() {
+		difficulty = job.diff.Uint64()
+	}
+
+	if len(v.jobs) == 0 || v.jobs[len(v.jobs)-1].tstamp != job.bl.Timestamp || v.jobs[len(v.jobs)-1].difficulty != difficulty {
+		v.jobs = append(v.jobs, session_job{tstamp: job.bl.Timestamp, difficulty: difficulty, network: job.diff})
+		if len(v.jobs) > SESSION_JOBS_MAX {
+			v.jobs = v.jobs[1:]
+			for mblid, tstamp := range v.seen { // shares of forgotten jobs are stale anyway
+				if tstamp < v.jobs[0].tstamp {
+					delete(v.seen, mblid)
+				}
+			}
+		}
+	}
+	return difficulty
+}
+
+// retarget difficulty so that worker submits a share every vardiff_target seconds, caller must hold lock
+func (v *user_session) vardiff() uint64 {
+	now := time.Now()
+	if v.difficulty == 0 { // start assuming a slow cpu miner, difficulty rises quickly for faster ones
+		v.difficulty = 1000 * vardiff_target
+		if v.difficulty < VARDIFF_MIN_DIFFICULTY {
+			v.difficulty = VARDIFF_MIN_DIFFICULTY
+		}
+		v.retarget_time = now
+		v.retarget_shares = 0
+	}
+
+	elapsed := now.Sub(v.retarget_time).Seconds()
+	if elapsed >= float64(vardiff_target*VARDIFF_RETARGET_FACTOR) || (v.retarget_shares >= VARDIFF_RETARGET_SHARES && elapsed >= 1) {
+		v.difficulty = vardiff_retarget(v.difficulty, v.retarget_shares, elapsed, vardiff_target)
+		v.retarget_time = now
+		v.retarget_shares = 0
+	}
+	return v.difficulty
+}
+
+func vardiff_retarget(difficulty uint64, shares uint64, elapsed float64, target uint64) uint64 {
+	next := difficulty / VARDIFF_MAX_CHANGE
+	if shares > 0 {
+		next = uint64(float64(difficulty) * float64(shares) * float64(target) / elapsed)
+	}
+	if next < difficulty/VARDIFF_MAX_CHANGE {
+		next = difficulty / VARDIFF_MAX_CHANGE
+	}
+	if next > difficulty*VARDIFF_MAX_CHANGE {
+		next = difficulty * VARDIFF_MAX_CHANGE
+	}
+	if next < VARDIFF_MIN_DIFFICULTY {
+		next = VARDIFF_MIN_DIFFICULTY
+	}
+	return next
+}
+
+// locate job given to this miner
+func (v *user_session) find_job(tstamp uint64) (job session_job, ok bool) {
+	v.Lock()
+	defer v.Unlock()
+	for i := len(v.jobs) - 1; i >= 0; i-- {
+		if v.jobs[i].tstamp == tstamp {
+			return v.jobs[i], true
+		}
+	}
+	return
+}
+
+// remember a share, false if it was already submitted
+func (v *user_session) first_share(tstamp uint64, mblid crypto.Hash) bool {
+	v.Lock()
+	defer v.Unlock()
+	if _, ok := v.seen[mblid]; ok {
+		return false
+	}
+	if v.seen == nil {
+		v.seen = map[crypto.Hash]uint64{}
+	}
+	v.seen[mblid] = tstamp
+	return true
+}
+
+func (v *user_session) accept_share(difficulty uint64) {
+	v.Lock()
+	defer v.Unlock()
+
+	now := time.Now().Unix()
+	v.shares++
+	v.retarget_shares++
+	v.last_share = now
+	v.share_log = append(v.share_log, share_event{time: now, difficulty: difficulty})
+	for len(v.share_log) > 0 && v.share_log[0].time < now-SESSION_HASHRATE_WINDOW {
+		v.share_log = v.share_log[1:]
+	}
+	metrics.Set.GetOrCreateCounter(v.metric("getwork_shares_total")).Inc()
+	if v.labeled {
+		metrics.Set.GetOrCreateCounter(v.worker_metric("getwork_worker_shares_total")).Inc()
+	}
+}
+
+func (v *user_session) reject(reason string) {
+	v.Lock()
+	defer v.Unlock()
+	v.rejected++
+	v.lasterr = reason
+	v.rejects[reason]++
+	metrics.Set.GetOrCreateCounter(v.metric("getwork_rejected_total")).Inc()
+	if v.labeled {
+		metrics.Set.GetOrCreateCounter(v.worker_metric("getwork_worker_rejected_total")).Inc()
+	}
+}
+
+// a miniblock or block was accepted by chain
+func (v *user_session) found(is_block bool) {
+	v.Lock()
+	defer v.Unlock()
+	if is_block {
+		v.blocks++
+	} else {
+		v.miniblocks++
+	}
+	metrics.Set.GetOrCreateCounter(v.metric("getwork_miniblocks_total")).Inc()
+	if v.labeled {
+		metrics.Set.GetOrCreateCounter(v.worker_metric("getwork_worker_miniblocks_total")).Inc()
+	}
+}
+
+// estimated hashrate from recent shares
+func (v *user_session) hashrate() uint64 {
+	v.Lock()
+	defer v.Unlock()
+
+	now := time.Now().Unix()
+	window := now - v.connected.Unix()
+	if window > SESSION_HASHRATE_WINDOW {
+		window = SESSION_HASHRATE_WINDOW
+	}
+	if window < 1 {
+		window = 1
+	}
+	total := uint64(0)
+	for _, share := range v.share_log {
+		if share.time >= now-SESSION_HASHRATE_WINDOW {
+			total += share.difficulty
+		}
+	}
+	return total / uint64(window)
+}
+
+func (v *user_session) info() (info rpc.Miner_Info) {
+	hashrate := v.hashrate()
+
+	v.Lock()
+	defer v.Unlock()
+	info = rpc.Miner_Info{Address: v.address.String(), Worker: v.worker, Protocol: v.protocol, Connected: v.connected.Unix(), Hashrate: hashrate,
+		Shares: v.shares, MiniBlocks: v.miniblocks, Blocks: v.blocks, Rejected: v.rejected, LastShare: v.last_share, LastError: v.lasterr, Rejects: map[string]uint64{}}
+	if len(v.jobs) > 0 {
+		info.Difficulty = v.jobs[len(v.jobs)-1].difficulty
+	}
+	for reason, count := range v.rejects {
+		info.Rejects[reason] = count
+	}
+	return
+}
+
+// name of per protocol metric
+func (v *user_session) metric(name string) string {
+	return fmt.Sprintf(`%s{protocol="%s"}`, name, v.protocol)
+}
+
+// name of per worker metric, only used for labeled sessions
+func (v *user_session) worker_metric(name string) string {
+	return fmt.Sprintf(`%s{address="%s",worker="%s"}`, name, v.address.String(), v.worker)
+}
+
+// workers with same name may be connected multiple times, their metrics are combined
+// worker names are chosen by miners, so only named workers are labeled and at most WORKER_METRICS_MAX of them
+var workers_mutex sync.Mutex
+var workers = map[string]map[*user_session]bool{}
+
+func worker_register(v *user_session) {
+	if v.worker == "" {
+		return
+	}
+
+	workers_mutex.Lock()
+	defer workers_mutex.Unlock()
+
+	key := v.worker_metric("")
+	if workers[key] == nil {
+		if len(workers) >= WORKER_METRICS_MAX {
+			return
+		}
+		workers[key] = map[*user_session]bool{}
+		metrics.Set.GetOrCreateGauge(v.worker_metric("getwork_worker_hashrate"), func() float64 {
+			total := uint64(0)
+			for _, s := range worker_sessions(key) {
+				total += s.hashrate()
+			}
+			return float64(total)
+		})
+		metrics.Set.GetOrCreateGauge(v.worker_metric("getwork_worker_difficulty"), func() float64 {
+			difficulty := uint64(0)
+			for _, s := range worker_sessions(key) {
+				if info := s.info(); info.Difficulty > difficulty {
+					difficulty = info.Difficulty
+				}
+			}
+			return float64(difficulty)
+		})
+	}
+	workers[key][v] = true
+	v.labeled = true
+}
+
+func worker_sessions(key string) (list []*user_session) {
+	workers_mutex.Lock()
+	defer workers_mutex.Unlock()
+	for s := range workers[key] {
+		list = append(list, s)
+	}
+	return
+}
+
+// miner disconnected, metrics of worker are removed once all its connections are gone
+func (v *user_session) close() {
+	if !v.labeled {
+		return
+	}
+
+	workers_mutex.Lock()
+	defer workers_mutex.Unlock()
+
+	key := v.worker_metric("")
+	delete(workers[key], v)
+	if len(workers[key]) == 0 {
+		delete(workers, key)
+		for _, name := range []string{"getwork_worker_hashrate", "getwork_worker_difficulty", "getwork_worker_shares_total", "getwork_worker_rejected_total", "getwork_worker_miniblocks_total"} {
+			metrics.Set.UnregisterMetric(v.worker_metric(name))
+		}
+	}
+}
+
+var metrics_registered sync.Map
+
+// gauges are computed from connected miners, registered once per protocol
+func metrics_register(protocol string) {
+	if _, loaded := metrics_registered.LoadOrStore(protocol, true); loaded {
+		return
+	}
+	metrics.Set.GetOrCreateGauge(fmt.Sprintf(`getwork_hashrate{protocol="%s"}`, protocol), func() float64 {
+		total := uint64(0)
+		for _, s := range all_sessions() {
+			if s.protocol == protocol {
+				total += s.hashrate()
+			}
+		}
+		return float64(total)
+	})
+}
+
+// all connected miners
+func all_sessions() (list []*user_session) {
+	client_list_mutex.Lock()
+	for _, v := range client_list {
+		list = append(list, v)
+	}
+	client_list_mutex.Unlock()
+
+	stratum_list_mutex.Lock()
+	for sc := range stratum_list {
+		if sc.session != nil {
+			list = append(list, sc.session)
+		}
+	}
+	stratum_list_mutex.Unlock()
+	return
+}
@@ -0,0 +1,157 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rpc
+
+import "fmt"
+import "time"
+import "testing"
+import "math/big"
+
+import "github.com/deroproject/derohe/block"
+import "github.com/deroproject/derohe/cryptography/crypto"
+import "github.com/deroproject/derohe/rpc"
+
+func Test_Parse_Worker(t *testing.T) {
+	tests := []struct{ login, address, worker string }{
+		{"deto1abc", "deto1abc", ""},
+		{"deto1abc.rig1", "deto1abc", "rig1"},
+		{"deto1abc.rig.1", "deto1abc", "rig1"},
+		{"deto1abc.r\"ig<1>", "deto1abc", "rig1"},
+		{"deto1abc.0123456789012345678901234567890123456789", "deto1abc", "01234567890123456789012345678901"},
+	}
+	for _, test := range tests {
+		if address, worker := parse_worker(test.login); address != test.address || worker != test.worker {
+			t.Fatalf("parsing %s failed, got %s %s", test.login, address, worker)
+		}
+	}
+}
+
+func Test_Vardiff_Retarget(t *testing.T) {
+	if diff := vardiff_retarget(10000, 16, 60, 15); diff != 40000 { // 4 times faster than target
+		t.Fatalf("unexpected difficulty %d", diff)
+	}
+	if diff := vardiff_retarget(10000, 8, 120, 15); diff != 10000 { // on target
+		t.Fatalf("unexpected difficulty %d", diff)
+	}
+	if diff := vardiff_retarget(10000, 1000, 1, 15); diff != 40000 { // change is limited
+		t.Fatalf("unexpected difficulty %d", diff)
+	}
+	if diff := vardiff_retarget(10000, 0, 120, 15); diff != 2500 { // no shares
+		t.Fatalf("unexpected difficulty %d", diff)
+	}
+	if diff := vardiff_retarget(2000, 0, 120, 15); diff != VARDIFF_MIN_DIFFICULTY {
+		t.Fatalf("unexpected difficulty %d", diff)
+	}
+}
+
+func Test_Session_Difficulty(t *testing.T) {
+	defer func(old uint64) { vardiff_target = old }(vardiff_target)
+
+	job := mining_job{bl: block.Block{Timestamp: 1000}, diff: big.NewInt(100000), job_diff: big.NewInt(100000)}
+	sess := &user_session{connected: time.Now(), rejects: map[string]uint64{}}
+
+	vardiff_target = 0
+	if diff := sess.job_difficulty(&job); diff != 100000 {
+		t.Fatalf("without vardiff job difficulty must be used, got %d", diff)
+	}
+
+	vardiff_target = 15
+	if diff := sess.job_difficulty(&job); diff != 15000 {
+		t.Fatalf("vardiff must start at 1000 times target, got %d", diff)
+	}
+	sess.retarget_time = time.Now().Add(-60 * time.Second)
+	sess.retarget_shares = 100
+	if diff := sess.job_difficulty(&job); diff != 60000 { // change is limited to 4 times
+		t.Fatalf("vardiff must retarget, got %d", diff)
+	}
+	sess.retarget_time = time.Now().Add(-60 * time.Second)
+	sess.retarget_shares = 16
+	if diff := sess.job_difficulty(&job); diff != 100000 {
+		t.Fatalf("vardiff cannot exceed network difficulty, got %d", diff)
+	}
+
+	sess.fixed_difficulty = 10
+	if diff := sess.job_difficulty(&job); diff != STRATUM_MIN_DIFFICULTY {
+		t.Fatalf("fixed difficulty must be clamped, got %d", diff)
+	}
+
+	if job, ok := sess.find_job(1000); !ok || job.difficulty != STRATUM_MIN_DIFFICULTY || job.network.Cmp(big.NewInt(100000)) != 0 {
+		t.Fatalf("job must be found %+v", job)
+	}
+	if _, ok := sess.find_job(999); ok {
+		t.Fatalf("unknown job must not be found")
+	}
+
+	now := time.Now().Unix()
+	sess.connected = time.Now().Add(-1000 * time.Second)
+	sess.share_log = []share_event{{time: now - 700, difficulty: 60000}, {time: now - 10, difficulty: 60000}, {time: now, difficulty: 60000}}
+	if hashrate := sess.hashrate(); hashrate != 200 {
+		t.Fatalf("unexpected hashrate %d", hashrate)
+	}
+}
+
+// shares are remembered only while their job is remembered
+func Test_Session_First_Share(t *testing.T) {
+	sess := &user_session{connected: time.Now(), rejects: map[string]uint64{}}
+	job := mining_job{bl: block.Block{Timestamp: 1000}, diff: big.NewInt(100000), job_diff: big.NewInt(100000)}
+	sess.job_difficulty(&job)
+
+	if !sess.first_share(1000, [32]byte{1}) || sess.first_share(1000, [32]byte{1}) {
+		t.Fatalf("share must be accepted only once")
+	}
+
+	for i := uint64(1); i <= SESSION_JOBS_MAX; i++ {
+		job.bl.Timestamp = 1000 + i
+		sess.job_difficulty(&job)
+	}
+	if len(sess.seen) != 0 {
+		t.Fatalf("shares of forgotten jobs must be dropped %+v", sess.seen)
+	}
+}
+
+// only named workers get their own metrics, at most WORKER_METRICS_MAX of them
+func Test_Worker_Metrics_Limit(t *testing.T) {
+	var addr rpc.Address
+	addr.PublicKey = crypto.GPoint.ScalarMult(crypto.RandomScalarBNRed())
+
+	var sessions []*user_session
+	defer func() {
+		for _, v := range sessions {
+			v.close()
+		}
+	}()
+
+	if v := new_session(addr, "", "getwork"); v.labeled {
+		t.Fatalf("unnamed worker must not be labeled")
+	}
+	for i := 0; i < WORKER_METRICS_MAX+10; i++ {
+		sessions = append(sessions, new_session(addr, fmt.Sprintf("rig%d", i), "getwork"))
+	}
+	sessions = append(sessions, new_session(addr, "rig0", "stratum")) // same worker connected twice
+
+	workers_mutex.Lock()
+	count := len(workers)
+	workers_mutex.Unlock()
+	if count != WORKER_METRICS_MAX || !sessions[0].labeled || sessions[WORKER_METRICS_MAX].labeled || !sessions[len(sessions)-1].labeled {
+		t.Fatalf("labeled workers must be limited, got %d", count)
+	}
+
+	sessions[0].close()
+	if len(worker_sessions(sessions[0].worker_metric(""))) != 1 {
+		t.Fatalf("worker metrics must stay while worker is connected")
+	}
+}
@@ -0,0 +1,387 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rpc
+
+// this file implements pool mode of the getwork server
+// miners mine to the pool address at a lower share difficulty, shares which also meet network difficulty are submitted to chain
+// rewards of miniblocks found by pool are distributed using PPLNS (pay per last N shares) and paid out by the pool wallet
+
+import "fmt"
+import "sort"
+import "sync"
+import "time"
+import "strconv"
+import "math/big"
+import "path/filepath"
+import "encoding/json"
+
+import "github.com/deroproject/derohe/block"
+import "github.com/deroproject/derohe/blockchain"
+import "github.com/deroproject/derohe/cryptography/crypto"
+import "github.com/deroproject/derohe/globals"
+import "github.com/deroproject/derohe/metrics"
+import "github.com/deroproject/derohe/rpc"
+import "github.com/deroproject/graviton"
+
+const POOL_PPLNS_FACTOR = 2      // PPLNS window covers these many times network difficulty worth of shares
+const POOL_SHARE_DIVISOR = 64    // default share difficulty is network difficulty divided by this
+const POOL_JOBS_MAX = 64         // shares are accepted for these many recent jobs
+const POOL_HISTORY_MAX = 1000    // rounds and payments kept in history
+const POOL_HASHRATE_WINDOW = 600 // seconds of shares used to estimate hashrate
+const POOL_SAVE_INTERVAL = "@every 60s"
+
+const (
+	ROUND_PENDING   = "pending"   // miniblock found, waiting to mature
+	ROUND_CONFIRMED = "confirmed" // reward credited to miners
+	ROUND_ORPHANED  = "orphaned"  // miniblock did not make it to chain
+)
+
+type pool_share struct {
+	Address    string `json:"address"`
+	Difficulty uint64 `json:"difficulty"`
+	Time       int64  `json:"time"`
+}
+
+// a miniblock found by pool, shares within PPLNS window at that time get its reward
+type pool_round struct {
+	MiniBlock string            `json:"miniblock"`
+	Height    int64             `json:"height"`
+	Time      int64             `json:"time"`
+	Status    string            `json:"status"`
+	Reward    uint64            `json:"reward"` // set when confirmed
+	Fee       uint64            `json:"fee"`    // pool fee deducted from reward
+	Shares    map[string]uint64 `json:"shares"` // address -> difficulty of its shares
+}
+
+// a single payout tx
+type pool_payment struct {
+	TXID    string            `json:"txid"`
+	Height  int64             `json:"height"` // chain height when tx was sent
+	Time    int64             `json:"time"`
+	Status  string            `json:"status"`
+	Amounts map[string]uint64 `json:"amounts"` // address -> amount
+}
+
+// everything which survives restarts
+type pool_state struct {
+	Shares   []pool_share      `json:"shares"` // PPLNS window, oldest first
+	Balances map[string]uint64 `json:"balances"`
+	Paid     map[string]uint64 `json:"paid"`
+	Rounds   []pool_round      `json:"rounds"`
+	Payments []pool_payment    `json:"payments"`
+}
+
+type pool_job struct {
+	height     int64
+	difficulty *big.Int        // network difficulty of job
+	template   block.MiniBlock // miniblock given to miners, keyhash is pool address
+	seen       map[crypto.Hash]bool
+}
+
+type mining_pool struct {
+	sync.Mutex
+	filename         string
+	address          rpc.Address
+	address_sum      [32]byte
+	share_difficulty uint64 // 0 means derive from network difficulty
+	fee_percent      float64
+	payout_threshold uint64
+	wallet           Pool_Wallet
+
+	jobs       map[uint64]*pool_job // recent jobs by job timestamp
+	network    *big.Int             // network difficulty of latest job
+	job_order  []uint64
+	window_sum uint64 // difficulty of all shares in window
+	state      pool_state
+	dirty      bool
+}
+
+var pool *mining_pool // nil unless pool mode is enabled
+
+// enable pool mode, if a pool wallet was provided
+func pool_init() (err error) {
+	if PoolWallet == nil {
+		return nil
+	}
+
+	p := &mining_pool{filename: filepath.Join(globals.GetDataDirectory(), "pool.json"), fee_percent: 1.0, payout_threshold: 100000, jobs: map[uint64]*pool_job{}, wallet: PoolWallet}
+
+	if v := globals.Arguments["--pool-share-diff"]; v != nil {
+		if p.share_difficulty, err = strconv.ParseUint(v.(string), 10, 64); err != nil {
+			return fmt.Errorf("--pool-share-diff is invalid: %s", err)
+		}
+	}
+	if v := globals.Arguments["--pool-fee"]; v != nil {
+		if p.fee_percent, err = strconv.ParseFloat(v.(string), 64); err != nil || p.fee_percent < 0 || p.fee_percent > 100 {
+			return fmt.Errorf("--pool-fee must be a percentage between 0 and 100")
+		}
+	}
+	if v := globals.Arguments["--pool-payout-threshold"]; v != nil {
+		if p.payout_threshold, err = strconv.ParseUint(v.(string), 10, 64); err != nil {
+			return fmt.Errorf("--pool-payout-threshold is invalid: %s", err)
+		}
+	}
+
+	if err = p.load(); err != nil {
+		return err
+	}
+	p.address = p.wallet.GetAddress()
+	p.address_sum = graviton.Sum(p.address.PublicKey.EncodeCompressed())
+
+	globals.Cron.AddFunc(POOL_SAVE_INTERVAL, p.save)
+	globals.Cron.AddFunc(POOL_PAYOUT_INTERVAL, p.payout)
+
+	if v := globals.Arguments["--pool-http-bind"]; v != nil {
+		go p.serve_http(v.(string))
+	}
+
+	pool = p
+	logger_getwork.Info("Pool mode enabled", "address", p.address.String(), "fee", p.fee_percent, "payout_threshold", globals.FormatMoney(p.payout_threshold))
+	return nil
+}
+
+func (p *mining_pool) load() error {
+	p.state = pool_state{Balances: map[string]uint64{}, Paid: map[string]uint64{}}
+
+	if err := globals.LoadJSON(p.filename, &p.state); err != nil {
+		return fmt.Errorf("pool state %s could not be loaded: %s", p.filename, err)
+	}
+	if p.state.Balances == nil {
+		p.state.Balances = map[string]uint64{}
+	}
+	if p.state.Paid == nil {
+		p.state.Paid = map[string]uint64{}
+	}
+	for _, share := range p.state.Shares {
+		p.window_sum += share.Difficulty
+	}
+	return nil
+}
+
+// save state if it changed, a crash never leaves partial state
+func (p *mining_pool) save() {
+	p.Lock()
+	if !p.dirty {
+		p.Unlock()
+		return
+	}
+	data, err := json.Marshal(&p.state) // snapshot, state keeps changing once unlocked
+	p.dirty = false
+	p.Unlock()
+
+	if err == nil {
+		err = globals.SaveJSON(p.filename, json.RawMessage(data))
+	}
+	if err != nil {
+		logger_getwork.Error(err, "Could not save pool state", "file", p.filename)
+	}
+}
+
+// difficulty at which shares are accepted, never more than network difficulty
+func (p *mining_pool) job_difficulty(network *big.Int) uint64 {
+	diff := p.share_difficulty
+	if diff == 0 {
+		diff = new(big.Int).Div(network, big.NewInt(POOL_SHARE_DIVISOR)).Uint64()
+	}
+	if diff == 0 {
+		diff = 1
+	}
+	if network.IsUint64() && diff > network.Uint64() {
+		diff = network.Uint64()
+	}
+	return diff
+}
+
+// remember job so that shares can be validated against it
+func (p *mining_pool) add_job(tstamp uint64, height int64, difficulty *big.Int, template block.MiniBlock) {
+	p.Lock()
+	defer p.Unlock()
+	if _, ok := p.jobs[tstamp]; ok {
+		return
+	}
+	if !template.Final { // work_for gives miners this keyhash
+		copy(template.KeyHash[:], p.address_sum[:])
+	}
+	p.jobs[tstamp] = &pool_job{height: height, difficulty: new(big.Int).Set(difficulty), template: template, seen: map[crypto.Hash]bool{}}
+	p.network = p.jobs[tstamp].difficulty
+	p.job_order = append(p.job_order, tstamp)
+	if len(p.job_order) > POOL_JOBS_MAX {
+		delete(p.jobs, p.job_order[0])
+		p.job_order = p.job_order[1:]
+	}
+}
+
+// validate a share, candidate is true if share also meets network difficulty and must be submitted to chain
+// share_difficulty of 0 means pool share difficulty of the job
+func (p *mining_pool) check_share(address string, tstamp uint64, blob []byte, share_difficulty uint64) (mblid crypto.Hash, candidate bool, height int64, err error) {
+	var mbl block.MiniBlock
+	if err = mbl.Deserialize(blob); err != nil {
+		p.reject("invalid")
+		return mblid, false, 0, fmt.Errorf("share could not be decoded: %s", err)
+	}
+	if !mbl.Final && mbl.KeyHash != p.address_sum {
+		p.reject("address")
+		return mblid, false, 0, fmt.Errorf("share is not for pool address")
+	}
+
+	mblid = mbl.GetHash()
+
+	var reason string
+	p.Lock()
+	job, ok := p.jobs[tstamp]
+	switch {
+	case !ok:
+		reason, err = "stale", fmt.Errorf("stale share, job not found")
+	case mbl.Height != job.template.Height:
+		reason, err = "height", fmt.Errorf("share height %d does not match job height %d", mbl.Height, job.template.Height)
+	case !job.matches(mbl):
+		reason, err = "template", fmt.Errorf("share does not match job template")
+	case p.seen(mblid):
+		reason, err = "duplicate", fmt.Errorf("duplicate share")
+	default:
+		job.seen[mblid] = true
+		if share_difficulty == 0 {
+			share_difficulty = p.job_difficulty(job.difficulty)
+		}
+	}
+	p.Unlock()
+
+	if err != nil {
+		p.reject(reason)
+		return mblid, false, 0, err
+	}
+
+	pow := mbl.GetPoWHash()
+	if !blockchain.CheckPowHashBig(pow, new(big.Int).SetUint64(share_difficulty)) {
+		p.reject("lowdiff")
+		return mblid, false, 0, fmt.Errorf("share does not meet share difficulty")
+	}
+
+	p.add_share(pool_share{Address: address, Difficulty: share_difficulty, Time: time.Now().Unix()}, job.difficulty)
+	metrics.Set.GetOrCreateCounter("pool_shares_accepted_total").Inc()
+
+	return mblid, blockchain.CheckPowHashBig(pow, job.difficulty), job.height, nil
+}
+
+// miners may only change nonce and flags of the job template
+func (job *pool_job) matches(mbl block.MiniBlock) bool {
+	mbl.Flags, mbl.Nonce = job.template.Flags, job.template.Nonce
+	return mbl == job.template
+}
+
+// whether share was already submitted for any job in window, caller must hold lock
+func (p *mining_pool) seen(mblid crypto.Hash) bool {
+	for _, job := range p.jobs {
+		if job.seen[mblid] {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *mining_pool) reject(reason string) {
+	metrics.Set.GetOrCreateCounter(fmt.Sprintf(`pool_shares_rejected_total{reason="%s"}`, reason)).Inc()
+}
+
+// add share to PPLNS window, dropping oldest shares which do not fit the window
+func (p *mining_pool) add_share(share pool_share, network *big.Int) {
+	window := new(big.Int).Mul(network, big.NewInt(POOL_PPLNS_FACTOR))
+	limit := uint64(^uint64(0))
+	if window.IsUint64() {
+		limit = window.Uint64()
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.state.Shares = append(p.state.Shares, share)
+	p.window_sum += share.Difficulty
+	for len(p.state.Shares) > 1 && p.window_sum-p.state.Shares[0].Difficulty >= limit {
+		p.window_sum -= p.state.Shares[0].Difficulty
+		p.state.Shares = p.state.Shares[1:]
+	}
+	p.dirty = true
+}
+
+// record a miniblock found by pool, along with shares which will get its reward
+func (p *mining_pool) found(mblid crypto.Hash, height int64) {
+	p.Lock()
+	defer p.Unlock()
+
+	round := pool_round{MiniBlock: mblid.String(), Height: height, Time: time.Now().Unix(), Status: ROUND_PENDING, Shares: map[string]uint64{}}
+	for _, share := range p.state.Shares {
+		round.Shares[share.Address] += share.Difficulty
+	}
+	p.state.Rounds = append(p.state.Rounds, round)
+	p.trim_history()
+	p.dirty = true
+	metrics.Set.GetOrCreateCounter("pool_rounds_found_total").Inc()
+}
+
+// keep history bounded, but never drop pending entries
+func (p *mining_pool) trim_history() {
+	for len(p.state.Rounds) > POOL_HISTORY_MAX && p.state.Rounds[0].Status != ROUND_PENDING {
+		p.state.Rounds = p.state.Rounds[1:]
+	}
+	for len(p.state.Payments) > POOL_HISTORY_MAX && p.state.Payments[0].Status != PAYMENT_PENDING {
+		p.state.Payments = p.state.Payments[1:]
+	}
+}
+
+// split amount proportional to difficulty of shares, remainder due to integer division stays with pool
+func pplns_split(amount uint64, shares map[string]uint64) map[string]uint64 {
+	total := new(big.Int)
+	for _, diff := range shares {
+		total.Add(total, new(big.Int).SetUint64(diff))
+	}
+
+	result := map[string]uint64{}
+	if total.Sign() == 0 {
+		return result
+	}
+
+	addresses := make([]string, 0, len(shares))
+	for address := range shares {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+
+	for _, address := range addresses {
+		part := new(big.Int).Mul(new(big.Int).SetUint64(amount), new(big.Int).SetUint64(shares[address]))
+		part.Div(part, total)
+		if part.Uint64() > 0 {
+			result[address] = part.Uint64()
+		}
+	}
+	return result
+}
+
+// estimate pool hashrate from shares in the last few minutes
+func (p *mining_pool) hashrate() (total uint64, per_address map[string]uint64) {
+	p.Lock()
+	defer p.Unlock()
+
+	per_address = map[string]uint64{}
+	start := time.Now().Unix() - POOL_HASHRATE_WINDOW
+	for i := len(p.state.Shares) - 1; i >= 0 && p.state.Shares[i].Time >= start; i-- {
+		per_address[p.state.Shares[i].Address] += p.state.Shares[i].Difficulty
+	}
+	for address := range per_address {
+		per_address[address] /= POOL_HASHRATE_WINDOW
+		total += per_address[address]
+	}
+	return
+}
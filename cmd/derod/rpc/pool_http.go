@@ -0,0 +1,153 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rpc
+
+// this file serves pool statistics as json over http
+// /stats for pool, /miner/<address> for a miner, /rounds and /payments for recent history
+
+import "strings"
+import "net/http"
+import "encoding/json"
+
+const POOL_HTTP_HISTORY = 100 // rounds and payments returned
+
+type pool_stats struct {
+	Address          string         `json:"address"`
+	Fee              float64        `json:"fee"` // percent
+	PayoutThreshold  uint64         `json:"payout_threshold"`
+	ShareDifficulty  uint64         `json:"share_difficulty"`
+	Difficulty       string         `json:"network_difficulty"`
+	Miners           int            `json:"miners"`
+	Hashrate         uint64         `json:"hashrate"`
+	WindowShares     int            `json:"window_shares"`
+	WindowDifficulty uint64         `json:"window_difficulty"`
+	Rounds           map[string]int `json:"rounds"`  // count by status
+	Pending          uint64         `json:"pending"` // credited to miners but not yet paid
+	Paid             uint64         `json:"paid"`
+}
+
+type pool_miner_stats struct {
+	Address          string         `json:"address"`
+	Balance          uint64         `json:"balance"`
+	Paid             uint64         `json:"paid"`
+	Hashrate         uint64         `json:"hashrate"`
+	WindowDifficulty uint64         `json:"window_difficulty"`
+	Payments         []pool_payment `json:"payments"`
+}
+
+func (p *mining_pool) serve_http(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", p.http_stats)
+	mux.HandleFunc("/miner/", p.http_miner)
+	mux.HandleFunc("/rounds", p.http_rounds)
+	mux.HandleFunc("/payments", p.http_payments)
+
+	logger_getwork.Info("Pool stats will be served", "address", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		logger_getwork.Error(err, "Pool stats server failed")
+	}
+}
+
+func write_json(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (p *mining_pool) http_stats(w http.ResponseWriter, r *http.Request) {
+	hashrate, _ := p.hashrate()
+	stats := pool_stats{Address: p.address.String(), Fee: p.fee_percent, PayoutThreshold: p.payout_threshold, Miners: CountMiners(), Hashrate: hashrate, Rounds: map[string]int{}}
+
+	p.Lock()
+	if p.network != nil {
+		stats.ShareDifficulty = p.job_difficulty(p.network)
+		stats.Difficulty = p.network.String()
+	}
+	stats.WindowShares = len(p.state.Shares)
+	stats.WindowDifficulty = p.window_sum
+	for _, round := range p.state.Rounds {
+		stats.Rounds[round.Status]++
+	}
+	for _, balance := range p.state.Balances {
+		stats.Pending += balance
+	}
+	for _, paid := range p.state.Paid {
+		stats.Paid += paid
+	}
+	p.Unlock()
+
+	write_json(w, stats)
+}
+
+func (p *mining_pool) http_miner(w http.ResponseWriter, r *http.Request) {
+	address := strings.TrimPrefix(r.URL.Path, "/miner/")
+	_, hashrates := p.hashrate()
+	stats := pool_miner_stats{Address: address, Hashrate: hashrates[address], Payments: []pool_payment{}}
+
+	p.Lock()
+	stats.Balance = p.state.Balances[address]
+	stats.Paid = p.state.Paid[address]
+	for _, share := range p.state.Shares {
+		if share.Address == address {
+			stats.WindowDifficulty += share.Difficulty
+		}
+	}
+	for i := len(p.state.Payments) - 1; i >= 0 && len(stats.Payments) < POOL_HTTP_HISTORY; i-- {
+		if amount, ok := p.state.Payments[i].Amounts[address]; ok {
+			payment := p.state.Payments[i]
+			payment.Amounts = map[string]uint64{address: amount} // do not leak other miners
+			stats.Payments = append(stats.Payments, payment)
+		}
+	}
+	p.Unlock()
+
+	write_json(w, stats)
+}
+
+func (p *mining_pool) http_rounds(w http.ResponseWriter, r *http.Request) {
+	rounds := []pool_round{}
+	p.Lock()
+	for i := len(p.state.Rounds) - 1; i >= 0 && len(rounds) < POOL_HTTP_HISTORY; i-- {
+		round := p.state.Rounds[i]
+		round.Shares = nil
+		rounds = append(rounds, round)
+	}
+	p.Unlock()
+	write_json(w, rounds)
+}
+
+func (p *mining_pool) http_payments(w http.ResponseWriter, r *http.Request) {
+	type payment_summary struct {
+		TXID       string `json:"txid"`
+		Height     int64  `json:"height"`
+		Time       int64  `json:"time"`
+		Status     string `json:"status"`
+		Recipients int    `json:"recipients"`
+		Amount     uint64 `json:"amount"`
+	}
+	payments := []payment_summary{}
+	p.Lock()
+	for i := len(p.state.Payments) - 1; i >= 0 && len(payments) < POOL_HTTP_HISTORY; i-- {
+		payment := p.state.Payments[i]
+		summary := payment_summary{TXID: payment.TXID, Height: payment.Height, Time: payment.Time, Status: payment.Status, Recipients: len(payment.Amounts)}
+		for _, amount := range payment.Amounts {
+			summary.Amount += amount
+		}
+		payments = append(payments, summary)
+	}
+	p.Unlock()
+	write_json(w, payments)
+}
@@ -0,0 +1,189 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rpc
+
+// this file settles rounds found by the pool and pays out miner balances using pool wallet
+
+import "sort"
+import "time"
+
+import "github.com/deroproject/derohe/config"
+import "github.com/deroproject/derohe/cryptography/crypto"
+import "github.com/deroproject/derohe/globals"
+import "github.com/deroproject/derohe/metrics"
+import "github.com/deroproject/derohe/rpc"
+import "github.com/deroproject/derohe/transaction"
+
+const POOL_PAYOUT_INTERVAL = "@every 600s"
+const POOL_PAYOUT_BATCH = 8                         // max recipients in a single payout tx
+const POOL_ROUND_MATURITY = 2 * config.STABLE_LIMIT // rounds and payments are settled after these many blocks
+
+const (
+	PAYMENT_PENDING   = "pending"   // tx sent, waiting to be mined
+	PAYMENT_CONFIRMED = "confirmed" // tx mined
+	PAYMENT_FAILED    = "failed"    // tx never got mined, amounts have been credited back
+)
+
+// Pool_Wallet pays out pool rewards, it is a walletapi wallet provided by derod
+type Pool_Wallet interface {
+	GetAddress() rpc.Address
+	IsDaemonOnlineCached() bool
+	TransferPayload0(transfers []rpc.Transfer, ringsize uint64, transfer_all bool, scdata rpc.Arguments, gasstorage uint64, dry_run bool) (*transaction.Transaction, error)
+	SendTransaction(tx *transaction.Transaction) error
+}
+
+// must be set before Getwork_server is started to enable pool mode
+var PoolWallet Pool_Wallet
+
+// settle rounds and payments, then pay out balances above threshold
+func (p *mining_pool) payout() {
+	defer globals.Recover(1)
+
+	p.settle_rounds()
+	p.settle_payments()
+
+	if !p.wallet.IsDaemonOnlineCached() {
+		return
+	}
+
+	p.Lock()
+	for _, payment := range p.state.Payments {
+		if payment.Status == PAYMENT_PENDING { // wallet balance changes only after tx is mined, so one tx at a time
+			p.Unlock()
+			return
+		}
+	}
+	var addresses []string
+	for address, balance := range p.state.Balances {
+		if balance > 0 && balance >= p.payout_threshold {
+			addresses = append(addresses, address)
+		}
+	}
+	sort.Slice(addresses, func(i, j int) bool { return p.state.Balances[addresses[i]] > p.state.Balances[addresses[j]] })
+	if len(addresses) > POOL_PAYOUT_BATCH {
+		addresses = addresses[:POOL_PAYOUT_BATCH]
+	}
+	amounts := map[string]uint64{}
+	var transfers []rpc.Transfer
+	for _, address := range addresses {
+		amounts[address] = p.state.Balances[address]
+		transfers = append(transfers, rpc.Transfer{Destination: address, Amount: amounts[address]})
+	}
+	p.Unlock()
+
+	if len(transfers) == 0 {
+		return
+	}
+
+	tx, err := p.wallet.TransferPayload0(transfers, 0, false, rpc.Arguments{}, 0, false)
+	if err != nil {
+		logger_getwork.Error(err, "Pool payout tx could not be built", "recipients", len(transfers))
+		return
+	}
+	if err = p.wallet.SendTransaction(tx); err != nil {
+		logger_getwork.Error(err, "Pool payout tx could not be sent", "txid", tx.GetHash().String())
+		return
+	}
+
+	p.Lock()
+	total := uint64(0)
+	for address, amount := range amounts {
+		p.state.Balances[address] -= amount
+		p.state.Paid[address] += amount
+		total += amount
+	}
+	p.state.Payments = append(p.state.Payments, pool_payment{TXID: tx.GetHash().String(), Height: chain.Get_Height(), Time: time.Now().Unix(), Status: PAYMENT_PENDING, Amounts: amounts})
+	p.trim_history()
+	p.dirty = true
+	p.Unlock()
+	p.save()
+
+	metrics.Set.GetOrCreateCounter("pool_paid_total").Add(int(total))
+	logger_getwork.Info("Pool payout sent", "txid", tx.GetHash().String(), "recipients", len(amounts), "amount", globals.FormatMoney(total))
+}
+
+// credit rewards of mature rounds to miners
+func (p *mining_pool) settle_rounds() {
+	height := chain.Get_Height()
+
+	p.Lock()
+	defer p.Unlock()
+	for i := range p.state.Rounds {
+		round := &p.state.Rounds[i]
+		if round.Status != ROUND_PENDING || height < round.Height+POOL_ROUND_MATURITY {
+			continue
+		}
+
+		var mblid crypto.Hash
+		if err := mblid.UnmarshalText([]byte(round.MiniBlock)); err != nil {
+			round.Status = ROUND_ORPHANED
+			continue
+		}
+		reward, found := chain.MiniBlock_Reward(mblid, round.Height)
+		if !found {
+			round.Status = ROUND_ORPHANED
+			p.dirty = true
+			continue
+		}
+
+		round.Reward = reward
+		round.Fee = uint64(float64(reward) * p.fee_percent / 100)
+		for address, amount := range pplns_split(reward-round.Fee, round.Shares) {
+			p.state.Balances[address] += amount
+		}
+		round.Status = ROUND_CONFIRMED
+		p.dirty = true
+	}
+}
+
+// confirm mined payouts, payouts which never got mined are credited back
+func (p *mining_pool) settle_payments() {
+	height := chain.Get_Height()
+
+	p.Lock()
+	defer p.Unlock()
+	for i := range p.state.Payments {
+		payment := &p.state.Payments[i]
+		if payment.Status != PAYMENT_PENDING {
+			continue
+		}
+
+		var txid crypto.Hash
+		if err := txid.UnmarshalText([]byte(payment.TXID)); err != nil {
+			continue
+		}
+		// tx is confirmed only once it is valid in a block buried deep enough to survive reorgs
+		if valid_blid, _, valid := chain.IS_TX_Valid(txid); valid {
+			if height >= chain.Load_Height_for_BL_ID(valid_blid)+POOL_ROUND_MATURITY {
+				payment.Status = PAYMENT_CONFIRMED
+				p.dirty = true
+			}
+			continue
+		}
+		if chain.Mempool.Mempool_Get_TX(txid) != nil || height < payment.Height+POOL_ROUND_MATURITY {
+			continue
+		}
+
+		for address, amount := range payment.Amounts {
+			p.state.Balances[address] += amount
+			p.state.Paid[address] -= amount
+		}
+		payment.Status = PAYMENT_FAILED
+		p.dirty = true
+		logger_getwork.Info("Pool payout was not mined, balances credited back", "txid", payment.TXID)
+	}
+}
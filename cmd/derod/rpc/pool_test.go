@@ -0,0 +1,108 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rpc
+
+import "testing"
+import "math/big"
+
+import "github.com/deroproject/derohe/block"
+
+// rewards must be split by share difficulty and never exceed amount
+func Test_PPLNS_Split(t *testing.T) {
+	split := pplns_split(1000, map[string]uint64{"a": 1, "b": 2, "c": 0})
+	if split["a"] != 333 || split["b"] != 666 || len(split) != 2 {
+		t.Fatalf("unexpected split %+v", split)
+	}
+
+	if split = pplns_split(1000, map[string]uint64{}); len(split) != 0 {
+		t.Fatalf("empty window split %+v", split)
+	}
+
+	// difficulty * amount overflows uint64
+	split = pplns_split(^uint64(0), map[string]uint64{"a": ^uint64(0), "b": ^uint64(0)})
+	if split["a"] != ^uint64(0)/2 || split["b"] != ^uint64(0)/2 {
+		t.Fatalf("large split %+v", split)
+	}
+}
+
+// window must only keep latest shares worth POOL_PPLNS_FACTOR times network difficulty
+func Test_PPLNS_Window(t *testing.T) {
+	p := &mining_pool{state: pool_state{Balances: map[string]uint64{}, Paid: map[string]uint64{}}}
+	network := big.NewInt(100)
+
+	for i := 0; i < 30; i++ {
+		p.add_share(pool_share{Address: "old", Difficulty: 10}, network)
+	}
+	if p.window_sum != POOL_PPLNS_FACTOR*100 || len(p.state.Shares) != 20 {
+		t.Fatalf("window not trimmed sum %d shares %d", p.window_sum, len(p.state.Shares))
+	}
+
+	for i := 0; i < 15; i++ {
+		p.add_share(pool_share{Address: "new", Difficulty: 10}, network)
+	}
+	p.found([32]byte{1}, 10)
+
+	round := p.state.Rounds[0]
+	if round.Status != ROUND_PENDING || round.Shares["old"] != 50 || round.Shares["new"] != 150 {
+		t.Fatalf("unexpected round %+v", round)
+	}
+}
+
+// shares must be built from a known job template and are credited only once across all jobs
+func Test_Pool_Check_Share(t *testing.T) {
+	p := &mining_pool{jobs: map[uint64]*pool_job{}, address_sum: [32]byte{7}, state: pool_state{Balances: map[string]uint64{}, Paid: map[string]uint64{}}}
+	template := block.MiniBlock{Version: 1, Height: 100, PastCount: 1, Past: [2]uint32{5}, KeyHash: [32]byte{9}}
+	p.add_job(1000, 100, big.NewInt(1000), template)
+	p.add_job(2000, 100, big.NewInt(1000), template)
+
+	share := template
+	share.KeyHash = p.address_sum
+	share.Flags, share.Nonce = 3, [3]uint32{1, 2, 3}
+
+	if _, _, height, err := p.check_share("a", 1000, share.Serialize(), 1); err != nil || height != 100 {
+		t.Fatalf("valid share rejected height %d err %s", height, err)
+	}
+	if _, _, _, err := p.check_share("a", 1000, share.Serialize(), 1); err == nil {
+		t.Fatalf("duplicate share accepted")
+	}
+	if _, _, _, err := p.check_share("a", 2000, share.Serialize(), 1); err == nil {
+		t.Fatalf("duplicate share accepted for another job")
+	}
+	if _, _, _, err := p.check_share("a", 3000, share.Serialize(), 1); err == nil {
+		t.Fatalf("share for unknown job accepted")
+	}
+
+	wrong := share
+	wrong.Height = 101
+	if _, _, _, err := p.check_share("a", 1000, wrong.Serialize(), 1); err == nil {
+		t.Fatalf("share with wrong height accepted")
+	}
+	wrong = share
+	wrong.Past[0] = 6
+	if _, _, _, err := p.check_share("a", 1000, wrong.Serialize(), 1); err == nil {
+		t.Fatalf("share with wrong past accepted")
+	}
+	wrong = share
+	wrong.KeyHash = template.KeyHash
+	if _, _, _, err := p.check_share("a", 1000, wrong.Serialize(), 1); err == nil {
+		t.Fatalf("share not for pool address accepted")
+	}
+
+	if len(p.state.Shares) != 1 || p.window_sum != 1 {
+		t.Fatalf("only one share must be credited %+v", p.state.Shares)
+	}
+}
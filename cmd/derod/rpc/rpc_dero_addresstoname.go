@@ -21,6 +21,9 @@ func AddressToName(ctx context.Context, p rpc.AddressToName_Params) (result rpc.
 		}
 	}()
 
+	chain.Prune_Mutex.RLock() // state versions must not change under us
+	defer chain.Prune_Mutex.RUnlock()
+
 	var req_addr *rpc.Address
 	if req_addr, err = rpc.NewAddress(strings.TrimSpace(p.Address)); err != nil {
 		err = fmt.Errorf("Invalid Address")
@@ -43,6 +43,9 @@ func GetGasEstimate(ctx context.Context, p rpc.GasEstimate_Params) (result rpc.G
 		}
 	}()
 
+	chain.Prune_Mutex.RLock() // state versions must not change under us
+	defer chain.Prune_Mutex.RUnlock()
+
 	if len(p.SC_Code) >= 1 && !strings.Contains(strings.ToLower(p.SC_Code), "initialize") { // decode SC from base64 if possible, since json hash limitations
 		if sc, err := base64.StdEncoding.DecodeString(p.SC_Code); err == nil {
 			p.SC_Code = string(sc)
@@ -0,0 +1,98 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rpc
+
+import "fmt"
+import "context"
+import "encoding/hex"
+import "runtime/debug"
+import "github.com/deroproject/derohe/block"
+import "github.com/deroproject/derohe/blockchain"
+import "github.com/deroproject/derohe/rpc"
+import "github.com/deroproject/derohe/transaction"
+
+// block template along with txs selected by template policy
+func GetBlockTemplateDetailed(ctx context.Context, p rpc.GetBlockTemplateDetailed_Params) (result rpc.GetBlockTemplateDetailed_Result, err error) {
+	defer func() { // safety so if anything wrong happens, we return error
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic occured. stack trace %s", debug.Stack())
+		}
+	}()
+
+	params := rpc.GetBlockTemplate_Params(p)
+	params.Block = true
+	if result.GetBlockTemplate_Result, err = GetBlockTemplate(ctx, params); err != nil {
+		return
+	}
+
+	var bl block.Block
+	blob, err := hex.DecodeString(result.Blocktemplate_blob)
+	if err != nil {
+		return
+	}
+	if err = bl.Deserialize(blob); err != nil {
+		return
+	}
+	if !p.Block {
+		result.Blocktemplate_blob = ""
+	}
+
+	policy := chain.GetTemplatePolicy()
+	result.Txs = []rpc.Template_TX{}
+	for _, txid := range bl.Tx_hashes {
+		var tx *transaction.Transaction
+		if tx = chain.Mempool.Mempool_Get_TX(txid); tx == nil {
+			tx = chain.Regpool.Regpool_Get_TX(txid)
+		}
+		entry := rpc.Template_TX{TXID: txid.String()}
+		if tx != nil {
+			entry.Type = tx.TransactionType.String()
+			entry.Size = uint64(len(tx.Serialize()))
+			entry.Fees = tx.Fees()
+		}
+		if policy != nil {
+			entry.Priority = policy.Priority(txid)
+		}
+		result.TxsSize += entry.Size
+		result.TotalFees += entry.Fees
+		result.Txs = append(result.Txs, entry)
+	}
+	result.Policy = template_policy_info()
+	result.Status = "OK"
+	return
+}
+
+// current policy in rpc form, custom policies only report their size limit
+func template_policy_info() (info rpc.Template_Policy) {
+	policy := chain.GetTemplatePolicy()
+	if policy == nil {
+		return
+	}
+	info.MaxBlockSize = policy.MaxBlockSize()
+	if static, ok := policy.(*blockchain.Static_Template_Policy); ok {
+		for i := range static.PriorityTXIDs {
+			info.Priority = append(info.Priority, static.PriorityTXIDs[i].String())
+		}
+		for i := range static.ExcludeTXIDs {
+			info.Exclude = append(info.Exclude, static.ExcludeTXIDs[i].String())
+		}
+		for i := range static.ExcludeSCIDs {
+			info.ExcludeSCIDs = append(info.ExcludeSCIDs, static.ExcludeSCIDs[i].String())
+		}
+	}
+	return
+}
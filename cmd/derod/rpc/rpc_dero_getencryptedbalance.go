@@ -38,6 +38,9 @@ func GetEncryptedBalance(ctx context.Context, p rpc.GetEncryptedBalance_Params)
 		}
 	}()
 
+	chain.Prune_Mutex.RLock() // state versions must not change under us
+	defer chain.Prune_Mutex.RUnlock()
+
 	uaddress, err := globals.ParseValidateAddress(p.Address)
 	if err != nil {
 		panic(err)
@@ -79,6 +82,21 @@ func GetEncryptedBalance(ctx context.Context, p rpc.GetEncryptedBalance_Params)
 
 	if err != nil {
 		if xerrors.Is(err, graviton.ErrNotFound) { // address needs registration
+			if p.Proof { // proof of absence is returned as result, since errors carry no data
+				result := rpc.GetEncryptedBalance_Result{
+					SCID:         p.SCID,
+					Registration: registration,
+					Height:       toporecord.Height,
+					Topoheight:   topoheight,
+					BlockHash:    toporecord.BLOCK_ID,
+					Status:       errormsg.ErrAccountUnregistered.Error(),
+				}
+				if result.Proof, err = state_proof(ss, topoheight, toporecord.BLOCK_ID, p.SCID, keyname); err != nil {
+					panic(err)
+				}
+				result.Merkle_Balance_TreeHash = result.Proof.StateHash
+				return result, nil
+			}
 			return rpc.GetEncryptedBalance_Result{ // return success
 				Registration: registration,
 				Status:       errormsg.ErrAccountUnregistered.Error(),
@@ -112,6 +130,13 @@ func GetEncryptedBalance(ctx context.Context, p rpc.GetEncryptedBalance_Params)
 		panic(err)
 	}
 
+	var proof *rpc.StateProof
+	if p.Proof {
+		if proof, err = state_proof(ss, topoheight, toporecord.BLOCK_ID, p.SCID, keyname); err != nil {
+			panic(err)
+		}
+	}
+
 	return rpc.GetEncryptedBalance_Result{ // return success
 		SCID:                     p.SCID,
 		Data:                     fmt.Sprintf("%x", balance_serialized),
@@ -124,6 +149,7 @@ func GetEncryptedBalance(ctx context.Context, p rpc.GetEncryptedBalance_Params)
 		DHeight:                  chain.Get_Height(),
 		DTopoheight:              chain.Load_TOPO_HEIGHT(),
 		DMerkle_Balance_TreeHash: fmt.Sprintf("%x", dmerkle_hash[:]),
+		Proof:                    proof,
 		Status:                   "OK",
 	}, nil
 }
@@ -35,6 +35,9 @@ func GetInfo(ctx context.Context) (result rpc.GetInfo_Result, err error) {
 		}
 	}()
 
+	chain.Prune_Mutex.RLock() // state versions must not change under us
+	defer chain.Prune_Mutex.RUnlock()
+
 	//result.Difficulty = chain.Get_Difficulty_At_Block(top_id)
 	result.Height = chain.Get_Height()
 	result.StableHeight = chain.Get_Stable_Height()
@@ -75,8 +78,9 @@ func GetInfo(ctx context.Context) (result rpc.GetInfo_Result, err error) {
 
 	result.Tx_pool_size = uint64(len(chain.Mempool.Mempool_List_TX()))
 	// get dynamic fees per kb, used by wallet for tx creation
-	//result.Dynamic_fee_per_kb = config.FEE_PER_KB
-	//result.Median_Block_Size = config.CRYPTONOTE_MAX_BLOCK_SIZE
+	estimate := chain.Estimate_Fee_Per_KB(0)
+	result.Dynamic_fee_per_kb = estimate.FeePerKB
+	result.Median_Block_Size = estimate.MedianBlockSize
 
 	result.Total_Supply = (config.PREMINE + blockchain.CalcBlockReward(uint64(result.TopoHeight))*uint64(result.TopoHeight)) // valid for few years
 	result.Total_Supply = result.Total_Supply / 100000                                                                       // only give deros remove fractional part
@@ -0,0 +1,49 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rpc
+
+import "fmt"
+import "sort"
+import "context"
+import "runtime/debug"
+import "github.com/deroproject/derohe/rpc"
+
+// list miners connected to getwork and stratum servers
+func GetMiners(ctx context.Context, p rpc.GetMiners_Params) (result rpc.GetMiners_Result, err error) {
+	defer func() { // safety so if anything wrong happens, we return error
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic occured. stack trace %s", debug.Stack())
+		}
+	}()
+
+	result.Miners = []rpc.Miner_Info{}
+	for _, sess := range all_sessions() {
+		info := sess.info()
+		if p.Address != "" && p.Address != info.Address {
+			continue
+		}
+		result.Miners = append(result.Miners, info)
+	}
+	sort.SliceStable(result.Miners, func(i, j int) bool {
+		if result.Miners[i].Address != result.Miners[j].Address {
+			return result.Miners[i].Address < result.Miners[j].Address
+		}
+		return result.Miners[i].Worker < result.Miners[j].Worker
+	})
+	result.Status = "OK"
+	return
+}
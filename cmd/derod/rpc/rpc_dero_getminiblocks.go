@@ -0,0 +1,131 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rpc
+
+import "fmt"
+import "context"
+import "encoding/binary"
+import "runtime/debug"
+import "github.com/deroproject/derohe/block"
+import "github.com/deroproject/derohe/config"
+import "github.com/deroproject/derohe/globals"
+import "github.com/deroproject/derohe/blockchain"
+import "github.com/deroproject/derohe/cryptography/crypto"
+import "github.com/deroproject/derohe/rpc"
+
+import "github.com/deroproject/graviton"
+
+func GetMiniBlocks(ctx context.Context, p rpc.GetMiniBlocks_Params) (result rpc.GetMiniBlocks_Result, err error) {
+	defer func() { // safety so if anything wrong happens, we return error
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic occured. stack trace %s", debug.Stack())
+		}
+	}()
+
+	if len(p.Past) > 2 {
+		return result, fmt.Errorf("miniblock key can have atmost 2 tips")
+	}
+	return GetMiniBlocksInfo(chain, p), nil
+}
+
+// collect miniblocks pending in the DAG, also used by the console
+func GetMiniBlocksInfo(chain *blockchain.Blockchain, p rpc.GetMiniBlocks_Params) (result rpc.GetMiniBlocks_Result) {
+	chain.Prune_Mutex.RLock() // state versions must not change under us
+	defer chain.Prune_Mutex.RUnlock()
+
+	result.Height = p.Height
+	if result.Height == 0 {
+		result.Height = uint64(chain.Get_Height() + 1)
+	}
+
+	tips := chain.Get_TIPS()
+	for i := range tips {
+		result.Tips = append(result.Tips, tips[i].String())
+	}
+
+	var balance_tree *graviton.Tree // used to resolve miner addresses
+	if toporecord, err := chain.Store.Topo_store.Read(chain.Load_TOPO_HEIGHT()); err == nil {
+		if ss, err := chain.Store.Balance_store.LoadSnapshot(toporecord.State_Version); err == nil {
+			balance_tree, _ = ss.GetTree(config.BALANCE_TREE)
+		}
+	}
+
+	result.Keys = []rpc.MiniBlock_Key_Info{}
+	for _, key := range chain.MiniBlocks.GetAllKeys(int64(result.Height)) {
+		past := []uint32{key.Past0}
+		mbls := chain.MiniBlocks.GetAllMiniBlocks(key)
+		if len(mbls) >= 1 && mbls[0].PastCount == 2 {
+			past = append(past, key.Past1)
+		}
+		if len(p.Past) >= 1 && (len(p.Past) != len(past) || p.Past[0] != past[0] || (len(past) == 2 && p.Past[1] != past[1])) {
+			continue
+		}
+
+		info := rpc.MiniBlock_Key_Info{Height: key.Height, Count: len(mbls), MiniBlocks: []rpc.MiniBlock_Info{}}
+		matched := 0
+		for _, prefix := range past {
+			var tip crypto.Hash
+			binary.BigEndian.PutUint32(tip[:], prefix)
+			if ehash, ok := chain.ExpandMiniBlockTip(tip); ok {
+				info.Past = append(info.Past, ehash.String())
+				if chain.Is_Block_Tip(ehash) {
+					matched++
+				}
+			} else {
+				info.Past = append(info.Past, fmt.Sprintf("%08x", prefix))
+			}
+		}
+		info.Tips = matched == len(past) && matched == len(tips)
+
+		for _, mbl := range mbls {
+			info.MiniBlocks = append(info.MiniBlocks, miniblock_info(chain, balance_tree, mbl))
+		}
+		result.Keys = append(result.Keys, info)
+		result.Count += len(mbls)
+	}
+	result.Collisions = chain.MiniBlocks.CollisionCount(int64(result.Height))
+	result.Status = "OK"
+	return
+}
+
+func miniblock_info(chain *blockchain.Blockchain, balance_tree *graviton.Tree, mbl block.MiniBlock) (info rpc.MiniBlock_Info) {
+	info.Hash = mbl.GetHash().String()
+	info.Timestamp = mbl.Timestamp
+	info.KeyHash = fmt.Sprintf("%x", mbl.KeyHash[:16])
+	info.Final = mbl.Final
+	info.HighDiff = mbl.HighDiff
+	info.Flags = mbl.Flags
+	info.Nonce = fmt.Sprintf("%08x%08x%08x", mbl.Nonce[0], mbl.Nonce[1], mbl.Nonce[2])
+
+	if stats, found := chain.MiniBlocks.GetMiniBlockStats(mbl); found {
+		info.Received = stats.Received.UnixMilli()
+		info.Collisions = stats.Collisions
+	}
+
+	if !mbl.Final { // final miniblock carries block header hash instead of miner
+		info.Miner = "unknown"
+		if balance_tree != nil {
+			if bits, key, _, err := balance_tree.GetKeyValueFromHash(mbl.KeyHash[0:16]); err == nil && bits < 120 {
+				if addr, err := rpc.NewAddressFromCompressedKeys(key); err == nil {
+					addr.Mainnet = globals.IsMainnet()
+					info.Miner = addr.String()
+				}
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,43 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rpc
+
+import "context"
+import "github.com/deroproject/derohe/rpc"
+
+func GetPruneStatus(ctx context.Context) rpc.Daemon_GetPruneStatus_Result {
+	status := chain.Prune_Status()
+	result := rpc.Daemon_GetPruneStatus_Result{
+		Enabled:         status.Enabled,
+		Running:         status.Running,
+		Phase:           status.Phase,
+		Progress:        status.Progress,
+		Depth:           status.Depth,
+		PrunedTopo:      status.PrunedTopo,
+		TopoHeight:      chain.Load_TOPO_HEIGHT(),
+		Runs:            status.Runs,
+		BlocksDiscarded: status.BlocksDiscarded,
+		TxsDiscarded:    status.TxsDiscarded,
+		LastDuration:    status.LastDuration.Seconds(),
+		LastError:       status.LastError,
+		Status:          "OK",
+	}
+	if !status.LastRun.IsZero() {
+		result.LastRun = status.LastRun.Unix()
+	}
+	return result
+}
@@ -34,6 +34,9 @@ func GetRandomAddress(ctx context.Context, p rpc.GetRandomAddress_Params) (resul
 			err = fmt.Errorf("panic occured. stack trace %s", debug.Stack())
 		}
 	}()
+
+	chain.Prune_Mutex.RLock() // state versions must not change under us
+	defer chain.Prune_Mutex.RUnlock()
 	topoheight := chain.Load_TOPO_HEIGHT()
 	old_topoheight := topoheight
 
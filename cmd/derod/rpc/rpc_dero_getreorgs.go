@@ -0,0 +1,65 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rpc
+
+import "fmt"
+import "context"
+import "runtime/debug"
+import "github.com/deroproject/derohe/cryptography/crypto"
+import "github.com/deroproject/derohe/rpc"
+
+const MAX_REORGS = 1000 // limit reorgs returned in a single call
+
+func GetReorgs(ctx context.Context, p rpc.Daemon_GetReorgs_Params) (result rpc.Daemon_GetReorgs_Result, err error) {
+	defer func() { // safety so if anything wrong happens, we return error
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic occured. stack trace %s", debug.Stack())
+		}
+	}()
+
+	count := p.Count
+	if count == 0 {
+		count = 20
+	}
+	if count > MAX_REORGS {
+		count = MAX_REORGS
+	}
+
+	result.Reorgs = []rpc.Daemon_Reorg{}
+	for _, event := range chain.Get_Reorgs(int(count)) {
+		result.Reorgs = append(result.Reorgs, rpc.Daemon_Reorg{
+			Time:        event.Time.Unix(),
+			Height:      event.Height,
+			TopoHeight:  event.TopoHeight,
+			Depth:       event.Depth,
+			OldTop:      event.OldTop.String(),
+			NewTop:      event.NewTop.String(),
+			OldBlocks:   hash_strings(event.OldBlocks),
+			NewBlocks:   hash_strings(event.NewBlocks),
+			TxsReturned: hash_strings(event.TxsReturned),
+		})
+	}
+	result.Status = "OK"
+	return
+}
+
+func hash_strings(hashes []crypto.Hash) (list []string) {
+	for i := range hashes {
+		list = append(list, hashes[i].String())
+	}
+	return
+}
@@ -41,6 +41,9 @@ func GetSC(ctx context.Context, p rpc.GetSC_Params) (result rpc.GetSC_Result, er
 		}
 	}()
 
+	chain.Prune_Mutex.RLock() // state versions must not change under us
+	defer chain.Prune_Mutex.RUnlock()
+
 	result.VariableStringKeys = map[string]interface{}{}
 	result.VariableUint64Keys = map[uint64]interface{}{}
 	result.Balances = map[string]uint64{}
@@ -202,6 +205,28 @@ func GetSC(ctx context.Context, p rpc.GetSC_Params) (result rpc.GetSC_Result, er
 					}
 				}
 
+				if p.Proof { // prove SC balance, code and all requested keys, whether they exist or not
+					keys := [][]byte{zerohash[:]}
+					if p.Code {
+						keys = append(keys, dvm.SC_Code_Key(scid))
+					}
+					for _, value := range p.KeysUint64 {
+						key, _ := dvm.Variable{Type: dvm.Uint64, ValueUint64: value}.MarshalBinary()
+						keys = append(keys, key)
+					}
+					for _, value := range p.KeysString {
+						key, _ := dvm.Variable{Type: dvm.String, ValueString: value}.MarshalBinary()
+						keys = append(keys, key)
+					}
+					for _, value := range p.KeysBytes {
+						key, _ := dvm.Variable{Type: dvm.String, ValueString: string(value)}.MarshalBinary()
+						keys = append(keys, key)
+					}
+					if result.Proof, err = state_proof(ss, topoheight, toporecord.BLOCK_ID, scid, keys...); err != nil {
+						return
+					}
+				}
+
 			}
 
 		}
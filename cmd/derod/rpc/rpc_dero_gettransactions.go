@@ -40,6 +40,9 @@ func GetTransaction(ctx context.Context, p rpc.GetTransaction_Params) (result rp
 		}
 	}()
 
+	chain.Prune_Mutex.RLock() // state versions must not change under us
+	defer chain.Prune_Mutex.RUnlock()
+
 	for i := 0; i < len(p.Tx_Hashes); i++ {
 
 		hash := crypto.HashHexToHash(p.Tx_Hashes[i])
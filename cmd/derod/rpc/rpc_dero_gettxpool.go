@@ -23,6 +23,17 @@ import "github.com/deroproject/derohe/rpc"
 func GetTxPool(ctx context.Context) (result rpc.GetTxPool_Result) {
 	result.Status = "OK"
 
+	policy := chain.Mempool.Policy()
+	result.Policy = rpc.TxPool_Policy{
+		MaxSize:        policy.MaxSize,
+		Size:           policy.Size,
+		Count:          policy.Count,
+		LowestFeePerKB: policy.LowestFeePerKB,
+		RBFBumpPercent: policy.RBFBumpPercent,
+		MaxTxPerPeer:   policy.MaxTxPerPeer,
+		MaxTxPerIP:     policy.MaxTxPerIP,
+	}
+
 	pool_list := chain.Mempool.Mempool_List_TX()
 	for i := range pool_list {
 		result.Tx_list = append(result.Tx_list, fmt.Sprintf("%s", pool_list[i]))
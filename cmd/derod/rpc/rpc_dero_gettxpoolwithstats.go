@@ -0,0 +1,92 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rpc
+
+import "fmt"
+import "time"
+import "context"
+import "runtime/debug"
+import "github.com/deroproject/derohe/cryptography/crypto"
+import "github.com/deroproject/derohe/transaction"
+import "github.com/deroproject/derohe/rpc"
+
+// return pool entries alongwith their fees and aggregate fee statistics
+func GetTxPoolWithStats(ctx context.Context) (result rpc.GetTxPoolWithStats_Result, err error) {
+	defer func() { // safety so if anything wrong happens, we return error
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic occured. stack trace %s", debug.Stack())
+		}
+	}()
+
+	now := uint64(time.Now().UTC().Unix())
+	var fees_per_kb []uint64
+
+	for _, info := range chain.Mempool.Mempool_List_TX_Info() {
+		entry := rpc.TxPool_Entry{
+			TXID:   info.Hash.String(),
+			Type:   info.Tx.TransactionType.String(),
+			Size:   info.Size,
+			Fee:    info.Tx.Fees(),
+			Height: info.Height,
+		}
+		if info.Size > 0 {
+			entry.FeePerKB = entry.Fee * 1024 / info.Size
+		}
+		if now > info.Added {
+			entry.Age = now - info.Added
+		}
+		if info.Tx.TransactionType == transaction.SC_TX {
+			entry.SCID = sc_target(info.Tx)
+		}
+
+		result.Entries = append(result.Entries, entry)
+		fees_per_kb = append(fees_per_kb, entry.FeePerKB)
+
+		result.Stats.Count++
+		result.Stats.Size += entry.Size
+		result.Stats.TotalFees += entry.Fee
+		if result.Stats.MinFeePerKB == 0 || entry.FeePerKB < result.Stats.MinFeePerKB {
+			result.Stats.MinFeePerKB = entry.FeePerKB
+		}
+		if entry.FeePerKB > result.Stats.MaxFeePerKB {
+			result.Stats.MaxFeePerKB = entry.FeePerKB
+		}
+	}
+
+	if len(fees_per_kb) > 0 { // entries are sorted by fees, highest first
+		result.Stats.MedianFeePerKB = fees_per_kb[len(fees_per_kb)/2]
+	}
+
+	result.Status = "OK"
+	return
+}
+
+// SC which will be called by this tx, installs target the SC they create which has the txid as SCID
+func sc_target(tx *transaction.Transaction) string {
+	if !tx.SCDATA.Has(rpc.SCACTION, rpc.DataUint64) {
+		return ""
+	}
+	switch rpc.SC_ACTION(tx.SCDATA.Value(rpc.SCACTION, rpc.DataUint64).(uint64)) {
+	case rpc.SC_INSTALL:
+		return tx.GetHash().String()
+	case rpc.SC_CALL:
+		if tx.SCDATA.Has(rpc.SCID, rpc.DataHash) {
+			return tx.SCDATA.Value(rpc.SCID, rpc.DataHash).(crypto.Hash).String()
+		}
+	}
+	return ""
+}
@@ -34,6 +34,9 @@ func NameToAddress(ctx context.Context, p rpc.NameToAddress_Params) (result rpc.
 		}
 	}()
 
+	chain.Prune_Mutex.RLock() // state versions must not change under us
+	defer chain.Prune_Mutex.RUnlock()
+
 	topoheight := chain.Load_TOPO_HEIGHT()
 
 	toporecord, err := chain.Store.Topo_store.Read(topoheight)
@@ -57,6 +57,15 @@ func SendRawTransaction(ctx context.Context, p rpc.SendRawTransaction_Params) (r
 	}
 
 	// lets try to add it to pool
+	// if dandelion is enabled, tx goes to mempool only after the stem phase, this hides the origin
+	if p2p.IsDandelionEnabled() && !tx.IsRegistration() {
+		if err = p2p.Stem_Tx(&tx); err == nil {
+			result.Status = "OK"
+		} else {
+			err = fmt.Errorf("Transaction %s rejected by daemon err '%s'", tx.GetHash(), err)
+		}
+		return
+	}
 
 	if err = chain.Add_TX_To_Pool(&tx); err == nil {
 		p2p.Broadcast_Tx(&tx, 0) // broadcast tx
@@ -0,0 +1,120 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rpc
+
+// SetTemplatePolicy lets anyone reaching it censor txs mined by this node, so it is never part of public rpc
+// it is only served on /admin/json_rpc, which exists only if daemon was started with --rpc-admin-login
+
+import "io"
+import "fmt"
+import "context"
+import "strings"
+import "net/http"
+import "encoding/hex"
+import "runtime/debug"
+import "crypto/subtle"
+
+import "github.com/deroproject/derohe/blockchain"
+import "github.com/deroproject/derohe/cryptography/crypto"
+import "github.com/deroproject/derohe/globals"
+import "github.com/deroproject/derohe/rpc"
+
+import "github.com/creachadair/jrpc2/handler"
+import "github.com/creachadair/jrpc2/jhttp"
+
+var admin_apis = handler.ServiceMap{
+	"DERO": handler.Map{
+		"SetTemplatePolicy": handler.New(SetTemplatePolicy),
+	},
+}
+
+var admin_bridge = jhttp.NewBridge(admin_apis, nil)
+
+// credentials from --rpc-admin-login, admin rpc is disabled if empty
+var admin_user, admin_password string
+
+// parse --rpc-admin-login=<username:password>, empty password is not allowed
+func admin_init() error {
+	admin_user, admin_password = "", ""
+	if v, ok := globals.Arguments["--rpc-admin-login"]; !ok || v == nil {
+		return nil
+	}
+	parts := strings.SplitN(globals.Arguments["--rpc-admin-login"].(string), ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("--rpc-admin-login must be username:password")
+	}
+	admin_user, admin_password = parts[0], parts[1]
+	return nil
+}
+
+// every admin request must carry admin credentials using basic auth
+func admin_handler(w http.ResponseWriter, r *http.Request) {
+	u, p, ok := r.BasicAuth()
+	user_ok := subtle.ConstantTimeCompare([]byte(u), []byte(admin_user))
+	password_ok := subtle.ConstantTimeCompare([]byte(p), []byte(admin_password))
+	if !ok || admin_user == "" || user_ok&password_ok != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="derod admin"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, "Authorization Required")
+		return
+	}
+	admin_bridge.ServeHTTP(w, r)
+}
+
+// configure which txs are selected for block templates
+func SetTemplatePolicy(ctx context.Context, p rpc.SetTemplatePolicy_Params) (result rpc.SetTemplatePolicy_Result, err error) {
+	defer func() { // safety so if anything wrong happens, we return error
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic occured. stack trace %s", debug.Stack())
+		}
+	}()
+
+	var policy blockchain.Static_Template_Policy
+	if policy.PriorityTXIDs, err = parse_hashes(p.Priority); err != nil {
+		return
+	}
+	if policy.ExcludeTXIDs, err = parse_hashes(p.Exclude); err != nil {
+		return
+	}
+	if policy.ExcludeSCIDs, err = parse_hashes(p.ExcludeSCIDs); err != nil {
+		return
+	}
+	policy.MaxSize = p.MaxBlockSize
+
+	if len(policy.PriorityTXIDs) == 0 && len(policy.ExcludeTXIDs) == 0 && len(policy.ExcludeSCIDs) == 0 && policy.MaxSize == 0 {
+		chain.SetTemplatePolicy(nil)
+	} else {
+		chain.SetTemplatePolicy(&policy)
+	}
+	logger.Info("block template policy changed over admin rpc", "priority", len(policy.PriorityTXIDs), "exclude", len(policy.ExcludeTXIDs), "exclude_scids", len(policy.ExcludeSCIDs), "max_block_size", policy.MaxSize)
+
+	result.Status = "OK"
+	return
+}
+
+func parse_hashes(list []string) (hashes []crypto.Hash, err error) {
+	for _, h := range list {
+		raw, err := hex.DecodeString(h)
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("invalid hash %s", h)
+		}
+		var hash crypto.Hash
+		copy(hash[:], raw)
+		hashes = append(hashes, hash)
+	}
+	return
+}
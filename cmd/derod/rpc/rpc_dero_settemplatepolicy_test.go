@@ -0,0 +1,67 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rpc
+
+import "context"
+import "strings"
+import "testing"
+import "net/http"
+import "net/http/httptest"
+
+import "github.com/deroproject/derohe/globals"
+
+// admin rpc needs --rpc-admin-login and every request must carry its credentials
+func Test_Admin_RPC_Auth(t *testing.T) {
+	defer func(old map[string]interface{}) { globals.Arguments = old; admin_init() }(globals.Arguments)
+
+	globals.Arguments = map[string]interface{}{"--rpc-admin-login": "admin:nopass:word"}
+	if err := admin_init(); err != nil || admin_user != "admin" || admin_password != "nopass:word" {
+		t.Fatalf("login not parsed %s %s %v", admin_user, admin_password, err)
+	}
+	for _, login := range []string{"admin", "admin:", ":secret"} {
+		globals.Arguments = map[string]interface{}{"--rpc-admin-login": login}
+		if err := admin_init(); err == nil || admin_user != "" {
+			t.Fatalf("login %q must be rejected", login)
+		}
+	}
+
+	if servicemux.Assign(context.Background(), "DERO.SetTemplatePolicy") != nil || historical_apis.Assign(context.Background(), "settemplatepolicy") != nil {
+		t.Fatalf("template policy must not be available over public rpc")
+	}
+
+	globals.Arguments = map[string]interface{}{"--rpc-admin-login": "admin:secret"}
+	admin_init()
+	request := func(user, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/admin/json_rpc", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"DERO.Unknown"}`))
+		req.Header.Set("Content-Type", "application/json")
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		w := httptest.NewRecorder()
+		admin_handler(w, req)
+		return w
+	}
+	if w := request("", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("request without credentials must fail, got %d", w.Code)
+	}
+	if w := request("admin", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("request with wrong password must fail, got %d", w.Code)
+	}
+	if w := request("admin", "secret"); w.Code != http.StatusOK {
+		t.Fatalf("request with credentials must reach rpc, got %d %s", w.Code, w.Body.String())
+	}
+}
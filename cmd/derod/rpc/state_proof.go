@@ -0,0 +1,98 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rpc
+
+import "fmt"
+
+import "github.com/deroproject/derohe/config"
+import "github.com/deroproject/derohe/cryptography/crypto"
+import "github.com/deroproject/derohe/rpc"
+
+import "github.com/deroproject/graviton"
+
+// generates merkle proofs, so clients can verify state against a state root they trust
+// for native balances, key is the account, for SCs keys are within SC data tree
+func state_proof(ss *graviton.Snapshot, topoheight int64, blid crypto.Hash, scid crypto.Hash, keys ...[]byte) (proof *rpc.StateProof, err error) {
+	var zerohash crypto.Hash
+	var balance_tree, meta_tree, data_tree *graviton.Tree
+
+	if balance_tree, err = ss.GetTree(config.BALANCE_TREE); err != nil {
+		return
+	}
+	if meta_tree, err = ss.GetTree(config.SC_META); err != nil {
+		return
+	}
+
+	balance_hash, err := balance_tree.Hash()
+	if err != nil {
+		return
+	}
+	meta_hash, err := meta_tree.Hash()
+	if err != nil {
+		return
+	}
+	var state_hash crypto.Hash
+	for i := range state_hash {
+		state_hash[i] = balance_hash[i] ^ meta_hash[i]
+	}
+
+	proof = &rpc.StateProof{
+		TopoHeight:  topoheight,
+		BlockHash:   blid,
+		StateHash:   fmt.Sprintf("%x", state_hash[:]),
+		BalanceHash: fmt.Sprintf("%x", balance_hash[:]),
+		MetaHash:    fmt.Sprintf("%x", meta_hash[:]),
+	}
+
+	balance_key, meta_key := zerohash[:], scid[:]
+	if scid.IsZero() {
+		if len(keys) != 1 {
+			return nil, fmt.Errorf("native balance proof requires a single key")
+		}
+		balance_key = keys[0]
+	}
+
+	if proof.BalanceProof, err = generate_proof(balance_tree, balance_key); err != nil {
+		return nil, err
+	}
+	if proof.MetaProof, err = generate_proof(meta_tree, meta_key); err != nil {
+		return nil, err
+	}
+
+	if scid.IsZero() {
+		return
+	}
+
+	if data_tree, err = ss.GetTree(string(scid[:])); err != nil {
+		return nil, err
+	}
+	proof.DataProofs = map[string]string{}
+	for _, key := range keys {
+		if proof.DataProofs[fmt.Sprintf("%x", key)], err = generate_proof(data_tree, key); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+func generate_proof(tree *graviton.Tree, key []byte) (string, error) {
+	proof, err := tree.GenerateProof(key)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", proof.Marshal()), nil
+}
@@ -0,0 +1,365 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rpc
+
+// this file implements a stratum listener for miners and proxies which do not speak getwork
+// protocol is newline delimited json-rpc over tcp, methods are login, submit and keepalived, jobs are notified using job method
+// login is "<address>[.<worker>]" or "<address>[.<worker>]+<difficulty>" for a fixed per connection difficulty
+// submit carries job_id and hex nonce, which are the trailing 4 to 12 bytes of the job blob (48 bytes miniblock)
+
+import "fmt"
+import "net"
+import "sync"
+import "time"
+import "bufio"
+import "strings"
+import "strconv"
+import "math/big"
+import "encoding/hex"
+import "encoding/json"
+import "encoding/binary"
+
+import "github.com/deroproject/derohe/block"
+import "github.com/deroproject/derohe/globals"
+
+const STRATUM_MIN_DIFFICULTY = 1000           // per connection difficulty cannot be lower, unless network difficulty is
+const STRATUM_JOBS_MAX = 8                    // submits are accepted for these many recent jobs of a connection
+const STRATUM_MAX_LINE = 16 * 1024            // max size of a request
+const STRATUM_IDLE_TIMEOUT = 10 * time.Minute // connections without any request are closed
+
+type stratum_request struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type stratum_error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type stratum_response struct {
+	ID      json.RawMessage `json:"id"`
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result"`
+	Error   *stratum_error  `json:"error"`
+}
+
+type stratum_notification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type stratum_job struct {
+	Blob       string `json:"blob"`
+	JobID      string `json:"job_id"`
+	Target     string `json:"target"` // 8 byte little endian target, 2^64 / difficulty
+	Difficulty uint64 `json:"difficulty"`
+	Height     uint64 `json:"height"`
+	Algo       string `json:"algo"`
+	LastError  string `json:"lasterror,omitempty"`
+}
+
+type stratum_login_params struct {
+	Login string `json:"login"`
+	Pass  string `json:"pass"`
+	Agent string `json:"agent"`
+}
+
+type stratum_submit_params struct {
+	ID     string `json:"id"`
+	JobID  string `json:"job_id"`
+	Nonce  string `json:"nonce"`
+	Result string `json:"result"` // ignored, PoW is always computed by daemon
+}
+
+// work handed out to a connection
+type stratum_work struct {
+	job_id     string
+	tstamp     uint64
+	blob       []byte
+	difficulty uint64          // share difficulty
+	network    *big.Int        // network difficulty
+	seen       map[string]bool // submitted miniblocks, keyed by final bytes
+}
+
+type stratum_conn struct {
+	sync.Mutex
+	conn       net.Conn
+	id         string
+	session    *user_session
+	jobs       []stratum_work
+	job_seq    uint64
+	write_lock sync.Mutex
+}
+
+var stratum_list_mutex sync.Mutex
+var stratum_list = map[*stratum_conn]bool{}
+
+// number of miners connected using stratum
+func stratum_count() int {
+	stratum_list_mutex.Lock()
+	defer stratum_list_mutex.Unlock()
+	return len(stratum_list)
+}
+
+// start stratum listener if --stratum-bind was provided
+func Stratum_server() {
+	if globals.Arguments["--stratum-bind"] == nil {
+		return
+	}
+	addr, err := net.ResolveTCPAddr("tcp", globals.Arguments["--stratum-bind"].(string))
+	if err != nil {
+		logger_getwork.Error(err, "--stratum-bind address is invalid")
+		return
+	}
+	if addr.Port == 0 {
+		logger_getwork.Info("STRATUM server is disabled")
+		return
+	}
+
+	listener, err := net.Listen("tcp", addr.String())
+	if err != nil {
+		logger_getwork.Error(err, "STRATUM server could not listen", "address", addr.String())
+		return
+	}
+	logger_getwork.Info("STRATUM will listen", "address", addr.String())
+	start_job_dispatcher()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			logger_getwork.Error(err, "STRATUM accept failed")
+			time.Sleep(time.Second)
+			continue
+		}
+		go stratum_handle(conn)
+	}
+}
+
+func stratum_handle(conn net.Conn) {
+	defer globals.Recover(2)
+
+	sc := &stratum_conn{conn: conn}
+	defer func() {
+		stratum_list_mutex.Lock()
+		delete(stratum_list, sc)
+		stratum_list_mutex.Unlock()
+		sc.Lock()
+		if sc.session != nil {
+			sc.session.close()
+		}
+		sc.Unlock()
+		conn.Close()
+	}()
+
+	reader := bufio.NewScanner(conn)
+	reader.Buffer(make([]byte, 0, 1024), STRATUM_MAX_LINE)
+	for {
+		conn.SetReadDeadline(time.Now().Add(STRATUM_IDLE_TIMEOUT))
+		if !reader.Scan() {
+			return
+		}
+		line := reader.Bytes()
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+
+		var req stratum_request
+		if err := json.Unmarshal(line, &req); err != nil {
+			sc.reply(nil, nil, -32700, "parse error")
+			return
+		}
+
+		switch req.Method {
+		case "login":
+			sc.login(req)
+		case "submit":
+			sc.submit(req)
+		case "keepalived":
+			sc.reply(req.ID, map[string]string{"status": "KEEPALIVED"}, 0, "")
+		default:
+			sc.reply(req.ID, nil, -32601, "method not found")
+		}
+	}
+}
+
+func (sc *stratum_conn) reply(id json.RawMessage, result interface{}, code int, message string) {
+	response := stratum_response{ID: id, JSONRPC: "2.0", Result: result}
+	if code != 0 {
+		response.Error = &stratum_error{Code: code, Message: message}
+	}
+	sc.write(response)
+}
+
+func (sc *stratum_conn) write(v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	sc.write_lock.Lock()
+	defer sc.write_lock.Unlock()
+	sc.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	sc.conn.Write(append(data, '\n'))
+}
+
+// parse "<address>" or "<address>+<difficulty>"
+func parse_stratum_login(login string) (address string, difficulty uint64, err error) {
+	address = login
+	if i := strings.LastIndex(login, "+"); i >= 0 {
+		address = login[:i]
+		if difficulty, err = strconv.ParseUint(login[i+1:], 10, 64); err != nil {
+			return "", 0, fmt.Errorf("invalid difficulty in login")
+		}
+	}
+	return
+}
+
+func (sc *stratum_conn) login(req stratum_request) {
+	var params stratum_login_params
+	if err := json.Unmarshal(req.Params, &params); err != nil {
+		sc.reply(req.ID, nil, -32602, "invalid params")
+		return
+	}
+
+	login, difficulty, err := parse_stratum_login(params.Login)
+	if err != nil {
+		sc.reply(req.ID, nil, -1, err.Error())
+		return
+	}
+	address, worker := parse_worker(login)
+	addr, err := globals.ParseValidateAddress(address)
+	if err != nil {
+		sc.reply(req.ID, nil, -1, fmt.Sprintf("invalid address: %s", err))
+		return
+	}
+
+	job, err := new_mining_job()
+	if err != nil {
+		sc.reply(req.ID, nil, -1, "no job available")
+		return
+	}
+
+	sc.Lock()
+	sc.id = fmt.Sprintf("%x", globals.Global_Random.Uint64())
+	if sc.session != nil { // miner logged in again
+		sc.session.close()
+	}
+	sc.session = new_session(*addr, worker, "stratum")
+	sc.session.fixed_difficulty = difficulty
+	work := sc.new_work(&job)
+	sc.Unlock()
+
+	stratum_list_mutex.Lock()
+	stratum_list[sc] = true
+	stratum_list_mutex.Unlock()
+
+	sc.reply(req.ID, map[string]interface{}{"id": sc.id, "job": work, "status": "OK"}, 0, "")
+}
+
+// create work for this connection from job, caller must hold lock
+func (sc *stratum_conn) new_work(job *mining_job) (result stratum_job) {
+	mbl, difficulty, lasterr := job.work_for(sc.session)
+	sc.job_seq++
+
+	work := stratum_work{job_id: fmt.Sprintf("%d.%d", job.bl.Timestamp, sc.job_seq), tstamp: job.bl.Timestamp, blob: mbl.Serialize(), difficulty: difficulty, network: job.diff, seen: map[string]bool{}}
+	sc.jobs = append(sc.jobs, work)
+	if len(sc.jobs) > STRATUM_JOBS_MAX {
+		sc.jobs = sc.jobs[1:]
+	}
+
+	return stratum_job{Blob: hex.EncodeToString(work.blob), JobID: work.job_id, Target: stratum_target(work.difficulty), Difficulty: work.difficulty, Height: job.bl.Height, Algo: "astrobwt/v3", LastError: lasterr}
+}
+
+// 8 byte little endian target as used by stratum miners
+func stratum_target(difficulty uint64) string {
+	if difficulty == 0 {
+		difficulty = 1
+	}
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], ^uint64(0)/difficulty)
+	return hex.EncodeToString(buf[:])
+}
+
+// notify all logged in connections of new job
+func stratum_send_job(job *mining_job) {
+	stratum_list_mutex.Lock()
+	defer stratum_list_mutex.Unlock()
+
+	for sc := range stratum_list {
+		go func(sc *stratum_conn) {
+			defer globals.Recover(2)
+			sc.Lock()
+			work := sc.new_work(job)
+			sc.Unlock()
+			sc.write(stratum_notification{JSONRPC: "2.0", Method: "job", Params: work})
+		}(sc)
+	}
+}
+
+func (sc *stratum_conn) submit(req stratum_request) {
+	var params stratum_submit_params
+	if err := json.Unmarshal(req.Params, &params); err != nil {
+		sc.reply(req.ID, nil, -32602, "invalid params")
+		return
+	}
+
+	sc.Lock()
+	defer sc.Unlock()
+
+	if sc.session == nil || params.ID != sc.id {
+		sc.reply(req.ID, nil, -1, "unauthenticated")
+		return
+	}
+
+	var work *stratum_work
+	for i := range sc.jobs {
+		if sc.jobs[i].job_id == params.JobID {
+			work = &sc.jobs[i]
+		}
+	}
+	if work == nil {
+		sc.session.reject("stale job")
+		sc.reply(req.ID, nil, -1, "stale job")
+		return
+	}
+
+	nonce, err := hex.DecodeString(params.Nonce)
+	if err != nil || len(nonce) < 4 || len(nonce) > 12 {
+		sc.session.reject("nonce must be 4 to 12 hex bytes")
+		sc.reply(req.ID, nil, -1, "nonce must be 4 to 12 hex bytes")
+		return
+	}
+
+	blob := append([]byte{}, work.blob...)
+	copy(blob[block.MINIBLOCK_SIZE-len(nonce):], nonce)
+
+	// different hex spellings of a nonce result in same miniblock, so dedupe on what gets hashed
+	if work.seen[string(blob)] {
+		sc.session.reject("duplicate share")
+		sc.reply(req.ID, nil, -1, "duplicate share")
+		return
+	}
+	work.seen[string(blob)] = true
+
+	if err = submit_work(sc.session, work.tstamp, blob, work.difficulty, work.network); err != nil {
+		sc.reply(req.ID, nil, -1, err.Error())
+		return
+	}
+	sc.reply(req.ID, map[string]string{"status": "OK"}, 0, "")
+}
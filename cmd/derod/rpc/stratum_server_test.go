@@ -0,0 +1,79 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rpc
+
+import "net"
+import "bufio"
+import "testing"
+import "encoding/json"
+
+func Test_Stratum_Login_Target(t *testing.T) {
+	if address, difficulty, err := parse_stratum_login("deto1abc+5000"); err != nil || address != "deto1abc" || difficulty != 5000 {
+		t.Fatalf("login parsing failed %s %d %s", address, difficulty, err)
+	}
+	if address, difficulty, err := parse_stratum_login("deto1abc"); err != nil || address != "deto1abc" || difficulty != 0 {
+		t.Fatalf("login parsing failed %s %d %s", address, difficulty, err)
+	}
+	if login, difficulty, err := parse_stratum_login("deto1abc.rig1+5000"); err != nil || login != "deto1abc.rig1" || difficulty != 5000 {
+		t.Fatalf("login parsing failed %s %d %s", login, difficulty, err)
+	}
+	if _, _, err := parse_stratum_login("deto1abc+x"); err == nil {
+		t.Fatalf("invalid difficulty must fail")
+	}
+
+	if target := stratum_target(1); target != "ffffffffffffffff" {
+		t.Fatalf("unexpected target %s", target)
+	}
+	if target := stratum_target(0x100); target != "ffffffffffffff00" {
+		t.Fatalf("unexpected target %s", target)
+	}
+}
+
+// requests which do not need chain
+func Test_Stratum_Protocol(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	go stratum_handle(server)
+
+	reader := bufio.NewReader(client)
+	call := func(request string) (response stratum_response) {
+		if _, err := client.Write([]byte(request + "\n")); err != nil {
+			t.Fatalf("write failed err %s", err)
+		}
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("read failed err %s", err)
+		}
+		if err = json.Unmarshal(line, &response); err != nil {
+			t.Fatalf("invalid response %s err %s", line, err)
+		}
+		return
+	}
+
+	if response := call(`{"id":1,"method":"keepalived","params":{"id":"x"}}`); response.Error != nil || string(response.ID) != "1" {
+		t.Fatalf("keepalived failed %+v", response)
+	}
+	if response := call(`{"id":2,"method":"submit","params":{"id":"x","job_id":"1.1","nonce":"00000000"}}`); response.Error == nil || response.Error.Message != "unauthenticated" {
+		t.Fatalf("submit without login must fail %+v", response)
+	}
+	if response := call(`{"id":3,"method":"login","params":{"login":"invalid"}}`); response.Error == nil {
+		t.Fatalf("login with invalid address must fail %+v", response)
+	}
+	if response := call(`{"id":4,"method":"getjob"}`); response.Error == nil || response.Error.Code != -32601 {
+		t.Fatalf("unknown method must fail %+v", response)
+	}
+}
@@ -31,10 +31,12 @@ import "crypto/rand"
 import "crypto/x509"
 import "encoding/pem"
 
+import "github.com/deroproject/derohe/block"
+import "github.com/deroproject/derohe/blockchain"
 import "github.com/deroproject/derohe/globals"
 import "github.com/deroproject/derohe/config"
+import "github.com/deroproject/derohe/cryptography/crypto"
 import "github.com/deroproject/derohe/rpc"
-import "github.com/deroproject/graviton"
 import "github.com/go-logr/logr"
 
 // this file implements the non-blocking job streamer
@@ -55,13 +57,28 @@ var (
 )
 
 type user_session struct {
-	blocks        uint64
-	miniblocks    uint64
-	rejected      uint64
-	lasterr       string
-	address       rpc.Address
-	valid_address bool
-	address_sum   [32]byte
+	sync.Mutex
+	blocks           uint64
+	miniblocks       uint64
+	rejected         uint64
+	shares           uint64 // accepted shares
+	lasterr          string
+	address          rpc.Address
+	valid_address    bool
+	address_sum      [32]byte
+	worker           string // optional worker name
+	protocol         string // getwork or stratum
+	connected        time.Time
+	fixed_difficulty uint64 // requested by miner, overrides vardiff
+	difficulty       uint64 // current vardiff difficulty
+	retarget_time    time.Time
+	retarget_shares  uint64
+	share_log        []share_event
+	last_share       int64
+	rejects          map[string]uint64 // reject reasons
+	jobs             []session_job
+	seen             map[crypto.Hash]uint64 // submitted shares, mblid -> job timestamp
+	labeled          bool                   // worker has its own metrics
 }
 
 var client_list_mutex sync.Mutex
@@ -129,7 +146,7 @@ func CountMiners() int {
 	defer cleanup()
 	client_list_mutex.Lock()
 	defer client_list_mutex.Unlock()
-	miners_count = len(client_list)
+	miners_count = len(client_list) + stratum_count()
 	return miners_count
 }
 
@@ -138,26 +155,76 @@ var CountMinisRejected int64 // total rejected // note we are only counting reje
 var CountBlocks int64        //  total blocks found as integrator, note that block can still be a orphan
 // total = CountAccepted + CountRejected + CountBlocks(they may be orphan or may not get rewarded)
 
-func SendJob() {
-
-	defer globals.Recover(1)
+// a block template alongwith difficulty, from which work for each miner is derived
+type mining_job struct {
+	bl        block.Block
+	mbl       block.MiniBlock
+	prev_hash string
+	diff      *big.Int // network difficulty
+	job_diff  *big.Int // difficulty at which miners work
+}
 
+func new_mining_job() (job mining_job, err error) {
 	// get a block template, and then we will fill the address here as optimization
 	bl, mbl_main, _, _, err := chain.Create_new_block_template_mining(chain.IntegratorAddress())
 	if err != nil {
 		return
 	}
+	job.bl, job.mbl = bl, mbl_main
 
-	prev_hash := ""
 	for i := range bl.Tips {
-		prev_hash = prev_hash + bl.Tips[i].String()
+		job.prev_hash = job.prev_hash + bl.Tips[i].String()
 	}
 
-	diff := chain.Get_Difficulty_At_Tips(bl.Tips)
+	job.diff = chain.Get_Difficulty_At_Tips(bl.Tips)
 
 	if mbl_main.HighDiff {
-		diff.Mul(diff, new(big.Int).SetUint64(config.MINIBLOCK_HIGHDIFF))
+		job.diff.Mul(job.diff, new(big.Int).SetUint64(config.MINIBLOCK_HIGHDIFF))
+	}
+
+	job.job_diff = job.diff
+	if pool != nil { // miners work at share difficulty, pool submits shares which meet network difficulty
+		pool.add_job(bl.Timestamp, int64(bl.Height), job.diff, mbl_main)
+		job.job_diff = new(big.Int).SetUint64(pool.job_difficulty(job.diff))
+	}
+	return
+}
+
+// personalise work for a miner, lasterr is non empty if miner cannot mine
+// difficulty is the share difficulty at which miner should work
+func (job *mining_job) work_for(v *user_session) (mbl block.MiniBlock, difficulty uint64, lasterr string) {
+	mbl = job.mbl
+	difficulty = v.job_difficulty(job)
+
+	if !mbl.Final && pool != nil { // rewards go to pool, which distributes them
+		copy(mbl.KeyHash[:], pool.address_sum[:])
+	} else if !mbl.Final { //write miners address only if possible
+		copy(mbl.KeyHash[:], v.address_sum[:])
+	}
+
+	for i := range mbl.Nonce { // give each user different work
+		mbl.Nonce[i] = globals.Global_Random.Uint32() // fill with randomness
+	}
+
+	if !v.valid_address && !chain.IsAddressHashValid(false, v.address_sum) {
+		lasterr = "unregistered miner or you need to wait 15 mins"
+	} else {
+		v.valid_address = true
 	}
+	return
+}
+
+func SendJob() {
+
+	defer globals.Recover(1)
+
+	job, err := new_mining_job()
+	if err != nil {
+		return
+	}
+
+	stratum_send_job(&job)
+
 	client_list_mutex.Lock()
 	defer client_list_mutex.Unlock()
 
@@ -169,31 +236,23 @@ func SendJob() {
 			encoder := json.NewEncoder(&buf)
 
 			var params rpc.GetBlockTemplate_Result
-			params.JobID = fmt.Sprintf("%d.%d.%s", bl.Timestamp, 0, "notified")
-			params.Height = bl.Height
-			params.Prev_Hash = prev_hash
-			params.Difficultyuint64 = diff.Uint64()
-			params.Difficulty = diff.String()
-
-			mbl := mbl_main
-
-			if !mbl.Final { //write miners address only if possible
-				copy(mbl.KeyHash[:], v.address_sum[:])
-			}
-
-			for i := range mbl.Nonce { // give each user different work
-				mbl.Nonce[i] = globals.Global_Random.Uint32() // fill with randomness
-			}
-
-			if !v.valid_address && !chain.IsAddressHashValid(false, v.address_sum) {
-				params.LastError = "unregistered miner or you need to wait 15 mins"
-			} else {
-				v.valid_address = true
-			}
+			params.JobID = fmt.Sprintf("%d.%d.%s", job.bl.Timestamp, 0, "notified")
+			params.Height = job.bl.Height
+			params.Prev_Hash = job.prev_hash
+
+			mbl, difficulty, lasterr := job.work_for(v)
+			params.Difficultyuint64 = difficulty
+			params.Difficulty = fmt.Sprintf("%d", difficulty)
+			params.LastError = lasterr
 			params.Blockhashing_blob = fmt.Sprintf("%x", mbl.Serialize())
+			v.Lock()
 			params.Blocks = v.blocks
 			params.MiniBlocks = v.miniblocks
+			if pool != nil {
+				params.MiniBlocks = v.shares // miners are more interested in their accepted shares
+			}
 			params.Rejected = v.rejected
+			v.Unlock()
 
 			encoder.Encode(params)
 			k.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
@@ -206,6 +265,85 @@ func SendJob() {
 
 }
 
+// validate work submitted by a miner and submit it to chain, session counters are updated
+// if share_difficulty is non zero, work is first checked against it and only work meeting network difficulty is submitted
+// in pool mode, every share is credited to miner
+func submit_work(sess *user_session, tstamp uint64, blob []byte, share_difficulty uint64, network *big.Int) (err error) {
+	var share_mblid crypto.Hash
+	var share_height int64
+	if pool != nil {
+		var candidate bool
+		if share_mblid, candidate, share_height, err = pool.check_share(sess.address.String(), tstamp, blob, share_difficulty); err != nil {
+			sess.reject(err.Error())
+			return
+		}
+		sess.accept_share(share_difficulty)
+		if !candidate { // share does not meet network difficulty
+			return
+		}
+	} else if share_difficulty > 0 {
+		var mbl block.MiniBlock
+		if err = mbl.Deserialize(blob); err != nil {
+			sess.reject("Submitted block could not be decoded")
+			return
+		}
+		if !mbl.Final && mbl.KeyHash != sess.address_sum {
+			sess.reject("share is not for miner address")
+			return fmt.Errorf("share is not for miner address")
+		}
+		if !sess.first_share(tstamp, mbl.GetHash()) {
+			sess.reject("duplicate share")
+			return fmt.Errorf("duplicate share")
+		}
+		pow := mbl.GetPoWHash()
+		if !blockchain.CheckPowHashBig(pow, new(big.Int).SetUint64(share_difficulty)) {
+			sess.reject("share does not meet share difficulty")
+			return fmt.Errorf("share does not meet share difficulty")
+		}
+		sess.accept_share(share_difficulty)
+		if !blockchain.CheckPowHashBig(pow, network) { // share does not meet network difficulty
+			return
+		}
+	}
+
+	_, blid, sresult, err := chain.Accept_new_block(tstamp, blob)
+
+	if sresult && blid.IsZero() && pool != nil {
+		pool.found(share_mblid, share_height)
+	}
+
+	if sresult {
+		//logger.Infof("Submitted block %s accepted", blid)
+		sess.found(!blid.IsZero())
+		if share_difficulty == 0 && pool == nil { // work at network difficulty, every accepted miniblock is a share
+			if network == nil {
+				network = chain.Get_Difficulty_At_Tips(chain.Get_TIPS())
+			}
+			if network.IsUint64() {
+				sess.accept_share(network.Uint64())
+			}
+		}
+		if blid.IsZero() {
+			atomic.AddInt64(&CountMinisAccepted, 1)
+
+			rate_lock.Lock()
+			defer rate_lock.Unlock()
+			mini_found_time = append(mini_found_time, time.Now().Unix())
+		} else {
+			atomic.AddInt64(&CountBlocks, 1)
+		}
+	}
+
+	if !sresult || err != nil {
+		atomic.AddInt64(&CountMinisRejected, 1)
+		if err == nil {
+			err = fmt.Errorf("rejected by chain")
+		}
+		sess.reject("rejected by chain")
+	}
+	return
+}
+
 func newUpgrader() *websocket.Upgrader {
 	u := websocket.NewUpgrader()
 
@@ -231,39 +369,30 @@ func newUpgrader() *websocket.Upgrader {
 		mbl_block_data_bytes, err := hex.DecodeString(p.MiniBlockhashing_blob)
 		if err != nil {
 			//logger.Info("Submitting block could not be decoded")
-			sess.lasterr = fmt.Sprintf("Submitted block could not be decoded. err: %s", err)
+			sess.reject("Submitted block could not be decoded")
 			return
 		}
 
 		var tstamp, extra uint64
 		fmt.Sscanf(p.JobID, "%d.%d", &tstamp, &extra)
 
-		_, blid, sresult, err := chain.Accept_new_block(tstamp, mbl_block_data_bytes)
-
-		if sresult {
-			//logger.Infof("Submitted block %s accepted", blid)
-			if blid.IsZero() {
-				sess.miniblocks++
-				atomic.AddInt64(&CountMinisAccepted, 1)
-
-				rate_lock.Lock()
-				defer rate_lock.Unlock()
-				mini_found_time = append(mini_found_time, time.Now().Unix())
-			} else {
-				sess.blocks++
-				atomic.AddInt64(&CountBlocks, 1)
-			}
+		var share_difficulty uint64
+		var network *big.Int
+		if job, ok := sess.find_job(tstamp); ok {
+			share_difficulty, network = job.difficulty, job.network
 		}
-
-		if !sresult || err != nil {
-			sess.rejected++
-			atomic.AddInt64(&CountMinisRejected, 1)
+		if network != nil && network.IsUint64() && share_difficulty >= network.Uint64() {
+			share_difficulty = 0 // work is at network difficulty, chain will verify it
 		}
+		submit_work(sess, tstamp, mbl_block_data_bytes, share_difficulty, network)
 
 	})
 	u.OnClose(func(c *websocket.Conn, err error) {
 		client_list_mutex.Lock()
 		defer client_list_mutex.Unlock()
+		if sess, ok := client_list[c]; ok {
+			sess.close()
+		}
 		delete(client_list, c)
 
 	})
@@ -276,14 +405,13 @@ func onWebsocket(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
-	address := strings.TrimPrefix(r.URL.Path, "/ws/")
+	address, worker := parse_worker(strings.TrimPrefix(r.URL.Path, "/ws/"))
 
 	addr, err := globals.ParseValidateAddress(address)
 	if err != nil {
 		fmt.Fprintf(w, "err: %s\n", err)
 		return
 	}
-	addr_raw := addr.PublicKey.EncodeCompressed()
 
 	upgrader := newUpgrader()
 	conn, err := upgrader.Upgrade(w, r, nil)
@@ -293,15 +421,49 @@ func onWebsocket(w http.ResponseWriter, r *http.Request) {
 	}
 	wsConn := conn.(*websocket.Conn)
 
-	session := user_session{address: *addr, address_sum: graviton.Sum(addr_raw)}
-	wsConn.SetSession(&session)
+	session := new_session(*addr, worker, "getwork")
+	wsConn.SetSession(session)
 
 	client_list_mutex.Lock()
 	defer client_list_mutex.Unlock()
-	client_list[wsConn] = &session
+	client_list[wsConn] = session
 
 }
 
+var job_dispatcher sync.Once
+
+// jobs are dispatched to getwork and stratum miners by a single dispatcher
+func start_job_dispatcher() {
+	job_dispatcher.Do(func() {
+		//globals.Cron.AddFunc("@every 2s", SendJob) // if daemon restart automaticaly send job
+		go func() { // try to be as optimized as possible to lower hash wastage
+			sleeptime, _ := time.ParseDuration(os.Getenv("JOB_SEND_TIME_DELAY")) // this will hopefully be never required to change
+			if sleeptime.Milliseconds() < 40 {
+				sleeptime = 500 * time.Millisecond
+			}
+			logger_getwork.Info("Job will be dispatched every", "time", sleeptime)
+			old_mini_count := 0
+			old_time := time.Now()
+			old_height := int64(0)
+			for {
+				if miners_count > 0 {
+					current_mini_count := chain.MiniBlocks.Count()
+					current_height := chain.Get_Height()
+					if old_mini_count != current_mini_count || old_height != current_height || time.Now().Sub(old_time) > sleeptime {
+						old_mini_count = current_mini_count
+						old_height = current_height
+						SendJob()
+						old_time = time.Now()
+					}
+				} else {
+
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}()
+	})
+}
+
 func Getwork_server() {
 
 	var err error
@@ -315,6 +477,13 @@ func Getwork_server() {
 		InsecureSkipVerify: true,
 	}
 
+	vardiff_init()
+	if err = pool_init(); err != nil {
+		logger_getwork.Error(err, "Pool mode could not be enabled")
+		return
+	}
+	go Stratum_server()
+
 	mux := &http.ServeMux{}
 	mux.HandleFunc("/", onWebsocket) // handle everything
 
@@ -357,32 +526,7 @@ func Getwork_server() {
 		memPool.Put(b)
 	})
 
-	//globals.Cron.AddFunc("@every 2s", SendJob) // if daemon restart automaticaly send job
-	go func() { // try to be as optimized as possible to lower hash wastage
-		sleeptime, _ := time.ParseDuration(os.Getenv("JOB_SEND_TIME_DELAY")) // this will hopefully be never required to change
-		if sleeptime.Milliseconds() < 40 {
-			sleeptime = 500 * time.Millisecond
-		}
-		logger_getwork.Info("Job will be dispatched every", "time", sleeptime)
-		old_mini_count := 0
-		old_time := time.Now()
-		old_height := int64(0)
-		for {
-			if miners_count > 0 {
-				current_mini_count := chain.MiniBlocks.Count()
-				current_height := chain.Get_Height()
-				if old_mini_count != current_mini_count || old_height != current_height || time.Now().Sub(old_time) > sleeptime {
-					old_mini_count = current_mini_count
-					old_height = current_height
-					SendJob()
-					old_time = time.Now()
-				}
-			} else {
-
-			}
-			time.Sleep(10 * time.Millisecond)
-		}
-	}()
+	start_job_dispatcher()
 
 	if err = svr.Start(); err != nil {
 		logger_getwork.Error(err, "nbio.Start failed.")
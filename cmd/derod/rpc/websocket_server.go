@@ -143,6 +143,24 @@ func Notify_Height_Changes() {
 	}
 }
 
+// this function triggers notification to all clients that main chain has been reorganised, details are available using GetReorgs
+func Notify_Reorg() {
+
+	for {
+		chain.RPC_NotifyReorg.L.Lock()
+		chain.RPC_NotifyReorg.Wait()
+		chain.RPC_NotifyReorg.L.Unlock()
+
+		go func() {
+			defer globals.Recover(2)
+			client_connections.Range(func(key, value interface{}) bool {
+				key.(*jrpc2.Server).Notify(context.Background(), "Reorg", nil)
+				return true
+			})
+		}()
+	}
+}
+
 func RPCServer_Start(params map[string]interface{}) (*RPCServer, error) {
 	var r RPCServer
 
@@ -218,6 +236,13 @@ func (r *RPCServer) Run() {
 	r.mux.HandleFunc("/", hello)
 	r.mux.HandleFunc("/metrics", metrics.WritePrometheus) // register metrics handler
 
+	if err := admin_init(); err != nil {
+		logger.Error(err, "admin rpc is disabled")
+	} else if admin_user != "" {
+		r.mux.HandleFunc("/admin/json_rpc", admin_handler)
+		logger.Info("admin rpc enabled", "endpoint", "/admin/json_rpc")
+	}
+
 	//if DEBUG_MODE {
 	// r.mux.HandleFunc("/debug/pprof/", pprof.Index)
 
@@ -238,6 +263,7 @@ func (r *RPCServer) Run() {
 	go Notify_Block_Addition()     // process all blocks
 	go Notify_MiniBlock_Addition() // process all blocks
 	go Notify_Height_Changes()     // gives notification of changed height
+	go Notify_Reorg()              // gives notification of reorganised chain
 	if err := r.srv.ListenAndServe(); err != http.ErrServerClosed {
 		logger.Error(err, "ListenAndServe failed")
 	}
@@ -305,6 +331,11 @@ var historical_apis = handler.Map{
 	"getblockheaderbytopoheight": handler.New(GetBlockHeaderByTopoHeight),
 	"getblockheaderbyhash":       handler.New(GetBlockHeaderByHash),
 	"gettxpool":                  handler.New(GetTxPool),
+	"gettxpoolwithstats":         handler.New(GetTxPoolWithStats),
+	"getfeeestimate":             handler.New(GetFeeEstimate),
+	"getminers":                  handler.New(GetMiners),
+	"getblocktemplatedetailed":   handler.New(GetBlockTemplateDetailed),
+	"getminiblocks":              handler.New(GetMiniBlocks),
 	"getrandomaddress":           handler.New(GetRandomAddress),
 	"gettransactions":            handler.New(GetTransaction),
 	"sendrawtransaction":         handler.New(SendRawTransaction),
@@ -318,6 +349,8 @@ var historical_apis = handler.Map{
 	"getgasestimate":             handler.New(GetGasEstimate),
 	"nametoaddress":              handler.New(NameToAddress),
 	"addresstoname":              handler.New(AddressToName),
+	"getprunestatus":             handler.New(GetPruneStatus),
+	"getreorgs":                  handler.New(GetReorgs),
 }
 
 var servicemux = handler.ServiceMap{
@@ -329,6 +362,11 @@ var servicemux = handler.ServiceMap{
 		"GetBlockHeaderByTopoHeight": handler.New(GetBlockHeaderByTopoHeight),
 		"GetBlockHeaderByHash":       handler.New(GetBlockHeaderByHash),
 		"GetTxPool":                  handler.New(GetTxPool),
+		"GetTxPoolWithStats":         handler.New(GetTxPoolWithStats),
+		"GetFeeEstimate":             handler.New(GetFeeEstimate),
+		"GetMiners":                  handler.New(GetMiners),
+		"GetBlockTemplateDetailed":   handler.New(GetBlockTemplateDetailed),
+		"GetMiniBlocks":              handler.New(GetMiniBlocks),
 		"GetRandomAddress":           handler.New(GetRandomAddress),
 		"GetTransaction":             handler.New(GetTransaction),
 		"SendRawTransaction":         handler.New(SendRawTransaction),
@@ -342,6 +380,8 @@ var servicemux = handler.ServiceMap{
 		"GetGasEstimate":             handler.New(GetGasEstimate),
 		"NameToAddress":              handler.New(NameToAddress),
 		"AddressToName":              handler.New(AddressToName),
+		"GetPruneStatus":             handler.New(GetPruneStatus),
+		"GetReorgs":                  handler.New(GetReorgs),
 	},
 	"DAEMON": handler.Map{
 		"Echo": handler.New(DAEMON_Echo),
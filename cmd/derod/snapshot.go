@@ -0,0 +1,517 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+// this file implements state snapshots, a node can be started from a trusted snapshot without fastsync
+// snapshot contains all state trees at a topoheight followed by the last few blocks together with their state changes
+// it uses the same framing as chain archives, every entry is cbor encoded
+// state after every block must match Load_Merkle_Hash recorded by the exporting node, otherwise nothing is written
+// hashes inside snapshot only prove that it is consistent, state after last block must match a state hash obtained
+// from a trusted node, blocks must also carry valid PoW for their difficulty
+// difficulty of the first blocks cannot be recomputed from snapshot, so the trusted hash covers them together with state
+
+import "os"
+import "io"
+import "fmt"
+import "time"
+import "bytes"
+import "math/big"
+import "path/filepath"
+
+import "github.com/fxamacker/cbor/v2"
+
+import "github.com/deroproject/derohe/block"
+import "github.com/deroproject/derohe/blockchain"
+import "github.com/deroproject/derohe/config"
+import "github.com/deroproject/derohe/cryptography/crypto"
+import "github.com/deroproject/derohe/globals"
+import "github.com/deroproject/derohe/p2p"
+
+import "github.com/deroproject/graviton"
+
+var snapshot_magic = [8]byte{'D', 'E', 'R', 'O', 'S', 'N', 'A', 'P'}
+
+const SNAPSHOT_BLOCKS = 50        // blocks included after the state, these are required for difficulty and stability checks
+const SNAPSHOT_CHUNK_KEYS = 10000 // keys per tree entry
+
+// changes done by a block to a single tree
+type snapshot_changes struct {
+	Tree    []byte   `cbor:"TREE"`
+	Keys    [][]byte `cbor:"KEYS,omitempty"`
+	Values  [][]byte `cbor:"VALUES,omitempty"`
+	Deleted [][]byte `cbor:"DELETED,omitempty"`
+}
+
+// an entry is either a chunk of a state tree or a block
+type snapshot_entry struct {
+	Tree   []byte   `cbor:"TREE,omitempty"`
+	Keys   [][]byte `cbor:"KEYS,omitempty"`
+	Values [][]byte `cbor:"VALUES,omitempty"`
+
+	Block      []byte             `cbor:"BLOCK,omitempty"` // complete block in p2p format
+	Difficulty string             `cbor:"DIFF,omitempty"`
+	Changes    []snapshot_changes `cbor:"CHANGES,omitempty"`
+	StateHash  crypto.Hash        `cbor:"STATE"` // Load_Merkle_Hash after this block
+}
+
+// all changes between 2 versions of a tree
+func snapshot_diff(previous_ss, current_ss *graviton.Snapshot, treename string) (changes snapshot_changes, err error) {
+	var previous_tree, current_tree *graviton.Tree
+	if previous_tree, err = previous_ss.GetTree(treename); err != nil {
+		return
+	}
+	if current_tree, err = current_ss.GetTree(treename); err != nil {
+		return
+	}
+	changes.Tree = []byte(treename)
+	change_handler := func(k, v []byte) {
+		changes.Keys = append(changes.Keys, k)
+		changes.Values = append(changes.Values, v)
+	}
+	delete_handler := func(k, v []byte) {
+		changes.Deleted = append(changes.Deleted, k)
+	}
+	err = graviton.Diff(previous_tree, current_tree, delete_handler, change_handler, change_handler)
+	return
+}
+
+func write_snapshot_entry(writer *archive_writer, topo int64, blid crypto.Hash, entry *snapshot_entry) error {
+	data, err := cbor.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return writer.write(archive_record{Topo: topo, BLID: blid, Block: data})
+}
+
+// writes a tree in chunks
+func export_tree(writer *archive_writer, topo int64, ss *graviton.Snapshot, treename string) (keys [][]byte, err error) {
+	tree, err := ss.GetTree(treename)
+	if err != nil {
+		return nil, err
+	}
+	entry := snapshot_entry{Tree: []byte(treename)}
+	cursor := tree.Cursor()
+	for k, v, err := cursor.First(); err == nil; k, v, err = cursor.Next() {
+		keys = append(keys, k)
+		entry.Keys = append(entry.Keys, k)
+		entry.Values = append(entry.Values, v)
+		if len(entry.Keys) >= SNAPSHOT_CHUNK_KEYS {
+			if err = write_snapshot_entry(writer, topo, crypto.Hash{}, &entry); err != nil {
+				return nil, err
+			}
+			entry.Keys, entry.Values = nil, nil
+		}
+	}
+	if len(entry.Keys) > 0 {
+		err = write_snapshot_entry(writer, topo, crypto.Hash{}, &entry)
+	}
+	return keys, err
+}
+
+// exports state at topoheight together with the blocks before it
+func export_state(chain *blockchain.Blockchain, topo int64, filename string) (err error) {
+	chain.Prune_Mutex.RLock() // state versions must not change while exporting, online pruning waits
+	defer chain.Prune_Mutex.RUnlock()
+
+	if topo < 0 || topo > chain.Load_TOPO_HEIGHT() {
+		topo = chain.Load_TOPO_HEIGHT()
+	}
+	start := topo - (SNAPSHOT_BLOCKS - 1) // state is written at this topoheight
+	if start < 1 {
+		return fmt.Errorf("chain is too short, atleast %d blocks are required", SNAPSHOT_BLOCKS)
+	}
+	if pruned := chain.LocatePruneTopo(); start < pruned {
+		return fmt.Errorf("chain has been pruned till topoheight %d, export from %d onwards", pruned, pruned+SNAPSHOT_BLOCKS-1)
+	}
+
+	file, err := os.Create(filename + ".part")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		file.Close()
+		if err != nil {
+			os.Remove(filename + ".part")
+		}
+	}()
+
+	header := archive_header{Magic: snapshot_magic, From: start, To: topo}
+	copy(header.Network[:], globals.Config.Network_ID.Bytes())
+	writer, err := new_archive_writer(file, header)
+	if err != nil {
+		return err
+	}
+
+	begin := time.Now()
+	record, err := chain.Store.Topo_store.Read(start)
+	if err != nil {
+		return err
+	}
+	ss, err := chain.Store.Balance_store.LoadSnapshot(record.State_Version)
+	if err != nil {
+		return err
+	}
+	if _, err = export_tree(writer, start, ss, config.BALANCE_TREE); err != nil {
+		return err
+	}
+	scids, err := export_tree(writer, start, ss, config.SC_META)
+	if err != nil {
+		return err
+	}
+	for _, scid := range scids {
+		if _, err = export_tree(writer, start, ss, string(scid)); err != nil {
+			return err
+		}
+	}
+	logger.Info("State exported", "topoheight", start, "scs", len(scids))
+
+	var state_hash crypto.Hash // state after last block, importers need it to verify snapshot
+	var blocks []snapshot_block
+	previous_ss := ss
+	for t := start; t <= topo; t++ {
+		if record, err = chain.Store.Topo_store.Read(t); err != nil {
+			return err
+		}
+		cbl, err := load_complete_block(chain, record.BLOCK_ID)
+		if err != nil {
+			return fmt.Errorf("cannot load block at topoheight %d err %s", t, err)
+		}
+		diff := chain.Load_Block_Difficulty(record.BLOCK_ID)
+		entry := snapshot_entry{Block: p2p.Convert_CBL_TO_P2PCBL(cbl, true), Difficulty: diff.String()}
+		if entry.StateHash, err = chain.Load_Merkle_Hash(record.State_Version); err != nil {
+			return err
+		}
+
+		if t != start { // state of first block is already written
+			current_ss, err := chain.Store.Balance_store.LoadSnapshot(record.State_Version)
+			if err != nil {
+				return err
+			}
+			for _, treename := range []string{config.BALANCE_TREE, config.SC_META} {
+				changes, err := snapshot_diff(previous_ss, current_ss, treename)
+				if err != nil {
+					return err
+				}
+				entry.Changes = append(entry.Changes, changes)
+			}
+			for _, scid := range entry.Changes[1].Keys { // data of every changed SC
+				changes, err := snapshot_diff(previous_ss, current_ss, string(scid))
+				if err != nil {
+					return err
+				}
+				entry.Changes = append(entry.Changes, changes)
+			}
+			previous_ss = current_ss
+		}
+
+		if err = write_snapshot_entry(writer, t, record.BLOCK_ID, &entry); err != nil {
+			return err
+		}
+		state_hash = entry.StateHash
+		blocks = append(blocks, snapshot_block{cbl: cbl, diff: diff})
+	}
+
+	if err = writer.close(); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	if err = os.Rename(filename+".part", filename); err != nil {
+		return err
+	}
+	logger.Info("Snapshot exported", "file", filename, "from", start, "topoheight", topo, "state_hash", snapshot_trusted_hash(state_hash, blocks), "duration", time.Since(begin))
+	return nil
+}
+
+// commits changes to state, returns version of state
+func apply_snapshot_changes(store *graviton.Store, version uint64, changes []snapshot_changes) (uint64, error) {
+	ss, err := store.LoadSnapshot(version)
+	if err != nil {
+		return 0, err
+	}
+	var changed_trees []*graviton.Tree
+	for _, change := range changes {
+		if len(change.Keys) != len(change.Values) {
+			return 0, fmt.Errorf("tree %x has %d keys and %d values", change.Tree, len(change.Keys), len(change.Values))
+		}
+		tree, err := ss.GetTree(string(change.Tree))
+		if err != nil {
+			return 0, err
+		}
+		for _, k := range change.Deleted {
+			if err = tree.Delete(k); err != nil {
+				return 0, err
+			}
+		}
+		for j := range change.Keys {
+			if err = tree.Put(change.Keys[j], change.Values[j]); err != nil {
+				return 0, err
+			}
+		}
+		changed_trees = append(changed_trees, tree)
+	}
+	if len(changed_trees) == 0 {
+		return version, nil
+	}
+	return graviton.Commit(changed_trees...)
+}
+
+// keys present in latest version of a tree
+func tree_keys(store *graviton.Store, treename string) (keys [][]byte, err error) {
+	ss, err := store.LoadSnapshot(0)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := ss.GetTree(treename)
+	if err != nil {
+		return nil, err
+	}
+	cursor := tree.Cursor()
+	for k, _, err := cursor.First(); err == nil; k, _, err = cursor.Next() {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// imports a snapshot into an empty data directory
+// blocks and topo records are written only after state of every block has been verified
+// a block read from snapshot
+type snapshot_block struct {
+	cbl     *block.Complete_Block
+	diff    *big.Int
+	version uint64
+}
+
+// blocks of a snapshot, difficulty of a block can be recomputed if its tips and their parents are part of snapshot
+type snapshot_blocks map[crypto.Hash]*snapshot_block
+
+func (s snapshot_blocks) Load_Block_Height(h crypto.Hash) int64 {
+	if b, ok := s[h]; ok {
+		return int64(b.cbl.Bl.Height)
+	}
+	return -1
+}
+func (s snapshot_blocks) Load_Block_Difficulty(h crypto.Hash) *big.Int {
+	return new(big.Int).Set(s[h].diff)
+}
+func (s snapshot_blocks) Load_Block_Timestamp(h crypto.Hash) uint64 {
+	return s[h].cbl.Bl.Timestamp
+}
+func (s snapshot_blocks) Get_Block_Past(h crypto.Hash) []crypto.Hash {
+	return s[h].cbl.Bl.Tips
+}
+
+func (s snapshot_blocks) computable(tips []crypto.Hash) bool {
+	if len(tips) == 0 {
+		return false
+	}
+	for _, tip := range tips {
+		if _, ok := s[tip]; !ok {
+			return false
+		}
+	}
+	parents := s[tips[0]].cbl.Bl.Tips
+	if len(parents) == 0 {
+		return false
+	}
+	_, ok := s[parents[0]]
+	return ok
+}
+
+// every miniblock must solve difficulty of its block, and that difficulty must follow from previous blocks
+// wherever they are part of snapshot, so a snapshot cannot carry blocks without work
+func verify_snapshot_pow(blocks []snapshot_block) error {
+	known := snapshot_blocks{}
+	for i := range blocks {
+		known[blocks[i].cbl.Bl.GetHash()] = &blocks[i]
+	}
+	for i := range blocks {
+		bl := blocks[i].cbl.Bl
+		if known.computable(bl.Tips) {
+			if diff := blockchain.Get_Difficulty_At_Tips(known, bl.Tips); diff.Cmp(blocks[i].diff) != 0 {
+				return fmt.Errorf("block %s has difficulty %s, expected %s", bl.GetHash(), blocks[i].diff, diff)
+			}
+		}
+	}
+	for i := range blocks { // PoW is checked last, since it is expensive
+		bl := blocks[i].cbl.Bl
+		if err := blockchain.Verify_MiniBlocks(*bl); err != nil {
+			return fmt.Errorf("block %s has invalid miniblocks err %s", bl.GetHash(), err)
+		}
+		for j := range bl.MiniBlocks {
+			diff := new(big.Int).Set(blocks[i].diff)
+			if bl.MiniBlocks[j].HighDiff {
+				diff.Mul(diff, new(big.Int).SetUint64(config.MINIBLOCK_HIGHDIFF))
+			}
+			if !blockchain.CheckPowHashBig(bl.MiniBlocks[j].GetPoWHash(), diff) {
+				return fmt.Errorf("block %s miniblock %d has invalid PoW", bl.GetHash(), j)
+			}
+		}
+	}
+	return nil
+}
+
+// hash which importers must obtain from a trusted node, export-state prints it
+// it covers state after last block and difficulties of blocks, which cannot be recomputed from snapshot
+func snapshot_trusted_hash(state_hash crypto.Hash, blocks []snapshot_block) crypto.Hash {
+	known := snapshot_blocks{}
+	for i := range blocks {
+		known[blocks[i].cbl.Bl.GetHash()] = &blocks[i]
+	}
+	data := [][]byte{state_hash[:]}
+	for i := range blocks {
+		if bl := blocks[i].cbl.Bl; !known.computable(bl.Tips) {
+			blid := bl.GetHash()
+			data = append(data, blid[:], []byte(blocks[i].diff.String()+"\n"))
+		}
+	}
+	return crypto.Keccak256(data...)
+}
+
+// trusted_hash is printed by export-state on a trusted node, see snapshot_trusted_hash
+func import_state(chain *blockchain.Blockchain, filename string, trusted_hash crypto.Hash) (err error) {
+	if chain.Load_TOPO_HEIGHT() > 0 {
+		return fmt.Errorf("state can only be imported into an empty data directory")
+	}
+	if filename, err = filepath.Abs(filename); err != nil {
+		return err
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := new_archive_reader(file, snapshot_magic)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(reader.header.Network[:], globals.Config.Network_ID.Bytes()) {
+		return fmt.Errorf("snapshot belongs to a different network")
+	}
+
+	var blocks []snapshot_block
+	imported_trees := map[string]bool{}
+	store := chain.Store.Balance_store
+	version := uint64(0)
+	begin := time.Now()
+
+	for {
+		record, err := reader.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		var entry snapshot_entry
+		if err = cbor.Unmarshal(record.Block, &entry); err != nil {
+			return fmt.Errorf("cannot decode snapshot entry at topoheight %d err %s", record.Topo, err)
+		}
+
+		if len(entry.Block) == 0 { // a chunk of state tree
+			if len(blocks) > 0 {
+				return fmt.Errorf("state entry after blocks")
+			}
+			changes := snapshot_changes{Tree: entry.Tree, Keys: entry.Keys, Values: entry.Values}
+			if !imported_trees[string(entry.Tree)] { // genesis state is replaced entirely
+				if changes.Deleted, err = tree_keys(store, string(entry.Tree)); err != nil {
+					return err
+				}
+				imported_trees[string(entry.Tree)] = true
+			}
+			if version, err = apply_snapshot_changes(store, 0, []snapshot_changes{changes}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if record.Topo != reader.header.From+int64(len(blocks)) {
+			return fmt.Errorf("block at topoheight %d is out of order", record.Topo)
+		}
+		cbl, err := p2p.Convert_P2PCBL_TO_CBL(entry.Block)
+		if err != nil {
+			return fmt.Errorf("cannot decode block at topoheight %d err %s", record.Topo, err)
+		}
+		if cbl.Bl.GetHash() != record.BLID {
+			return fmt.Errorf("block at topoheight %d does not match its id", record.Topo)
+		}
+		for j := range cbl.Txs {
+			if cbl.Txs[j].GetHash() != cbl.Bl.Tx_hashes[j] {
+				return fmt.Errorf("block at topoheight %d has mismatching tx %s", record.Topo, cbl.Bl.Tx_hashes[j])
+			}
+		}
+		diff, ok := new(big.Int).SetString(entry.Difficulty, 10)
+		if !ok {
+			return fmt.Errorf("block at topoheight %d has invalid difficulty", record.Topo)
+		}
+
+		if len(blocks) == 0 {
+			if version == 0 {
+				return fmt.Errorf("snapshot has no state")
+			}
+		} else if version, err = apply_snapshot_changes(store, version, entry.Changes); err != nil {
+			return err
+		}
+
+		// resulting state must be exactly the one seen by exporting node
+		state_hash, err := chain.Load_Merkle_Hash(version)
+		if err != nil {
+			return err
+		}
+		if state_hash != entry.StateHash {
+			return fmt.Errorf("state mismatch at topoheight %d, expected %s actual %s", record.Topo, entry.StateHash, state_hash)
+		}
+		blocks = append(blocks, snapshot_block{cbl: cbl, diff: diff, version: version})
+	}
+	if len(blocks) != int(reader.header.To-reader.header.From+1) {
+		return fmt.Errorf("snapshot has %d blocks, expected %d", len(blocks), reader.header.To-reader.header.From+1)
+	}
+	if state_hash, err := chain.Load_Merkle_Hash(blocks[len(blocks)-1].version); err != nil {
+		return err
+	} else if hash := snapshot_trusted_hash(state_hash, blocks); hash != trusted_hash {
+		return fmt.Errorf("snapshot state or difficulty of its first blocks %s does not match trusted state hash %s", hash, trusted_hash)
+	}
+	if err = verify_snapshot_pow(blocks); err != nil {
+		return err
+	}
+
+	// same layout as fastsync, all topoheights before the snapshot share its state
+	var zerohash crypto.Hash
+	for i := int64(0); i <= reader.header.From; i++ {
+		chain.Store.Topo_store.Write(i, zerohash, blocks[0].version, 0)
+	}
+	for i, b := range blocks {
+		bl := b.cbl.Bl
+		for j := range b.cbl.Txs {
+			if err = chain.Store.Block_tx_store.WriteTX(bl.Tx_hashes[j], b.cbl.Txs[j].Serialize()); err != nil {
+				return err
+			}
+		}
+		if err = chain.Store.Block_tx_store.WriteBlock(bl.GetHash(), bl.Serialize(), b.diff, b.version, bl.Height); err != nil {
+			return err
+		}
+		if err = chain.Store.Topo_store.Write(reader.header.From+int64(i), bl.GetHash(), b.version, int64(bl.Height)); err != nil {
+			return err
+		}
+	}
+	chain.Initialise_Chain_From_DB()
+
+	logger.Info("Snapshot imported", "file", filename, "topoheight", chain.Load_TOPO_HEIGHT(), "height", chain.Get_Height(), "duration", time.Since(begin))
+	return nil
+}
@@ -0,0 +1,189 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import "io"
+import "bytes"
+import "testing"
+import "math/big"
+
+import "github.com/fxamacker/cbor/v2"
+
+import "github.com/deroproject/derohe/block"
+import "github.com/deroproject/derohe/blockchain"
+import "github.com/deroproject/derohe/config"
+import "github.com/deroproject/derohe/cryptography/crypto"
+import "github.com/deroproject/graviton"
+
+func test_tree_hash(t *testing.T, store *graviton.Store, version uint64, treename string) [32]byte {
+	ss, err := store.LoadSnapshot(version)
+	if err != nil {
+		t.Fatalf("cannot load snapshot err %s", err)
+	}
+	tree, _ := ss.GetTree(treename)
+	hash, _ := tree.Hash()
+	return hash
+}
+
+// state written by export must be recreated exactly, including later changes and deletions
+func Test_Snapshot_State(t *testing.T) {
+	source, _ := graviton.NewMemStore()
+	target, _ := graviton.NewMemStore()
+	trees := []string{config.BALANCE_TREE, config.SC_META, "scdata"}
+
+	ss, _ := source.LoadSnapshot(0)
+	var changed []*graviton.Tree
+	for i, treename := range trees {
+		tree, _ := ss.GetTree(treename)
+		for k := 0; k < SNAPSHOT_CHUNK_KEYS+10; k++ {
+			tree.Put([]byte{byte(i), byte(k >> 8), byte(k)}, []byte{byte(k)})
+		}
+		changed = append(changed, tree)
+	}
+	v1, _ := graviton.Commit(changed...)
+
+	ss, _ = source.LoadSnapshot(0)
+	balance_tree, _ := ss.GetTree(config.BALANCE_TREE)
+	balance_tree.Delete([]byte{0, 0, 1})
+	balance_tree.Put([]byte{0, 0, 2}, []byte{0xff})
+	balance_tree.Put([]byte{0xaa}, []byte{0xbb})
+	v2, _ := graviton.Commit(balance_tree)
+
+	// target has some keys which are not part of snapshot, like genesis state
+	ss, _ = target.LoadSnapshot(0)
+	balance_tree, _ = ss.GetTree(config.BALANCE_TREE)
+	balance_tree.Put([]byte{0xee}, []byte{0xee})
+	graviton.Commit(balance_tree)
+
+	var buf bytes.Buffer
+	writer, _ := new_archive_writer(&buf, archive_header{Magic: snapshot_magic})
+	ss, _ = source.LoadSnapshot(v1)
+	for _, treename := range trees {
+		if _, err := export_tree(writer, 0, ss, treename); err != nil {
+			t.Fatalf("cannot export tree err %s", err)
+		}
+	}
+	writer.close()
+
+	reader, err := new_archive_reader(bytes.NewReader(buf.Bytes()), snapshot_magic)
+	if err != nil {
+		t.Fatalf("cannot read snapshot err %s", err)
+	}
+	imported, version, chunks := map[string]bool{}, uint64(0), 0
+	for {
+		record, err := reader.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("cannot read entry err %s", err)
+		}
+		var entry snapshot_entry
+		if err = cbor.Unmarshal(record.Block, &entry); err != nil {
+			t.Fatalf("cannot decode entry err %s", err)
+		}
+		changes := snapshot_changes{Tree: entry.Tree, Keys: entry.Keys, Values: entry.Values}
+		if !imported[string(entry.Tree)] {
+			changes.Deleted, _ = tree_keys(target, string(entry.Tree))
+			imported[string(entry.Tree)] = true
+		}
+		if version, err = apply_snapshot_changes(target, 0, []snapshot_changes{changes}); err != nil {
+			t.Fatalf("cannot apply entry err %s", err)
+		}
+		chunks++
+	}
+	if chunks != 6 {
+		t.Fatalf("trees must be written in chunks, %d chunks", chunks)
+	}
+	for _, treename := range trees {
+		if test_tree_hash(t, source, v1, treename) != test_tree_hash(t, target, version, treename) {
+			t.Fatalf("tree %s differs after import", treename)
+		}
+	}
+
+	// block changes
+	old_ss, _ := source.LoadSnapshot(v1)
+	new_ss, _ := source.LoadSnapshot(v2)
+	changes, err := snapshot_diff(old_ss, new_ss, config.BALANCE_TREE)
+	if err != nil || len(changes.Deleted) != 1 || len(changes.Keys) != 2 {
+		t.Fatalf("diff err %v deleted %d changed %d", err, len(changes.Deleted), len(changes.Keys))
+	}
+	if version, err = apply_snapshot_changes(target, version, []snapshot_changes{changes}); err != nil {
+		t.Fatalf("cannot apply changes err %s", err)
+	}
+	if test_tree_hash(t, source, v2, config.BALANCE_TREE) != test_tree_hash(t, target, version, config.BALANCE_TREE) {
+		t.Fatalf("balance tree differs after applying changes")
+	}
+	if v, _ := apply_snapshot_changes(target, version, nil); v != version {
+		t.Fatalf("no changes must not create a version")
+	}
+}
+
+// snapshot blocks must carry work, difficulty which does not follow from previous blocks is rejected
+func Test_Snapshot_PoW(t *testing.T) {
+	var blocks []snapshot_block
+	var tips []crypto.Hash
+	for i := uint64(0); i < 3; i++ {
+		bl := &block.Block{Height: 10 + i, Timestamp: 1000000 + i*18000, Tips: tips}
+		blocks = append(blocks, snapshot_block{cbl: &block.Complete_Block{Bl: bl}, diff: big.NewInt(1000)})
+		tips = []crypto.Hash{bl.GetHash()}
+	}
+
+	known := snapshot_blocks{}
+	for i := range blocks {
+		known[blocks[i].cbl.Bl.GetHash()] = &blocks[i]
+	}
+	if known.computable(blocks[1].cbl.Bl.Tips) || !known.computable(blocks[2].cbl.Bl.Tips) {
+		t.Fatalf("difficulty can only be computed if tip and its parent are known")
+	}
+
+	blocks[2].diff = big.NewInt(1)
+	if err := verify_snapshot_pow(blocks); err == nil || !bytes.Contains([]byte(err.Error()), []byte("difficulty")) {
+		t.Fatalf("wrong difficulty accepted err %v", err)
+	}
+	blocks[2].diff = blockchain.Get_Difficulty_At_Tips(known, blocks[2].cbl.Bl.Tips)
+	if err := verify_snapshot_pow(blocks); err == nil || !bytes.Contains([]byte(err.Error()), []byte("miniblocks")) {
+		t.Fatalf("blocks without miniblocks accepted err %v", err)
+	}
+}
+
+// difficulty of blocks which cannot be recomputed is covered by trusted hash
+func Test_Snapshot_Trusted_Hash(t *testing.T) {
+	var blocks []snapshot_block
+	var tips []crypto.Hash
+	for i := uint64(0); i < 3; i++ {
+		bl := &block.Block{Height: 10 + i, Timestamp: 1000000 + i*18000, Tips: tips}
+		blocks = append(blocks, snapshot_block{cbl: &block.Complete_Block{Bl: bl}, diff: big.NewInt(1000)})
+		tips = []crypto.Hash{bl.GetHash()}
+	}
+	state_hash := crypto.Hash{1}
+	trusted := snapshot_trusted_hash(state_hash, blocks)
+
+	if snapshot_trusted_hash(crypto.Hash{2}, blocks) == trusted {
+		t.Fatalf("trusted hash must cover state")
+	}
+	for i := 0; i < 2; i++ {
+		blocks[i].diff = big.NewInt(1)
+		if snapshot_trusted_hash(state_hash, blocks) == trusted {
+			t.Fatalf("trusted hash must cover difficulty of block %d", i)
+		}
+		blocks[i].diff = big.NewInt(1000)
+	}
+	blocks[2].diff = big.NewInt(1) // recomputed while verifying PoW
+	if snapshot_trusted_hash(state_hash, blocks) != trusted {
+		t.Fatalf("trusted hash must only cover difficulties which cannot be recomputed")
+	}
+}
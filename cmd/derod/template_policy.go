@@ -0,0 +1,83 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+// this file implements template_policy console command, which controls which txs are selected for block templates
+// it is not part of public rpc, anyone reaching rpc could otherwise censor txs mined by this node
+// DERO.SetTemplatePolicy does the same over admin rpc, enabled by --rpc-admin-login
+
+import "fmt"
+import "strconv"
+import "strings"
+import "encoding/hex"
+
+import "github.com/deroproject/derohe/blockchain"
+import "github.com/deroproject/derohe/cryptography/crypto"
+
+// template_policy [clear | priority <txid>... | exclude <txid>... | exclude_sc <scid>... | max_size <bytes>]
+// each option replaces its own setting and keeps the others, without options current policy is printed
+func template_policy_command(chain *blockchain.Blockchain, args []string) (err error) {
+	var policy blockchain.Static_Template_Policy
+	if current, ok := chain.GetTemplatePolicy().(*blockchain.Static_Template_Policy); ok {
+		policy = *current // lists are replaced, never modified in place, so sharing them is safe
+	}
+
+	if len(args) > 0 {
+		switch strings.ToLower(args[0]) {
+		case "clear":
+			policy = blockchain.Static_Template_Policy{}
+		case "priority":
+			policy.PriorityTXIDs, err = parse_hashes(args[1:])
+		case "exclude":
+			policy.ExcludeTXIDs, err = parse_hashes(args[1:])
+		case "exclude_sc":
+			policy.ExcludeSCIDs, err = parse_hashes(args[1:])
+		case "max_size":
+			if len(args) != 2 {
+				return fmt.Errorf("max_size needs size in bytes, 0 means network limit")
+			}
+			policy.MaxSize, err = strconv.ParseUint(args[1], 10, 64)
+		default:
+			return fmt.Errorf("unknown template_policy option %s", args[0])
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(policy.PriorityTXIDs) == 0 && len(policy.ExcludeTXIDs) == 0 && len(policy.ExcludeSCIDs) == 0 && policy.MaxSize == 0 {
+			chain.SetTemplatePolicy(nil)
+		} else {
+			chain.SetTemplatePolicy(&policy)
+		}
+	}
+
+	logger.Info("block template policy", "priority", policy.PriorityTXIDs, "exclude", policy.ExcludeTXIDs, "exclude_scids", policy.ExcludeSCIDs, "max_block_size", policy.MaxSize)
+	return nil
+}
+
+func parse_hashes(list []string) (hashes []crypto.Hash, err error) {
+	for _, h := range list {
+		raw, err := hex.DecodeString(h)
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("invalid hash %s", h)
+		}
+		var hash crypto.Hash
+		copy(hash[:], raw)
+		hashes = append(hashes, hash)
+	}
+	return
+}
@@ -0,0 +1,215 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+// difficulty-sim runs the consensus difficulty algorithm outside of the daemon
+// it either replays block timestamps from an existing data directory or simulates hashrate scenarios
+// every block is written as a CSV row, so results can be plotted or compared between algorithm changes
+
+import "io"
+import "os"
+import "fmt"
+import "math/rand"
+import "strconv"
+
+import "github.com/docopt/docopt-go"
+import "github.com/go-logr/logr"
+
+import "github.com/deroproject/derohe/block"
+import "github.com/deroproject/derohe/config"
+import "github.com/deroproject/derohe/globals"
+import "github.com/deroproject/derohe/blockchain"
+
+var command_line string = `difficulty-sim
+DERO difficulty algorithm simulator: replays historical timestamps or synthetic hashrate scenarios, writes CSV.
+
+Usage:
+  difficulty-sim [--scenario=<steady>] [--blocks=<2000>] [--hashrate=<10000000>] [--factor=<10>] [--change=<1000>] [--period=<100>] [--attacker=<0.3>] [--skew=<-9000>] [--seed=<1>] [--window=<100>] [--output=<difficulty.csv>] [--testnet] [--debug]
+  difficulty-sim --replay [--data-dir=<directory>] [--start=<topoheight>] [--stop=<topoheight>] [--window=<100>] [--output=<difficulty.csv>] [--testnet] [--debug]
+  difficulty-sim -h | --help
+  difficulty-sim --version
+
+Options:
+  -h --help     Show this screen.
+  --version     Show version.
+  --testnet     Use testnet difficulty settings and data directory.
+  --debug       Debug mode enabled, print more log messages.
+  --scenario=<steady>    Hashrate scenario, steady, drop (hashrate falls by factor at change), rise (hashrate grows by factor at change), flap (hashrate falls by factor every other period blocks), timestamp (attacker blocks carry timestamps shifted by skew).
+  --blocks=<2000>    Number of blocks to simulate.
+  --hashrate=<10000000>    Network hashrate in H/s at start, chain starts at equilibrium.
+  --factor=<10>    Hashrate change factor for drop, rise and flap scenarios.
+  --change=<1000>    Block at which hashrate changes, default is half of blocks.
+  --period=<100>    Blocks between hashrate changes in flap scenario.
+  --attacker=<0.3>    Fraction of blocks with manipulated timestamp in timestamp scenario.
+  --skew=<-9000>    Milliseconds added to attacker timestamps, timestamps are kept increasing. Honest nodes reject timestamps more than 50 ms in future, positive values model clock drift.
+  --seed=<1>    Random seed, same seed gives same result.
+  --replay    Replay block timestamps from data directory through difficulty algorithm, daemon must not be running.
+  --data-dir=<directory>    Data directory of derod, default is current directory.
+  --start=<topoheight>    First topoheight to replay, default is 10000 blocks before top.
+  --stop=<topoheight>    Last topoheight to replay, default is top.
+  --window=<100>    Blocks used for moving averages.
+  --output=<difficulty.csv>    Write CSV to this file instead of stdout.
+`
+
+const REPLAY_BLOCKS = 10000 // default number of blocks replayed
+
+var logger logr.Logger
+
+func main() {
+	var err error
+
+	globals.Arguments, err = docopt.Parse(command_line, nil, true, config.Version.String(), false)
+	if err != nil {
+		fmt.Printf("Error while parsing options err: %s\n", err)
+		return
+	}
+
+	globals.InitializeLog(os.Stderr, io.Discard) // stdout may carry CSV
+	logger = globals.Logger.WithName("difficulty-sim")
+	logger.V(1).Info("", "Arguments", globals.Arguments)
+
+	globals.Initialize() // setup network
+
+	window := int_argument("--window", 100)
+	if window < 1 {
+		logger.Error(nil, "Window should be atleast 1")
+		return
+	}
+
+	var records []sim_record
+	if globals.Arguments["--replay"].(bool) {
+		history, err := load_history(int64(int_argument("--start", -1)), int64(int_argument("--stop", -1)))
+		if err != nil {
+			logger.Error(err, "Cannot load chain history")
+			return
+		}
+		records = replay(history)
+	} else {
+		p := sim_params{scenario: "steady", blocks: int_argument("--blocks", 2000), hashrate: float_argument("--hashrate", 10000000),
+			factor: float_argument("--factor", 10), period: int_argument("--period", 100), attacker: float_argument("--attacker", 0.3), skew: int64(int_argument("--skew", -9000))}
+		if globals.Arguments["--scenario"] != nil {
+			p.scenario = globals.Arguments["--scenario"].(string)
+		}
+		p.change = int_argument("--change", p.blocks/2)
+		if p.scenario != "timestamp" {
+			p.attacker = 0
+		}
+		if err = p.validate(); err != nil {
+			logger.Error(err, "Invalid parameters")
+			return
+		}
+		records = simulate(p, rand.New(rand.NewSource(int64(int_argument("--seed", 1)))))
+	}
+
+	output := io.Writer(os.Stdout)
+	report := io.Writer(os.Stderr) // keep stdout clean for CSV
+	if globals.Arguments["--output"] != nil {
+		f, err := os.Create(globals.Arguments["--output"].(string))
+		if err != nil {
+			logger.Error(err, "Cannot create output file")
+			return
+		}
+		defer f.Close()
+		output, report = f, os.Stdout
+	}
+
+	if err = write_csv(output, records, window); err != nil {
+		logger.Error(err, "Cannot write CSV")
+		return
+	}
+	summarize(records).print(report)
+}
+
+// read main chain timestamps and difficulties from topo and block stores of data directory
+// a block is a side block if previous block in topo order has same height, same rule as consensus
+func load_history(start, stop int64) (history []history_block, err error) {
+	store, err := blockchain.Open_History_Store()
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close_History()
+
+	if count := store.Topo_store.Count(); stop < 0 || stop > count-1 {
+		stop = count - 1
+	}
+	if start < 0 {
+		start = stop - REPLAY_BLOCKS
+	}
+	if start < 0 {
+		start = 0
+	}
+	logger.Info("Loading history", "start", start, "stop", stop)
+
+	for topo := start; topo <= stop; topo++ {
+		record, err := store.Topo_store.Read(topo)
+		if err != nil {
+			continue
+		}
+		if topo > 0 {
+			if previous, err := store.Topo_store.Read(topo - 1); err == nil && previous.Height == record.Height { // side block
+				continue
+			}
+		}
+		data, err := store.Block_tx_store.ReadBlock(record.BLOCK_ID)
+		if err != nil { // pruned
+			continue
+		}
+		var bl block.Block
+		if err = bl.Deserialize(data); err != nil {
+			continue
+		}
+		difficulty, err := store.Block_tx_store.ReadBlockDifficulty(record.BLOCK_ID)
+		if err != nil {
+			continue
+		}
+
+		current := history_block{height: int64(bl.Height), timestamp: bl.Timestamp, difficulty: difficulty}
+		if n := len(history); n > 0 && current.height <= history[n-1].height { // never expected on main chain, keep the harder block
+			if current.height == history[n-1].height && current.difficulty.Cmp(history[n-1].difficulty) > 0 {
+				history[n-1] = current
+			}
+			continue
+		}
+		history = append(history, current)
+	}
+	if len(history) < 3 {
+		return nil, fmt.Errorf("atleast 3 blocks are required, found %d", len(history))
+	}
+	return history, nil
+}
+
+func int_argument(name string, value int) int {
+	if globals.Arguments[name] != nil {
+		if s, err := strconv.Atoi(globals.Arguments[name].(string)); err == nil {
+			return s
+		} else {
+			logger.Error(err, "Argument cannot be parsed, using default", "argument", name, "default", value)
+		}
+	}
+	return value
+}
+
+func float_argument(name string, value float64) float64 {
+	if globals.Arguments[name] != nil {
+		if s, err := strconv.ParseFloat(globals.Arguments[name].(string), 64); err == nil {
+			return s
+		} else {
+			logger.Error(err, "Argument cannot be parsed, using default", "argument", name, "default", value)
+		}
+	}
+	return value
+}
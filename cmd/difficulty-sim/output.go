@@ -0,0 +1,110 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import "io"
+import "fmt"
+import "math"
+import "math/big"
+import "strconv"
+import "encoding/csv"
+
+import "github.com/deroproject/derohe/config"
+
+var csv_header = []string{"height", "timestamp", "solve_time", "difficulty", "target", "deviation", "avg_solve_time", "avg_deviation"}
+
+// deviation of solve time from block time, 0.5 means 50% slower
+func deviation(solve_time float64) float64 {
+	return (solve_time - float64(config.BLOCK_TIME_MILLISECS)) / float64(config.BLOCK_TIME_MILLISECS)
+}
+
+// writes one row per block, averages are over last window blocks
+func write_csv(w io.Writer, records []sim_record, window int) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csv_header); err != nil {
+		return err
+	}
+
+	sum := uint64(0)
+	for i, r := range records {
+		sum += r.solve_time
+		if i >= window {
+			sum -= records[i-window].solve_time
+		}
+		count := i + 1
+		if count > window {
+			count = window
+		}
+		avg := float64(sum) / float64(count)
+
+		row := []string{
+			strconv.FormatInt(r.height, 10),
+			strconv.FormatUint(r.timestamp, 10),
+			strconv.FormatUint(r.solve_time, 10),
+			r.difficulty.String(),
+			strconv.FormatFloat(r.target, 'f', 0, 64),
+			strconv.FormatFloat(deviation(float64(r.solve_time)), 'f', 4, 64),
+			strconv.FormatFloat(avg, 'f', 1, 64),
+			strconv.FormatFloat(deviation(avg), 'f', 4, 64),
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+type sim_summary struct {
+	blocks          int
+	mean_solve_time float64 // ms
+	stddev          float64 // ms
+	mean_error      float64 // mean absolute difference between difficulty and target, relative to target
+	max_error       float64
+}
+
+func summarize(records []sim_record) (s sim_summary) {
+	s.blocks = len(records)
+	if s.blocks == 0 {
+		return
+	}
+	for _, r := range records {
+		s.mean_solve_time += float64(r.solve_time)
+		if r.target > 0 {
+			difficulty, _ := new(big.Float).SetInt(r.difficulty).Float64()
+			e := math.Abs(difficulty-r.target) / r.target
+			s.mean_error += e
+			s.max_error = math.Max(s.max_error, e)
+		}
+	}
+	s.mean_solve_time /= float64(s.blocks)
+	s.mean_error /= float64(s.blocks)
+
+	for _, r := range records {
+		d := float64(r.solve_time) - s.mean_solve_time
+		s.stddev += d * d
+	}
+	s.stddev = math.Sqrt(s.stddev / float64(s.blocks))
+	return
+}
+
+func (s sim_summary) print(w io.Writer) {
+	fmt.Fprintf(w, "Blocks %d\n", s.blocks)
+	fmt.Fprintf(w, "Mean solve time %.3f s (target %d s) deviation %.2f%%\n", s.mean_solve_time/1000, config.BLOCK_TIME, deviation(s.mean_solve_time)*100)
+	fmt.Fprintf(w, "Solve time stddev %.3f s\n", s.stddev/1000)
+	fmt.Fprintf(w, "Difficulty error from target mean %.2f%% max %.2f%%\n", s.mean_error*100, s.max_error*100)
+}
@@ -0,0 +1,213 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+// this file implements an in memory chain which feeds blocks through the consensus difficulty algorithm
+// blocks are linear, each block has single tip, which is how the main chain behaves most of the time
+
+import "fmt"
+import "math/big"
+import "math/rand"
+import "encoding/binary"
+
+import "github.com/deroproject/derohe/config"
+import "github.com/deroproject/derohe/globals"
+import "github.com/deroproject/derohe/blockchain"
+import "github.com/deroproject/derohe/cryptography/crypto"
+
+type sim_block struct {
+	height     int64
+	timestamp  uint64
+	difficulty *big.Int
+	past       []crypto.Hash
+}
+
+// implements blockchain.DiffProvider
+type sim_chain struct {
+	blocks map[crypto.Hash]*sim_block
+	top    crypto.Hash
+	count  uint64
+}
+
+var _ blockchain.DiffProvider = (*sim_chain)(nil)
+
+// one simulated or replayed block
+type sim_record struct {
+	height     int64
+	timestamp  uint64 // ms
+	solve_time uint64 // ms since previous block
+	difficulty *big.Int
+	target     float64 // difficulty algorithm should reach, simulated hashrate or difficulty recorded in chain
+}
+
+// a block from chain history
+type history_block struct {
+	height     int64
+	timestamp  uint64
+	difficulty *big.Int
+}
+
+type sim_params struct {
+	scenario string
+	blocks   int
+	hashrate float64 // H/s, at equilibrium difficulty equals hashrate
+	factor   float64 // hashrate change in drop, rise and flap scenarios
+	change   int     // block at which hashrate changes
+	period   int     // blocks between changes in flap scenario
+	attacker float64 // fraction of blocks with manipulated timestamp
+	skew     int64   // ms added to timestamp of attacker blocks
+}
+
+var scenarios = []string{"steady", "drop", "rise", "flap", "timestamp"}
+
+// chain is seeded with 2 blocks, since difficulty needs tip and its parent
+func new_sim_chain(height int64, parent_timestamp, timestamp uint64, difficulty *big.Int) *sim_chain {
+	s := &sim_chain{blocks: map[crypto.Hash]*sim_block{}}
+	s.insert(&sim_block{height: height - 1, timestamp: parent_timestamp, difficulty: new(big.Int).Set(difficulty)})
+	s.insert(&sim_block{height: height, timestamp: timestamp, difficulty: new(big.Int).Set(difficulty), past: []crypto.Hash{s.top}})
+	return s
+}
+
+func (s *sim_chain) insert(bl *sim_block) {
+	var blid crypto.Hash
+	s.count++
+	binary.BigEndian.PutUint64(blid[:], s.count)
+	s.blocks[blid] = bl
+	s.top = blid
+}
+
+func (s *sim_chain) Load_Block_Height(blid crypto.Hash) int64 {
+	if bl, ok := s.blocks[blid]; ok {
+		return bl.height
+	}
+	return -1
+}
+
+func (s *sim_chain) Load_Block_Difficulty(blid crypto.Hash) *big.Int {
+	return new(big.Int).Set(s.blocks[blid].difficulty)
+}
+
+func (s *sim_chain) Load_Block_Timestamp(blid crypto.Hash) uint64 {
+	return s.blocks[blid].timestamp
+}
+
+func (s *sim_chain) Get_Block_Past(blid crypto.Hash) []crypto.Hash {
+	return s.blocks[blid].past
+}
+
+// difficulty of the block which will be mined on top
+func (s *sim_chain) next_difficulty() *big.Int {
+	return blockchain.Get_Difficulty_At_Tips(s, []crypto.Hash{s.top})
+}
+
+// add a block on top, timestamp must increase like consensus requires, so it may be bumped
+func (s *sim_chain) add(timestamp uint64, difficulty *big.Int) (record sim_record) {
+	parent := s.blocks[s.top]
+	if timestamp <= parent.timestamp {
+		timestamp = parent.timestamp + 1
+	}
+	s.insert(&sim_block{height: parent.height + 1, timestamp: timestamp, difficulty: difficulty, past: []crypto.Hash{s.top}})
+	return sim_record{height: parent.height + 1, timestamp: timestamp, solve_time: timestamp - parent.timestamp, difficulty: difficulty}
+}
+
+func (p sim_params) validate() error {
+	found := false
+	for _, name := range scenarios {
+		found = found || name == p.scenario
+	}
+	switch {
+	case !found:
+		return fmt.Errorf("unknown scenario %q, possible values %v", p.scenario, scenarios)
+	case p.blocks < 1:
+		return fmt.Errorf("blocks should be atleast 1")
+	case p.hashrate < 1 || p.factor <= 0:
+		return fmt.Errorf("hashrate and factor should be positive")
+	case p.period < 1:
+		return fmt.Errorf("period should be atleast 1")
+	case p.attacker < 0 || p.attacker > 1:
+		return fmt.Errorf("attacker should be between 0 and 1")
+	}
+	return nil
+}
+
+// network hashrate while i'th block is being mined
+func (p sim_params) hashrate_at(i int) float64 {
+	switch p.scenario {
+	case "drop":
+		if i >= p.change {
+			return p.hashrate / p.factor
+		}
+	case "rise":
+		if i >= p.change {
+			return p.hashrate * p.factor
+		}
+	case "flap": // miners hop in and out
+		if (i/p.period)%2 == 1 {
+			return p.hashrate / p.factor
+		}
+	}
+	return p.hashrate
+}
+
+// simulate mining, a block consists of normal miniblocks followed by final miniblock with high difficulty
+func simulate(p sim_params, rng *rand.Rand) (records []sim_record) {
+	start := uint64(config.BLOCK_TIME_MILLISECS) * 2
+	height := globals.Config.MAJOR_HF2_HEIGHT + 3 // difficulty resets around hard fork
+	chain := new_sim_chain(height, start-config.BLOCK_TIME_MILLISECS, start, new(big.Int).SetUint64(uint64(p.hashrate)))
+
+	now := float64(start) // real time in ms
+	for i := 0; i < p.blocks; i++ {
+		hashrate := p.hashrate_at(i)
+		difficulty := chain.next_difficulty()
+		work, _ := new(big.Float).SetInt(difficulty).Float64()
+
+		solve_time := 0.0 // seconds
+		for j := uint64(0); j < config.BLOCK_TIME-config.MINIBLOCK_HIGHDIFF; j++ {
+			solve_time += rng.ExpFloat64() * work / hashrate
+		}
+		solve_time += rng.ExpFloat64() * work * config.MINIBLOCK_HIGHDIFF / hashrate
+		now += solve_time * 1000
+
+		timestamp := int64(now)
+		if p.attacker > 0 && rng.Float64() < p.attacker {
+			timestamp += p.skew
+		}
+		if timestamp < 0 {
+			timestamp = 0
+		}
+
+		record := chain.add(uint64(timestamp), difficulty)
+		record.target = hashrate
+		records = append(records, record)
+	}
+	return
+}
+
+// replay recorded timestamps through difficulty algorithm, first 2 blocks seed the chain
+func replay(history []history_block) (records []sim_record) {
+	if len(history) < 3 {
+		return
+	}
+	chain := new_sim_chain(history[1].height, history[0].timestamp, history[1].timestamp, history[1].difficulty)
+
+	for _, hbl := range history[2:] {
+		record := chain.add(hbl.timestamp, chain.next_difficulty())
+		record.target, _ = new(big.Float).SetInt(hbl.difficulty).Float64()
+		records = append(records, record)
+	}
+	return
+}
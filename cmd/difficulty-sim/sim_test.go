@@ -0,0 +1,120 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import "bytes"
+import "strings"
+import "testing"
+import "math/big"
+import "math/rand"
+
+import "github.com/deroproject/derohe/config"
+
+func test_params(scenario string) sim_params {
+	return sim_params{scenario: scenario, blocks: 2000, hashrate: 10000000, factor: 10, change: 1000, period: 100, attacker: 0.3, skew: -9000}
+}
+
+// steady hashrate should average block time
+func Test_Simulate_Steady(t *testing.T) {
+	records := simulate(test_params("steady"), rand.New(rand.NewSource(1)))
+	if len(records) != 2000 {
+		t.Fatalf("expected 2000 records, got %d", len(records))
+	}
+	for i := 1; i < len(records); i++ {
+		if records[i].height != records[i-1].height+1 || records[i].timestamp <= records[i-1].timestamp {
+			t.Fatalf("chain not linear at %d", i)
+		}
+	}
+	if s := summarize(records); s.mean_solve_time < 0.9*float64(config.BLOCK_TIME_MILLISECS) || s.mean_solve_time > 1.1*float64(config.BLOCK_TIME_MILLISECS) {
+		t.Fatalf("mean solve time %f too far from block time", s.mean_solve_time)
+	}
+}
+
+// difficulty should follow a 10x drop within a few hundred blocks
+func Test_Simulate_Drop(t *testing.T) {
+	p := test_params("drop")
+	records := simulate(p, rand.New(rand.NewSource(1)))
+	if s := summarize(records[p.change+500:]); s.mean_error > 0.25 {
+		t.Fatalf("difficulty did not recover after drop, mean error %f", s.mean_error)
+	}
+}
+
+// same seed gives same result
+func Test_Simulate_Deterministic(t *testing.T) {
+	p := test_params("timestamp")
+	a := simulate(p, rand.New(rand.NewSource(7)))
+	b := simulate(p, rand.New(rand.NewSource(7)))
+	for i := range a {
+		if a[i].timestamp != b[i].timestamp || a[i].difficulty.Cmp(b[i].difficulty) != 0 {
+			t.Fatalf("simulation not deterministic at %d", i)
+		}
+	}
+}
+
+// replaying simulated timestamps must give back the same difficulties
+func Test_Replay(t *testing.T) {
+	records := simulate(test_params("flap"), rand.New(rand.NewSource(3)))
+
+	var history []history_block
+	for _, r := range records {
+		history = append(history, history_block{height: r.height, timestamp: r.timestamp, difficulty: r.difficulty})
+	}
+	replayed := replay(history)
+	if len(replayed) != len(history)-2 {
+		t.Fatalf("expected %d records, got %d", len(history)-2, len(replayed))
+	}
+	for i, r := range replayed {
+		if r.difficulty.Cmp(records[i+2].difficulty) != 0 || r.solve_time != records[i+2].solve_time {
+			t.Fatalf("replay mismatch at %d expected %s actual %s", i, records[i+2].difficulty, r.difficulty)
+		}
+	}
+	if replay(history[:2]) != nil {
+		t.Fatalf("replay needs atleast 3 blocks")
+	}
+}
+
+func Test_Params(t *testing.T) {
+	if err := test_params("steady").validate(); err != nil {
+		t.Fatalf("valid params rejected err %s", err)
+	}
+	p := test_params("unknown")
+	if err := p.validate(); err == nil {
+		t.Fatalf("unknown scenario accepted")
+	}
+	p = test_params("flap")
+	if p.hashrate_at(50) != p.hashrate || p.hashrate_at(150) != p.hashrate/p.factor || p.hashrate_at(250) != p.hashrate {
+		t.Fatalf("flap hashrate wrong")
+	}
+}
+
+func Test_CSV(t *testing.T) {
+	records := []sim_record{
+		{height: 10, timestamp: 18000, solve_time: 18000, difficulty: big.NewInt(100), target: 100},
+		{height: 11, timestamp: 45000, solve_time: 27000, difficulty: big.NewInt(90), target: 100},
+	}
+	var buf bytes.Buffer
+	if err := write_csv(&buf, records, 2); err != nil {
+		t.Fatalf("write csv err %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || lines[0] != strings.Join(csv_header, ",") {
+		t.Fatalf("unexpected csv\n%s", buf.String())
+	}
+	if lines[2] != "11,45000,27000,90,100,0.5000,22500.0,0.2500" {
+		t.Fatalf("unexpected row %s", lines[2])
+	}
+}
@@ -196,6 +196,7 @@ func Test_Creation_TX(t *testing.T) {
 	wgenesis.SetDaemonAddress(rpcport)
 	wsrc.SetDaemonAddress(rpcport)
 	wdst.SetDaemonAddress(rpcport)
+	wsrc.SetVerifyProofs(true) // src wallet verifies merkle proofs of all balances
 	wgenesis.SetOnlineMode()
 	wsrc.SetOnlineMode()
 	wdst.SetOnlineMode()
@@ -371,6 +372,20 @@ func Test_Creation_TX(t *testing.T) {
 		t.Fatalf("transfer failed.Invalid balance expected %d actual %d", 1, pre_transfer_src_balance-(post_transfer_src_balance+dtx.Fees()+reverse_dtx.Fees()))
 	}
 
+	// entire chain including registrations and transfers must pass offline verification
+	if result, err := chain.Verify_Chain(0, -1, 0, nil); err != nil || result.First != nil || result.Verified != chain.Load_TOPO_HEIGHT()+1 {
+		t.Fatalf("chain verification failed err %v first %v verified %d", err, result.First, result.Verified)
+	}
+	{ // a damaged topo record must be reported as first divergence
+		record, _ := chain.Store.Topo_store.Read(5)
+		previous, _ := chain.Store.Topo_store.Read(4)
+		chain.Store.Topo_store.Write(5, record.BLOCK_ID, previous.State_Version, record.Height)
+		if result, err := chain.Verify_Chain(0, -1, 4, nil); err != nil || result.First == nil || result.First.Topo != 5 {
+			t.Fatalf("damaged topo record not detected err %v first %v", err, result.First)
+		}
+		chain.Store.Topo_store.Write(5, record.BLOCK_ID, record.State_Version, record.Height)
+	}
+
 	//	fmt.Printf("balance src %v\n", wsrc.account.Balance_Mature)
 	//fmt.Printf("balance wdst1 %v ringsize %d\n", wdst.account.Balance_Mature, wdst.account.Ringsize)
 	//fmt.Printf("balance wdst2 %v\n", wdst2.account.Balance_Mature)
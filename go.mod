@@ -1,3 +1,45 @@
 module github.com/deroproject/derohe
 
-go 1.17
+go 1.26.0
+
+require (
+	github.com/VictoriaMetrics/metrics v1.35.1
+	github.com/beevik/ntp v1.6.0
+	github.com/blang/semver/v4 v4.0.0
+	github.com/caarlos0/env/v6 v6.10.1
+	github.com/cespare/xxhash v1.1.0
+	github.com/chzyer/readline v1.5.1
+	github.com/creachadair/jrpc2 v1.3.5
+	github.com/dchest/siphash v1.2.3
+	github.com/docopt/docopt-go v0.0.0-20180111231733-ee0de3bc6815
+	github.com/dustin/go-humanize v1.1.0
+	github.com/fxamacker/cbor/v2 v2.9.4
+	github.com/go-logr/logr v1.4.4
+	github.com/go-logr/zapr v1.3.0
+	github.com/gorilla/websocket v1.5.3
+	github.com/hashicorp/golang-lru v1.0.2
+	github.com/klauspost/reedsolomon v1.14.2
+	github.com/miekg/dns v1.1.73
+	github.com/minio/sha256-simd v1.0.1
+	github.com/robfig/cron/v3 v3.0.1
+	github.com/satori/go.uuid v1.2.0
+	github.com/stretchr/testify v1.12.1
+	go.uber.org/zap v1.28.0
+	golang.org/x/crypto v0.57.0
+	golang.org/x/net v0.59.0
+	golang.org/x/sync v0.22.0
+	golang.org/x/sys v0.48.0
+	golang.org/x/xerrors v0.0.0-20240903120638-7835f813f4da
+	gopkg.in/natefinch/lumberjack.v2 v2.2.1
+	nhooyr.io/websocket v1.8.17
+)
+
+require (
+	github.com/creachadair/mds v0.26.1 // indirect
+	github.com/klauspost/cpuid/v2 v2.3.0 // indirect
+	github.com/valyala/fastrand v1.1.0 // indirect
+	github.com/valyala/histogram v1.2.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+	go.uber.org/multierr v1.10.0 // indirect
+	go.yaml.in/yaml/v3 v3.0.5 // indirect
+)
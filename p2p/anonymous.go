@@ -0,0 +1,190 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package p2p
+
+/* this file implements anonymous mode, where all p2p traffic goes through a SOCKS5 proxy (tor/i2p)
+ * KCP is UDP based and cannot be carried by such proxies, so in this mode everything runs over TCP
+ * peers are identified by their .onion/.i2p address instead of an IP
+ */
+import "net"
+import "time"
+import "errors"
+import "strings"
+import "crypto/tls"
+
+import "github.com/deroproject/derohe/globals"
+
+import "github.com/cenkalti/rpc2"
+
+var anonymous_mode bool     // whether p2p is being tunnelled through a socks proxy
+var external_address string // address advertised to peers, such as xyz.onion:18089
+
+// represents an endpoint which can only be reached through the proxy
+// Host is used as the key for connection/peer/ban book keeping
+type AnonAddr struct {
+	Host     string
+	Endpoint string
+}
+
+func (a *AnonAddr) Network() string { return "tcp" }
+func (a *AnonAddr) String() string  { return a.Endpoint }
+
+// whether p2p is running in anonymous mode
+func IsAnonymousMode() bool {
+	return anonymous_mode
+}
+
+// returns true if the address is a tor hidden service or i2p address
+// address may be host or host:port
+func IsAnonymousAddress(address string) bool {
+	host := strings.ToLower(strings.TrimSpace(address))
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.HasSuffix(host, ".onion") || strings.HasSuffix(host, ".i2p")
+}
+
+// whether we should try to dial this peer in the current mode
+// clearnet nodes cannot dial anonymous peers and anonymous nodes only dial anonymous peers
+func is_peer_dialable(address string) bool {
+	return anonymous_mode == IsAnonymousAddress(address)
+}
+
+// setup anonymous mode if a proxy has been provided
+func anonymous_init() {
+	if globals.Arguments["--socks-proxy"] == nil {
+		return
+	}
+	anonymous_mode = true
+
+	if _, ok := globals.Arguments["--p2p-external-address"]; ok && globals.Arguments["--p2p-external-address"] != nil {
+		addr := strings.ToLower(strings.TrimSpace(globals.Arguments["--p2p-external-address"].(string)))
+		if _, _, err := net.SplitHostPort(addr); err != nil || !IsAnonymousAddress(addr) {
+			logger.Error(err, "--p2p-external-address must be an onion/i2p address with port, ignoring it", "address", addr)
+		} else {
+			external_address = addr
+		}
+	}
+	logger.Info("P2P is in anonymous mode, KCP is disabled and all connections go through proxy", "proxy", globals.Arguments["--socks-proxy"], "external_address", external_address)
+}
+
+// dial an endpoint using the proxy, name resolution is done by the proxy, so nothing leaks
+func dial_anonymous(endpoint string) (net.Conn, error) {
+	return globals.Dialer.Dial("tcp", endpoint)
+}
+
+// anonymous counterpart of connect_with_endpoint
+// will block until the connection dies or is killed
+func connect_with_endpoint_anonymous(endpoint string, sync_node bool) {
+	defer globals.Recover(2)
+
+	host, _, err := net.SplitHostPort(strings.ToLower(strings.TrimSpace(endpoint)))
+	if err != nil {
+		logger.V(3).Error(err, "invalid endpoint", "endpoint", endpoint)
+		return
+	}
+
+	if IsAddressInBanList(host) {
+		logger.V(2).Info("Connecting to banned address is prohibited", "address", host)
+		return
+	}
+
+	if IsAddressConnected(host) {
+		logger.V(4).Info("outgoing address is already connected", "address", host)
+		return
+	}
+
+	if shouldwebackoff(host) {
+		logger.V(1).Info("backing off from this connection", "address", host)
+		return
+	} else {
+		backoff_mutex.Lock()
+		backoff[host] = time.Now().Unix() + 10
+		backoff_mutex.Unlock()
+	}
+
+	conn, err := dial_anonymous(endpoint)
+	if err != nil {
+		logger.V(3).Error(err, "Dial through proxy failed", "endpoint", endpoint)
+		Peer_SetFail(endpoint)
+		return
+	}
+
+	conntls := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	process_outgoing_connection(conn, conntls, &AnonAddr{Host: host, Endpoint: endpoint}, false, sync_node)
+}
+
+// accepts incoming connections forwarded by the hidden service over plain tcp
+func serve_anonymous(srv *rpc2.Server, tlsconfig *tls.Config, address string) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		logger.Error(err, "Could not listen", "address", address)
+		return
+	}
+	defer l.Close()
+
+	logger.Info("P2P is listening (anonymous mode)", "address", l.Addr().String(), "external_address", external_address)
+	serve_anonymous_listener(srv, tlsconfig, l)
+}
+
+// all connections arrive from the local proxy, so they are identified by the proxy host
+// the hidden service address a peer advertises is never trusted, it is only dialed, see verify_anonymous_address
+func serve_anonymous_listener(srv *rpc2.Server, tlsconfig *tls.Config, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-Exit_Event:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.V(1).Error(err, "Err while accepting incoming connection")
+			continue
+		}
+
+		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			host = conn.RemoteAddr().String()
+		}
+		raddr := &AnonAddr{Host: host, Endpoint: conn.RemoteAddr().String()}
+
+		tlsconn := tls.Server(conn, tlsconfig)
+		state := rpc2.NewState()
+		state.Set("addr", raddr)
+		state.Set("conn", conn)
+		state.Set("tlsconn", tlsconn)
+
+		codec := NewCBORCodec(tlsconn)
+		state.Set("codec", codec)
+
+		go srv.ServeCodecWithState(codec, state)
+	}
+}
+
+// an incoming peer advertised its hidden service, which may belong to anyone
+// the address is dialed through the proxy and only the outgoing connection, once handshake succeeds, adds it to peer list
+func verify_anonymous_address(address string) {
+	address = strings.ToLower(strings.TrimSpace(address))
+	host, _, err := net.SplitHostPort(address)
+	if err != nil || !IsAnonymousAddress(host) || address == external_address || IsAddressConnected(host) {
+		return
+	}
+	go connect_with_endpoint_anonymous(address, false)
+}
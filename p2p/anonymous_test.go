@@ -0,0 +1,283 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package p2p
+
+import "io"
+import "net"
+import "time"
+import "testing"
+import "crypto/tls"
+import "encoding/binary"
+
+import "golang.org/x/net/proxy"
+import "github.com/cenkalti/rpc2"
+import "github.com/go-logr/logr"
+
+import "github.com/deroproject/derohe/globals"
+
+// minimal socks5 stand-in, supports no auth and CONNECT only
+// every domain name is resolved using the provided map, just like tor resolves onion addresses
+func socks_standin(t *testing.T, hosts map[string]string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen err %s", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				buf := make([]byte, 512)
+				if _, err := io.ReadFull(conn, buf[:2]); err != nil { // version, method count
+					return
+				}
+				if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+					return
+				}
+				conn.Write([]byte{5, 0}) // no auth
+
+				if _, err := io.ReadFull(conn, buf[:4]); err != nil || buf[1] != 1 || buf[3] != 3 { // only CONNECT to domain names
+					return
+				}
+				if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+					return
+				}
+				host := make([]byte, buf[0])
+				if _, err := io.ReadFull(conn, host); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+					return
+				}
+				port := binary.BigEndian.Uint16(buf[:2])
+
+				target, ok := hosts[string(host)]
+				if !ok || port != 18089 {
+					conn.Write([]byte{5, 4, 0, 1, 0, 0, 0, 0, 0, 0}) // host unreachable
+					return
+				}
+				remote, err := net.Dial("tcp", target)
+				if err != nil {
+					conn.Write([]byte{5, 4, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer remote.Close()
+				conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+
+				go io.Copy(remote, conn)
+				io.Copy(conn, remote)
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func Test_Anonymous_Address(t *testing.T) {
+	for _, addr := range []string{"abcdefgh.onion", "abcdefgh.onion:18089", "ABCDEFGH.ONION:18089", "xyz.b32.i2p:80"} {
+		if !IsAnonymousAddress(addr) {
+			t.Fatalf("%s should be an anonymous address", addr)
+		}
+	}
+	for _, addr := range []string{"127.0.0.1:18089", "[::1]:18089", "onion.example.com:80", ""} {
+		if IsAnonymousAddress(addr) {
+			t.Fatalf("%s should not be an anonymous address", addr)
+		}
+	}
+
+	anonymous_mode = false
+	if is_peer_dialable("abcdefgh.onion:18089") || !is_peer_dialable("1.2.3.4:18089") {
+		t.Fatalf("clearnet node must only dial clearnet peers")
+	}
+	anonymous_mode = true
+	defer func() { anonymous_mode = false }()
+	if !is_peer_dialable("abcdefgh.onion:18089") || is_peer_dialable("1.2.3.4:18089") {
+		t.Fatalf("anonymous node must only dial anonymous peers")
+	}
+
+	if ParseIPNoError("abcdefgh.onion:18089") != "abcdefgh.onion" {
+		t.Fatalf("onion host could not be extracted")
+	}
+}
+
+func Test_Anonymous_Ban(t *testing.T) {
+	logger = logr.Discard()
+	if err := Ban_Address("BadPeer.onion:18089", 600); err != nil {
+		t.Fatalf("banning onion address failed err %s", err)
+	}
+	defer UnBan_Address("badpeer.onion")
+
+	if !IsAddressInBanList("badpeer.onion") {
+		t.Fatalf("onion address must be banned")
+	}
+	if IsAddressInBanList("goodpeer.onion") {
+		t.Fatalf("onion address must not be banned")
+	}
+	if err := Ban_Address("not an address", 600); err == nil {
+		t.Fatalf("invalid address must not be banned")
+	}
+
+	c := &Connection{Addr: &AnonAddr{Host: "badpeer.onion", Endpoint: "badpeer.onion:18089"}}
+	if Address(c) != "badpeer.onion" || !IsAddressInBanList(Address(c)) {
+		t.Fatalf("anonymous connection must be identified by onion host")
+	}
+}
+
+func Test_Anonymous_Dial(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen err %s", err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("DERO"))
+	}()
+
+	socks := socks_standin(t, map[string]string{"peer.onion": target.Addr().String()})
+	defer socks.Close()
+
+	old_dialer := globals.Dialer
+	defer func() { globals.Dialer = old_dialer }()
+	if globals.Dialer, err = proxy.SOCKS5("tcp", socks.Addr().String(), nil, proxy.Direct); err != nil {
+		t.Fatalf("cannot create socks dialer err %s", err)
+	}
+
+	conn, err := dial_anonymous("peer.onion:18089")
+	if err != nil {
+		t.Fatalf("dial through socks failed err %s", err)
+	}
+	defer conn.Close()
+
+	var buf [4]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil || string(buf[:]) != "DERO" {
+		t.Fatalf("data not relayed through proxy err %s", err)
+	}
+
+	if _, err := dial_anonymous("unknown.onion:18089"); err == nil {
+		t.Fatalf("dial to unknown onion must fail")
+	}
+}
+
+// a remote anonymous node, it only answers handshakes, advertising any address it likes
+func anonymous_test_peer(conn net.Conn, peer_id uint64, advertise string) {
+	client := rpc2.NewClientWithCodec(NewCBORCodec(conn))
+	client.Handle("Peer.Handshake", func(client *rpc2.Client, args Handshake_Struct, reply *Handshake_Struct) error {
+		reply.Fill()
+		reply.Peer_ID = peer_id
+		reply.ExternalAddress = advertise
+		return nil
+	})
+	go client.Run()
+}
+
+// advertised hidden service addresses are only trusted once we reach them ourselves
+func Test_Anonymous_Serve(t *testing.T) {
+	harness_chain_start(t)
+	anonymous_mode = true
+	defer func() { anonymous_mode = false }()
+
+	tlsconfig := &tls.Config{Certificates: []tls.Certificate{generate_random_tls_cert()}}
+
+	hidden, err := net.Listen("tcp", "127.0.0.1:0") // genuine.onion is reachable through proxy
+	if err != nil {
+		t.Fatalf("cannot listen err %s", err)
+	}
+	defer hidden.Close()
+	go func() {
+		for {
+			conn, err := hidden.Accept()
+			if err != nil {
+				return
+			}
+			anonymous_test_peer(tls.Server(conn, tlsconfig), 0xa11ce, "genuine.onion:18089")
+		}
+	}()
+
+	socks := socks_standin(t, map[string]string{"genuine.onion": hidden.Addr().String()})
+	defer socks.Close()
+	old_dialer := globals.Dialer
+	defer func() { globals.Dialer = old_dialer }()
+	if globals.Dialer, err = proxy.SOCKS5("tcp", socks.Addr().String(), nil, proxy.Direct); err != nil {
+		t.Fatalf("cannot create socks dialer err %s", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0") // our hidden service
+	if err != nil {
+		t.Fatalf("cannot listen err %s", err)
+	}
+	defer l.Close()
+	go serve_anonymous_listener(new_p2p_server(), tlsconfig, l)
+
+	defer func() {
+		connection_map.Range(func(k, value interface{}) bool {
+			c := value.(*Connection)
+			if _, ok := c.Addr.(*AnonAddr); ok {
+				c.exit()
+				Connection_Delete(c)
+			}
+			return true
+		})
+		if p := GetPeerInList("genuine.onion:18089"); p != nil {
+			Peer_Delete(p)
+		}
+		backoff_mutex.Lock()
+		delete(backoff, "genuine.onion")
+		delete(backoff, "victim.onion")
+		backoff_mutex.Unlock()
+	}()
+
+	// both peers arrive through the proxy, second one claims an address it does not own
+	for i, advertise := range []string{"genuine.onion:18089", "victim.onion:18089"} {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("cannot connect err %s", err)
+		}
+		defer conn.Close()
+		anonymous_test_peer(tls.Client(conn, &tls.Config{InsecureSkipVerify: true}), uint64(0xb0b+i), advertise)
+	}
+
+	for deadline := time.Now().Add(15 * time.Second); GetPeerInList("genuine.onion:18089") == nil; time.Sleep(100 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("reachable hidden service was not added to peer list")
+		}
+	}
+	if GetPeerInList("victim.onion:18089") != nil || IsAddressConnected("victim.onion") {
+		t.Fatalf("unreachable advertised address must not be trusted")
+	}
+
+	var incoming []*Connection
+	connection_map.Range(func(k, value interface{}) bool {
+		if c := value.(*Connection); c.Incoming && Address(c) == "127.0.0.1" {
+			incoming = append(incoming, c)
+		}
+		return true
+	})
+	if len(incoming) != 2 {
+		t.Fatalf("incoming connections through proxy must be identified by proxy host and kept apart, found %d", len(incoming))
+	}
+	incoming[0].ban(nil)
+	if IsAddressInBanList("127.0.0.1") || IsAddressInBanList("victim.onion") {
+		t.Fatalf("proxy host or advertised address must never be banned")
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package p2p
+
+/* this file implements bandwidth shaping and traffic accounting per message type
+ * limits are token buckets in bytes/sec, applied globally and per peer
+ * messages are classified in 3 priorities, every priority is limited, priority only decides who is served first
+ * high priority (miniblocks, blocks, chunks, pings) jumps ahead of everything queued
+ * normal priority is served after high priority
+ * low priority (bootstrap data) is served last and is additionally restricted to half the bandwidth
+ */
+import "fmt"
+import "sort"
+import "sync"
+import "context"
+import "strconv"
+import "sync/atomic"
+
+import "github.com/dustin/go-humanize"
+import "golang.org/x/time/rate"
+
+import "github.com/deroproject/derohe/globals"
+import "github.com/deroproject/derohe/metrics"
+
+const (
+	PRIORITY_HIGH   = 0 // served first
+	PRIORITY_NORMAL = 1
+	PRIORITY_LOW    = 2 // served last
+)
+
+// token bucket, traffic queued on it is served in priority order
+type limiter struct {
+	bucket  *rate.Limiter
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	busy    bool   // some sender is consuming tokens
+	waiting [3]int // senders queued per priority
+}
+
+// global limiters, nil if unlimited
+var upload_limiter, download_limiter *limiter
+var upload_bulk_limiter, download_bulk_limiter *limiter
+
+// per peer limits in bytes/sec, 0 if unlimited
+var peer_upload_limit, peer_download_limit int64
+
+// traffic per message type
+type traffic_counter struct {
+	In  uint64
+	Out uint64
+}
+
+var traffic_map sync.Map // map[string]*traffic_counter
+
+// methods registered by set_handlers, peers may send anything else so it must not become a metric label
+var p2p_methods = map[string]bool{"Peer.Handshake": true, "Peer.Chain": true, "Peer.ChangeSet": true, "Peer.NotifyINV": true, "Peer.GetObject": true,
+	"Peer.TreeSection": true, "Peer.NotifyMiniBlock": true, "Peer.Ping": true, "Peer.NotifyStem": true}
+
+// returns priority class of a message
+func method_priority(method string) int {
+	switch method {
+	case "Peer.Handshake", "Peer.Ping", "Peer.NotifyMiniBlock", "Peer.NotifyINV", "Peer.GetObject":
+		return PRIORITY_HIGH
+	case "Peer.ChangeSet", "Peer.TreeSection":
+		return PRIORITY_LOW
+	default:
+		return PRIORITY_NORMAL
+	}
+}
+
+// limit is in bytes/sec, 1 sec worth of data can be sent as burst
+func new_limiter(limit int64) *limiter {
+	burst := limit
+	if burst < 64*1024 {
+		burst = 64 * 1024
+	}
+	l := &limiter{bucket: rate.NewLimiter(rate.Limit(limit), int(burst))}
+	l.cond = sync.NewCond(&l.mutex)
+	return l
+}
+
+// wait till n bytes worth of tokens are consumed
+// senders take turns for every burst worth of data, the next one is always of highest priority queued
+func (l *limiter) wait(priority int, n int) {
+	burst := l.bucket.Burst()
+	for remaining := n; remaining > 0; remaining -= burst {
+		chunk := remaining
+		if chunk > burst {
+			chunk = burst
+		}
+
+		l.mutex.Lock()
+		l.waiting[priority]++
+		for l.busy || l.higher_waiting(priority) {
+			l.cond.Wait()
+		}
+		l.waiting[priority]--
+		l.busy = true
+		l.mutex.Unlock()
+
+		l.bucket.WaitN(context.Background(), chunk)
+
+		l.mutex.Lock()
+		l.busy = false
+		l.cond.Broadcast()
+		l.mutex.Unlock()
+	}
+}
+
+// whether traffic of higher priority is queued, mutex must be held
+func (l *limiter) higher_waiting(priority int) bool {
+	for p := PRIORITY_HIGH; p < priority; p++ {
+		if l.waiting[p] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// parse limit in KB/sec from command line, returns bytes/sec
+func parse_bandwidth_limit(option string) int64 {
+	if _, ok := globals.Arguments[option]; ok && globals.Arguments[option] != nil {
+		i, err := strconv.ParseInt(globals.Arguments[option].(string), 10, 64)
+		if err != nil || i < 0 {
+			logger.Error(fmt.Errorf("%s should be positive KB/sec", option), "ignoring limit")
+			return 0
+		}
+		if i > 0 {
+			logger.Info("bandwidth limit", "option", option, "limit", humanize.IBytes(uint64(i*1024))+"/s")
+		}
+		return i * 1024
+	}
+	return 0
+}
+
+// setup bandwidth limits from command line
+func bandwidth_init() {
+	if limit := parse_bandwidth_limit("--p2p-max-upload"); limit > 0 {
+		upload_limiter = new_limiter(limit)
+		upload_bulk_limiter = new_limiter(limit / 2)
+	}
+	if limit := parse_bandwidth_limit("--p2p-max-download"); limit > 0 {
+		download_limiter = new_limiter(limit)
+		download_bulk_limiter = new_limiter(limit / 2)
+	}
+	peer_upload_limit = parse_bandwidth_limit("--p2p-max-upload-peer")
+	peer_download_limit = parse_bandwidth_limit("--p2p-max-download-peer")
+}
+
+// wait till enough tokens are available from all the limiters
+func shape(priority int, n int, limiters ...*limiter) {
+	for _, l := range limiters {
+		if l != nil {
+			l.wait(priority, n)
+		}
+	}
+}
+
+// shape outgoing data
+func shape_upload(priority int, n int, peer_limiter *limiter) {
+	if priority == PRIORITY_LOW {
+		shape(priority, n, upload_bulk_limiter)
+	}
+	shape(priority, n, upload_limiter, peer_limiter)
+}
+
+// shape incoming data, delaying reads causes the remote end to slow down
+func shape_download(priority int, n int, peer_limiter *limiter) {
+	if priority == PRIORITY_LOW {
+		shape(priority, n, download_bulk_limiter)
+	}
+	shape(priority, n, download_limiter, peer_limiter)
+}
+
+// account traffic for message type and connection, connection may be nil
+func account_traffic(c *Connection, method string, incoming bool, n int) {
+	if !p2p_methods[method] {
+		method = "unknown"
+	}
+	counter_interface, _ := traffic_map.LoadOrStore(method, &traffic_counter{})
+	counter := counter_interface.(*traffic_counter)
+
+	if incoming {
+		atomic.AddUint64(&counter.In, uint64(n))
+		metrics.Set.GetOrCreateCounter(fmt.Sprintf(`p2p_bytes_in_total{method=%q}`, method)).Add(n)
+		if c != nil {
+			atomic.AddUint64(&c.BytesIn, uint64(n))
+		}
+	} else {
+		atomic.AddUint64(&counter.Out, uint64(n))
+		metrics.Set.GetOrCreateCounter(fmt.Sprintf(`p2p_bytes_out_total{method=%q}`, method)).Add(n)
+		if c != nil {
+			atomic.AddUint64(&c.BytesOut, uint64(n))
+		}
+	}
+}
+
+// prints traffic per message type
+func Traffic_Print() {
+	var methods []string
+	traffic_map.Range(func(k, value interface{}) bool {
+		methods = append(methods, k.(string))
+		return true
+	})
+	sort.Strings(methods)
+
+	fmt.Printf("\n%-22s %10s %10s\n", "Message", "IN", "OUT")
+	for _, method := range methods {
+		if v, ok := traffic_map.Load(method); ok {
+			counter := v.(*traffic_counter)
+			fmt.Printf("%-22s %10s %10s\n", method, humanize.Bytes(atomic.LoadUint64(&counter.In)), humanize.Bytes(atomic.LoadUint64(&counter.Out)))
+		}
+	}
+}
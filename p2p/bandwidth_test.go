@@ -0,0 +1,143 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package p2p
+
+import "net"
+import "time"
+import "testing"
+import "sync/atomic"
+
+import "github.com/cenkalti/rpc2"
+
+// traffic must be accounted to both the message type and the connection, including the response
+func Test_Traffic_Accounting(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	client, server := NewCBORCodec(a), NewCBORCodec(b)
+	client_connection, server_connection := &Connection{}, &Connection{}
+	client.Attach(client_connection)
+	server.Attach(server_connection)
+
+	counter_before := func(method string) (in, out uint64) {
+		if v, ok := traffic_map.Load(method); ok {
+			return atomic.LoadUint64(&v.(*traffic_counter).In), atomic.LoadUint64(&v.(*traffic_counter).Out)
+		}
+		return 0, 0
+	}
+	in_before, out_before := counter_before("Peer.Ping")
+	unknown_in, unknown_out := counter_before("unknown")
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+		if err := client.WriteRequest(&rpc2.Request{Method: "Peer.Ping", Seq: 7}, Dummy{}); err != nil {
+			t.Errorf("write request err %s", err)
+		}
+	}()
+
+	var req rpc2.Request
+	var resp rpc2.Response
+	var request Dummy
+	if err := server.ReadHeader(&req, &resp); err != nil || req.Method != "Peer.Ping" || req.Seq != 7 {
+		t.Fatalf("read header err %s req %+v", err, req)
+	}
+	if err := server.ReadRequestBody(&request); err != nil {
+		t.Fatalf("read body err %s", err)
+	}
+	<-done
+
+	go func() {
+		defer func() { done <- true }()
+		if err := server.WriteResponse(&rpc2.Response{Seq: 7}, Dummy{}); err != nil {
+			t.Errorf("write response err %s", err)
+		}
+	}()
+
+	var response Dummy
+	if err := client.ReadHeader(&req, &resp); err != nil || resp.Seq != 7 {
+		t.Fatalf("read response header err %s resp %+v", err, resp)
+	}
+	if err := client.ReadResponseBody(&response); err != nil {
+		t.Fatalf("read response body err %s", err)
+	}
+	<-done
+
+	if client_connection.BytesOut == 0 || client_connection.BytesOut != server_connection.BytesIn {
+		t.Fatalf("request bytes mismatch out %d in %d", client_connection.BytesOut, server_connection.BytesIn)
+	}
+	if server_connection.BytesOut == 0 || server_connection.BytesOut != client_connection.BytesIn {
+		t.Fatalf("response bytes mismatch out %d in %d", server_connection.BytesOut, client_connection.BytesIn)
+	}
+
+	in_after, out_after := counter_before("Peer.Ping")
+	total := client_connection.BytesOut + server_connection.BytesOut
+	if in_after-in_before != total || out_after-out_before != total {
+		t.Fatalf("message type accounting mismatch in %d out %d expected %d", in_after-in_before, out_after-out_before, total)
+	}
+	if in, out := counter_before("unknown"); in != unknown_in || out != unknown_out {
+		t.Fatalf("response could not be attributed to request")
+	}
+}
+
+// method names sent by peers are only used as labels if they are known
+func Test_Traffic_Unknown_Method(t *testing.T) {
+	account_traffic(nil, "Peer.Bogus", true, 10)
+	account_traffic(nil, "", false, 10)
+	if _, ok := traffic_map.Load("Peer.Bogus"); ok {
+		t.Fatalf("unregistered method accounted separately")
+	}
+	if _, ok := traffic_map.Load("unknown"); !ok {
+		t.Fatalf("unregistered method not accounted as unknown")
+	}
+}
+
+// every priority is limited, queued traffic is served highest priority first
+func Test_Shaping_Priority(t *testing.T) {
+	limiter := new_limiter(512 * 1024)
+
+	start := time.Now()
+	shape(PRIORITY_HIGH, 1024*1024, limiter) // twice the burst, block serving must respect upload limit
+	if time.Since(start) < 900*time.Millisecond {
+		t.Fatalf("high priority was not limited %s", time.Since(start))
+	}
+
+	limiter = new_limiter(128 * 1024)
+	shape(PRIORITY_HIGH, 128*1024, limiter) // drain the bucket, now every 32 KB takes 250 ms
+
+	order := make(chan int, 3)
+	send := func(priority int) {
+		shape(priority, 32*1024, limiter)
+		order <- priority
+	}
+	go send(PRIORITY_NORMAL) // takes its turn right away
+	time.Sleep(50 * time.Millisecond)
+	go send(PRIORITY_LOW)
+	time.Sleep(50 * time.Millisecond)
+	go send(PRIORITY_HIGH) // queued after low, but served before it
+
+	for _, expected := range []int{PRIORITY_NORMAL, PRIORITY_HIGH, PRIORITY_LOW} {
+		if priority := <-order; priority != expected {
+			t.Fatalf("traffic served out of priority order, expected %d got %d", expected, priority)
+		}
+	}
+
+	if method_priority("Peer.NotifyMiniBlock") != PRIORITY_HIGH || method_priority("Peer.TreeSection") != PRIORITY_LOW || method_priority("Peer.Chain") != PRIORITY_NORMAL {
+		t.Fatalf("wrong priority classes")
+	}
+}
@@ -25,6 +25,7 @@ import "net"
 import "sync"
 import "time"
 import "errors"
+import "strings"
 
 //import "sort"
 import "path/filepath"
@@ -142,8 +143,16 @@ func ban_clean_up() {
 }
 
 // convert address to subnet form
-// address is an IP address or ipnet in string form
+// address is an IP address or ipnet in string form, onion/i2p hosts are returned as it is
 func ParseAddress(address string) (ipnet *net.IPNet, result string, err error) {
+	if IsAnonymousAddress(address) {
+		result = strings.ToLower(strings.TrimSpace(address))
+		if host, _, err1 := net.SplitHostPort(result); err1 == nil {
+			result = host
+		}
+		return
+	}
+
 	var ip net.IP
 	ip, ipnet, err = net.ParseCIDR(address)
 	if err != nil { // other check whether the the IP is an IP
@@ -221,6 +230,20 @@ func Ban_Address(address string, ban_seconds uint64) (err error) {
 	return
 }
 
+const MISBEHAVIOUR_BAN_SECONDS = 3600 // peers violating protocol are banned for this long
+
+// ban a peer which has violated the protocol and terminate the connection
+// in anonymous mode, peers which have not revealed their hidden service are only disconnected, since their address is that of the proxy
+func (c *Connection) ban(reason error) {
+	address := Address(c)
+	if address != "" && (!anonymous_mode || IsAnonymousAddress(address)) {
+		if err := Ban_Address(address, MISBEHAVIOUR_BAN_SECONDS); err == nil {
+			c.logger.V(1).Error(reason, "peer banned", "address", address, "seconds", MISBEHAVIOUR_BAN_SECONDS)
+		}
+	}
+	c.exit()
+}
+
 /*
 /// ban a peer only if it can be banned
 func Peer_Ban_Internal(address string, ban_seconds uint64) (err error){
@@ -0,0 +1,350 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package p2p
+
+/* this file implements verification of the state downloaded during fastsync
+ * the state root (as returned by Load_Merkle_Hash) at the bootstrap topoheight must be vouched by several independent peers
+ * peers are independent if they are on different subnets, since a single operator can easily run many nodes on one subnet
+ * most of the network does not provide state hashes yet, so if not enough peers can vouch, the primary peer is trusted
+ * unless --fastsync-verify is given
+ * every tree section is downloaded from one peer and its hash is cross checked with other peers
+ * sections which do not match are refetched from other peers
+ * progress is persisted to disk after every committed section, so an interrupted fastsync resumes where it stopped
+ */
+import "os"
+import "net"
+import "fmt"
+import "errors"
+import "math/bits"
+import "sync/atomic"
+import "path/filepath"
+import "encoding/json"
+import "encoding/binary"
+
+import "golang.org/x/crypto/sha3"
+
+import "github.com/deroproject/derohe/config"
+import "github.com/deroproject/derohe/globals"
+import "github.com/deroproject/derohe/cryptography/crypto"
+
+import "github.com/deroproject/graviton"
+
+const FLAG_STATE_VERIFY = "STATEVERIFY" // handshake flag, peer fills StateHash and SectionHash in Peer.TreeSection
+
+const BOOTSTRAP_QUORUM_PEERS = 5 // max peers asked to vouch for the state
+const BOOTSTRAP_MIN_AGREE = 2    // atleast these many independent peers must agree on every root and section
+
+// persisted fastsync progress, sections are committed in order, so only a count is required
+type bootstrap_progress struct {
+	Topo          int64       `json:"topo"`           // state is bootstrapped at this topoheight
+	StateHash     crypto.Hash `json:"state_hash"`     // state root agreed by peers at topo
+	BalanceHash   crypto.Hash `json:"balance_hash"`   // balance tree root agreed by peers at topo
+	BalanceLength uint64      `json:"balance_length"` // balance tree is fetched in 2^length sections
+	BalanceDone   int64       `json:"balance_done"`   // balance sections committed
+	SCLength      uint64      `json:"sc_length"`      // sc meta tree is fetched in 2^length sections
+	SCDone        int64       `json:"sc_done"`        // sc meta sections committed
+	Version       uint64      `json:"version"`        // graviton version after all sections have been committed, 0 if not complete
+}
+
+// hash of all keys and values of a section, both sides use it to compare sections without transferring them
+func section_hash(keys, values [][]byte) (hash crypto.Hash) {
+	var length [4]byte
+	h := sha3.NewLegacyKeccak256()
+	for i := range keys {
+		binary.BigEndian.PutUint32(length[:], uint32(len(keys[i])))
+		h.Write(length[:])
+		h.Write(keys[i])
+		if i < len(values) {
+			binary.BigEndian.PutUint32(length[:], uint32(len(values[i])))
+			h.Write(length[:])
+			h.Write(values[i])
+		}
+	}
+	h.Sum(hash[:0])
+	return
+}
+
+// path of section index i, sections are numbered with the least significant bit as the first bit of path
+func section_path(i int64) []byte {
+	var section [8]byte
+	binary.BigEndian.PutUint64(section[:], bits.Reverse64(uint64(i))) // place reverse path
+	return section[:]
+}
+
+// path of a subsection, bit at index length is set as requested
+func subsection_path(section []byte, length uint64, bit bool) []byte {
+	sub := make([]byte, len(section))
+	copy(sub, section)
+	if int(length/8) >= len(sub) {
+		sub = append(sub, make([]byte, int(length/8)+1-len(sub))...)
+	}
+	if bit {
+		sub[length/8] |= 1 << (7 - length%8)
+	} else {
+		sub[length/8] &^= 1 << (7 - length%8)
+	}
+	return sub
+}
+
+// number of bits required to split count keys into sections of roughly 640 keys
+func section_length(count int64) (length uint64) {
+	for chunks := int64(2); chunks < count/640; chunks *= 2 {
+		length++
+	}
+	return length + 1
+}
+
+func bootstrap_progress_file() string {
+	return filepath.Join(globals.GetDataDirectory(), "bootstrap.json")
+}
+
+// loads fastsync progress from disk, nil if not available
+func load_bootstrap_progress() *bootstrap_progress {
+	file, err := os.Open(bootstrap_progress_file())
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Error(err, "opening bootstrap progress file")
+		}
+		return nil
+	}
+	defer file.Close()
+
+	var progress bootstrap_progress
+	if err = json.NewDecoder(file).Decode(&progress); err != nil {
+		logger.Error(err, "Error unmarshalling bootstrap progress")
+		return nil
+	}
+	return &progress
+}
+
+// save fastsync progress to disk
+func (progress *bootstrap_progress) save() {
+	file, err := os.Create(bootstrap_progress_file())
+	if err != nil {
+		logger.Error(err, "creating bootstrap progress file")
+		return
+	}
+	defer file.Close()
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "\t")
+	if err = encoder.Encode(progress); err != nil {
+		logger.Error(err, "Error marshalling bootstrap progress")
+	}
+}
+
+func delete_bootstrap_progress() {
+	os.Remove(bootstrap_progress_file())
+}
+
+// subnet of peer, peers on the same subnet are not independent, onion/i2p hosts are returned as it is
+func peer_subnet(c *Connection) string {
+	address := Address(c)
+	ip := net.ParseIP(address)
+	switch {
+	case ip == nil:
+		return address
+	case ip.To4() != nil:
+		return ip.Mask(net.CIDRMask(24, 32)).String()
+	default:
+		return ip.Mask(net.CIDRMask(48, 128)).String()
+	}
+}
+
+// peers which can serve verifiable state at this topo, primary peer is the first if it can
+// older peers do not provide state and section hashes, so they cannot vouch for the state
+// only one peer per subnet is chosen
+func bootstrap_peers(primary *Connection, topo int64) (peers []*Connection) {
+	subnets := map[string]bool{}
+	if primary.StateVerify {
+		peers = append(peers, primary)
+		subnets[peer_subnet(primary)] = true
+	}
+
+	var others []*Connection
+	for _, c := range UniqueConnections() {
+		if c == primary || c.Peer_ID == primary.Peer_ID || !c.StateVerify {
+			continue
+		}
+		if atomic.LoadInt64(&c.TopoHeight) > topo && c.Pruned <= topo {
+			others = append(others, c)
+		}
+	}
+	globals.Global_Random.Shuffle(len(others), func(i, j int) { others[i], others[j] = others[j], others[i] })
+	for _, c := range others {
+		if len(peers) >= BOOTSTRAP_QUORUM_PEERS {
+			break
+		}
+		if subnet := peer_subnet(c); !subnets[subnet] {
+			subnets[subnet] = true
+			peers = append(peers, c)
+		}
+	}
+	return
+}
+
+// peers which will vouch for state at this topo and how many of them must agree
+// if not enough independent peers are available, only primary peer is used, unless --fastsync-verify is given
+func bootstrap_quorum(primary *Connection, topo int64) (peers []*Connection, agree int, ok bool) {
+	if peers = bootstrap_peers(primary, topo); len(peers) >= BOOTSTRAP_MIN_AGREE {
+		return peers, BOOTSTRAP_MIN_AGREE, true
+	}
+	if verify, _ := globals.Arguments["--fastsync-verify"].(bool); verify {
+		return peers, BOOTSTRAP_MIN_AGREE, false
+	}
+	return []*Connection{primary}, 1, true
+}
+
+// request a tree section, a peer advertising FLAG_STATE_VERIFY must be consistent with its own section hash
+func call_tree_section(c *Connection, request Request_Tree_Section_Struct) (response Response_Tree_Section_Struct, err error) {
+	fill_common(&request.Common)
+	if err = c.Client.Call("Peer.TreeSection", request, &response); err != nil {
+		return
+	}
+	c.update(&response.Common)
+
+	if len(response.Keys) != len(response.Values) {
+		err = fmt.Errorf("key count %d value count %d", len(response.Keys), len(response.Values))
+		c.ban(err)
+		return
+	}
+	if c.StateVerify && !request.HashOnly && section_hash(response.Keys, response.Values) != crypto.Hash(response.SectionHash) {
+		err = fmt.Errorf("section data does not match section hash")
+		c.ban(err)
+	}
+	return
+}
+
+// find the state root and balance tree root at this topo, atleast agree peers must agree
+// the sc meta tree root is implied, since state root is balance root xor sc meta root
+// if a single peer is trusted and it does not provide hashes, roots are returned as zero
+func quorum_state(peers []*Connection, topo int64, agree int) (state_hash, balance_hash crypto.Hash, err error) {
+	// a small section is requested so that peers only return roots
+	request := Request_Tree_Section_Struct{Topo: topo, TreeName: []byte(config.BALANCE_TREE), Section: section_path(0), SectionLength: 63, HashOnly: true}
+
+	votes := map[[64]byte]int{}
+	for _, c := range peers {
+		response, err := call_tree_section(c, request)
+		if err != nil {
+			c.logger.V(1).Error(err, "Call failed TreeSection")
+			continue
+		}
+		if response.StateHash == [32]byte{} && agree > 1 { // peer does not provide hashes
+			continue
+		}
+		var vote [64]byte
+		copy(vote[:], response.StateHash[:])
+		copy(vote[32:], response.TreeHash[:])
+		votes[vote]++
+	}
+
+	best, best_count, tied := [64]byte{}, 0, false
+	for vote, count := range votes {
+		if count > best_count {
+			best, best_count, tied = vote, count, false
+		} else if count == best_count {
+			tied = true
+		}
+	}
+	if best_count < agree || tied {
+		err = fmt.Errorf("peers do not agree on state at topoheight %d, votes %d needed %d", topo, best_count, agree)
+		return
+	}
+	copy(state_hash[:], best[:32])
+	copy(balance_hash[:], best[32:])
+	return
+}
+
+// fetch a section and verify it with other peers, atleast agree peers must agree
+// a section which does not match is refetched from the next peer
+// if the section is truncated by the server, it is fetched as 2 smaller sections
+func fetch_verified_section(peers []*Connection, topo int64, agree_needed int, treename []byte, section []byte, length uint64) (keys, values [][]byte, err error) {
+	request := Request_Tree_Section_Struct{Topo: topo, TreeName: treename, Section: section, SectionLength: length}
+
+	digests := map[int]crypto.Hash{} // hash only responses, asked only once per peer
+	for i := range peers {
+		response, err := call_tree_section(peers[i], request)
+		if err != nil {
+			peers[i].logger.V(1).Error(err, "Call failed TreeSection")
+			continue
+		}
+		digest := crypto.Hash(response.SectionHash)
+
+		agree := 1
+		for j := range peers {
+			if agree >= agree_needed {
+				break
+			}
+			if j == i {
+				continue
+			}
+			if _, ok := digests[j]; !ok {
+				hash_request := request
+				hash_request.HashOnly = true
+				if hash_response, err := call_tree_section(peers[j], hash_request); err == nil {
+					digests[j] = crypto.Hash(hash_response.SectionHash)
+				} else {
+					digests[j] = crypto.Hash{}
+				}
+			}
+			if digests[j] == digest {
+				agree++
+			}
+		}
+
+		if agree < agree_needed {
+			peers[i].logger.V(1).Info("tree section could not be verified, refetching from another peer", "tree", fmt.Sprintf("%x", treename), "section", fmt.Sprintf("%x", section), "length", length)
+			continue
+		}
+
+		if len(response.Keys) <= MAX_TREE_SECTION_KEYS {
+			return response.Keys, response.Values, nil
+		}
+		if length >= 255 {
+			return nil, nil, fmt.Errorf("tree section cannot be split further")
+		}
+		for _, bit := range []bool{false, true} { // section was truncated, split it
+			sub_keys, sub_values, err := fetch_verified_section(peers, topo, agree_needed, treename, subsection_path(section, length, bit), length+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			keys = append(keys, sub_keys...)
+			values = append(values, sub_values...)
+		}
+		return keys, values, nil
+	}
+	return nil, nil, fmt.Errorf("tree section could not be verified from %d peers", len(peers))
+}
+
+// replace all keys of a section, keys already present from an earlier attempt are discarded, so reapplying is harmless
+func apply_section(tree *graviton.Tree, section []byte, length uint64, keys, values [][]byte) (err error) {
+	var stale [][]byte
+	cursor := tree.Cursor()
+	for k, _, err := cursor.SpecialFirst(section, uint(length)); err == nil; k, _, err = cursor.Next() {
+		stale = append(stale, k)
+	}
+	for _, k := range stale {
+		if err = tree.Delete(k); err != nil {
+			return
+		}
+	}
+	for i := range keys {
+		if err = tree.Put(keys[i], values[i]); err != nil {
+			return
+		}
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package p2p
+
+import "fmt"
+import "net"
+import "bytes"
+import "time"
+import "testing"
+
+import "github.com/cenkalti/rpc2"
+
+import "github.com/deroproject/derohe/globals"
+import "github.com/deroproject/derohe/cryptography/crypto"
+
+import "github.com/deroproject/graviton"
+
+// peer serving a fixed section and fixed roots, inconsistent peers send a section hash which does not match data
+func section_peer(t *testing.T, keys, values [][]byte, state_hash crypto.Hash, inconsistent bool) *test_peer {
+	p := harness_peer(t, map[string]interface{}{
+		"Peer.TreeSection": func(client *rpc2.Client, args Request_Tree_Section_Struct, reply *Response_Tree_Section_Struct) error {
+			reply.StateHash = state_hash
+			reply.TreeHash = state_hash
+			reply.SectionHash = section_hash(keys, values)
+			if inconsistent {
+				reply.SectionHash[0] ^= 0xff
+			}
+			if !args.HashOnly {
+				reply.Keys, reply.Values = keys, values
+			}
+			return nil
+		},
+	})
+	p.node.StateVerify = true // as if advertised in handshake
+	return p
+}
+
+func test_section(prefix string, count int) (keys, values [][]byte) {
+	for i := 0; i < count; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("%s key %d", prefix, i)))
+		values = append(values, []byte(fmt.Sprintf("%s value %d", prefix, i)))
+	}
+	return
+}
+
+// sections and roots are only accepted if enough peers agree, bad sections are refetched from others
+func Test_Bootstrap_Verified_Section(t *testing.T) {
+	keys, values := test_section("honest", 20)
+	bad_keys, bad_values := test_section("liar", 20)
+
+	liar := section_peer(t, bad_keys, bad_values, crypto.Hash{2}, false)
+	honest1 := section_peer(t, keys, values, crypto.Hash{1}, false)
+	honest2 := section_peer(t, keys, values, crypto.Hash{1}, false)
+	defer liar.close()
+	defer honest1.close()
+	defer honest2.close()
+	peers := []*Connection{liar.node, honest1.node, honest2.node}
+
+	rkeys, rvalues, err := fetch_verified_section(peers, 10, BOOTSTRAP_MIN_AGREE, []byte("T"), section_path(0), 1)
+	if err != nil {
+		t.Fatalf("section could not be fetched err %s", err)
+	}
+	if section_hash(rkeys, rvalues) != section_hash(keys, values) {
+		t.Fatalf("section from lying peer was accepted")
+	}
+
+	if state_hash, _, err := quorum_state(peers, 10, BOOTSTRAP_MIN_AGREE); err != nil || state_hash != (crypto.Hash{1}) {
+		t.Fatalf("state root agreed by majority was not chosen err %v", err)
+	}
+	if _, _, err := quorum_state(peers[:2], 10, BOOTSTRAP_MIN_AGREE); err == nil {
+		t.Fatalf("state root was accepted without agreement")
+	}
+	if _, _, err := fetch_verified_section(peers[:2], 10, BOOTSTRAP_MIN_AGREE, []byte("T"), section_path(0), 1); err == nil {
+		t.Fatalf("section was accepted without agreement")
+	}
+
+	inconsistent := section_peer(t, keys, values, crypto.Hash{1}, true)
+	if _, _, err := fetch_verified_section([]*Connection{inconsistent.node, honest1.node}, 10, BOOTSTRAP_MIN_AGREE, []byte("T"), section_path(0), 1); err == nil {
+		t.Fatalf("section was accepted from inconsistent peer")
+	}
+	inconsistent.must_be_banned(t)
+}
+
+// older peers do not fill state and section hashes, they must neither be banned nor counted in quorum
+func Test_Bootstrap_Old_Peer(t *testing.T) {
+	keys, values := test_section("old", 20)
+	old := harness_peer(t, map[string]interface{}{
+		"Peer.TreeSection": func(client *rpc2.Client, args Request_Tree_Section_Struct, reply *Response_Tree_Section_Struct) error {
+			reply.Keys, reply.Values = keys, values
+			return nil
+		},
+	})
+	defer old.close()
+
+	if _, err := call_tree_section(old.node, Request_Tree_Section_Struct{Topo: 10, TreeName: []byte("T"), Section: section_path(0)}); err != nil {
+		t.Fatalf("section from old peer failed err %s", err)
+	}
+	if old.disconnected(100*time.Millisecond) || IsAddressInBanList(Address(old.node)) {
+		t.Fatalf("old peer must not be banned")
+	}
+	if peers := bootstrap_peers(old.node, 10); len(peers) != 0 {
+		t.Fatalf("old peer cannot vouch for state")
+	}
+}
+
+// without enough independent peers, fastsync falls back to the primary peer, unless --fastsync-verify is given
+func Test_Bootstrap_Fallback(t *testing.T) {
+	keys, values := test_section("old", 20)
+	old := harness_peer(t, map[string]interface{}{
+		"Peer.TreeSection": func(client *rpc2.Client, args Request_Tree_Section_Struct, reply *Response_Tree_Section_Struct) error {
+			reply.Keys, reply.Values = keys, values
+			return nil
+		},
+	})
+	defer old.close()
+
+	peers, agree, ok := bootstrap_quorum(old.node, 10)
+	if !ok || agree != 1 || len(peers) != 1 || peers[0] != old.node {
+		t.Fatalf("fastsync must fall back to primary peer")
+	}
+	if state_hash, _, err := quorum_state(peers, 10, agree); err != nil || state_hash != (crypto.Hash{}) {
+		t.Fatalf("primary peer without hashes must be trusted err %v", err)
+	}
+	if rkeys, rvalues, err := fetch_verified_section(peers, 10, agree, []byte("T"), section_path(0), 1); err != nil || section_hash(rkeys, rvalues) != section_hash(keys, values) {
+		t.Fatalf("section from primary peer failed err %v", err)
+	}
+
+	globals.Arguments["--fastsync-verify"] = true
+	defer delete(globals.Arguments, "--fastsync-verify")
+	if _, _, ok := bootstrap_quorum(old.node, 10); ok {
+		t.Fatalf("fastsync must wait for more peers with --fastsync-verify")
+	}
+}
+
+// peers on the same subnet count as a single peer
+func Test_Bootstrap_Subnet_Quorum(t *testing.T) {
+	keys, values := test_section("honest", 20)
+	primary := section_peer(t, keys, values, crypto.Hash{1}, false)
+	same_subnet := section_peer(t, keys, values, crypto.Hash{1}, false)
+	defer primary.close()
+	defer same_subnet.close()
+	same_subnet.node.TopoHeight = 20
+
+	if peers := bootstrap_peers(primary.node, 10); len(peers) != 1 || peers[0] != primary.node {
+		t.Fatalf("peers on same subnet must be counted once, got %d peers", len(peers))
+	}
+	if peers, agree, _ := bootstrap_quorum(primary.node, 10); len(peers) != 1 || agree != 1 {
+		t.Fatalf("peers on same subnet cannot form a quorum")
+	}
+	for address, subnet := range map[string]string{"1.2.3.4": "1.2.3.0", "2001:db8:1:2::1": "2001:db8:1::", "abc.onion": "abc.onion"} {
+		c := &Connection{Addr: &AnonAddr{Host: address}}
+		if !IsAnonymousAddress(address) {
+			c.Addr = &net.TCPAddr{IP: net.ParseIP(address), Port: 18089}
+		}
+		if peer_subnet(c) != subnet {
+			t.Fatalf("subnet of %s expected %s actual %s", address, subnet, peer_subnet(c))
+		}
+	}
+}
+
+// sections cover the tree without overlap, and applying a section any number of times gives the same tree
+func Test_Bootstrap_Apply_Section(t *testing.T) {
+	store, err := graviton.NewMemStore()
+	if err != nil {
+		t.Fatalf("store err %s", err)
+	}
+	ss, _ := store.LoadSnapshot(0)
+	tree, _ := ss.GetTree("T")
+
+	keys, values := test_section("key", 300)
+	for i := range keys {
+		tree.Put(keys[i], values[i])
+	}
+	expected, _ := tree.Hash()
+
+	length := uint64(2)
+	var sections [][2][][]byte
+	total := 0
+	for i := int64(0); i < 1<<length; i++ {
+		var skeys, svalues [][]byte
+		cursor := tree.Cursor()
+		for k, v, err := cursor.SpecialFirst(section_path(i), uint(length)); err == nil; k, v, err = cursor.Next() {
+			skeys = append(skeys, k)
+			svalues = append(svalues, v)
+		}
+		total += len(skeys)
+		sections = append(sections, [2][][]byte{skeys, svalues})
+	}
+	if total != len(keys) {
+		t.Fatalf("sections contain %d keys, expected %d", total, len(keys))
+	}
+
+	// subsections of section 1 are sections 1 and 5 of a longer path
+	if !bytes.Equal(subsection_path(section_path(1), length, false), section_path(1)) || !bytes.Equal(subsection_path(section_path(1), length, true), section_path(5)) {
+		t.Fatalf("subsection paths are wrong")
+	}
+
+	// a stale key within a section is removed when the section is applied
+	stale_ss, _ := store.LoadSnapshot(0)
+	stale_tree, _ := stale_ss.GetTree("T")
+	stale_tree.Put([]byte("stale"), []byte("stale"))
+	for round := 0; round < 2; round++ {
+		for i := range sections {
+			if err := apply_section(stale_tree, section_path(int64(i)), length, sections[i][0], sections[i][1]); err != nil {
+				t.Fatalf("section could not be applied err %s", err)
+			}
+		}
+		if h, _ := stale_tree.Hash(); h != expected {
+			t.Fatalf("applied sections do not give the same tree, round %d", round)
+		}
+	}
+}
+
+func Test_Bootstrap_Progress(t *testing.T) {
+	harness_chain_start(t)
+	delete_bootstrap_progress()
+	if load_bootstrap_progress() != nil {
+		t.Fatalf("progress loaded without being saved")
+	}
+
+	progress := bootstrap_progress{Topo: 1000, StateHash: crypto.Hash{1}, BalanceHash: crypto.Hash{2}, BalanceLength: section_length(100000), BalanceDone: 7, SCLength: 1, SCDone: 1}
+	progress.save()
+	if loaded := load_bootstrap_progress(); loaded == nil || *loaded != progress {
+		t.Fatalf("progress could not be restored")
+	}
+	delete_bootstrap_progress()
+
+	if section_length(0) != 1 || section_length(100000) != 8 { // 100000 keys need 256 sections of roughly 640 keys
+		t.Fatalf("section length is wrong %d %d", section_length(0), section_length(100000))
+	}
+}
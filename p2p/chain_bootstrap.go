@@ -21,9 +21,7 @@ import "fmt"
 //import "net"
 import "time"
 import "math/big"
-import "math/bits"
 import "sync/atomic"
-import "encoding/binary"
 
 import "github.com/deroproject/derohe/config"
 import "github.com/deroproject/derohe/block"
@@ -40,8 +38,8 @@ import "github.com/deroproject/derohe/cryptography/crypto"
 // we are expecting other side to have a heavier PoW chain
 // this is for the case when the chain only moves in pruned state
 // if after bootstraping the chain can continousky sync for few minutes, this means we have got the job done
-// TODO if during bootstrap error occurs, then we must discard data and restart from scratch
-// resume may be implemented in future
+// state is only accepted if it matches the state root vouched by multiple peers, see bootstrap_verify.go
+// progress is saved after every section, so an interrupted bootstrap resumes from where it stopped
 func (connection *Connection) bootstrap_chain() {
 	defer handle_connection_panic(connection)
 	var request ChangeList
@@ -54,16 +52,40 @@ func (connection *Connection) bootstrap_chain() {
 		connection.logger.Info("fastsync cannot be done as peer's chain has low height")
 		connection.logger.Info("will do normal sync")
 		connection.sync_chain()
+		chain.Sync = true
 		return
 	}
 
 	// we will request top 60 blocks
 	ctopo := connection.TopoHeight - 50 // last 50 blocks have to be synced, this syncing will help us detect error
+	start_topo := ctopo - (max_request_topoheights - 1)
+
+	progress := load_bootstrap_progress()
+	if progress != nil { // resume only if state at that topo is still available from enough peers
+		if _, _, ok := bootstrap_quorum(connection, progress.Topo); ok && connection.Pruned <= progress.Topo && progress.Topo+max_request_topoheights <= connection.TopoHeight {
+			start_topo = progress.Topo
+			connection.logger.Info("Bootstrap resuming", "topoheight", progress.Topo, "balance_sections", progress.BalanceDone, "sc_sections", progress.SCDone)
+		} else {
+			connection.logger.Info("Bootstrap progress discarded, since state is no longer available from peers", "topoheight", progress.Topo)
+			delete_bootstrap_progress()
+			progress = nil
+		}
+	}
+
 	var topos []int64
-	for i := ctopo - (max_request_topoheights - 1); i < ctopo; i++ {
+	for i := start_topo; i < start_topo+(max_request_topoheights-1); i++ {
 		topos = append(topos, i)
 	}
 
+	peers, agree, ok := bootstrap_quorum(connection, start_topo)
+	if !ok {
+		connection.logger.Info("fastsync requires state verification from more peers, waiting", "peers", len(peers), "required", agree)
+		return
+	}
+	if agree < BOOTSTRAP_MIN_AGREE {
+		connection.logger.Info("not enough independent peers can verify state, fastsync will trust this peer", "peers", len(peers))
+	}
+
 	connection.logger.Info("Bootstrap Initiated")
 
 	for i := range topos {
@@ -77,168 +99,125 @@ func (connection *Connection) bootstrap_chain() {
 	}
 	// we have a response, see if its valid and try to add to get the blocks
 	connection.logger.V(1).Info("changeset received", "keycount", response.KeyCount, "sccount", response.SCKeyCount)
+	if len(response.CBlocks) != len(request.TopoHeights) {
+		connection.ban(fmt.Errorf("changeset has %d blocks, requested %d", len(response.CBlocks), len(request.TopoHeights)))
+		return
+	}
 
-	commit_version := uint64(0)
-
-	{ // fetch and commit balance tree
-
-		chunksize := int64(640)
-		chunks_estm := response.KeyCount / chunksize
-		chunks := int64(1) // chunks need to be in power of 2
-		path_length := 0
-		for chunks < chunks_estm {
-			chunks = chunks * 2
-			path_length++
-		}
-
-		if chunks < 2 {
-			chunks = 2
-			path_length = 1
+	if progress == nil { // find the state root which we must reach
+		state_hash, balance_hash, err := quorum_state(peers, start_topo, agree)
+		if err != nil {
+			connection.logger.Error(err, "fastsync state could not be verified")
+			return
 		}
+		progress = &bootstrap_progress{Topo: start_topo, StateHash: state_hash, BalanceHash: balance_hash,
+			BalanceLength: section_length(response.KeyCount), SCLength: section_length(response.SCKeyCount)}
+		progress.save()
+	}
 
-		var section [8]byte
-
-		total_keys := 0
-
-		for i := int64(0); i < chunks; i++ {
-			binary.BigEndian.PutUint64(section[:], bits.Reverse64(uint64(i))) // place reverse path
-			ts_request := Request_Tree_Section_Struct{Topo: request.TopoHeights[0], TreeName: []byte(config.BALANCE_TREE), Section: section[:], SectionLength: uint64(path_length)}
-			var ts_response Response_Tree_Section_Struct
-			fill_common(&ts_response.Common)
-			if err := connection.Client.Call("Peer.TreeSection", ts_request, &ts_response); err != nil {
-				connection.logger.V(1).Error(err, "Call failed TreeSection")
+	{ // fetch and commit balance tree
+		chunks := int64(1) << progress.BalanceLength
+		for i := progress.BalanceDone; i < chunks; i++ {
+			keys, values, err := fetch_verified_section(peers, progress.Topo, agree, []byte(config.BALANCE_TREE), section_path(i), progress.BalanceLength)
+			if err != nil {
+				connection.logger.Error(err, "Bootstrap failed, will resume later")
 				return
-			} else {
-				// now we must write all the state changes to gravition
-				var balance_tree *graviton.Tree
-				if ss, err := chain.Store.Balance_store.LoadSnapshot(0); err != nil {
-					panic(err)
-				} else if balance_tree, err = ss.GetTree(config.BALANCE_TREE); err != nil {
-					panic(err)
-				}
-
-				if len(ts_response.Keys) != len(ts_response.Values) {
-					//rlog.Warnf("Incoming Key count %d value count %d \"%s\" ", len(ts_response.Keys), len(ts_response.Values), globals.CTXString(connection.logger))
-					connection.exit()
-					return
-				}
-				//rlog.Debugf("chunk %d Will write %d keys\n", i, len(ts_response.Keys))
-
-				for j := range ts_response.Keys {
-					balance_tree.Put(ts_response.Keys[j], ts_response.Values[j])
-				}
-				total_keys += len(ts_response.Keys)
-
-				commit_version, err = graviton.Commit(balance_tree)
-				if err != nil {
-					panic(err)
-				}
+			}
 
-				h, err := balance_tree.Hash()
-				_ = h
-				_ = err
-				//rlog.Debugf("total keys %d hash %x err %s\n", total_keys, h, err)
+			// now we must write all the state changes to gravition
+			var balance_tree *graviton.Tree
+			if ss, err := chain.Store.Balance_store.LoadSnapshot(0); err != nil {
+				panic(err)
+			} else if balance_tree, err = ss.GetTree(config.BALANCE_TREE); err != nil {
+				panic(err)
+			}
 
+			if err = apply_section(balance_tree, section_path(i), progress.BalanceLength, keys, values); err != nil {
+				panic(err)
 			}
+			if _, err = graviton.Commit(balance_tree); err != nil {
+				panic(err)
+			}
+
+			progress.BalanceDone = i + 1
+			progress.save()
 			connection.logger.Info("Bootstrap in progress(step1)", "percent", float32(i*100)/float32(chunks))
 		}
 	}
 
 	{ // fetch and commit SC tree
+		chunks := int64(1) << progress.SCLength
+		for i := progress.SCDone; i < chunks; i++ {
+			keys, values, err := fetch_verified_section(peers, progress.Topo, agree, []byte(config.SC_META), section_path(i), progress.SCLength)
+			if err != nil {
+				connection.logger.Error(err, "Bootstrap failed, will resume later")
+				return
+			}
 
-		chunksize := int64(640)
-		chunks_estm := response.SCKeyCount / chunksize
-		chunks := int64(1) // chunks need to be in power of 2
-		path_length := 0
-		for chunks < chunks_estm {
-			chunks = chunks * 2
-			path_length++
-		}
-
-		if chunks < 2 {
-			chunks = 2
-			path_length = 1
-		}
-
-		var section [8]byte
+			// now we must write all the state changes to gravition
+			var changed_trees []*graviton.Tree
+			var sc_tree *graviton.Tree
+			ss, err := chain.Store.Balance_store.LoadSnapshot(0)
+			if err != nil {
+				panic(err)
+			} else if sc_tree, err = ss.GetTree(config.SC_META); err != nil {
+				panic(err)
+			}
 
-		total_keys := 0
+			if err = apply_section(sc_tree, section_path(i), progress.SCLength, keys, values); err != nil {
+				panic(err)
+			}
 
-		for i := int64(0); i < chunks; i++ {
-			binary.BigEndian.PutUint64(section[:], bits.Reverse64(uint64(i))) // place reverse path
-			ts_request := Request_Tree_Section_Struct{Topo: request.TopoHeights[0], TreeName: []byte(config.SC_META), Section: section[:], SectionLength: uint64(path_length)}
-			var ts_response Response_Tree_Section_Struct
-			fill_common(&ts_response.Common)
-			if err := connection.Client.Call("Peer.TreeSection", ts_request, &ts_response); err != nil {
-				connection.logger.V(1).Error(err, "Call failed TreeSection")
-				return
-			} else {
-				// now we must write all the state changes to gravition
-				var changed_trees []*graviton.Tree
-				var sc_tree *graviton.Tree
-				//var changed_trees []*graviton.Tree
-				ss, err := chain.Store.Balance_store.LoadSnapshot(0)
+			for j := range keys { // we must fetch each individual SC tree
+				sc_keys, sc_values, err := fetch_verified_section(peers, progress.Topo, agree, keys[j], section_path(0), 0)
 				if err != nil {
-					panic(err)
-				} else if sc_tree, err = ss.GetTree(config.SC_META); err != nil {
-					panic(err)
-				}
-
-				if len(ts_response.Keys) != len(ts_response.Values) {
-					//rlog.Warnf("Incoming Key count %d value count %d \"%s\" ", len(ts_response.Keys), len(ts_response.Values), globals.CTXString(connection.logger))
-					connection.exit()
+					connection.logger.Error(err, "Bootstrap failed, will resume later")
 					return
 				}
-				//rlog.Debugf("SC chunk %d Will write %d keys\n", i, len(ts_response.Keys))
-
-				for j := range ts_response.Keys {
-					sc_tree.Put(ts_response.Keys[j], ts_response.Values[j])
-
-					// we must fetch each individual SC tree
-
-					sc_request := Request_Tree_Section_Struct{Topo: request.TopoHeights[0], TreeName: ts_response.Keys[j], Section: section[:], SectionLength: uint64(0)}
-					var sc_response Response_Tree_Section_Struct
-					fill_common(&sc_response.Common)
-					if err := connection.Client.Call("Peer.TreeSection", sc_request, &sc_response); err != nil {
-						connection.logger.V(1).Error(err, "Call failed TreeSection")
-						return
-					} else {
-						var sc_data_tree *graviton.Tree
-						if sc_data_tree, err = ss.GetTree(string(ts_response.Keys[j])); err != nil {
-							panic(err)
-						} else {
-							for j := range sc_response.Keys {
-								sc_data_tree.Put(sc_response.Keys[j], sc_response.Values[j])
-							}
-							changed_trees = append(changed_trees, sc_data_tree)
-
-						}
-
-					}
-
+				var sc_data_tree *graviton.Tree
+				if sc_data_tree, err = ss.GetTree(string(keys[j])); err != nil {
+					panic(err)
 				}
-				total_keys += len(ts_response.Keys)
-				changed_trees = append(changed_trees, sc_tree)
-				commit_version, err = graviton.Commit(changed_trees...)
-				if err != nil {
+				if err = apply_section(sc_data_tree, section_path(0), 0, sc_keys, sc_values); err != nil {
 					panic(err)
 				}
+				changed_trees = append(changed_trees, sc_data_tree)
+			}
 
-				h, err := sc_tree.Hash()
-				_ = h
-				_ = err
-				//rlog.Debugf("total SC keys %d hash %x err %s\n", total_keys, h, err)
-
+			changed_trees = append(changed_trees, sc_tree)
+			if _, err = graviton.Commit(changed_trees...); err != nil {
+				panic(err)
 			}
+
+			progress.SCDone = i + 1
+			progress.save()
 			connection.logger.Info("Bootstrap in progress(step 2)", "percent", float32(i*100)/float32(chunks))
 		}
 	}
 
-	for i := int64(0); i <= request.TopoHeights[0]; i++ {
-		chain.Store.Topo_store.Write(i, zerohash, commit_version, 0) // commit everything
+	if progress.Version == 0 { // whatever datastore we have written, its state hash must match
+		ss, err := chain.Store.Balance_store.LoadSnapshot(0)
+		if err != nil {
+			panic(err)
+		}
+		if err = verify_bootstrap_state(ss.GetVersion(), progress.StateHash, progress.BalanceHash); err != nil {
+			connection.logger.Error(err, "Bootstrapped state does not match, bootstrap will restart")
+			delete_bootstrap_progress()
+			return
+		}
+		progress.Version = ss.GetVersion()
+		progress.save()
+	}
+
+	type bootstrap_block struct {
+		cbl            block.Complete_Block
+		diff           *big.Int
+		commit_version uint64
 	}
+	var blocks []bootstrap_block
 
-	for i := range response.CBlocks { // we must store the blocks
+	commit_version := progress.Version
+	for i := range response.CBlocks { // apply all the changes first, nothing is written before state is verified
 
 		var cbl block.Complete_Block // parse incoming block and deserialize it
 		var bl block.Block
@@ -247,44 +226,35 @@ func (connection *Connection) bootstrap_chain() {
 		err := bl.Deserialize(response.CBlocks[i].Block)
 		if err != nil { // we have a block which could not be deserialized ban peer
 			connection.logger.Error(err, "Error Incoming block could not be deserialised.")
-			connection.exit()
+			connection.ban(err)
 			return
 		}
 
 		// give the chain some more time to respond
 		atomic.StoreInt64(&connection.LastObjectRequestTime, time.Now().Unix())
 
-		if i == 0 { // whatever datastore we have written, its state hash must match
-			// ToDo
-
-		}
-
 		// complete the txs
+		if len(bl.Tx_hashes) != len(response.CBlocks[i].Txs) {
+			connection.ban(fmt.Errorf("block has %d txs, received %d", len(bl.Tx_hashes), len(response.CBlocks[i].Txs)))
+			return
+		}
 		for j := range response.CBlocks[i].Txs {
 			var tx transaction.Transaction
 			err = tx.Deserialize(response.CBlocks[i].Txs[j])
 			if err != nil { // we have a tx which could not be deserialized ban peer
 				connection.logger.Error(err, "Error Incoming TX could not be deserialized")
-				connection.exit()
+				connection.ban(err)
 				return
 			}
 			if bl.Tx_hashes[j] != tx.GetHash() {
 				connection.logger.Error(err, "Error Incoming TX has mismatch.")
-				connection.exit()
+				connection.ban(fmt.Errorf("tx hash mismatch"))
 				return
 			}
 
 			cbl.Txs = append(cbl.Txs, &tx)
 		}
 
-		{ // first lets save all the txs, together with their link to this block as height
-			for i := 0; i < len(cbl.Txs); i++ {
-				if err = chain.Store.Block_tx_store.WriteTX(bl.Tx_hashes[i], cbl.Txs[i].Serialize()); err != nil {
-					panic(err)
-				}
-			}
-		}
-
 		diff := new(big.Int)
 		if _, ok := diff.SetString(response.CBlocks[i].Difficulty, 10); !ok { // if Cumulative_Difficulty could not be parsed, kill connection
 			connection.logger.Error(fmt.Errorf("Could not Parse Difficulty in common"), "", "diff", response.CBlocks[i].Difficulty)
@@ -293,21 +263,12 @@ func (connection *Connection) bootstrap_chain() {
 		}
 
 		// now we must write all the state changes to gravition
-
-		var ss *graviton.Snapshot
-		if ss, err = chain.Store.Balance_store.LoadSnapshot(0); err != nil {
-			panic(err)
-		}
-
-		/*if len(response.CBlocks[i].Keys) != len(response.CBlocks[i].Values) {
-			rlog.Warnf("Incoming Key count %d value count %d \"%s\" ", len(response.CBlocks[i].Keys), len(response.CBlocks[i].Values), globals.CTXString(connection.logger))
-			connection.exit()
-			return
-		}*/
-
 		write_count := 0
-		commit_version := ss.GetVersion()
 		if i != 0 {
+			var ss *graviton.Snapshot
+			if ss, err = chain.Store.Balance_store.LoadSnapshot(commit_version); err != nil {
+				panic(err)
+			}
 
 			var changed_trees []*graviton.Tree
 
@@ -316,6 +277,10 @@ func (connection *Connection) bootstrap_chain() {
 				if tree, err = ss.GetTree(string(change.TreeName)); err != nil {
 					panic(err)
 				}
+				if len(change.Keys) != len(change.Values) {
+					connection.ban(fmt.Errorf("changeset key count %d value count %d", len(change.Keys), len(change.Values)))
+					return
+				}
 
 				for j := range change.Keys {
 					tree.Put(change.Keys[j], change.Values[j])
@@ -329,18 +294,84 @@ func (connection *Connection) bootstrap_chain() {
 			}
 		}
 
-		if err = chain.Store.Block_tx_store.WriteBlock(bl.GetHash(), bl.Serialize(), diff, commit_version, bl.Height); err != nil {
-			panic(fmt.Sprintf("error while writing block"))
+		connection.logger.V(2).Info("Writing version", "topoheight", request.TopoHeights[i], "keycount", write_count, "commit version ", commit_version)
+		blocks = append(blocks, bootstrap_block{cbl: cbl, diff: diff, commit_version: commit_version})
+	}
+
+	{ // changes are only accepted if the state at last topo matches the state root vouched by peers
+		last_topo := request.TopoHeights[len(request.TopoHeights)-1]
+		var state_hash crypto.Hash
+		var err error
+		last_peers, last_agree, ok := bootstrap_quorum(connection, last_topo)
+		if !ok {
+			err = fmt.Errorf("not enough peers to verify state at topoheight %d", last_topo)
+		} else if state_hash, _, err = quorum_state(last_peers, last_topo, last_agree); err == nil {
+			err = verify_bootstrap_state(commit_version, state_hash, crypto.Hash{})
+		}
+		if err != nil {
+			connection.logger.Error(err, "changeset could not be verified, will retry later")
+			return
 		}
+	}
 
-		connection.logger.V(2).Info("Writing version", "topoheight", request.TopoHeights[i], "keycount", write_count, "commit version ", commit_version)
+	for i := int64(0); i <= request.TopoHeights[0]; i++ {
+		chain.Store.Topo_store.Write(i, zerohash, progress.Version, 0) // commit everything
+	}
+
+	for i, b := range blocks { // we must store the blocks
+		bl := b.cbl.Bl
+		{ // first lets save all the txs, together with their link to this block as height
+			for j := 0; j < len(b.cbl.Txs); j++ {
+				if err := chain.Store.Block_tx_store.WriteTX(bl.Tx_hashes[j], b.cbl.Txs[j].Serialize()); err != nil {
+					panic(err)
+				}
+			}
+		}
+
+		if err := chain.Store.Block_tx_store.WriteBlock(bl.GetHash(), bl.Serialize(), b.diff, b.commit_version, bl.Height); err != nil {
+			panic(fmt.Sprintf("error while writing block"))
+		}
 
-		chain.Store.Topo_store.Write(request.TopoHeights[i], bl.GetHash(), commit_version, int64(bl.Height)) // commit everything
+		chain.Store.Topo_store.Write(request.TopoHeights[i], bl.GetHash(), b.commit_version, int64(bl.Height)) // commit everything
 	}
 
+	delete_bootstrap_progress()
 	connection.logger.Info("Bootstrap completed successfully.")
 	// load the chain from the disk
 	chain.Initialise_Chain_From_DB()
 	chain.Sync = true
 	return
 }
+
+// verify local state at this version against the roots agreed by peers, roots which are zero are skipped
+func verify_bootstrap_state(version uint64, state_hash, balance_hash crypto.Hash) error {
+	if state_hash == (crypto.Hash{}) { // trusted peer did not provide roots
+		return nil
+	}
+	local_state_hash, err := chain.Load_Merkle_Hash(version)
+	if err != nil {
+		return err
+	}
+	if local_state_hash != state_hash {
+		return fmt.Errorf("state root mismatch, expected %s actual %s", state_hash, local_state_hash)
+	}
+
+	if balance_hash != (crypto.Hash{}) {
+		ss, err := chain.Store.Balance_store.LoadSnapshot(version)
+		if err != nil {
+			return err
+		}
+		balance_tree, err := ss.GetTree(config.BALANCE_TREE)
+		if err != nil {
+			return err
+		}
+		local_balance_hash, err := balance_tree.Hash()
+		if err != nil {
+			return err
+		}
+		if local_balance_hash != balance_hash {
+			return fmt.Errorf("balance root mismatch, expected %s actual %x", balance_hash, local_balance_hash)
+		}
+	}
+	return nil
+}
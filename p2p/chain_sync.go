@@ -26,9 +26,12 @@ import "github.com/deroproject/derohe/globals"
 import "github.com/deroproject/derohe/block"
 import "github.com/deroproject/derohe/errormsg"
 import "github.com/deroproject/derohe/blockchain"
+import "github.com/deroproject/derohe/blockchain/mempool"
 import "github.com/deroproject/derohe/transaction"
 import "github.com/deroproject/derohe/cryptography/crypto"
 
+const SYNC_PREVERIFY_BATCH = 16 // blocks fetched while syncing before their PoW is verified in parallel
+
 // used to satisfy difficulty interface
 type MemorySource struct {
 	Blocks     map[crypto.Hash]*block.Complete_Block
@@ -85,28 +88,59 @@ func (x *MemorySource) Load_Block_Difficulty(blid crypto.Hash) *big.Int {
 }
 
 // convert block which was serialized in p2p format to in ram block format
-func ConvertCBlock_To_CompleteBlock(cblock Complete_Block) (cbl block.Complete_Block, diff *big.Int) {
+// malformed blocks or txs are returned as error, so caller can ban the peer
+func ConvertCBlock_To_CompleteBlock(cblock Complete_Block) (cbl block.Complete_Block, err error) {
 	var bl block.Block
 	cbl.Bl = &bl
-	if err := bl.Deserialize(cblock.Block); err != nil {
-		panic(err)
+	if err = bl.Deserialize(cblock.Block); err != nil {
+		return
 	}
 	// complete the txs
 	for j := range cblock.Txs {
 		var tx transaction.Transaction
-		if err := tx.Deserialize(cblock.Txs[j]); err != nil { // we have a tx which could not be deserialized ban peer
-			panic(err)
+		if err = tx.Deserialize(cblock.Txs[j]); err != nil { // we have a tx which could not be deserialized ban peer
+			return
 		}
 		cbl.Txs = append(cbl.Txs, &tx)
 	}
 
 	if len(bl.Tx_hashes) != len(cbl.Txs) {
-		panic(fmt.Errorf("txcount mismatch, expected %d txs actual %d", len(bl.Tx_hashes), len(cbl.Txs)))
+		err = fmt.Errorf("txcount mismatch, expected %d txs actual %d", len(bl.Tx_hashes), len(cbl.Txs))
 	}
 
 	return
 }
 
+// peer must answer with a chain starting at one of the blocks we sent
+// a response starting elsewhere conflicts with our own chain and would make us rewind blindly
+// response is checked against the request, since our chain may have changed while peer was answering
+func validate_chain_response(request *Chain_Request_Struct, response *Chain_Response_Struct) error {
+	if len(response.Block_list) > 1024 || len(response.TopBlocks) > 1024 {
+		return fmt.Errorf("chain response too large blocks %d topblocks %d", len(response.Block_list), len(response.TopBlocks))
+	}
+	for i := range request.TopoHeights {
+		if request.TopoHeights[i] != response.Start_topoheight || i >= len(request.Block_list) {
+			continue
+		}
+		blid := request.Block_list[i]
+		if i == len(request.Block_list)-1 && request.TopoHeights[i] == 0 { // genesis entry is a network marker, compare with our own genesis
+			genesis, err := chain.Load_Block_Topological_order_at_index(0)
+			if err != nil || genesis.IsZero() { // fastsynced or imported chains do not keep genesis
+				return nil
+			}
+			blid = genesis
+		}
+		if len(response.Block_list) >= 1 && response.Block_list[0] != blid {
+			return fmt.Errorf("chain response conflicts at topoheight %d", response.Start_topoheight)
+		}
+		if height := chain.Load_Height_for_BL_ID(blid); height >= 0 && response.Start_height != height { // height of a block never changes
+			return fmt.Errorf("chain response height %d conflicts at topoheight %d", response.Start_height, response.Start_topoheight)
+		}
+		return nil
+	}
+	return fmt.Errorf("chain response starts at topoheight %d which was not requested", response.Start_topoheight)
+}
+
 // we are expecting other side to have a heavier PoW chain, try to sync now
 func (connection *Connection) sync_chain() {
 
@@ -159,6 +193,10 @@ try_again:
 		return
 	}
 	// we have a response, see if its valid and try to add to get the blocks
+	if err := validate_chain_response(&request, &response); err != nil {
+		connection.ban(err)
+		return
+	}
 
 	connection.logger.V(2).Info("Peer wants to give chain", "from topoheight", response.Start_height)
 
@@ -224,8 +262,15 @@ try_again:
 				if err := connection.Client.Call("Peer.GetObject", orequest, &oresponse); err != nil {
 					connection.logger.V(2).Error(err, "Call failed GetObject")
 					return
+				} else if len(oresponse.CBlocks) != 1 {
+					connection.ban(fmt.Errorf("requested 1 block, received %d", len(oresponse.CBlocks)))
+					return
 				} else { // process the response
-					cbl, _ := ConvertCBlock_To_CompleteBlock(oresponse.CBlocks[0])
+					cbl, err := ConvertCBlock_To_CompleteBlock(oresponse.CBlocks[0])
+					if err != nil {
+						connection.ban(err)
+						return
+					}
 					ramstore.insert_block(&cbl) // insert block with checking verification
 				}
 			}
@@ -256,6 +301,19 @@ try_again:
 	// check whether the objects are in our db or not
 	// until we put in place a parallel object tracker, do it one at a time
 
+	// blocks are fetched in batches, PoW of a batch is verified in parallel before blocks are added one by one
+	var pending []Objects
+	process_pending := func() error {
+		preverify_pow(pending)
+		defer func() { pending = pending[:0] }()
+		for _, oresponse := range pending {
+			if err := connection.process_object_response(oresponse, 0, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
 	connection.logger.V(2).Info("response block list", "count", len(response.Block_list))
 	for i := range response.Block_list {
 		our_topo_order := chain.Load_Block_Topological_order(response.Block_list[i])
@@ -271,10 +329,13 @@ try_again:
 				fill_common(&orequest.Common)
 				if err := connection.Client.Call("Peer.GetObject", orequest, &oresponse); err != nil {
 					connection.logger.V(2).Error(err, "Call failed GetObject")
+					process_pending() // blocks already fetched are still useful
 					return
 				} else { // process the response
-					if err = connection.process_object_response(oresponse, 0, true); err != nil {
-						return
+					if pending = append(pending, oresponse); len(pending) >= SYNC_PREVERIFY_BATCH {
+						if err = process_pending(); err != nil {
+							return
+						}
 					}
 				}
 
@@ -284,6 +345,9 @@ try_again:
 			connection.logger.V(3).Info("We must have queued but we skipped it at height", "blid", fmt.Sprintf("%x", response.Block_list[i]), "height", response.Start_height+int64(i))
 		}
 	}
+	if err := process_pending(); err != nil {
+		return
+	}
 
 	// request alt-tips ( blocks if we are nearing the main tip )
 	/*if (response.Common.TopoHeight - chain.Load_TOPO_HEIGHT()) <= 5 {
@@ -299,6 +363,20 @@ try_again:
 
 }
 
+// compute PoW of miniblocks of fetched blocks in parallel, blocks which cannot be decoded are left for normal processing
+func preverify_pow(responses []Objects) {
+	var mbls []block.MiniBlock
+	for _, response := range responses {
+		for i := range response.CBlocks {
+			var bl block.Block
+			if err := bl.Deserialize(response.CBlocks[i].Block); err == nil {
+				mbls = append(mbls, bl.MiniBlocks...)
+			}
+		}
+	}
+	chain.PreVerify_MiniBlocks_PoW(mbls)
+}
+
 func (connection *Connection) process_object_response(response Objects, sent int64, syncing bool) error {
 	var err error
 	defer globals.Recover(2)
@@ -352,8 +430,7 @@ func (connection *Connection) process_object_response(response Objects, sent int
 		// check if we can add ourselves to chain
 		err, ok := chain.Add_Complete_Block(&cbl)
 		if !ok && err == errormsg.ErrInvalidPoW {
-			connection.logger.V(2).Error(err, "This peer should be banned")
-			connection.exit()
+			connection.ban(err)
 			if syncing {
 				return nil
 			} else {
@@ -390,7 +467,8 @@ func (connection *Connection) process_object_response(response Objects, sent int
 		}
 
 		if !chain.Mempool.Mempool_TX_Exist(tx.GetHash()) { // we still donot have it, so try to process it
-			if chain.Add_TX_To_Pool(&tx) == nil { // currently we are ignoring error
+			source := mempool.TX_Source{Peer: connection.Peer_ID, IP: Address(connection)}
+			if chain.Add_TX_To_Pool_Source(&tx, source) == nil { // currently we are ignoring error
 				broadcast_Tx(&tx, 0, sent)
 			}
 		}
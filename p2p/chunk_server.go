@@ -63,10 +63,10 @@ func (connection *Connection) feed_chunk(chunk *Block_Chunk, sent int64) error {
 	chunk_lock.Lock()
 	defer chunk_lock.Unlock()
 
-	if chunk.HHash != chunk.HeaderHash() {
-		connection.logger.V(2).Info("This peer should be banned, since he supplied wrong chunk")
-		connection.exit()
-		return fmt.Errorf("Corrupted Chunk")
+	if chunk.HHash != chunk.HeaderHash() { // peer supplied wrong chunk
+		err := fmt.Errorf("Corrupted Chunk")
+		connection.ban(err)
+		return err
 	}
 
 	if chunk.CHUNK_COUNT > uint(MAX_CHUNKS) || chunk.CHUNK_NEED > chunk.CHUNK_COUNT {
@@ -93,7 +93,9 @@ func (connection *Connection) feed_chunk(chunk *Block_Chunk, sent int64) error {
 	}
 
 	if chunk.CHUNK_HASH[chunk.CHUNK_ID] != crypto.Keccak256_64(chunk.CHUNK_DATA) { // chunk data corrupt
-		return fmt.Errorf("Corrupted Chunk")
+		err := fmt.Errorf("Corrupted Chunk")
+		connection.ban(err)
+		return err
 	}
 
 	if nil != is_chunk_exist(chunk.HHash, uint8(chunk.CHUNK_ID)) { // chunk already exists return
@@ -271,27 +273,31 @@ func Convert_CBL_TO_P2PCBL(cbl *block.Complete_Block, processblock bool) []byte
 }
 
 // convert p2p complete block to complete block format
-func Convert_P2PCBL_TO_CBL(input []byte) *block.Complete_Block {
+func Convert_P2PCBL_TO_CBL(input []byte) (*block.Complete_Block, error) {
 	var cbor_cbl Complete_Block
 	cbl := &block.Complete_Block{Bl: &block.Block{}}
 
 	if err := cbor.Unmarshal(input, &cbor_cbl); err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	if err := cbl.Bl.Deserialize(cbor_cbl.Block); err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	if len(cbor_cbl.Txs) != len(cbl.Bl.Tx_hashes) {
+		return nil, fmt.Errorf("invalid complete block, expected %d txs actual %d", len(cbl.Bl.Tx_hashes), len(cbor_cbl.Txs))
 	}
 
 	for _, tx_bytes := range cbor_cbl.Txs {
 		var tx transaction.Transaction
 		if err := tx.Deserialize(tx_bytes); err != nil {
-			panic(err)
+			return nil, err
 		}
 		cbl.Txs = append(cbl.Txs, &tx)
 	}
 
-	return cbl
+	return cbl, nil
 }
 
 // note we do not send complete block,
@@ -13,6 +13,9 @@ func fill_common(common *Common_Struct) {
 	//common.StableHeight = chain.Get_Stable_Height()
 	common.TopoHeight = chain.Load_TOPO_HEIGHT()
 
+	chain.Prune_Mutex.RLock() // state versions must not change under us
+	defer chain.Prune_Mutex.RUnlock()
+
 	version, err := chain.ReadBlockSnapshotVersion(chain.Get_Top_ID())
 	if err != nil {
 		panic(err)
@@ -85,6 +85,8 @@ type Connection struct {
 	Incoming        bool     // is connection incoming or outgoing
 	Addr            net.Addr // endpoint on the other end
 	SyncNode        bool     // whether the peer has been added to command line as sync node
+	Dandelion       bool     // whether the peer can relay txs in stem phase
+	StateVerify     bool     // whether the peer provides state and section hashes for fastsync verification
 	ProtocolVersion string
 	Tag             string // tag for the other end
 	DaemonVersion   string
@@ -113,9 +115,21 @@ func Address(c *Connection) string {
 	if c.Addr == nil {
 		return ""
 	}
+	if a, ok := c.Addr.(*AnonAddr); ok { // anonymous peers are identified by their onion/i2p host
+		return a.Host
+	}
 	return ParseIPNoError(c.Addr.String())
 }
 
+// key of connection in connection map, same as Address
+// except incoming anonymous connections, which all share the proxy host and are kept apart by their endpoint
+func connection_key(c *Connection) string {
+	if a, ok := c.Addr.(*AnonAddr); ok && !IsAnonymousAddress(a.Host) {
+		return a.Endpoint
+	}
+	return Address(c)
+}
+
 func (c *Connection) exit() {
 	defer globals.Recover(0)
 	c.onceexit.Do(func() {
@@ -131,7 +145,7 @@ func Connection_Delete(c *Connection) {
 	connection_map.Range(func(k, value interface{}) bool {
 		v := value.(*Connection)
 		if c.Addr.String() == v.Addr.String() {
-			connection_map.Delete(Address(v))
+			connection_map.Delete(connection_key(v))
 			return false
 		}
 		return true
@@ -176,7 +190,7 @@ func IsAddressConnected(address string) bool {
 // same ip max 8 ip ( considering NAT)
 //same Peer ID   4
 func Connection_Add(c *Connection) bool {
-	if dup, ok := connection_map.LoadOrStore(Address(c), c); !ok {
+	if dup, ok := connection_map.LoadOrStore(connection_key(c), c); !ok {
 		c.Created = time.Now()
 		c.logger.V(3).Info("IP address being added", "ip", c.Addr.String())
 		return true
@@ -249,12 +263,15 @@ func Connection_Print() {
 		return true
 	})
 
+	chain.Prune_Mutex.RLock() // state versions must not change under us
 	version, err := chain.ReadBlockSnapshotVersion(chain.Get_Top_ID())
 	if err != nil {
+		chain.Prune_Mutex.RUnlock()
 		panic(err)
 	}
 
 	StateHash, err := chain.Load_Merkle_Hash(version)
+	chain.Prune_Mutex.RUnlock()
 
 	if err != nil {
 		panic(err)
@@ -318,6 +335,8 @@ func Connection_Print() {
 
 	avg_latency := sum_latency / int64(len(clist))
 	fmt.Printf("Average Latency: %7s\n", time.Duration(avg_latency).Round(time.Millisecond).String())
+
+	Traffic_Print()
 }
 
 // for continuos update on command line, get the maximum height of all peers
@@ -711,8 +730,7 @@ func trigger_sync() {
 						connection.logger.V(1).Info("sync done")
 
 					} else { // we need a state only sync, bootstrap without history but verified chain
-						connection.bootstrap_chain()
-						chain.Sync = true
+						connection.bootstrap_chain() // sets sync mode on success, otherwise retried later
 					}
 					break
 				}
@@ -0,0 +1,305 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package p2p
+
+/* this file implements dandelion++ style tx propagation https://arxiv.org/abs/1805.11060
+ * a tx is first passed along a random path (stem phase) and only then flooded to everyone (fluff phase)
+ * this hides the originating node from well connected observers
+ * stem txs are not placed in mempool, so they cannot be requested by anyone using GetObject
+ * every node keeping a stem tx keeps an embargo timer, if the tx is not seen in fluff phase before
+ * the timer expires, the node fluffs it itself, so a black holing peer cannot drop txs
+ */
+import "fmt"
+import "sync"
+import "time"
+import "strconv"
+import "context"
+import "sync/atomic"
+
+import "github.com/deroproject/derohe/globals"
+import "github.com/deroproject/derohe/metrics"
+import "github.com/deroproject/derohe/transaction"
+import "github.com/deroproject/derohe/cryptography/crypto"
+
+const FLAG_DANDELION = "DANDELION" // handshake flag, peer supports Peer.NotifyStem
+
+const DANDELION_EPOCH = 10 * time.Minute // relays are chosen again every epoch
+const DANDELION_RELAYS = 2               // number of outgoing stem relays per epoch
+const DANDELION_MAX_STEM = 4096          // max stem txs held, beyond this everything is fluffed
+
+var dandelion_enabled bool                  // whether locally submitted txs are stemmed
+var dandelion_fluff_probability = int64(10) // probability in percent that a node fluffs a stem tx
+var dandelion_embargo = 30 * time.Second    // base embargo, random upto same value is added
+
+type stem_tx struct {
+	tx      *transaction.Transaction
+	embargo time.Time // if tx is not fluffed by this time, we fluff it ourselves
+}
+
+var dandelion_mutex sync.Mutex
+var stem_pool = map[crypto.Hash]*stem_tx{}
+var stem_epoch time.Time              // when current epoch started
+var stem_relays []uint64              // peer ids of relays chosen for this epoch
+var stem_routes = map[uint64]uint64{} // source peer id to relay peer id, 0 is used for local txs
+
+// setup dandelion from command line
+func dandelion_init() {
+	if _, ok := globals.Arguments["--dandelion"]; ok && globals.Arguments["--dandelion"] != nil {
+		dandelion_enabled = globals.Arguments["--dandelion"].(bool)
+	}
+
+	if _, ok := globals.Arguments["--dandelion-fluff"]; ok && globals.Arguments["--dandelion-fluff"] != nil {
+		i, err := strconv.ParseInt(globals.Arguments["--dandelion-fluff"].(string), 10, 64)
+		if err != nil || i < 0 || i > 100 {
+			logger.Error(fmt.Errorf("--dandelion-fluff should be between 0 and 100"), "using default", "dandelion-fluff", dandelion_fluff_probability)
+		} else {
+			dandelion_fluff_probability = i
+		}
+	}
+
+	if _, ok := globals.Arguments["--dandelion-embargo"]; ok && globals.Arguments["--dandelion-embargo"] != nil {
+		i, err := strconv.ParseInt(globals.Arguments["--dandelion-embargo"].(string), 10, 64)
+		if err != nil || i < 1 {
+			logger.Error(fmt.Errorf("--dandelion-embargo should be positive seconds"), "using default", "dandelion-embargo", dandelion_embargo)
+		} else {
+			dandelion_embargo = time.Duration(i) * time.Second
+		}
+	}
+
+	if dandelion_enabled {
+		logger.Info("Dandelion is enabled, local txs will be stemmed", "fluff_probability", dandelion_fluff_probability, "embargo", dandelion_embargo)
+	}
+
+	globals.Cron.AddFunc("@every 1s", dandelion_embargo_check)
+}
+
+// whether local txs are stemmed
+func IsDandelionEnabled() bool {
+	return dandelion_enabled
+}
+
+// count of txs currently in stem phase
+func Stem_Count() int {
+	dandelion_mutex.Lock()
+	defer dandelion_mutex.Unlock()
+	return len(stem_pool)
+}
+
+// a locally submitted tx, verify it and start stem phase
+func Stem_Tx(tx *transaction.Transaction) error {
+	if err := chain.Verify_TX_For_Pool(tx); err != nil {
+		return err
+	}
+	stem_relay_tx(tx, 0)
+	return nil
+}
+
+// choose relays for this epoch, if not done already or if some relay has gone away
+// dandelion_mutex must be held
+func stem_choose_relays() {
+	unique_map := UniqueConnections()
+
+	if time.Since(stem_epoch) < DANDELION_EPOCH {
+		alive := 0
+		for _, id := range stem_relays {
+			if _, ok := unique_map[id]; ok {
+				alive++
+			}
+		}
+		if alive == len(stem_relays) && alive >= 1 {
+			return
+		}
+	}
+
+	our_height := chain.Get_Height()
+	var outgoing, incoming []uint64
+	for _, v := range unique_map {
+		peer_height := atomic.LoadInt64(&v.Height)
+		if !v.Dandelion || (our_height-peer_height) > 25 || (our_height+5) < peer_height {
+			continue
+		}
+		if v.Incoming {
+			incoming = append(incoming, v.Peer_ID)
+		} else {
+			outgoing = append(outgoing, v.Peer_ID)
+		}
+	}
+
+	// outgoing connections are prefered, since they are chosen by us and are harder to sybil
+	globals.Global_Random.Shuffle(len(outgoing), func(i, j int) { outgoing[i], outgoing[j] = outgoing[j], outgoing[i] })
+	globals.Global_Random.Shuffle(len(incoming), func(i, j int) { incoming[i], incoming[j] = incoming[j], incoming[i] })
+	candidates := append(outgoing, incoming...)
+	if len(candidates) > DANDELION_RELAYS {
+		candidates = candidates[:DANDELION_RELAYS]
+	}
+
+	stem_relays = candidates
+	stem_routes = map[uint64]uint64{}
+	stem_epoch = time.Now()
+	logger.V(2).Info("dandelion relays chosen", "relays", len(stem_relays))
+}
+
+// finds the relay for txs from this source, every source is mapped to a single relay during an epoch
+func stem_route(source uint64) *Connection {
+	dandelion_mutex.Lock()
+	defer dandelion_mutex.Unlock()
+
+	stem_choose_relays()
+	if len(stem_relays) == 0 {
+		return nil
+	}
+
+	relay, ok := stem_routes[source]
+	if !ok {
+		relay = stem_relays[globals.Global_Random.Intn(len(stem_relays))]
+		stem_routes[source] = relay
+	}
+
+	if c, ok := UniqueConnections()[relay]; ok && relay != source {
+		return c
+	}
+	return nil
+}
+
+// keep tx under embargo and pass it to our relay, if anything fails tx is fluffed
+func stem_relay_tx(tx *transaction.Transaction, source uint64) {
+	txhash := tx.GetHash()
+
+	dandelion_mutex.Lock()
+	if _, ok := stem_pool[txhash]; !ok {
+		if len(stem_pool) >= DANDELION_MAX_STEM {
+			dandelion_mutex.Unlock()
+			fluff_tx(tx)
+			return
+		}
+		embargo := dandelion_embargo + time.Duration(globals.Global_Random.Int63n(int64(dandelion_embargo)))
+		stem_pool[txhash] = &stem_tx{tx: tx, embargo: time.Now().Add(embargo)}
+	}
+	dandelion_mutex.Unlock()
+
+	connection := stem_route(source)
+	if connection == nil {
+		fluff_tx(tx)
+		return
+	}
+
+	go func() {
+		defer globals.Recover(3)
+		var request Objects
+		var response Dummy
+		fill_common(&request.Common) // fill common info
+		request.Txs = append(request.Txs, tx.Serialize())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := connection.Client.CallWithContext(ctx, "Peer.NotifyStem", request, &response); err != nil {
+			connection.logger.V(2).Error(err, "stem relay failed, fluffing tx", "txid", txhash)
+			fluff_tx(tx)
+			return
+		}
+		connection.update(&response.Common) // update common information
+		metrics.Set.GetOrCreateCounter("p2p_dandelion_stem_total").Inc()
+	}()
+}
+
+// end stem phase, add tx to mempool and flood it to everyone
+func fluff_tx(tx *transaction.Transaction) {
+	txhash := tx.GetHash()
+
+	dandelion_mutex.Lock()
+	delete(stem_pool, txhash)
+	dandelion_mutex.Unlock()
+
+	if chain.Mempool.Mempool_TX_Exist(txhash) {
+		return
+	}
+	if err := chain.Add_TX_To_Pool(tx); err != nil {
+		logger.V(2).Error(err, "stem tx could not be fluffed", "txid", txhash)
+		return
+	}
+	metrics.Set.GetOrCreateCounter("p2p_dandelion_fluff_total").Inc()
+	broadcast_Tx(tx, 0, globals.Time().UTC().UnixMicro())
+}
+
+// drop txs which have been seen in fluff phase, fluff those whose embargo has expired
+func dandelion_embargo_check() {
+	defer globals.Recover(3)
+
+	var expired []*transaction.Transaction
+
+	dandelion_mutex.Lock()
+	for txhash, stx := range stem_pool {
+		if chain.Mempool.Mempool_TX_Exist(txhash) { // tx has been fluffed by someone
+			delete(stem_pool, txhash)
+			continue
+		}
+		if _, err := chain.Store.Block_tx_store.ReadTX(txhash); err == nil { // already mined
+			delete(stem_pool, txhash)
+			continue
+		}
+		if time.Now().After(stx.embargo) {
+			expired = append(expired, stx.tx)
+		}
+	}
+	dandelion_mutex.Unlock()
+
+	for _, tx := range expired {
+		logger.V(2).Info("stem tx embargo expired, fluffing", "txid", tx.GetHash())
+		metrics.Set.GetOrCreateCounter("p2p_dandelion_embargo_total").Inc()
+		fluff_tx(tx)
+	}
+}
+
+// handles txs in stem phase, verify and then either continue stem or fluff
+func (c *Connection) NotifyStem(request Objects, response *Dummy) (err error) {
+	defer handle_connection_panic(c)
+	if len(request.Txs) != 1 || len(request.CBlocks) != 0 || len(request.MiniBlocks) != 0 || len(request.Chunks) != 0 {
+		err = fmt.Errorf("NotifyStem can carry a single tx only")
+		c.ban(err)
+		return err
+	}
+	c.update(&request.Common) // update common information
+
+	var tx transaction.Transaction
+	if err = tx.Deserialize(request.Txs[0]); err != nil {
+		c.logger.V(2).Error(err, "Incoming stem TX could not be deserilised")
+		c.exit()
+		return err
+	}
+
+	txhash := tx.GetHash()
+
+	dandelion_mutex.Lock()
+	_, already_stemmed := stem_pool[txhash]
+	dandelion_mutex.Unlock()
+
+	if !already_stemmed && !chain.Mempool.Mempool_TX_Exist(txhash) {
+		if err = chain.Verify_TX_For_Pool(&tx); err != nil {
+			c.logger.V(2).Error(err, "Incoming stem TX could not be verified", "txid", txhash)
+			return err
+		}
+
+		if globals.Global_Random.Int63n(100) < dandelion_fluff_probability {
+			fluff_tx(&tx)
+		} else {
+			stem_relay_tx(&tx, c.Peer_ID)
+		}
+	}
+
+	fill_common(&response.Common) // fill common info
+	return nil
+}
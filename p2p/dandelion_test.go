@@ -0,0 +1,163 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package p2p
+
+import "fmt"
+import "time"
+import "strings"
+import "testing"
+
+import "github.com/deroproject/derohe/walletapi"
+import "github.com/deroproject/derohe/transaction"
+import "github.com/deroproject/derohe/cryptography/crypto"
+
+// registration txs are valid on their own and land in regpool once fluffed, so they are used as test txs
+func dandelion_test_tx(t *testing.T) *transaction.Transaction {
+	w, err := walletapi.Create_Encrypted_Wallet_Random_Memory("")
+	if err != nil {
+		t.Fatalf("cannot create wallet err %s", err)
+	}
+	return w.GetRegistrationTX()
+}
+
+// adds a fake active connection, only fields used by relay selection are set
+func dandelion_test_connection(id uint64, incoming, dandelion bool, height int64) *Connection {
+	c := &Connection{Peer_ID: id, Incoming: incoming, Dandelion: dandelion, Height: height, State: ACTIVE}
+	connection_map.Store(fmt.Sprintf("dandelion%d", id), c)
+	return c
+}
+
+func dandelion_test_reset() {
+	connection_map.Range(func(k, value interface{}) bool {
+		if key, ok := k.(string); ok && strings.HasPrefix(key, "dandelion") {
+			connection_map.Delete(k)
+		}
+		return true
+	})
+	dandelion_mutex.Lock()
+	stem_pool = map[crypto.Hash]*stem_tx{}
+	stem_epoch = time.Time{}
+	stem_relays = nil
+	stem_routes = map[uint64]uint64{}
+	dandelion_mutex.Unlock()
+}
+
+// relays are dandelion peers near our height, outgoing ones prefered, every source sticks to one relay
+func Test_Dandelion_Relay_Selection(t *testing.T) {
+	harness_chain_start(t)
+	defer dandelion_test_reset()
+	dandelion_test_reset()
+
+	height := chain.Get_Height()
+	dandelion_test_connection(101, false, true, height)
+	dandelion_test_connection(102, false, true, height)
+	dandelion_test_connection(103, false, true, height)
+	dandelion_test_connection(104, true, true, height)       // incoming
+	dandelion_test_connection(105, false, false, height)     // does not support dandelion
+	dandelion_test_connection(106, false, true, height+1000) // far away from our height
+
+	dandelion_mutex.Lock()
+	stem_choose_relays()
+	relays := append([]uint64{}, stem_relays...)
+	dandelion_mutex.Unlock()
+
+	if len(relays) != DANDELION_RELAYS {
+		t.Fatalf("expected %d relays, got %v", DANDELION_RELAYS, relays)
+	}
+	for _, id := range relays {
+		if id < 101 || id > 103 {
+			t.Fatalf("relay %d chosen while better outgoing dandelion peers exist", id)
+		}
+	}
+
+	first := stem_route(7)
+	for i := 0; i < 16; i++ {
+		if c := stem_route(7); c == nil || first == nil || c.Peer_ID != first.Peer_ID {
+			t.Fatalf("source must be routed to a single relay during an epoch")
+		}
+	}
+	for _, id := range relays {
+		if c := stem_route(id); c != nil && c.Peer_ID == id {
+			t.Fatalf("stem tx must never be relayed back to its source")
+		}
+	}
+
+	// relays went away, remaining incoming peer is chosen
+	for _, id := range []uint64{101, 102, 103} {
+		connection_map.Delete(fmt.Sprintf("dandelion%d", id))
+	}
+	if c := stem_route(8); c == nil || c.Peer_ID != 104 {
+		t.Fatalf("relays must be chosen again once they disconnect")
+	}
+}
+
+// txs whose embargo expired are fluffed, others stay in stem phase
+func Test_Dandelion_Embargo(t *testing.T) {
+	harness_chain_start(t)
+	defer dandelion_test_reset()
+	dandelion_test_reset()
+
+	expired, waiting := dandelion_test_tx(t), dandelion_test_tx(t)
+	dandelion_mutex.Lock()
+	stem_pool[expired.GetHash()] = &stem_tx{tx: expired, embargo: time.Now().Add(-time.Second)}
+	stem_pool[waiting.GetHash()] = &stem_tx{tx: waiting, embargo: time.Now().Add(time.Hour)}
+	dandelion_mutex.Unlock()
+	defer chain.Regpool.Regpool_Delete_TX(expired.GetHash())
+
+	dandelion_embargo_check()
+
+	if !chain.Regpool.Regpool_TX_Exist(expired.GetHash()) {
+		t.Fatalf("tx whose embargo expired must be fluffed")
+	}
+	if chain.Regpool.Regpool_TX_Exist(waiting.GetHash()) || Stem_Count() != 1 {
+		t.Fatalf("tx under embargo must stay in stem phase")
+	}
+}
+
+// invalid stem txs are rejected without being stemmed or fluffed, malformed messages lead to ban
+func Test_Dandelion_NotifyStem(t *testing.T) {
+	defer dandelion_test_reset()
+	p := harness_peer(t, map[string]interface{}{})
+	defer p.close()
+	dandelion_test_reset()
+
+	old_probability := dandelion_fluff_probability
+	defer func() { dandelion_fluff_probability = old_probability }()
+	dandelion_fluff_probability = 100 // anything accepted would be fluffed right away
+
+	invalid := dandelion_test_tx(t)
+	invalid.S[0] ^= 0xff // signature no longer verifies
+	var response Dummy
+	if err := p.client.Call("Peer.NotifyStem", Objects{Txs: [][]byte{invalid.Serialize()}}, &response); err == nil {
+		t.Fatalf("stem tx with invalid signature must be rejected")
+	}
+	if Stem_Count() != 0 || chain.Regpool.Regpool_TX_Exist(invalid.GetHash()) {
+		t.Fatalf("invalid stem tx must neither be stemmed nor fluffed")
+	}
+
+	registration := dandelion_test_tx(t) // registrations are never stemmed
+	if err := p.client.Call("Peer.NotifyStem", Objects{Txs: [][]byte{registration.Serialize()}}, &response); err == nil {
+		t.Fatalf("registration must not be accepted as stem tx")
+	}
+	if Stem_Count() != 0 || chain.Regpool.Regpool_TX_Exist(registration.GetHash()) {
+		t.Fatalf("rejected stem tx must neither be stemmed nor fluffed")
+	}
+
+	// a stem message carries exactly one tx
+	p.client.Call("Peer.NotifyStem", Objects{Txs: [][]byte{registration.Serialize(), invalid.Serialize()}}, &response)
+	p.must_be_banned(t)
+}
@@ -0,0 +1,87 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package p2p
+
+// fuzz targets for data received from peers, run using
+// go test -fuzz=FuzzBlock_Chunk ./p2p/
+// seeds are run as part of normal tests
+import "testing"
+
+import "github.com/fxamacker/cbor/v2"
+
+import "github.com/deroproject/derohe/block"
+import "github.com/deroproject/derohe/blockchain"
+
+// chunks are fed as received from a peer, node must ban or ignore, never panic
+func FuzzBlock_Chunk(f *testing.F) {
+	harness_chain_start(f)
+
+	f.Add(must_marshal(bogus_chunk([]byte("chunk data"))))
+	valid := bogus_chunk([]byte("chunk data"))
+	valid.CHUNK_HASH[0] = 0
+	f.Add(must_marshal(valid))
+	f.Add([]byte{0xa0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var chunk Block_Chunk
+		if err := cbor.Unmarshal(data, &chunk); err != nil {
+			return
+		}
+		p := harness_peer(t, nil)
+		defer p.close()
+		p.node.feed_chunk(&chunk, 0)
+	})
+}
+
+// blocks in p2p format, must decode or return error
+func FuzzConvert_P2PCBL_TO_CBL(f *testing.F) {
+	genesis := blockchain.Generate_Genesis_Block()
+	f.Add(Convert_CBL_TO_P2PCBL(&block.Complete_Block{Bl: &genesis}, true))
+	f.Add(must_marshal(Complete_Block{Block: genesis.Serialize(), Txs: [][]byte{{0x01, 0x02}}}))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cbl, err := Convert_P2PCBL_TO_CBL(data)
+		if err != nil {
+			return
+		}
+		if cbl.Bl == nil || len(cbl.Txs) != len(cbl.Bl.Tx_hashes) {
+			t.Fatalf("decoded block is inconsistent")
+		}
+	})
+}
+
+// handshakes are the first data received from any peer
+func FuzzHandshake_Struct(f *testing.F) {
+	harness_chain_start(f)
+
+	var handshake Handshake_Struct
+	handshake.Fill()
+	f.Add(must_marshal(handshake))
+	handshake.DaemonVersion = "3.4.0"
+	f.Add(must_marshal(handshake))
+	handshake.DaemonVersion = "not a version"
+	f.Add(must_marshal(handshake))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var handshake Handshake_Struct
+		if err := cbor.Unmarshal(data, &handshake); err != nil {
+			return
+		}
+		Verify_Handshake(&handshake)
+	})
+}
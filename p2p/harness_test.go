@@ -0,0 +1,371 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package p2p
+
+// in-process harness, our node talks to scriptable peers over net.Pipe
+// peers may misbehave in any way, the node must ban them and never panic
+import "os"
+import "net"
+import "sync"
+import "time"
+import "testing"
+import "path/filepath"
+import "sync/atomic"
+import "encoding/binary"
+
+import "github.com/cenkalti/rpc2"
+import "github.com/go-logr/logr"
+import "github.com/fxamacker/cbor/v2"
+
+import "github.com/deroproject/derohe/config"
+import "github.com/deroproject/derohe/globals"
+import "github.com/deroproject/derohe/blockchain"
+
+var harness_once sync.Once
+var harness_directory = filepath.Join(os.TempDir(), "dp2pharness")
+
+// starts a chain in simulator mode, which is used by our node
+// chain is started once and shared by all tests of the package
+func harness_chain_start(t testing.TB) {
+	harness_once.Do(func() {
+		logger = logr.Discard()
+		globals.Arguments = map[string]interface{}{"--testnet": true, "--simulator": true, "--data-dir": harness_directory}
+		os.RemoveAll(harness_directory)
+		globals.Initialize() // setup network
+
+		var err error
+		if chain, err = blockchain.Blockchain_Start(map[string]interface{}{"--simulator": true}); err != nil {
+			panic(err)
+		}
+	})
+	if chain == nil {
+		t.Fatalf("harness chain could not be started")
+	}
+}
+
+// a peer connected to our node
+type test_peer struct {
+	node   *Connection  // connection as seen by our node
+	client *rpc2.Client // rpc client of the peer, nil if peer only sends raw data
+	conn   net.Conn     // peer side of the pipe
+}
+
+var harness_peer_count uint32 // every peer gets a unique address, so bans do not leak between peers
+
+// connects a peer to our node, handlers are installed on the peer before it starts
+// if handlers is nil, peer does not run rpc and can write raw frames on conn
+func harness_peer(t testing.TB, handlers map[string]interface{}) *test_peer {
+	harness_chain_start(t)
+
+	node_side, peer_side := net.Pipe()
+
+	n := atomic.AddUint32(&harness_peer_count, 1)
+	addr := &net.TCPAddr{IP: net.IPv4(10, 29, byte(n>>8), byte(n)), Port: 18089}
+
+	codec := NewCBORCodec(node_side)
+	client := rpc2.NewClientWithCodec(codec)
+	c := &Connection{Client: client, Conn: node_side, ConnTls: node_side, Addr: addr, State: ACTIVE, Incoming: true, Created: time.Now()}
+	c.logger = logger.WithName("harness")
+	codec.Attach(c)
+	set_handlers(client)
+	client.State = rpc2.NewState()
+	client.State.Set("c", c)
+	go client.Run()
+
+	p := &test_peer{node: c, conn: peer_side}
+	if handlers != nil {
+		p.client = rpc2.NewClientWithCodec(NewCBORCodec(peer_side))
+		for method, handler := range handlers {
+			p.client.Handle(method, handler)
+		}
+		go p.client.Run()
+	}
+	return p
+}
+
+func (p *test_peer) close() {
+	p.node.exit()
+	p.conn.Close()
+}
+
+// whether our node has disconnected the peer
+func (p *test_peer) disconnected(timeout time.Duration) bool {
+	select {
+	case <-p.node.Client.DisconnectNotify():
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// peer must be disconnected and banned
+func (p *test_peer) must_be_banned(t *testing.T) {
+	t.Helper()
+	if !p.disconnected(5 * time.Second) {
+		t.Fatalf("misbehaving peer was not disconnected")
+	}
+	if !IsAddressInBanList(Address(p.node)) {
+		t.Fatalf("misbehaving peer %s was not banned", Address(p.node))
+	}
+}
+
+// writes a length prefixed frame, raw data is not checked in any way
+func (p *test_peer) write_raw(frames ...[]byte) {
+	go func() {
+		for _, frame := range frames {
+			var length [4]byte
+			binary.LittleEndian.PutUint32(length[:], uint32(len(frame)))
+			if _, err := p.conn.Write(append(length[:], frame...)); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func must_marshal(obj interface{}) []byte {
+	data, err := cbor.Marshal(obj)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// frames which can never be valid lead to ban, while broken connections do not
+func Test_Malicious_Frames(t *testing.T) {
+	garbage := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+	{ // frame length larger than allowed
+		p := harness_peer(t, nil)
+		var length [4]byte
+		binary.LittleEndian.PutUint32(length[:], uint32(5*config.STARGATE_HE_MAX_BLOCK_SIZE+1))
+		go p.conn.Write(length[:])
+		p.must_be_banned(t)
+	}
+
+	{ // header cannot be decoded
+		p := harness_peer(t, nil)
+		p.write_raw(garbage)
+		p.must_be_banned(t)
+	}
+
+	{ // valid header, body cannot be decoded
+		p := harness_peer(t, nil)
+		p.write_raw(must_marshal(RequestResponse{Method: "Peer.Ping", Seq: 1}), garbage)
+		p.must_be_banned(t)
+	}
+
+	{ // valid header, body is of wrong type
+		p := harness_peer(t, nil)
+		p.write_raw(must_marshal(RequestResponse{Method: "Peer.Chain", Seq: 1}), must_marshal([]string{"not", "a", "chain"}))
+		p.must_be_banned(t)
+	}
+
+	{ // truncated frame is a network error, peer is only disconnected
+		p := harness_peer(t, nil)
+		go func() {
+			var length [4]byte
+			binary.LittleEndian.PutUint32(length[:], 100)
+			p.conn.Write(append(length[:], garbage...))
+			p.conn.Close()
+		}()
+		if !p.disconnected(5 * time.Second) {
+			t.Fatalf("broken peer was not disconnected")
+		}
+		if IsAddressInBanList(Address(p.node)) {
+			t.Fatalf("peer with broken connection must not be banned")
+		}
+	}
+}
+
+// requests and announcements with too many objects lead to ban
+func Test_Malicious_Oversized_ObjectList(t *testing.T) {
+	var request ObjectList
+	for i := 0; i <= MAX_OBJECTS_PER_LIST; i++ {
+		var txhash [32]byte
+		binary.BigEndian.PutUint32(txhash[:], uint32(i))
+		request.Tx_list = append(request.Tx_list, txhash)
+	}
+
+	for _, method := range []string{"Peer.GetObject", "Peer.NotifyINV"} {
+		p := harness_peer(t, map[string]interface{}{})
+		var response Objects
+		if err := p.client.Call(method, request, &response); err == nil {
+			t.Fatalf("%s with %d objects must fail", method, len(request.Tx_list))
+		}
+		p.must_be_banned(t)
+	}
+
+	{ // empty request is also malformed
+		p := harness_peer(t, map[string]interface{}{})
+		var response Objects
+		p.client.Call("Peer.GetObject", ObjectList{}, &response)
+		p.must_be_banned(t)
+	}
+}
+
+// builds a chunk whose header is self consistent
+func bogus_chunk(data []byte) Block_Chunk {
+	chunk := Block_Chunk{DSIZE: 1024, BLOCK: []byte("not a block"), CHUNK_COUNT: 48, CHUNK_NEED: 16, CHUNK_DATA: data}
+	chunk.BLID[0] = 0xaa
+	for i := 0; i < int(chunk.CHUNK_COUNT); i++ {
+		chunk.CHUNK_HASH = append(chunk.CHUNK_HASH, uint64(i))
+	}
+	chunk.HHash = chunk.HeaderHash()
+	return chunk
+}
+
+// chunks with corrupted header or data, supplied on request, lead to ban
+func Test_Malicious_Bogus_Chunk(t *testing.T) {
+	corrupted_header := bogus_chunk([]byte("chunk data"))
+	corrupted_header.HHash[0]++
+
+	for _, chunk := range []Block_Chunk{corrupted_header, bogus_chunk([]byte("chunk data"))} {
+		chunk := chunk
+		p := harness_peer(t, map[string]interface{}{
+			"Peer.GetObject": func(client *rpc2.Client, args ObjectList, reply *Objects) error {
+				reply.Chunks = append(reply.Chunks, chunk)
+				return nil
+			},
+		})
+
+		var inv ObjectList
+		var chunkid [32 + 1 + 32]byte
+		copy(chunkid[:], chunk.BLID[:])
+		chunkid[32] = byte(chunk.CHUNK_ID)
+		copy(chunkid[33:], chunk.HHash[:])
+		inv.Chunk_list = append(inv.Chunk_list, chunkid)
+
+		var response Dummy
+		p.client.Call("Peer.NotifyINV", inv, &response)
+		p.must_be_banned(t)
+	}
+}
+
+// chain responses which do not start at a block we sent, lead to ban
+func Test_Malicious_Conflicting_Chain(t *testing.T) {
+	harness_chain_start(t)
+	genesis, err := chain.Load_Block_Topological_order_at_index(0)
+	if err != nil {
+		t.Fatalf("genesis could not be loaded err %s", err)
+	}
+	var unknown [32]byte
+	unknown[0] = 0xbb
+
+	conflicting := []Chain_Response_Struct{
+		{Start_topoheight: 7, Block_list: [][32]byte{unknown}},                  // we never sent topoheight 7
+		{Start_topoheight: 0, Block_list: [][32]byte{unknown}},                  // genesis does not match
+		{Start_topoheight: 0, Start_height: 5, Block_list: [][32]byte{genesis}}, // height does not match
+		{Start_topoheight: -1},
+		{Block_list: make([][32]byte, 2048)},
+	}
+
+	for _, response := range conflicting {
+		response := response
+		p := harness_peer(t, map[string]interface{}{
+			"Peer.Chain": func(client *rpc2.Client, args Chain_Request_Struct, reply *Chain_Response_Struct) error {
+				*reply = response
+				return nil
+			},
+		})
+		p.node.sync_chain()
+		p.must_be_banned(t)
+	}
+
+	{ // an honest peer at the same height is not banned
+		p := harness_peer(t, map[string]interface{}{
+			"Peer.Chain": func(client *rpc2.Client, args Chain_Request_Struct, reply *Chain_Response_Struct) error {
+				if len(args.Block_list) < 1 || args.Block_list[len(args.Block_list)-1] != globals.Config.Genesis_Block_Hash {
+					t.Errorf("chain request must end with network genesis")
+				}
+				reply.Block_list = [][32]byte{genesis}
+				return nil
+			},
+		})
+		defer p.close()
+		p.node.sync_chain()
+		if p.disconnected(100*time.Millisecond) || IsAddressInBanList(Address(p.node)) {
+			t.Fatalf("honest peer must not be disconnected")
+		}
+	}
+}
+
+// malformed blocks or txs are reported as error instead of panicking
+func Test_Malicious_CBlock(t *testing.T) {
+	harness_chain_start(t)
+	genesis, err := chain.Load_Block_Topological_order_at_index(0)
+	if err != nil {
+		t.Fatalf("genesis could not be loaded err %s", err)
+	}
+	bl, err := chain.Load_BL_FROM_ID(genesis)
+	if err != nil {
+		t.Fatalf("genesis could not be loaded err %s", err)
+	}
+
+	if _, err := ConvertCBlock_To_CompleteBlock(Complete_Block{Block: bl.Serialize()}); err != nil {
+		t.Fatalf("valid block rejected err %s", err)
+	}
+	for _, cblock := range []Complete_Block{
+		{Block: []byte("garbage")},
+		{Block: bl.Serialize(), Txs: [][]byte{[]byte("garbage")}},
+	} {
+		if _, err := ConvertCBlock_To_CompleteBlock(cblock); err == nil {
+			t.Fatalf("malformed block accepted")
+		}
+	}
+}
+
+// response is validated against the blocks we sent, even if our chain reorganised meanwhile
+func Test_Chain_Response_After_Reorg(t *testing.T) {
+	harness_chain_start(t)
+	var reorged, other [32]byte // reorged was at topoheight 3 when request was sent, it is no longer in our topo order
+	reorged[0], other[0] = 0xcc, 0xdd
+
+	request := Chain_Request_Struct{Block_list: [][32]byte{reorged}, TopoHeights: []int64{3}}
+	if err := validate_chain_response(&request, &Chain_Response_Struct{Start_topoheight: 3, Block_list: [][32]byte{reorged}}); err != nil {
+		t.Fatalf("honest response rejected err %s", err)
+	}
+	if err := validate_chain_response(&request, &Chain_Response_Struct{Start_topoheight: 3, Block_list: [][32]byte{other}}); err == nil {
+		t.Fatalf("conflicting response accepted")
+	}
+}
+
+// handshakes with unparseable versions are rejected without panicking
+func Test_Malicious_Handshake(t *testing.T) {
+	harness_chain_start(t)
+
+	var handshake Handshake_Struct
+	handshake.Fill()
+	if !Verify_Handshake(&handshake) {
+		t.Fatalf("our own handshake must verify")
+	}
+
+	for _, version := range []string{"", "garbage", "3.4.0", "1.2.3.4"} {
+		handshake.DaemonVersion = version
+		if Verify_Handshake(&handshake) {
+			t.Fatalf("handshake with version %q must not verify", version)
+		}
+	}
+
+	p := harness_peer(t, map[string]interface{}{})
+	var response Handshake_Struct
+	if err := p.client.Call("Peer.Handshake", handshake, &response); err == nil {
+		t.Fatalf("handshake with invalid version must fail")
+	}
+	if !p.disconnected(5 * time.Second) {
+		t.Fatalf("peer with invalid handshake must be disconnected")
+	}
+}
@@ -293,7 +293,7 @@ func find_peer_to_connect(version int) *Peer {
 	for _, v := range peer_map {
 		if uint64(time.Now().Unix()) > v.BlacklistBefore && //  if ip is blacklisted skip it
 			uint64(time.Now().Unix()) > v.ConnectAfter &&
-			!IsAddressConnected(ParseIPNoError(v.Address)) && v.Whitelist && !IsAddressInBanList(ParseIPNoError(v.Address)) {
+			!IsAddressConnected(ParseIPNoError(v.Address)) && v.Whitelist && !IsAddressInBanList(ParseIPNoError(v.Address)) && is_peer_dialable(v.Address) {
 			v.ConnectAfter = uint64(time.Now().UTC().Unix()) + 10 // minimum 10 secs gap
 			return v
 		}
@@ -302,7 +302,7 @@ func find_peer_to_connect(version int) *Peer {
 	for _, v := range peer_map {
 		if uint64(time.Now().Unix()) > v.BlacklistBefore && //  if ip is blacklisted skip it
 			uint64(time.Now().Unix()) > v.ConnectAfter &&
-			!IsAddressConnected(ParseIPNoError(v.Address)) && !v.Whitelist && !IsAddressInBanList(ParseIPNoError(v.Address)) {
+			!IsAddressConnected(ParseIPNoError(v.Address)) && !v.Whitelist && !IsAddressInBanList(ParseIPNoError(v.Address)) && is_peer_dialable(v.Address) {
 			v.ConnectAfter = uint64(time.Now().UTC().Unix()) + 10 // minimum 10 secs gap
 			return v
 		}
@@ -7,6 +7,7 @@ import "io"
 import "net"
 import "sync"
 import "time"
+import "sync/atomic"
 import "github.com/cenkalti/rpc2"
 import "encoding/binary"
 import "github.com/fxamacker/cbor/v2"
@@ -23,6 +24,11 @@ type RequestResponse struct {
 const READ_TIMEOUT = 20 * time.Second
 const WRITE_TIMEOUT = 20 * time.Second
 
+// peer sent a frame which can never be valid, such peers are banned
+type malformed_frame_error struct {
+	error
+}
+
 var bufPool = &sync.Pool{
 	New: func() interface{} {
 		return new(bytes.Buffer)
@@ -31,26 +37,32 @@ var bufPool = &sync.Pool{
 
 // reads our data, length prefix blocks
 func Read_Data_Frame(r net.Conn, obj interface{}) error {
+	_, err := read_data_frame(r, obj)
+	return err
+}
+
+// reads our data, length prefix blocks, returns bytes consumed from wire
+func read_data_frame(r net.Conn, obj interface{}) (int, error) {
 	var frame_length_buf [4]byte
 
 	//connection.set_timeout()
 	r.SetReadDeadline(time.Now().Add(READ_TIMEOUT))
 	nbyte, err := io.ReadFull(r, frame_length_buf[:])
 	if err != nil {
-		return err
+		return nbyte, err
 	}
 	if nbyte != 4 {
-		return fmt.Errorf("needed 4 bytes, but got %d bytes", nbyte)
+		return nbyte, fmt.Errorf("needed 4 bytes, but got %d bytes", nbyte)
 	}
 
 	//  time to ban
 	frame_length := binary.LittleEndian.Uint32(frame_length_buf[:])
 	if frame_length == 0 {
-		return nil
+		return nbyte, nil
 	}
 	// most probably memory DDOS attack, kill the connection
 	if uint64(frame_length) > (5 * config.STARGATE_HE_MAX_BLOCK_SIZE) {
-		return fmt.Errorf("Frame length is too big Expected %d Actual %d", 5*config.STARGATE_HE_MAX_BLOCK_SIZE, frame_length)
+		return nbyte, malformed_frame_error{fmt.Errorf("Frame length is too big Expected %d Actual %d", 5*config.STARGATE_HE_MAX_BLOCK_SIZE, frame_length)}
 	}
 
 	buf := bufPool.Get().(*bytes.Buffer)
@@ -62,44 +74,128 @@ func Read_Data_Frame(r net.Conn, obj interface{}) error {
 	data_buf = data_buf[:frame_length]
 	data_size, err := io.ReadFull(r, data_buf)
 	if err != nil || data_size <= 0 || uint32(data_size) != frame_length {
-		return fmt.Errorf("Could not read data size  read %d, frame length %d err %s", data_size, frame_length, err)
+		return nbyte + data_size, fmt.Errorf("Could not read data size  read %d, frame length %d err %s", data_size, frame_length, err)
 	}
 	data_buf = data_buf[:frame_length]
-	err = cbor.Unmarshal(data_buf, obj)
+	if err = cbor.Unmarshal(data_buf, obj); err != nil {
+		err = malformed_frame_error{err}
+	}
 
 	//fmt.Printf("Read object %+v raw %s\n",obj, data_buf)
-	return err
+	return nbyte + data_size, err
 }
 
 // reads our data, length prefix blocks
 func Write_Data_Frame(w net.Conn, obj interface{}) error {
-	var frame_length_buf [4]byte
 	data_bytes, err := cbor.Marshal(obj)
 	if err != nil {
 		return err
 	}
+	_, err = write_frame(w, data_bytes)
+	return err
+}
+
+// writes already serialized data with length prefix, returns bytes written to wire
+func write_frame(w net.Conn, data_bytes []byte) (int, error) {
+	var frame_length_buf [4]byte
 	binary.LittleEndian.PutUint32(frame_length_buf[:], uint32(len(data_bytes)))
 
 	w.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
-	if _, err = w.Write(frame_length_buf[:]); err != nil {
-		return err
+	if _, err := w.Write(frame_length_buf[:]); err != nil {
+		return 0, err
 	}
-	_, err = w.Write(data_bytes[:])
+	n, err := w.Write(data_bytes[:])
 	//fmt.Printf("Wrote object %+v raw %s\n",obj, data_bytes)
-	return err
+	return len(frame_length_buf) + n, err
 }
 
 // ClientCodec implements the rpc.ClientCodec interface for generic golang objects.
+// it also shapes and accounts traffic per message type
 type ClientCodec struct {
 	r net.Conn
 	sync.Mutex
+
+	connection atomic.Value // *Connection, once attached, used for accounting per peer
+
+	upload_limiter   *limiter // per peer limits, nil if unlimited
+	download_limiter *limiter
+
+	incoming sync.Map // seq to method of requests received, so our responses can be accounted
+	outgoing sync.Map // seq to method of requests sent, so their responses can be accounted
+	reading  string   // method of message being read, only accessed from the reading goroutine
 }
 
 // NewClientCodec returns a ClientCodec for communicating with the ServerCodec
 // on the other end of the conn.
 // to support deadlines we use net.conn
 func NewCBORCodec(conn net.Conn) *ClientCodec {
-	return &ClientCodec{r: conn}
+	c := &ClientCodec{r: conn}
+	if peer_upload_limit > 0 {
+		c.upload_limiter = new_limiter(peer_upload_limit)
+	}
+	if peer_download_limit > 0 {
+		c.download_limiter = new_limiter(peer_download_limit)
+	}
+	return c
+}
+
+// attach connection, so that traffic is accounted to it
+func (c *ClientCodec) Attach(connection *Connection) {
+	c.connection.Store(connection)
+}
+
+func (c *ClientCodec) getconnection() *Connection {
+	if connection, ok := c.connection.Load().(*Connection); ok {
+		return connection
+	}
+	return nil
+}
+
+// read a body frame, account and shape it according to the message being read
+func (c *ClientCodec) read(obj interface{}) error {
+	n, err := read_data_frame(c.r, obj)
+	return c.account_read(n, err)
+}
+
+// account and shape a frame read, peers sending malformed frames are banned
+func (c *ClientCodec) account_read(n int, err error) error {
+	connection := c.getconnection()
+	account_traffic(connection, c.reading, true, n)
+	if _, ok := err.(malformed_frame_error); ok && connection != nil {
+		connection.ban(err)
+		return err
+	}
+	shape_download(method_priority(c.reading), n, c.download_limiter)
+	return err
+}
+
+// serialize, shape, account and write header and body as single unit
+func (c *ClientCodec) write(method string, header RequestResponse, obj interface{}, write_body bool) error {
+	header_bytes, err := cbor.Marshal(header)
+	if err != nil {
+		return err
+	}
+	var body_bytes []byte
+	if write_body {
+		if body_bytes, err = cbor.Marshal(obj); err != nil {
+			return err
+		}
+	}
+
+	// waiting is done outside the lock, so high priority messages can overtake
+	shape_upload(method_priority(method), len(header_bytes)+len(body_bytes)+8, c.upload_limiter)
+
+	c.Lock()
+	defer c.Unlock()
+
+	n, err := write_frame(c.r, header_bytes)
+	account_traffic(c.getconnection(), method, false, n)
+	if err != nil || !write_body {
+		return err
+	}
+	n, err = write_frame(c.r, body_bytes)
+	account_traffic(c.getconnection(), method, false, n)
+	return err
 }
 
 // ReadResponseHeader reads a 4 byte length from the connection and decodes that many
@@ -107,8 +203,10 @@ func NewCBORCodec(conn net.Conn) *ClientCodec {
 // in the given request.
 func (c *ClientCodec) ReadResponseHeader(resp *rpc2.Response) error {
 	var header RequestResponse
-	if err := Read_Data_Frame(c.r, &header); err != nil {
-		return err
+	c.reading = ""
+	n, err := read_data_frame(c.r, &header)
+	if err != nil {
+		return c.account_read(n, err)
 	}
 	//if header.Method == "" {
 	//	return fmt.Errorf("header missing method: %s", "no Method")
@@ -116,8 +214,10 @@ func (c *ClientCodec) ReadResponseHeader(resp *rpc2.Response) error {
 	//resp.Method = header.Method
 	resp.Seq = header.Seq
 	resp.Error = header.Error
-
-	return nil
+	if method, ok := c.outgoing.LoadAndDelete(header.Seq); ok {
+		c.reading = method.(string)
+	}
+	return c.account_read(n, nil)
 }
 
 // Close closes the underlying connection.
@@ -130,18 +230,25 @@ func (c *ClientCodec) Close() error {
 // in the given request.
 func (s *ClientCodec) ReadHeader(req *rpc2.Request, resp *rpc2.Response) error {
 	var header RequestResponse
-	if err := Read_Data_Frame(s.r, &header); err != nil {
-		return err
+	s.reading = ""
+	n, err := read_data_frame(s.r, &header)
+	if err != nil {
+		return s.account_read(n, err)
 	}
 
 	if header.Method != "" {
 		req.Seq = header.Seq
 		req.Method = header.Method
+		s.reading = header.Method
+		s.incoming.Store(header.Seq, header.Method)
 	} else {
 		resp.Seq = header.Seq
 		resp.Error = header.Error
+		if method, ok := s.outgoing.LoadAndDelete(header.Seq); ok {
+			s.reading = method.(string)
+		}
 	}
-	return nil
+	return s.account_read(n, nil) // header is accounted once its message type is known
 }
 
 // ReadRequestBody reads a 4 byte length from the connection and decodes that many
@@ -150,7 +257,7 @@ func (s *ClientCodec) ReadRequestBody(obj interface{}) error {
 	if obj == nil {
 		return nil
 	}
-	return Read_Data_Frame(s.r, obj)
+	return s.read(obj)
 }
 
 // ReadResponseBody reads a 4 byte length from the connection and decodes that many
@@ -160,36 +267,27 @@ func (c *ClientCodec) ReadResponseBody(obj interface{}) error {
 	if obj == nil {
 		return nil
 	}
-	return Read_Data_Frame(c.r, obj)
+	return c.read(obj)
 }
 
 // WriteRequest writes the 4 byte length from the connection and encodes that many
 // subsequent bytes into the given object.
 func (c *ClientCodec) WriteRequest(req *rpc2.Request, obj interface{}) error {
-	c.Lock()
-	defer c.Unlock()
-
+	c.outgoing.Store(req.Seq, req.Method)
 	header := RequestResponse{Method: req.Method, Seq: req.Seq}
-	if err := Write_Data_Frame(c.r, header); err != nil {
-		return err
-	}
-	return Write_Data_Frame(c.r, obj)
+	return c.write(req.Method, header, obj, true)
 }
 
 // WriteResponse writes the appropriate header. If
 // the response was invalid, the size of the body of the resp is reported as
 // having size zero and is not sent.
 func (c *ClientCodec) WriteResponse(resp *rpc2.Response, obj interface{}) error {
-	c.Lock()
-	defer c.Unlock()
-	header := RequestResponse{Seq: resp.Seq, Error: resp.Error}
-	if err := Write_Data_Frame(c.r, header); err != nil {
-		return err
-	}
-
-	if resp.Error == "" { // only write response object if error is nil
-		return Write_Data_Frame(c.r, obj)
+	var method string
+	if m, ok := c.incoming.LoadAndDelete(resp.Seq); ok {
+		method = m.(string)
 	}
+	header := RequestResponse{Seq: resp.Seq, Error: resp.Error}
 
-	return nil
+	// only write response object if error is nil
+	return c.write(method, header, obj, resp.Error == "")
 }
@@ -16,7 +16,7 @@
 
 package p2p
 
-//import "fmt"
+import "fmt"
 //import "net"
 
 //import "container/list"
@@ -32,13 +32,13 @@ func (c *Connection) Chain(request Chain_Request_Struct, response *Chain_Respons
 	defer handle_connection_panic(c)
 	if len(request.Block_list) < 1 { // malformed request ban peer
 		c.logger.V(3).Info("malformed chain request  received, banning peer", "request", request)
-		c.exit()
+		c.ban(fmt.Errorf("empty chain request"))
 		return nil
 	}
 
 	if len(request.Block_list) != len(request.TopoHeights) || len(request.Block_list) > 1024 {
 		c.logger.V(3).Info("Peer chain is invalid", "blocks", len(request.Block_list), "topos", len(request.TopoHeights))
-		c.exit()
+		c.ban(fmt.Errorf("invalid chain request"))
 		return nil
 	}
 
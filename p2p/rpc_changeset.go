@@ -16,6 +16,8 @@
 
 package p2p
 
+import "fmt"
+
 import "github.com/deroproject/derohe/config"
 import "github.com/deroproject/graviton"
 
@@ -32,9 +34,19 @@ func (c *Connection) ChangeSet(request ChangeList, response *Changes) (err error
 
 	c.update(&request.Common) // update common information
 
+	fill_common(&response.Common) // fill common info, it takes Prune_Mutex itself so it is done before locking
+
+	chain.Prune_Mutex.RLock() // state versions must not change under us
+	defer chain.Prune_Mutex.RUnlock()
+
+	pruned := chain.LocatePruneTopo()
 	for _, topo := range request.TopoHeights {
 		var cbl Complete_Block
 
+		if topo <= pruned { // changes before pruned topoheight are no longer available
+			return fmt.Errorf("topoheight %d has been pruned, pruned till %d", topo, pruned)
+		}
+
 		blid, err := chain.Load_Block_Topological_order_at_index(topo)
 		if err != nil {
 			return err
@@ -109,9 +121,6 @@ func (c *Connection) ChangeSet(request ChangeList, response *Changes) (err error
 		}
 	}
 
-	// if everything is OK, we must respond with object response
-	fill_common(&response.Common) // fill common info
-
 	return nil
 
 }
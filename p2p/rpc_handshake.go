@@ -30,11 +30,17 @@ import "github.com/blang/semver/v4"
 
 // verify incoming handshake for number of checks such as mainnet/testnet etc etc
 func Verify_Handshake(handshake *Handshake_Struct) bool {
-	v := semver.MustParse(handshake.DaemonVersion)
+	v, err := semver.Parse(handshake.DaemonVersion)
+	if err != nil { // peer supplied version is not under our control
+		return false
+	}
 
 	if v.Major >= 3 && v.Minor >= 5 && v.Patch >= 0 {
 
 	} else {
+		if len(v.Pre) < 1 {
+			return false
+		}
 		var pre int
 		fmt.Sscanf(v.Pre[0].String(), "%d", &pre) // make sure previous releases can connect
 		if pre < 88 {
@@ -55,8 +61,10 @@ func (handshake *Handshake_Struct) Fill() {
 	handshake.Local_Port = uint32(P2P_Port)             // export requested or default port
 	handshake.Peer_ID = GetPeerID()                     // give our randomly generated peer id
 	handshake.Pruned = chain.LocatePruneTopo()
+	handshake.ExternalAddress = external_address // empty unless we are a hidden service
 
 	//	handshake.Flags = // add any flags necessary
+	handshake.Flags = append(handshake.Flags, FLAG_DANDELION, FLAG_STATE_VERIFY)
 
 	copy(handshake.Network_ID[:], globals.Config.Network_ID[:])
 }
@@ -84,6 +92,12 @@ func (connection *Connection) dispatch_test_handshake() {
 		connection.exit()
 		return
 	}
+	if IsAddressInBanList(Address(connection)) {
+		connection.logger.V(2).Info("terminating connection, peer is banned", "address", Address(connection))
+		connection.exit()
+		return
+	}
+
 	connection.update(&response.Common) // update common information
 	if !Connection_Add(connection) {    // add connection to pool
 		connection.exit()
@@ -105,10 +119,25 @@ func (connection *Connection) dispatch_test_handshake() {
 	if response.Pruned >= 1 {
 		connection.Pruned = response.Pruned
 	}
+	for _, flag := range response.Flags {
+		if flag == FLAG_DANDELION {
+			connection.Dandelion = true
+		}
+		if flag == FLAG_STATE_VERIFY {
+			connection.StateVerify = true
+		}
+	}
 
 	// TODO we must also add the peer to our list
 	// which can be distributed to other peers
-	if connection.Port != 0 && connection.Port <= 65535 { // peer is saying it has an open port, handshake is success so add peer
+	// in anonymous mode, only hidden service addresses we have dialed ourselves are added, since remote addresses are those of the proxy
+	if a, ok := connection.Addr.(*AnonAddr); ok {
+		if !connection.Incoming && IsAnonymousAddress(a.Host) { // we reached the peer at this address, so it is genuine
+			Peer_Add(&Peer{Address: a.Endpoint, ID: connection.Peer_ID, LastConnected: uint64(time.Now().UTC().Unix())})
+		} else if connection.Incoming && IsAnonymousAddress(response.ExternalAddress) {
+			verify_anonymous_address(response.ExternalAddress)
+		}
+	} else if !anonymous_mode && connection.Port != 0 && connection.Port <= 65535 { // peer is saying it has an open port, handshake is success so add peer
 
 		var p Peer
 		if net.ParseIP(Address(connection)).To4() != nil { // if ipv4
@@ -34,6 +34,12 @@ func (c *Connection) NotifyINV(request ObjectList, response *Dummy) (err error)
 	var need ObjectList
 	var dirty = false
 
+	if request.is_oversized() {
+		err = fmt.Errorf("INV too large blocks %d txs %d chunks %d", len(request.Block_list), len(request.Tx_list), len(request.Chunk_list))
+		c.ban(err)
+		return err
+	}
+
 	c.logger.V(3).Info("incoming INV", "request", request)
 
 	if len(request.Block_list) >= 1 { //  handle incoming blocks list
@@ -114,8 +120,7 @@ func (c *Connection) NotifyMiniBlock(request Objects, response *Dummy) (err erro
 	defer handle_connection_panic(c)
 	if len(request.MiniBlocks) >= 5 {
 		err = fmt.Errorf("Notify Block can notify max 5 miniblocks")
-		c.logger.V(3).Error(err, "Should be banned")
-		c.exit()
+		c.ban(err)
 		return err
 	}
 	fill_common_T1(&request.Common)
@@ -147,7 +152,7 @@ func (c *Connection) NotifyMiniBlock(request Objects, response *Dummy) (err erro
 		}
 
 		// first check whether it is already in the chain
-		if chain.MiniBlocks.IsCollision(mbl) {
+		if chain.MiniBlocks.RejectCollision(mbl) {
 			continue // miniblock already in chain, so skip it
 		}
 
@@ -208,8 +213,8 @@ func (c *Connection) processChunkedBlock(request Objects, data_shard_count, pari
 	cbl.Bl = &bl
 	err = bl.Deserialize(request.CBlocks[0].Block)
 	if err != nil { // we have a block which could not be deserialized ban peer
-		c.logger.V(3).Error(err, "Block cannot be deserialized.Should be banned")
-		c.exit()
+		c.logger.V(3).Error(err, "Block cannot be deserialized")
+		c.ban(err)
 		return err
 	}
 
@@ -227,8 +232,8 @@ func (c *Connection) processChunkedBlock(request Objects, data_shard_count, pari
 			var tx transaction.Transaction
 			err = tx.Deserialize(request.CBlocks[0].Txs[j])
 			if err != nil { // we have a tx which could not be deserialized ban peer
-				c.logger.V(3).Error(err, "tx cannot be deserialized.Should be banned")
-				c.exit()
+				c.logger.V(3).Error(err, "tx cannot be deserialized")
+				c.ban(err)
 				return err
 			}
 			cbl.Txs = append(cbl.Txs, &tx)
@@ -246,8 +251,7 @@ func (c *Connection) processChunkedBlock(request Objects, data_shard_count, pari
 		Broadcast_Block(&cbl, c.Peer_ID) // do not send back to the original peer
 	} else { // ban the peer for sometime
 		if err == errormsg.ErrInvalidPoW {
-			c.logger.Error(err, "This peer should be banned and terminated")
-			c.exit()
+			c.ban(err)
 			return err
 		}
 	}
@@ -18,6 +18,13 @@ package p2p
 
 import "fmt"
 
+const MAX_OBJECTS_PER_LIST = 1024 // max blocks/txs/chunks a peer may request or announce in a single list
+
+// whether any list is larger than allowed
+func (request *ObjectList) is_oversized() bool {
+	return len(request.Block_list) > MAX_OBJECTS_PER_LIST || len(request.Tx_list) > MAX_OBJECTS_PER_LIST || len(request.Chunk_list) > MAX_OBJECTS_PER_LIST
+}
+
 // peer has requested some objects, we must respond
 // if certain object is not in our list we respond with empty buffer for that slot
 // an object is either a block or a tx
@@ -26,9 +33,14 @@ func (connection *Connection) GetObject(request ObjectList, response *Objects) e
 	var err error
 	if len(request.Block_list) < 1 && len(request.Tx_list) < 1 && len(request.Chunk_list) < 1 { // we are expecting 1 block or 1 tx
 		connection.logger.V(2).Info("malformed object request  received, banning peer", "request", request)
-		connection.exit()
+		connection.ban(fmt.Errorf("empty object request"))
 		return nil
 	}
+	if request.is_oversized() {
+		err = fmt.Errorf("object request too large blocks %d txs %d chunks %d", len(request.Block_list), len(request.Tx_list), len(request.Chunk_list))
+		connection.ban(err)
+		return err
+	}
 	connection.update(&request.Common) // update common information
 
 	for i := range request.Block_list { // find the block
@@ -16,18 +16,32 @@
 
 package p2p
 
+import "fmt"
+
 import "github.com/deroproject/graviton"
 
+const MAX_TREE_SECTION_KEYS = 10000 // sections with more keys are truncated and must be requested as smaller sections
+
 // get parts of the specified balance tree chunk by chunk
 func (c *Connection) TreeSection(request Request_Tree_Section_Struct, response *Response_Tree_Section_Struct) (err error) {
 	defer handle_connection_panic(c)
 	if request.Topo < 2 || request.SectionLength > 256 || len(request.Section) < int(request.SectionLength/8) { // we are expecting 1 block or 1 tx
 		c.logger.V(1).Info("malformed object request  received, banning peer", "request", request)
 		c.exit()
+		return nil
 	}
 
 	c.update(&request.Common) // update common information
 
+	fill_common(&response.Common) // fill common info, it takes Prune_Mutex itself so it is done before locking
+
+	chain.Prune_Mutex.RLock() // state versions must not change under us
+	defer chain.Prune_Mutex.RUnlock()
+
+	if pruned := chain.LocatePruneTopo(); request.Topo < pruned {
+		return fmt.Errorf("topoheight %d has been pruned, pruned till %d", request.Topo, pruned)
+	}
+
 	topo_sr, err := chain.Store.Topo_store.Read(request.Topo)
 	if err != nil {
 		return
@@ -43,13 +57,16 @@ func (c *Connection) TreeSection(request Request_Tree_Section_Struct, response *
 					response.Keys = append(response.Keys, k)
 					response.Values = append(response.Values, v)
 
-					if len(response.Keys) > 10000 {
+					if len(response.Keys) > MAX_TREE_SECTION_KEYS {
 						break
 					}
 
 				}
 				err = nil
 
+				// hashes let the requester verify the section and the tree against other peers
+				response.SectionHash = section_hash(response.Keys, response.Values)
+				response.TreeHash, err = topo_balance_tree.Hash()
 			}
 
 		}
@@ -60,8 +77,14 @@ func (c *Connection) TreeSection(request Request_Tree_Section_Struct, response *
 
 	}
 
-	// if everything is OK, we must respond with object response
-	fill_common(&response.Common) // fill common info
+	if response.StateHash, err = chain.Load_Merkle_Hash(topo_sr.State_Version); err != nil {
+		return
+	}
+
+	if request.HashOnly {
+		response.Keys, response.Values = nil, nil
+	}
+
 	return nil
 
 }
@@ -57,11 +57,12 @@ type Handshake_Struct struct {
 	Flags           []string      `cbor:"FLAGS"`
 	PeerList        []Peer_Info   `cbor:"PLIST"`
 	Extension_List  []string      `cbor:"EXT"`
-	Request         bool          `cbor:"REQUEST"` //whether this is a request
+	Request         bool          `cbor:"REQUEST"`         //whether this is a request
+	ExternalAddress string        `cbor:"EADDR,omitempty"` // onion/i2p address if the peer is reachable as a hidden service
 }
 
 type Peer_Info struct {
-	Addr  string `cbor:"ADDR"` // ip:port pair
+	Addr  string `cbor:"ADDR"` // ip:port pair or onion/i2p host:port pair
 	Miner bool   `cbor:"MINER"`
 	//ID       uint64 `cbor:"I"`
 	//LastSeen uint64 `cbor:"LS"`
@@ -118,6 +119,7 @@ type Request_Tree_Section_Struct struct {
 	TreeName      []byte        `cbor:"TREENAME,omitempty"` // changes to state tree
 	Section       []byte        `cbor:"SECTION"`            // section path from which data must be received
 	SectionLength uint64        `cbor:"SECTIONL"`           // section length in bits
+	HashOnly      bool          `cbor:"HASHONLY,omitempty"` // only hashes are needed, used to verify data received from other peers
 }
 
 type Response_Tree_Section_Struct struct {
@@ -127,6 +129,8 @@ type Response_Tree_Section_Struct struct {
 	Section       []byte        `cbor:"SECTION"`
 	SectionLength uint64        `cbor:"SECTIONL"` // section length in bits
 	StateHash     [32]byte      `cbor:"STATE"`
+	TreeHash      [32]byte      `cbor:"THASH,omitempty"`  // root hash of the requested tree at topo
+	SectionHash   [32]byte      `cbor:"SHASH,omitempty"`  // hash of all keys and values within the section
 	Keys          [][]byte      `cbor:"KEYS,omitempty"`   // changes to state tree
 	Values        [][]byte      `cbor:"VALUES,omitempty"` // changes to state tree
 }
@@ -135,6 +135,39 @@ type (
 	}
 )
 
+// policy used by daemon to select txs for block templates
+type Template_Policy struct {
+	Priority     []string `json:"priority"`     // txids selected before others irrespective of fees
+	Exclude      []string `json:"exclude"`      // txids never selected
+	ExcludeSCIDs []string `json:"excludescids"` // txs invoking or transferring tokens of these SCs are never selected
+	MaxBlockSize uint64   `json:"maxblocksize"` // max bytes of txs in a block, 0 means network limit
+}
+
+type (
+	SetTemplatePolicy_Params Template_Policy // empty policy restores default fee based selection
+	SetTemplatePolicy_Result struct {
+		Status string `json:"status"`
+	}
+)
+
+type (
+	GetBlockTemplateDetailed_Params GetBlockTemplate_Params
+	Template_TX                     struct {
+		TXID     string `json:"txid"`
+		Type     string `json:"type"` // REGISTRATION, NORMAL, BURN or SC
+		Size     uint64 `json:"size"`
+		Fees     uint64 `json:"fees"`
+		Priority bool   `json:"priority"`
+	}
+	GetBlockTemplateDetailed_Result struct {
+		GetBlockTemplate_Result
+		Txs       []Template_TX   `json:"txs"`
+		TxsSize   uint64          `json:"txssize"`
+		TotalFees uint64          `json:"totalfees"`
+		Policy    Template_Policy `json:"policy"`
+	}
+)
+
 type ( // array without name containing block template in hex
 	SubmitBlock_Params struct {
 		JobID                 string `json:"jobid"`
@@ -164,6 +197,7 @@ type (
 		SCID                    crypto.Hash `json:"scid"`
 		Merkle_Balance_TreeHash string      `json:"treehash,omitempty"`
 		TopoHeight              int64       `json:"topoheight,omitempty"`
+		Proof                   bool        `json:"proof,omitempty"` // if true, merkle proof of balance (or its absence) is returned
 	} // no params
 	GetEncryptedBalance_Result struct {
 		SCID                     crypto.Hash `json:"scid"`
@@ -177,15 +211,106 @@ type (
 		DHeight                  int64       `json:"dheight"`     //  daemon height
 		DTopoheight              int64       `json:"dtopoheight"` // daemon topoheight
 		DMerkle_Balance_TreeHash string      `json:"dtreehash"`   // daemon dmerkle tree hash
+		Proof                    *StateProof `json:"proof,omitempty"`
 		Status                   string      `json:"status"`
 	}
 )
 
+// merkle proofs linking state to state root (treehash) at a topoheight, all proofs/hashes are hex encoded
+// state root is xor of balance tree hash and SC meta tree hash, proofs from both trees are always present
+// for native balances, balance proof is for the account and meta proof is for zero SCID
+// for SCs, balance proof is for zero key, meta proof is for SCID and data proofs are for keys within SC data tree
+type StateProof struct {
+	TopoHeight   int64             `json:"topoheight"`
+	BlockHash    crypto.Hash       `json:"blockhash"`
+	StateHash    string            `json:"statehash"` // state root at this topoheight
+	BalanceHash  string            `json:"balancehash"`
+	MetaHash     string            `json:"metahash"`
+	BalanceProof string            `json:"balanceproof"`
+	MetaProof    string            `json:"metaproof"`
+	DataProofs   map[string]string `json:"dataproofs,omitempty"` // indexed by hex of raw key in SC data tree
+}
+
 type (
 	GetTxPool_Params struct{} // no params
 	GetTxPool_Result struct {
-		Tx_list []string `json:"txs,omitempty"`
-		Status  string   `json:"status"`
+		Tx_list []string      `json:"txs,omitempty"`
+		Policy  TxPool_Policy `json:"policy"`
+		Status  string        `json:"status"`
+	}
+	TxPool_Policy struct { // limits of 0 mean unlimited
+		MaxSize        uint64 `json:"maxsize"` // bytes
+		Size           uint64 `json:"size"`    // bytes
+		Count          uint64 `json:"count"`
+		LowestFeePerKB uint64 `json:"lowestfeeperkb"` // non zero when pool is full, txs must pay more than this per KB
+		RBFBumpPercent uint64 `json:"rbfbumppercent"` // replacement must pay this much percent more fees than txs replaced
+		MaxTxPerPeer   uint64 `json:"maxtxperpeer"`
+		MaxTxPerIP     uint64 `json:"maxtxperip"`
+	}
+)
+
+type (
+	GetTxPoolWithStats_Params struct{} // no params
+	GetTxPoolWithStats_Result struct {
+		Entries []TxPool_Entry `json:"entries,omitempty"` // sorted by fee per KB, highest first
+		Stats   TxPool_Stats   `json:"stats"`
+		Status  string         `json:"status"`
+	}
+	TxPool_Entry struct {
+		TXID     string `json:"txid"`
+		Type     string `json:"type"`
+		SCID     string `json:"scid,omitempty"` // SC targetted by SC txs
+		Size     uint64 `json:"size"`           // bytes
+		Fee      uint64 `json:"fee"`
+		FeePerKB uint64 `json:"feeperkb"`
+		Age      uint64 `json:"age"`    // seconds since tx was added to pool
+		Height   uint64 `json:"height"` // height at which tx can be mined
+	}
+	TxPool_Stats struct {
+		Count          uint64 `json:"count"`
+		Size           uint64 `json:"size"` // bytes
+		TotalFees      uint64 `json:"totalfees"`
+		MinFeePerKB    uint64 `json:"minfeeperkb"`
+		MedianFeePerKB uint64 `json:"medianfeeperkb"`
+		MaxFeePerKB    uint64 `json:"maxfeeperkb"`
+	}
+)
+
+type (
+	GetFeeEstimate_Params struct {
+		Blocks uint64 `json:"blocks"` // tx should be mined within these many blocks, 0 means daemon default
+	}
+	GetFeeEstimate_Result struct {
+		Blocks          uint64 `json:"blocks"`
+		FeePerKB        uint64 `json:"feeperkb"`        // never lower than minimum network fee per KB
+		MedianBlockSize uint64 `json:"medianblocksize"` // median size of txs in recent blocks
+		PoolAhead       uint64 `json:"poolahead"`       // bytes of pool txs expected to be mined before
+		Status          string `json:"status"`
+	}
+)
+
+type (
+	GetMiners_Params struct {
+		Address string `json:"address"` // optional, list only workers of this address
+	}
+	Miner_Info struct {
+		Address    string            `json:"address"`
+		Worker     string            `json:"worker"`
+		Protocol   string            `json:"protocol"`   // getwork or stratum
+		Connected  int64             `json:"connected"`  // unix time
+		Difficulty uint64            `json:"difficulty"` // current share difficulty
+		Hashrate   uint64            `json:"hashrate"`   // estimated from shares
+		Shares     uint64            `json:"shares"`
+		MiniBlocks uint64            `json:"miniblocks"`
+		Blocks     uint64            `json:"blocks"`
+		Rejected   uint64            `json:"rejected"`
+		LastShare  int64             `json:"lastshare"` // unix time
+		LastError  string            `json:"lasterror"`
+		Rejects    map[string]uint64 `json:"rejects"` // reject reasons
+	}
+	GetMiners_Result struct {
+		Miners []Miner_Info `json:"miners"`
+		Status string       `json:"status"`
 	}
 )
 
@@ -200,6 +325,81 @@ type (
 	}
 )
 
+type (
+	Daemon_GetPruneStatus_Result struct {
+		Enabled         bool    `json:"enabled"`
+		Running         bool    `json:"running"`
+		Phase           string  `json:"phase"`    // idle, state, swap or blocks
+		Progress        float64 `json:"progress"` // percent of current phase
+		Depth           int64   `json:"depth"`
+		PrunedTopo      int64   `json:"prunedtopoheight"`
+		TopoHeight      int64   `json:"topoheight"`
+		Runs            uint64  `json:"runs"`
+		BlocksDiscarded uint64  `json:"blocks_discarded"`
+		TxsDiscarded    uint64  `json:"txs_discarded"`
+		LastRun         int64   `json:"lastrun"`      // unix timestamp
+		LastDuration    float64 `json:"lastduration"` // seconds
+		LastError       string  `json:"lasterror,omitempty"`
+
+		Status string `json:"status"`
+	}
+)
+
+type (
+	Daemon_GetReorgs_Params struct {
+		Count uint64 `json:"count,omitempty"` // number of recent reorgs to return, default 20
+	}
+	Daemon_Reorg struct {
+		Time        int64    `json:"time"` // unix timestamp
+		Height      int64    `json:"height"`
+		TopoHeight  int64    `json:"topoheight"` // first topoheight which was rewritten
+		Depth       int64    `json:"depth"`      // number of main chain blocks displaced
+		OldTop      string   `json:"old_top"`
+		NewTop      string   `json:"new_top"`
+		OldBlocks   []string `json:"old_blocks"`
+		NewBlocks   []string `json:"new_blocks"`
+		TxsReturned []string `json:"txs_returned,omitempty"` // txs placed back in pool
+	}
+	Daemon_GetReorgs_Result struct {
+		Reorgs []Daemon_Reorg `json:"reorgs"` // newest first
+		Status string         `json:"status"`
+	}
+)
+
+type (
+	GetMiniBlocks_Params struct {
+		Height uint64   `json:"height,omitempty"` // default is height of next block
+		Past   []uint32 `json:"past,omitempty"`   // optional key, first 4 bytes of each tip as used by miniblocks
+	}
+	MiniBlock_Info struct {
+		Hash       string `json:"hash"`
+		Timestamp  uint16 `json:"timestamp"`          // lower 16 bits of miner time in ms
+		Received   int64  `json:"received,omitempty"` // unix time in ms when this node received it
+		KeyHash    string `json:"keyhash"`
+		Miner      string `json:"miner"` // empty for final miniblock, unknown if address could not be resolved
+		Final      bool   `json:"final"`
+		HighDiff   bool   `json:"highdiff"`
+		Flags      uint32 `json:"flags"`
+		Nonce      string `json:"nonce"`
+		Collisions uint64 `json:"collisions"` // duplicates rejected by this node
+	}
+	MiniBlock_Key_Info struct {
+		Height     uint64           `json:"height"`
+		Past       []string         `json:"past"` // expanded tip hash if known, else 4 byte prefix
+		Tips       bool             `json:"tips"` // key builds on current chain tips
+		Count      int              `json:"count"`
+		MiniBlocks []MiniBlock_Info `json:"miniblocks"`
+	}
+	GetMiniBlocks_Result struct {
+		Height     uint64               `json:"height"`
+		Tips       []string             `json:"tips"`       // current chain tips
+		Keys       []MiniBlock_Key_Info `json:"keys"`       // sorted descending on miniblock count
+		Count      int                  `json:"count"`      // miniblocks at this height
+		Collisions uint64               `json:"collisions"` // duplicates rejected at this height
+		Status     string               `json:"status"`
+	}
+)
+
 type (
 	On_GetBlockHash_Params struct {
 		X [1]uint64
@@ -249,6 +449,7 @@ type (
 		KeysUint64 []uint64 `json:"keysuint64,omitempty"`
 		KeysString []string `json:"keysstring,omitempty"`
 		KeysBytes  [][]byte `json:"keysbytes,omitempty"` // all keys can also be represented as bytes
+		Proof      bool     `json:"proof,omitempty"`     // if true, merkle proofs of SC balance, code and requested keys are returned
 	}
 	GetSC_Result struct {
 		ValuesUint64       []string               `json:"valuesuint64,omitempty"`
@@ -259,6 +460,7 @@ type (
 		Balances           map[string]uint64      `json:"balances,omitempty"`
 		Balance            uint64                 `json:"balance"`
 		Code               string                 `json:"code"`
+		Proof              *StateProof            `json:"proof,omitempty"`
 		Status             string                 `json:"status"`
 	}
 )
@@ -193,6 +193,8 @@ func (w *Wallet_Memory) sync_loop() {
 			continue
 		}
 
+		w.update_fees_per_kb()
+
 		var zerohash crypto.Hash
 		if len(w.account.EntriesNative) == 0 {
 			err := w.Sync_Wallet_Memory_With_Daemon()
@@ -210,6 +212,39 @@ func (w *Wallet_Memory) sync_loop() {
 	}
 }
 
+const FEE_ESTIMATE_BLOCKS = 3 // wallet txs should be mined within these many blocks
+const FEE_ESTIMATE_MAX = 10   // daemon estimates are capped at these many times network minimum
+
+// ask daemon how much fees per KB are required to get mined within a few blocks
+// older daemons do not support estimation, in which case network minimum is used
+func (w *Wallet_Memory) update_fees_per_kb() {
+	if !IsDaemonOnline() {
+		return
+	}
+
+	var result rpc.GetFeeEstimate_Result
+	if err := rpc_client.Call("DERO.GetFeeEstimate", rpc.GetFeeEstimate_Params{Blocks: FEE_ESTIMATE_BLOCKS}, &result); err != nil {
+		logger.V(1).Error(err, "DERO.GetFeeEstimate Call failed:")
+		return
+	}
+	if result.FeePerKB > FEE_ESTIMATE_MAX*config.FEE_PER_KB {
+		logger.Info("daemon fee estimate too high, capping it", "daemon_fees_per_kb", result.FeePerKB, "cap", FEE_ESTIMATE_MAX*config.FEE_PER_KB)
+	}
+	w.dynamic_fees_per_kb = result.FeePerKB
+}
+
+// fees per KB used while building transactions, never lower than network minimum
+// nor higher than FEE_ESTIMATE_MAX times of it, so a rogue daemon cannot drain the wallet through fees
+func (w *Wallet_Memory) GetFeesPerKB() uint64 {
+	if w.dynamic_fees_per_kb < config.FEE_PER_KB {
+		return config.FEE_PER_KB
+	}
+	if w.dynamic_fees_per_kb > FEE_ESTIMATE_MAX*config.FEE_PER_KB {
+		return FEE_ESTIMATE_MAX * config.FEE_PER_KB
+	}
+	return w.dynamic_fees_per_kb
+}
+
 func (cli *Client) Call(method string, params interface{}, result interface{}) error {
 	return cli.RPC.CallResult(context.Background(), method, params, result)
 }
@@ -406,7 +441,7 @@ func (w *Wallet_Memory) GetEncryptedBalanceAtTopoHeight(scid crypto.Hash, topohe
 	var result rpc.GetEncryptedBalance_Result
 
 	// Issue a call with a response.
-	if err = rpc_client.Call("DERO.GetEncryptedBalance", rpc.GetEncryptedBalance_Params{SCID: scid, Address: accountaddr, TopoHeight: topoheight}, &result); err != nil {
+	if err = rpc_client.Call("DERO.GetEncryptedBalance", rpc.GetEncryptedBalance_Params{SCID: scid, Address: accountaddr, TopoHeight: topoheight, Proof: w.verify_proofs}, &result); err != nil {
 		logger.Error(err, "DERO.GetEncryptedBalance Call failed:")
 
 		if strings.Contains(strings.ToLower(err.Error()), strings.ToLower(errormsg.ErrAccountUnregistered.Error())) && accountaddr == w.GetAddress().String() && scid.IsZero() {
@@ -435,6 +470,26 @@ func (w *Wallet_Memory) GetEncryptedBalanceAtTopoHeight(scid crypto.Hash, topohe
 	}
 
 	//		fmt.Printf("GetEncryptedBalance result  %+v\n", result)
+	if w.verify_proofs {
+		w.RLock()
+		source := w.state_root_source
+		w.RUnlock()
+		if err = verify_encrypted_balance(scid, accountaddr, result, source); err != nil {
+			logger.Error(err, "DERO.GetEncryptedBalance proof verification failed", "address", accountaddr, "topoheight", result.Topoheight)
+			return
+		}
+
+		// proven absent token balances are considered zero, same as above
+		if !scid.IsZero() && result.Status == errormsg.ErrAccountUnregistered.Error() {
+			var addr *rpc.Address
+			if addr, err = rpc.NewAddress(accountaddr); err != nil {
+				return
+			}
+			e = crypto.ConstructElGamal(addr.PublicKey.G1(), crypto.ElGamal_BASE_G) // init zero balance
+			return
+		}
+	}
+
 	if scid.IsZero() && accountaddr == w.GetAddress().String() {
 		if result.Status == errormsg.ErrAccountUnregistered.Error() {
 			w.Error = errormsg.ErrAccountUnregistered
@@ -0,0 +1,208 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package walletapi
+
+// this file verifies merkle proofs returned by daemon, linking balances and SC state to a state root
+// proofs are only as good as the state root, state root reported by the same daemon only detects inconsistent responses
+// to use an untrusted daemon, state root must come from a source trusted by the caller, see SetStateRootSource
+// state root at a topoheight is xor of balance tree hash and SC meta tree hash
+// proofs from both trees are verified, so a daemon cannot pick a fake tree hash which xors to the state root
+// SC data trees are linked to state root through data hash stored in SC meta tree
+
+import "fmt"
+import "bytes"
+import "encoding/hex"
+
+import "github.com/deroproject/derohe/cryptography/crypto"
+import "github.com/deroproject/derohe/dvm"
+import "github.com/deroproject/derohe/rpc"
+
+import "github.com/deroproject/graviton"
+
+// checks that encrypted balance of an account is committed in state root
+// data is the serialized balance as returned by daemon, empty data means account must be proven absent
+// for native balances scid is zero, for tokens balance lies in SC data tree
+func VerifyBalanceProof(stateroot crypto.Hash, scid crypto.Hash, account []byte, data []byte, proof *rpc.StateProof) error {
+	balance_hash, data_hash, err := verify_state_proof(stateroot, scid, proof)
+	if err != nil {
+		return err
+	}
+
+	var value []byte
+	var exists bool
+	if scid.IsZero() {
+		value, exists, err = verify_key_proof(balance_hash, proof.BalanceProof, account)
+	} else {
+		value, exists, err = verify_key_proof(data_hash, proof.DataProofs[fmt.Sprintf("%x", account)], account)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(data) == 0 && exists:
+		return fmt.Errorf("account exists, but daemon reported it absent")
+	case len(data) != 0 && !exists:
+		return fmt.Errorf("account is proven absent, but daemon reported a balance")
+	case !bytes.Equal(value, data):
+		return fmt.Errorf("balance does not match proof")
+	}
+	return nil
+}
+
+// returns value of a key within SC data tree as committed in state root, exists is false if key is proven absent
+// key is raw key within SC data tree, eg. dvm.Variable{Type: dvm.String, ValueString: "owner"}.MarshalBinary()
+func VerifySCProof(stateroot crypto.Hash, scid crypto.Hash, key []byte, proof *rpc.StateProof) (value []byte, exists bool, err error) {
+	if scid.IsZero() {
+		return nil, false, fmt.Errorf("SCID cannot be zero")
+	}
+	_, data_hash, err := verify_state_proof(stateroot, scid, proof)
+	if err != nil {
+		return
+	}
+	return verify_key_proof(data_hash, proof.DataProofs[fmt.Sprintf("%x", key)], key)
+}
+
+// verifies both tree hashes against state root and returns hash of balance tree and SC data tree (if scid is non zero)
+func verify_state_proof(stateroot crypto.Hash, scid crypto.Hash, proof *rpc.StateProof) (balance_hash, data_hash crypto.Hash, err error) {
+	var zerohash, meta_hash crypto.Hash
+
+	if proof == nil {
+		err = fmt.Errorf("daemon did not return proof")
+		return
+	}
+	if balance_hash, err = decode_hash(proof.BalanceHash); err != nil {
+		return
+	}
+	if meta_hash, err = decode_hash(proof.MetaHash); err != nil {
+		return
+	}
+	for i := range stateroot {
+		if balance_hash[i]^meta_hash[i] != stateroot[i] {
+			err = fmt.Errorf("tree hashes do not match state root %s", stateroot)
+			return
+		}
+	}
+
+	if scid.IsZero() { // tree hash of meta tree must be genuine, any key proves it
+		_, _, err = verify_key_proof(meta_hash, proof.MetaProof, zerohash[:])
+		return
+	}
+
+	if _, _, err = verify_key_proof(balance_hash, proof.BalanceProof, zerohash[:]); err != nil {
+		return
+	}
+
+	meta_bytes, exists, err := verify_key_proof(meta_hash, proof.MetaProof, dvm.SC_Meta_Key(scid))
+	if err != nil {
+		return
+	}
+	if !exists {
+		err = fmt.Errorf("SC %s does not exist", scid)
+		return
+	}
+
+	var meta dvm.SC_META_DATA
+	if err = meta.UnmarshalBinaryGood(meta_bytes); err != nil {
+		return
+	}
+	if meta.DataHash.IsZero() { // meta written before HF2 did not commit data hash
+		err = fmt.Errorf("SC %s state is not committed at this topoheight", scid)
+		return
+	}
+	data_hash = meta.DataHash
+	return
+}
+
+// verifies proof of a key against tree hash, returns value if key exists
+func verify_key_proof(treehash crypto.Hash, proof_hex string, key []byte) (value []byte, exists bool, err error) {
+	proof_bytes, err := hex.DecodeString(proof_hex)
+	if err != nil {
+		return
+	}
+	if len(proof_bytes) < 3 {
+		err = fmt.Errorf("proof missing or too short")
+		return
+	}
+
+	var proof graviton.Proof
+	if err = unmarshal_proof(&proof, proof_bytes); err != nil {
+		return
+	}
+
+	switch {
+	case proof.VerifyMembership(treehash, key):
+		return proof.Value(), true, nil
+	case proof.VerifyNonMembership(treehash, key):
+		return nil, false, nil
+	}
+	err = fmt.Errorf("proof does not match tree hash %s", treehash)
+	return
+}
+
+// malformed proofs from daemon must not crash the wallet
+func unmarshal_proof(proof *graviton.Proof, buf []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed proof")
+		}
+	}()
+	return proof.Unmarshal(buf)
+}
+
+func decode_hash(s string) (hash crypto.Hash, err error) {
+	buf, err := hex.DecodeString(s)
+	if err != nil {
+		return
+	}
+	if len(buf) != len(hash) {
+		err = fmt.Errorf("hash is not of %d bytes", len(hash))
+		return
+	}
+	copy(hash[:], buf)
+	return
+}
+
+// verifies proof carried within GetEncryptedBalance result
+// if source is nil, state root reported by daemon is used, which does not protect against a malicious daemon
+func verify_encrypted_balance(scid crypto.Hash, accountaddr string, result rpc.GetEncryptedBalance_Result, source StateRootSource) error {
+	addr, err := rpc.NewAddress(accountaddr)
+	if err != nil {
+		return err
+	}
+	stateroot, err := decode_hash(result.Merkle_Balance_TreeHash)
+	if err != nil {
+		return err
+	}
+	if source != nil {
+		trusted, err := source(result.Topoheight, result.BlockHash)
+		if err != nil {
+			return fmt.Errorf("trusted state root at topoheight %d could not be obtained err %s", result.Topoheight, err)
+		}
+		if trusted != stateroot {
+			return fmt.Errorf("daemon state root %s does not match trusted state root %s at topoheight %d", stateroot, trusted, result.Topoheight)
+		}
+	}
+	data, err := hex.DecodeString(result.Data)
+	if err != nil {
+		return err
+	}
+	if result.Proof != nil && (result.Proof.TopoHeight != result.Topoheight || result.Proof.BlockHash != result.BlockHash) {
+		return fmt.Errorf("proof is not for topoheight %d", result.Topoheight)
+	}
+	return VerifyBalanceProof(stateroot, scid, addr.Compressed(), data, result.Proof)
+}
@@ -0,0 +1,181 @@
+// Copyright 2017-2021 DERO Project. All rights reserved.
+// Use of this source code in any form is governed by RESEARCH license.
+// license can be found in the LICENSE file.
+// GPG: 0F39 E425 8C65 3947 702A  8234 08B2 0360 A03A 9DE8
+//
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY
+// EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF
+// THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package walletapi
+
+import "fmt"
+import "testing"
+
+import "github.com/deroproject/derohe/config"
+import "github.com/deroproject/derohe/cryptography/crypto"
+import "github.com/deroproject/derohe/dvm"
+import "github.com/deroproject/derohe/rpc"
+
+import "github.com/deroproject/graviton"
+
+// generates proofs same as daemon does
+func test_state_proof(t *testing.T, ss *graviton.Snapshot, scid crypto.Hash, keys ...[]byte) (crypto.Hash, *rpc.StateProof) {
+	var zerohash, stateroot crypto.Hash
+	balance_tree, _ := ss.GetTree(config.BALANCE_TREE)
+	meta_tree, _ := ss.GetTree(config.SC_META)
+	balance_hash, _ := balance_tree.Hash()
+	meta_hash, _ := meta_tree.Hash()
+	for i := range stateroot {
+		stateroot[i] = balance_hash[i] ^ meta_hash[i]
+	}
+
+	prove := func(tree *graviton.Tree, key []byte) string {
+		proof, err := tree.GenerateProof(key)
+		if err != nil {
+			t.Fatalf("cannot generate proof err %s", err)
+		}
+		return fmt.Sprintf("%x", proof.Marshal())
+	}
+
+	proof := &rpc.StateProof{BalanceHash: fmt.Sprintf("%x", balance_hash[:]), MetaHash: fmt.Sprintf("%x", meta_hash[:])}
+	if scid.IsZero() {
+		proof.BalanceProof = prove(balance_tree, keys[0])
+		proof.MetaProof = prove(meta_tree, zerohash[:])
+	} else {
+		data_tree, _ := ss.GetTree(string(scid[:]))
+		proof.BalanceProof = prove(balance_tree, zerohash[:])
+		proof.MetaProof = prove(meta_tree, scid[:])
+		proof.DataProofs = map[string]string{}
+		for _, key := range keys {
+			proof.DataProofs[fmt.Sprintf("%x", key)] = prove(data_tree, key)
+		}
+	}
+	return stateroot, proof
+}
+
+func Test_State_Proof(t *testing.T) {
+	store, _ := graviton.NewMemStore()
+	ss, _ := store.LoadSnapshot(0)
+
+	account, absent := []byte("account"), []byte("absent")
+	balance := []byte("encrypted balance")
+	scid := crypto.Hash{1}
+	sc_key, _ := dvm.Variable{Type: dvm.String, ValueString: "owner"}.MarshalBinary()
+
+	balance_tree, _ := ss.GetTree(config.BALANCE_TREE)
+	meta_tree, _ := ss.GetTree(config.SC_META)
+	data_tree, _ := ss.GetTree(string(scid[:]))
+	balance_tree.Put(account, balance)
+	data_tree.Put(account, []byte("token balance"))
+	data_tree.Put(sc_key, []byte("value"))
+
+	meta := dvm.SC_META_DATA{}
+	meta.DataHash, _ = data_tree.Hash()
+	meta_tree.Put(dvm.SC_Meta_Key(scid), meta.MarshalBinaryGood())
+	if _, err := graviton.Commit(balance_tree, meta_tree, data_tree); err != nil {
+		t.Fatalf("commit failed err %s", err)
+	}
+	ss, _ = store.LoadSnapshot(0)
+
+	stateroot, proof := test_state_proof(t, ss, crypto.Hash{}, account)
+	if err := VerifyBalanceProof(stateroot, crypto.Hash{}, account, balance, proof); err != nil {
+		t.Fatalf("valid balance proof failed err %s", err)
+	}
+	if err := VerifyBalanceProof(stateroot, crypto.Hash{}, account, []byte("forged"), proof); err == nil {
+		t.Fatalf("forged balance verified")
+	}
+	if err := VerifyBalanceProof(stateroot, crypto.Hash{}, account, nil, proof); err == nil {
+		t.Fatalf("existing account verified as absent")
+	}
+	if err := VerifyBalanceProof(crypto.Hash{2}, crypto.Hash{}, account, balance, proof); err == nil {
+		t.Fatalf("proof verified against wrong state root")
+	}
+
+	stateroot, proof = test_state_proof(t, ss, crypto.Hash{}, absent)
+	if err := VerifyBalanceProof(stateroot, crypto.Hash{}, absent, nil, proof); err != nil {
+		t.Fatalf("valid absence proof failed err %s", err)
+	}
+
+	// a daemon picking fake tree hashes which xor to state root must fail
+	var fake crypto.Hash
+	fake[0] = 0xff
+	balance_hash, _ := decode_hash(proof.BalanceHash)
+	meta_hash, _ := decode_hash(proof.MetaHash)
+	for i := range fake {
+		balance_hash[i] ^= fake[i]
+		meta_hash[i] ^= fake[i]
+	}
+	forged := *proof
+	forged.BalanceHash, forged.MetaHash = fmt.Sprintf("%x", balance_hash[:]), fmt.Sprintf("%x", meta_hash[:])
+	if err := VerifyBalanceProof(stateroot, crypto.Hash{}, absent, nil, &forged); err == nil {
+		t.Fatalf("forged tree hashes verified")
+	}
+
+	stateroot, proof = test_state_proof(t, ss, scid, account, sc_key, absent)
+	if err := VerifyBalanceProof(stateroot, scid, account, []byte("token balance"), proof); err != nil {
+		t.Fatalf("valid token balance proof failed err %s", err)
+	}
+	if value, exists, err := VerifySCProof(stateroot, scid, sc_key, proof); err != nil || !exists || string(value) != "value" {
+		t.Fatalf("valid SC proof failed value %s exists %t err %s", value, exists, err)
+	}
+	if _, exists, err := VerifySCProof(stateroot, scid, absent, proof); err != nil || exists {
+		t.Fatalf("valid SC absence proof failed exists %t err %s", exists, err)
+	}
+	if _, _, err := VerifySCProof(stateroot, crypto.Hash{3}, sc_key, proof); err == nil {
+		t.Fatalf("proof verified for wrong SCID")
+	}
+
+	forged = *proof
+	forged.DataProofs = map[string]string{fmt.Sprintf("%x", sc_key): "01"}
+	if _, _, err := VerifySCProof(stateroot, scid, sc_key, &forged); err == nil {
+		t.Fatalf("malformed proof verified")
+	}
+}
+
+// state root reported by daemon is not trusted, if a trusted source is available
+func Test_State_Proof_Trusted_Root(t *testing.T) {
+	store, _ := graviton.NewMemStore()
+	ss, _ := store.LoadSnapshot(0)
+	balance_tree, _ := ss.GetTree(config.BALANCE_TREE)
+	meta_tree, _ := ss.GetTree(config.SC_META)
+	balance_tree.Put([]byte("account"), []byte("encrypted balance"))
+	if _, err := graviton.Commit(balance_tree, meta_tree); err != nil {
+		t.Fatalf("commit failed err %s", err)
+	}
+	ss, _ = store.LoadSnapshot(0)
+
+	address := "dero1qy40ku58at94snthwxca77mxym4ejj6vha0npjnrh77zzmkpfyctgqgry2zcv"
+	addr, err := rpc.NewAddress(address)
+	if err != nil {
+		t.Fatalf("cannot parse address err %s", err)
+	}
+	stateroot, proof := test_state_proof(t, ss, crypto.Hash{}, addr.Compressed())
+	result := rpc.GetEncryptedBalance_Result{Topoheight: 7, BlockHash: crypto.Hash{7}, Merkle_Balance_TreeHash: stateroot.String(), Proof: proof}
+	proof.TopoHeight, proof.BlockHash = result.Topoheight, result.BlockHash
+
+	trusted := func(topoheight int64, blockhash crypto.Hash) (crypto.Hash, error) {
+		if topoheight != 7 || blockhash != (crypto.Hash{7}) {
+			return crypto.Hash{}, fmt.Errorf("unknown block")
+		}
+		return stateroot, nil
+	}
+	if err := verify_encrypted_balance(crypto.Hash{}, address, result, trusted); err != nil {
+		t.Fatalf("valid proof failed err %s", err)
+	}
+	other := func(int64, crypto.Hash) (crypto.Hash, error) { return crypto.Hash{9}, nil }
+	if err := verify_encrypted_balance(crypto.Hash{}, address, result, other); err == nil {
+		t.Fatalf("state root not matching trusted source verified")
+	}
+	result.Topoheight, proof.TopoHeight = 8, 8
+	if err := verify_encrypted_balance(crypto.Hash{}, address, result, trusted); err == nil {
+		t.Fatalf("verified although trusted state root is not available")
+	}
+}
@@ -8,7 +8,6 @@ import "math/big"
 import mathrand "math/rand"
 import "github.com/deroproject/derohe/globals"
 import "github.com/deroproject/derohe/rpc"
-import "github.com/deroproject/derohe/config"
 import "github.com/deroproject/derohe/transaction"
 import "github.com/deroproject/derohe/cryptography/crypto"
 import "github.com/deroproject/derohe/cryptography/bn256"
@@ -136,7 +135,7 @@ rebuild_tx:
 		value := transfers[t].Amount
 		burn_value := transfers[t].Burn
 		if fees == 0 && asset.SCID.IsZero() && !fees_done {
-			fees = fees + uint64(len(transfers)+2)*uint64((float64(config.FEE_PER_KB)*float64(float32(len(publickeylist)/16)+w.GetFeeMultiplier())))
+			fees = fees + uint64(len(transfers)+2)*uint64((float64(w.GetFeesPerKB())*float64(float32(len(publickeylist)/16)+w.GetFeeMultiplier())))
 			if data, err := scdata.MarshalBinary(); err != nil {
 				panic(err)
 			} else {
@@ -372,6 +372,27 @@ func (w *Wallet_Memory) GetMode() bool {
 	return w.wallet_online_mode
 }
 
+// if set, balances are fetched with merkle proofs, which are verified against state root
+// without a state root source, state root reported by daemon is used, this only detects inconsistent responses
+func (w *Wallet_Memory) SetVerifyProofs(verify bool) bool {
+	w.verify_proofs = verify
+	return w.verify_proofs
+}
+
+func (w *Wallet_Memory) GetVerifyProofs() bool {
+	return w.verify_proofs
+}
+
+// returns state root at a topoheight, from a source trusted by the caller such as own node or several independent daemons
+type StateRootSource func(topoheight int64, blockhash crypto.Hash) (crypto.Hash, error)
+
+// proofs are verified against state root obtained from source, this is required when using untrusted public daemons
+func (w *Wallet_Memory) SetStateRootSource(source StateRootSource) {
+	w.Lock()
+	defer w.Unlock()
+	w.state_root_source = source
+}
+
 // use the endpoint set  by the program
 func (w *Wallet_Memory) SetDaemonAddress(endpoint string) string {
 	Daemon_Endpoint = endpoint
@@ -71,7 +71,9 @@ type Wallet_Memory struct {
 	// used to create transaction with this fee rate,
 	//if this is lower than network, then created transaction will be rejected by network
 	dynamic_fees_per_kb uint64
-	Quit                chan bool `json:"-"` // channel to quit any processing go routines
+	verify_proofs       bool            // request merkle proofs of balances and verify them against state root
+	state_root_source   StateRootSource // if set, state root is taken from here instead of daemon
+	Quit                chan bool       `json:"-"` // channel to quit any processing go routines
 
 	db_memory   []byte       // all data is stored here
 	wallet_disk *Wallet_Disk // a loopback pointer for some operations
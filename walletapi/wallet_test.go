@@ -20,6 +20,8 @@ import "fmt"
 import "testing"
 import "strings"
 
+import "github.com/deroproject/derohe/config"
+
 // we are covering atleast one test case each for all supported languages
 
 func Test_Wallet_Generation_and_Recovery(t *testing.T) {
@@ -158,3 +160,19 @@ func Test_Wallet_Generation_and_Recovery(t *testing.T) {
 	}
 
 }
+
+// daemon fee estimates must stay within network minimum and the cap
+func Test_Fees_Per_KB_Bounds(t *testing.T) {
+	w := &Wallet_Memory{}
+	for _, c := range []struct{ daemon, expected uint64 }{
+		{0, config.FEE_PER_KB},
+		{config.FEE_PER_KB * 2, config.FEE_PER_KB * 2},
+		{config.FEE_PER_KB * FEE_ESTIMATE_MAX, config.FEE_PER_KB * FEE_ESTIMATE_MAX},
+		{^uint64(0), config.FEE_PER_KB * FEE_ESTIMATE_MAX},
+	} {
+		w.dynamic_fees_per_kb = c.daemon
+		if fees := w.GetFeesPerKB(); fees != c.expected {
+			t.Fatalf("daemon estimate %d expected fees %d actual %d", c.daemon, c.expected, fees)
+		}
+	}
+}
@@ -82,16 +82,7 @@ func (w *Wallet_Memory) TransferPayload0(transfers []rpc.Transfer, ringsize uint
 
 	//ringsize = 2
 
-	// if wallet is online,take the fees from the network itself
-	// otherwise use whatever user has provided
-	//if w.GetMode()  {
-	fees_per_kb := w.dynamic_fees_per_kb // TODO disabled as protection while lots more testing is going on
-	//rlog.Infof("Fees per KB %d\n", fees_per_kb)
-	//}
-
-	if fees_per_kb == 0 {
-		fees_per_kb = config.FEE_PER_KB
-	}
+	// if wallet is online, fees per KB are taken from the network itself, see GetFeesPerKB
 
 	// user wants to do an SC call, but doesn't want any transfer, so we will transfer 0 to a random account
 	if len(scdata) >= 1 && len(transfers) == 0 {